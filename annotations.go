@@ -0,0 +1,64 @@
+package unifinames
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// annotationRecord returns the TXT record of record_annotations for name, each annotation is a string
+// of its own, e.g. "env=prod" "managed_by=unifi"
+func (c *config) annotationRecord(name string, ttl uint32) dns.TXT {
+	txt := make([]string, 0, len(c.RecordAnnotations))
+	for key, value := range c.RecordAnnotations {
+		txt = append(txt, key+"="+value)
+	}
+	// the map order would change the record on every answer
+	slices.Sort(txt)
+	return dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Txt: txt,
+	}
+}
+
+// validateAnnotations checks that the annotations fit into the strings of a TXT record
+func validateAnnotations(annotations map[string]string) error {
+	for key, value := range annotations {
+		if key == "" || strings.Contains(key, "=") {
+			return fmt.Errorf("'%s' is not a valid record_annotations key", key)
+		}
+		if len(key)+1+len(value) > 255 {
+			return fmt.Errorf("The record_annotations value of '%s' is longer than 255 characters", key)
+		}
+	}
+	return nil
+}
+
+// addressTTL returns the ttl of the A or AAAA record of name, or of the wildcard record that covers it.
+// p.mu has to be held
+func (p *unifinames) addressTTL(name string) (uint32, bool) {
+	wildcard := wildcardName(name)
+	for _, wanted := range []string{name, wildcard} {
+		if wanted == "" {
+			continue
+		}
+		for _, client := range p.aClients {
+			if strings.EqualFold(client.Hdr.Name, wanted) {
+				return client.Hdr.Ttl, true
+			}
+		}
+		for _, client := range p.aaaaClients {
+			if strings.EqualFold(client.Hdr.Name, wanted) {
+				return client.Hdr.Ttl, true
+			}
+		}
+	}
+	return 0, false
+}
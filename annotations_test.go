@@ -0,0 +1,51 @@
+package unifinames
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordAnnotations(t *testing.T) {
+	p := newTestPlugin()
+	p.Config.RecordAnnotations = map[string]string{"managed_by": "unifi", "env": "prod"}
+	require.Empty(t, p.lookup(new(dns.Msg).SetQuestion("server1.lan.", dns.TypeTXT)))
+
+	p.Config.IncludeAnnotations = true
+	rrs := p.lookup(new(dns.Msg).SetQuestion("Server1.lan.", dns.TypeTXT))
+	require.Len(t, rrs, 1)
+	txt := rrs[0].(*dns.TXT)
+	require.Equal(t, "Server1.lan.", txt.Hdr.Name)
+	require.Equal(t, []string{"env=prod", "managed_by=unifi"}, txt.Txt)
+	require.Empty(t, p.lookup(new(dns.Msg).SetQuestion("unknown.lan.", dns.TypeTXT)))
+}
+
+func TestRecordAnnotationsConfig(t *testing.T) {
+	parse := func(directives string) (*config, error) {
+		return newConfigFromDispenser(caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN lan
+				Unifi https://localhost:8443/ default admin test
+				`+directives+`
+			}
+		`))))
+	}
+	config, err := parse("include_annotations\nrecord_annotations env=prod managed_by=unifi")
+	require.NoError(t, err)
+	require.True(t, config.IncludeAnnotations)
+	require.Equal(t, map[string]string{"env": "prod", "managed_by": "unifi"}, config.RecordAnnotations)
+
+	for _, directives := range []string{
+		"include_annotations",
+		"record_annotations env",
+		"record_annotations =prod",
+		"record_annotations env=" + strings.Repeat("a", 255),
+	} {
+		_, err := parse(directives)
+		require.Error(t, err, directives)
+	}
+}
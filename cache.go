@@ -0,0 +1,121 @@
+package unifinames
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/miekg/dns"
+)
+
+// cacheFile is the format of the cache_file
+type cacheFile struct {
+	UpdatedAt time.Time     `json:"updated_at"`
+	Records   []cacheRecord `json:"records"`
+}
+
+type cacheRecord struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	IP   string `json:"ip"`
+	// TTL is the ttl of the network of the record, 0 uses the global ttl
+	TTL uint32 `json:"ttl,omitempty"`
+}
+
+// loadCache loads the records from the cache file, records older than max_cache_age are ignored
+func (p *unifinames) loadCache() error {
+	data, err := os.ReadFile(p.Config.CacheFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Annotate(err, "coredns-unifi-names: unable to read cache file")
+	}
+
+	var cache cacheFile
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return errors.Annotate(err, "coredns-unifi-names: unable to parse cache file")
+	}
+
+	if p.Config.MaxCacheAge > 0 && time.Since(cache.UpdatedAt) > p.Config.MaxCacheAge {
+		log.Warningf("ignoring cache file from %s", cache.UpdatedAt.Format(time.RFC3339))
+		return nil
+	}
+
+	var aClients []dns.A
+	var aaaaClients []dns.AAAA
+	for _, record := range cache.Records {
+		ip := net.ParseIP(record.IP)
+		if ip == nil {
+			continue
+		}
+		hdr := dns.RR_Header{
+			Name:  record.Name,
+			Class: dns.ClassINET,
+			Ttl:   record.TTL,
+		}
+		switch record.Type {
+		case "A":
+			hdr.Rrtype = dns.TypeA
+			aClients = append(aClients, dns.A{Hdr: hdr, A: ip})
+		case "AAAA":
+			hdr.Rrtype = dns.TypeAAAA
+			aaaaClients = append(aaaaClients, dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+
+	p.mu.Lock()
+	p.aClients = aClients
+	p.aaaaClients = aaaaClients
+	p.recordsHash = clientsHash(aClients, aaaaClients)
+	// the cached records are served with the full ttl until the first refresh replaces them
+	p.lastUpdate = time.Now()
+	p.indexRecords()
+	p.mu.Unlock()
+	log.Infof("loaded %d hosts from cache file", len(aClients)+len(aaaaClients))
+	return nil
+}
+
+// writeCache writes the records to the cache file, the file is replaced atomically
+func (p *unifinames) writeCache() error {
+	p.mu.Lock()
+	cache := cacheFile{UpdatedAt: p.lastUpdate}
+	for _, client := range p.aClients {
+		cache.Records = append(cache.Records, cacheRecord{Name: client.Hdr.Name, Type: "A", IP: client.A.String(), TTL: client.Hdr.Ttl})
+	}
+	for _, client := range p.aaaaClients {
+		cache.Records = append(cache.Records, cacheRecord{Name: client.Hdr.Name, Type: "AAAA", IP: client.AAAA.String(), TTL: client.Hdr.Ttl})
+	}
+	p.mu.Unlock()
+
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return errors.Annotate(err, "coredns-unifi-names: unable to encode cache file")
+	}
+
+	if err := writeFileAtomic(p.Config.CacheFile, data); err != nil {
+		return errors.Annotate(err, "coredns-unifi-names: unable to write cache file")
+	}
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with data, it is written to a temporary file next to it
+// first so readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,56 @@
+package unifinames
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	t.Run("Round Trip", func(t *testing.T) {
+		p := newTestPlugin()
+		p.Config.CacheFile = filepath.Join(t.TempDir(), "cache.json")
+		p.aaaaClients = []dns.AAAA{
+			{
+				Hdr:  dns.RR_Header{Name: "server2.lan.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET},
+				AAAA: net.ParseIP("::1"),
+			},
+		}
+		require.NoError(t, p.writeCache())
+
+		loaded := unifinames{Config: p.Config}
+		require.NoError(t, loaded.loadCache())
+		require.Equal(t, p.aClients, loaded.aClients)
+		require.Equal(t, p.aaaaClients, loaded.aaaaClients)
+		require.WithinDuration(t, time.Now(), loaded.lastUpdate, time.Second)
+	})
+
+	t.Run("Too Old", func(t *testing.T) {
+		p := newTestPlugin()
+		p.Config.CacheFile = filepath.Join(t.TempDir(), "cache.json")
+		p.Config.MaxCacheAge = time.Hour
+		p.lastUpdate = time.Now().Add(-2 * time.Hour)
+		require.NoError(t, p.writeCache())
+
+		loaded := unifinames{Config: p.Config}
+		require.NoError(t, loaded.loadCache())
+		require.Equal(t, 0, len(loaded.aClients))
+	})
+
+	t.Run("Missing File", func(t *testing.T) {
+		p := unifinames{Config: &config{CacheFile: filepath.Join(t.TempDir(), "cache.json")}}
+		require.NoError(t, p.loadCache())
+		require.Equal(t, 0, len(p.aClients))
+	})
+
+	t.Run("Invalid File", func(t *testing.T) {
+		p := unifinames{Config: &config{CacheFile: filepath.Join(t.TempDir(), "cache.json")}}
+		require.NoError(t, os.WriteFile(p.Config.CacheFile, []byte("{"), 0600))
+		require.Error(t, p.loadCache())
+	})
+}
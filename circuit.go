@@ -0,0 +1,77 @@
+package unifinames
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// the states of the circuit breaker, they are the values of UnifinamesCircuitState
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// errCircuitOpen is returned by refresh while the circuit breaker skips the controller, it isn't logged
+// as the opening of the circuit already was
+var errCircuitOpen = errors.New("coredns-unifi-names: circuit breaker is open")
+
+// circuitBreaker stops the refreshes of circuit_breaker after failure_threshold of them failed in a row,
+// once open_duration passed a single refresh tries the controller again
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+// circuitAllows returns whether a refresh may query the controller, the first refresh after open_duration makes
+// the circuit half-open and is the only one until its result is known
+func (p *unifinames) circuitAllows() bool {
+	if !p.Config.CircuitBreaker {
+		return true
+	}
+	b := &p.circuit
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < p.Config.CircuitOpenDuration {
+			return false
+		}
+		b.state = circuitHalfOpen
+		UnifinamesCircuitState.Set(circuitHalfOpen)
+		return true
+	case circuitHalfOpen:
+		return false
+	}
+	return true
+}
+
+// circuitResult updates the circuit breaker with the result of a refresh that queried the controller
+func (p *unifinames) circuitResult(err error) {
+	if !p.Config.CircuitBreaker {
+		return
+	}
+	b := &p.circuit
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.state != circuitClosed {
+			log.Infof("circuit breaker closed, the controller answered again")
+		}
+		b.state, b.failures = circuitClosed, 0
+		UnifinamesCircuitState.Set(circuitClosed)
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= p.Config.CircuitFailureThreshold {
+		if b.state == circuitClosed {
+			log.Warningf("circuit open after %d failed refreshes, not querying the controller for %s", b.failures, p.Config.CircuitOpenDuration)
+		}
+		b.state, b.openedAt = circuitOpen, time.Now()
+		UnifinamesCircuitState.Set(circuitOpen)
+	}
+}
@@ -0,0 +1,36 @@
+package unifinames
+
+// ClientInfo is a client that got a record, it is passed to OnClientsChanged
+type ClientInfo struct {
+	// Hostname is the name of the record, e.g. printer.lan.
+	Hostname string
+	IP       string
+	Network  string
+	MAC      string
+}
+
+// diffClients returns the clients of current that aren't in previous and the ones of previous that
+// aren't in current
+func diffClients(previous, current []ClientInfo) ([]ClientInfo, []ClientInfo) {
+	previousSet := make(map[ClientInfo]bool, len(previous))
+	for _, client := range previous {
+		previousSet[client] = true
+	}
+	currentSet := make(map[ClientInfo]bool, len(current))
+	for _, client := range current {
+		currentSet[client] = true
+	}
+
+	var added, removed []ClientInfo
+	for _, client := range current {
+		if !previousSet[client] {
+			added = append(added, client)
+		}
+	}
+	for _, client := range previous {
+		if !currentSet[client] {
+			removed = append(removed, client)
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,54 @@
+package unifinames
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffClients(t *testing.T) {
+	printer := ClientInfo{Hostname: "printer.lan.", IP: "192.168.1.10", Network: "lan", MAC: "00:00:00:00:00:01"}
+	phone := ClientInfo{Hostname: "phone.lan.", IP: "192.168.1.11", Network: "lan", MAC: "00:00:00:00:00:02"}
+	moved := phone
+	moved.IP = "192.168.1.12"
+
+	added, removed := diffClients([]ClientInfo{printer, phone}, []ClientInfo{printer, moved})
+	require.Equal(t, []ClientInfo{moved}, added)
+	require.Equal(t, []ClientInfo{phone}, removed)
+
+	added, removed = diffClients(nil, []ClientInfo{printer})
+	require.Equal(t, []ClientInfo{printer}, added)
+	require.Empty(t, removed)
+}
+
+func TestOnClientsChanged(t *testing.T) {
+	s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+	defer s.Close()
+	changes := make(chan [2][]ClientInfo, 2)
+	p := unifinames{
+		Config: newTestConfig(s.URL),
+		OnClientsChanged: func(added, removed []ClientInfo) {
+			changes <- [2][]ClientInfo{added, removed}
+		},
+	}
+
+	require.NoError(t, p.refresh())
+	select {
+	case change := <-changes:
+		require.Len(t, change[0], 1)
+		require.Equal(t, "server1.lan.", change[0][0].Hostname)
+		require.Equal(t, "127.0.0.1", change[0][0].IP)
+		require.Equal(t, "lan", change[0][0].Network)
+		require.Empty(t, change[1])
+	case <-time.After(time.Second):
+		t.Fatal("OnClientsChanged wasn't called")
+	}
+
+	require.NoError(t, p.refresh())
+	select {
+	case <-changes:
+		t.Fatal("OnClientsChanged was called without changes")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
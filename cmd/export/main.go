@@ -0,0 +1,38 @@
+// Command export queries the UniFi controller of the unifi-names block of a Corefile once and prints
+// the records as a block of the hosts plugin, e.g. to freeze the names before moving to static records
+//
+//	go run ./cmd/export -corefile /etc/coredns/Corefile -server lan:53
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	unifinames "github.com/reapertechlabs/coredns-unifi-names"
+)
+
+func main() {
+	corefile := flag.String("corefile", "Corefile", "path of the Corefile with the unifi-names block")
+	server := flag.String("server", "", "key of the server block to export, the first one with unifi-names when empty")
+	timeout := flag.Duration("timeout", time.Minute, "how long to wait for the controller")
+	flag.Parse()
+
+	f, err := os.Open(*corefile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	block, err := unifinames.ExportHostsBlock(ctx, f, *server)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Print(block)
+}
@@ -2,63 +2,766 @@ package unifinames
 
 import (
 	"fmt"
-	"log"
+	"math"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
+	"crypto/x509"
 	"encoding/hex"
 
 	"github.com/asaskevich/govalidator"
 	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+	"github.com/prometheus/common/model"
+	"github.com/unpoller/unifi"
+	"golang.org/x/time/rate"
 )
 
 type config struct {
-	// Networks maps the network to the specified domain
+	// Networks maps the network to its config with the domain
 	// e.g.
-	// "LAN" => local
+	// "LAN" => {Domain: local}
 	// so if a client has the name "Joe's Notebook" and it is in the "LAN" network it will get
 	// "joe-s-notebook.local" as a hostname
-	Networks map[string]string
+	// A name with a slash is a subnet, e.g. "192.168.10.0/24", it gets the clients with an ip in it whose
+	// network name doesn't match
+	Networks map[string]*NetworkConfig `yaml:"networks"`
+	// cidrNetworks are the networks of Networks that are subnets, the longest prefix first
+	cidrNetworks []cidrNetwork
+	// VLANNetworks maps a vlan id to a domain, it is used for the clients whose network isn't in Networks
+	VLANNetworks map[int]string `yaml:"vlans"`
+	// VPNDomain is the domain the remote user vpn clients (WireGuard, OpenVPN) of the controller get records
+	// in, they are handled as the network "vpn" (empty doesn't fetch them)
+	VPNDomain string `yaml:"vpn_domain"`
+	// DefaultDomain is the domain of the clients whose network isn't mapped by Networks or VLANNetworks,
+	// they are handled as the network "__default__" (empty skips them)
+	DefaultDomain string `yaml:"default_domain"`
+	// SiteDomains maps the lowercased name, description or id of a site to the domain its clients are put
+	// in no matter which network they are in, e.g. "site-a" => "site-a.home.arpa."
+	SiteDomains map[string]string `yaml:"site_domains"`
+	// NetworkAliases maps a network name to the network it is handled as, e.g. the old name of a renamed
+	// network to the new one
+	NetworkAliases map[string]string `yaml:"network_aliases"`
+	// ClientGroupNetworks maps a client (user) group id to a network, clients in the group get the domain
+	// of that network instead of the one of the network they are connected to
+	ClientGroupNetworks map[string]string `yaml:"client_group_networks"`
+	// ExcludeNetworks are the networks whose clients never get records, even if their vlan or client
+	// group maps them to a domain
+	ExcludeNetworks []string `yaml:"exclude_networks"`
+	// NetworkPriority are the networks in the order they win a name that clients of several networks
+	// end up with, the unlisted networks come last and hostname_collision_policy decides between equals
+	NetworkPriority []string `yaml:"network_priority"`
+	// IncludeSites are the names or ids of the sites the clients are fetched from (empty fetches them from
+	// all sites), they take precedence over ExcludeSites
+	IncludeSites []string `yaml:"include_sites"`
+	// ExcludeSites are the names or ids of the sites the clients aren't fetched from
+	ExcludeSites []string `yaml:"exclude_sites"`
+	// MaxSiteFailureRatio is the share of the sites whose clients may fail to be fetched, the refresh goes
+	// on with the clients of the other sites and only fails above it or when all sites fail (defaults to 0.5)
+	MaxSiteFailureRatio float64 `yaml:"max_site_failure_ratio"`
+	// IncludeDevices is the network the UniFi devices (access points, switches, gateways) get records in
+	// (empty doesn't create records for them)
+	IncludeDevices string `yaml:"include_devices"`
+	// ApexRecords maps a configured domain to the ip its apex resolves to, e.g.
+	// "home.arpa." => "192.168.1.1"
+	ApexRecords map[string]string `yaml:"apex_records"`
+	// MailRecords are the SPF, DMARC and DKIM TXT records of the domains, they are served next to the
+	// records of the clients
+	MailRecords map[string]MailRecords `yaml:"mail_records"`
+	// staticTXT are the TXT records of MailRecords by their lowercased name
+	staticTXT map[string]dns.TXT
 	// TTL to use for response (this is also the refresh rate of the client mapping) (defaults to 1hour)
-	TTL uint32
+	TTL uint32 `yaml:"ttl"`
+	// MinTTL is the lowest TTL that is answered with when the records are about to be refreshed (defaults to 5 seconds)
+	MinTTL uint32 `yaml:"min_ttl"`
+	// MaxTTL caps the TTL of the answers, e.g. to keep the resolvers from caching them for the whole TTL
+	// (defaults to 0, no cap)
+	MaxTTL uint32 `yaml:"max_ttl"`
 	// Debug mode
-	Debug bool
+	Debug bool `yaml:"debug"`
+	// CompactLogging logs one summary per refresh instead of a debug line per added or skipped client
+	CompactLogging bool `yaml:"compact_logging"`
 	// UnifiControllerURL in the form of http://localhost:8443
-	UnifiControllerURL string
+	UnifiControllerURL string `yaml:"unifi_url"`
 	// UnifiSite which site to use (most of the cases its default)
-	UnifiSite string
+	UnifiSite string `yaml:"unifi_site"`
 	// UnifiUsername
-	UnifiUsername string
+	UnifiUsername string `yaml:"unifi_username"`
 	// UnifiPassword
-	UnifiPassword string
+	UnifiPassword string `yaml:"unifi_password"`
 	// UnifiSSLFingerprint is the ssl certificate fingerprint we expect (currently ignored)
-	UnifiSSLFingerprint []byte
+	UnifiSSLFingerprint []byte `yaml:"-"`
 	// VerifySSL is whether to verify the ssl certificate
-	UnifiVerifySSL bool
-	// UseNameAsHostname is whether to use the name as the hostname
-	UseNameAsHostname bool
+	UnifiVerifySSL bool `yaml:"verifyssl"`
+	// CACertFile is a pem file with the CA certificates the controller is verified with, e.g. the self
+	// signed certificate of the controller, it turns on UnifiVerifySSL. It is read once by the setup
+	CACertFile string `yaml:"ca_cert_file"`
+	// VerifySSLSystemPool trusts the system certificates next to the ones of CACertFile, false only trusts
+	// CACertFile (default true)
+	VerifySSLSystemPool bool `yaml:"verify_ssl_system_pool"`
+	// rootCAs are the certificates the controller is verified with, nil uses the system pool
+	rootCAs *x509.CertPool
+	// AutoDiscover looks for a controller announced via mDNS (_unifi._tcp) when no controller url is set
+	AutoDiscover bool `yaml:"auto_discover"`
+	// DiscoveryTimeout is how long to look for a controller via mDNS (defaults to 10 seconds)
+	DiscoveryTimeout time.Duration `yaml:"discovery_timeout"`
+	// SecretsBackend is where the controller url and credentials are fetched from before logging in,
+	// "vault" is the only backend (empty uses the ones of the unifi directive)
+	SecretsBackend string `yaml:"secrets_backend"`
+	// VaultAddr is the address of vault, e.g. https://vault.lan.local:8200
+	VaultAddr string `yaml:"vault_addr"`
+	// VaultPath is the path of the secret with the username, password and url keys, e.g. secret/data/unifi
+	VaultPath string `yaml:"vault_path"`
+	// VaultToken is the token to read the secret with
+	VaultToken string `yaml:"vault_token"`
+	// VaultRoleID and VaultSecretID log into vault with AppRole instead of VaultToken
+	VaultRoleID   string `yaml:"vault_role_id"`
+	VaultSecretID string `yaml:"vault_secret_id"`
+	// ControllerVersion selects the api paths, "v1" for the classic controller (/api/s/...), "v2" for
+	// UniFi OS (/proxy/network/api/s/...) and "auto" (default) asks the controller which one it runs
+	ControllerVersion string `yaml:"controller_version"`
+	// AuthMode is how the requests to the controller are authenticated, "session" (default) logs in and
+	// sends the session cookie, "basic" sends the username and password with each request for the api
+	// proxies that want http basic authentication
+	AuthMode string `yaml:"auth_mode"`
+	// UseNameAsHostname is whether to use the name as the hostname, it is the same as hostname_fields name
+	UseNameAsHostname bool `yaml:"use_name_as_hostname"`
+	// StrictHostnameValidation skips the clients whose sanitized name starts or ends with a hyphen, is
+	// only digits or shorter than 2 characters
+	StrictHostnameValidation bool `yaml:"strict_hostname_validation"`
+	// StrictIPUniqueness skips all the clients whose ip is shared with a client with another mac, e.g.
+	// after a misconfiguration or arp spoofing
+	StrictIPUniqueness bool `yaml:"strict_ip_uniqueness"`
+	// DNSPrefix is put in front of all the hostnames with DNSPrefixSeparator (default is -), e.g.
+	// wifi-iphone.home.arpa, to tell the records apart from the ones of the other plugins
+	DNSPrefix          string `yaml:"dns_prefix"`
+	DNSPrefixSeparator string `yaml:"dns_prefix_separator"`
+	// ParseDNSOverride gives the clients whose note matches DNSOverridePattern the matched name, e.g.
+	// webserver for the note "dns:webserver". It wins over hostname_fields but not over trusted_macs
+	ParseDNSOverride bool `yaml:"parse_dns_override"`
+	// DNSOverridePattern is the regular expression that finds the name in the notes, the first group
+	// is the name if it has one (default is (?i)dns:([a-z0-9-]+))
+	DNSOverridePattern string `yaml:"dns_override_pattern"`
+	// dnsOverride is the compiled DNSOverridePattern
+	dnsOverride *regexp.Regexp
+	// HostnameFields are the fields of the clients that are tried in order until one gives a hostname,
+	// e.g. name, hostname (defaults to hostname)
+	HostnameFields []string `yaml:"hostname_fields"`
+	// PreserveDots keeps the dots in the names of the clients, printer.2nd.floor gets the labels printer,
+	// 2nd and floor instead of printer-2nd-floor. Each label is sanitized and truncated on its own
+	PreserveDots bool `yaml:"preserve_dots"`
+	// HostnameSuffixStrip are the lowercased suffixes that are removed from the names of the clients before
+	// they are sanitized, e.g. the .local of mDNS (defaults to .local, .home and .lan)
+	HostnameSuffixStrip []string `yaml:"hostname_suffix_strip"`
+	// AdditionalReservedNames are skipped like the built in reservedNames, the lowercased names are
+	// compared with the sanitized names of the clients
+	AdditionalReservedNames []string `yaml:"additional_reserved_names"`
+	// ClientLabelField is a field of unifi.Client by its go name, e.g. RadioName, that is tried for the
+	// hostname before hostname_fields. It can name the fields of newer versions of the unifi package, an
+	// unknown field or one that isn't a string is only logged and hostname_fields is used
+	ClientLabelField string `yaml:"client_label_field"`
+	// clientLabelField is the index of ClientLabelField in unifi.Client, nil when there is none
+	clientLabelField []int
+	// ProxyURL is the http proxy the controller is reached through
+	ProxyURL string `yaml:"proxy_url"`
+	// NoProxy is a comma separated list of the hosts that are reached without ProxyURL
+	NoProxy string `yaml:"no_proxy"`
+	// UseEnvProxy uses the proxy from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables when
+	// no ProxyURL is set
+	UseEnvProxy bool `yaml:"use_env_proxy"`
+	// Socks5Proxy is the host:port of the SOCKS5 proxy the controller is reached through, it can't be
+	// combined with ProxyURL
+	Socks5Proxy string `yaml:"socks5_proxy"`
+	// Socks5User and Socks5Pass authenticate with the SOCKS5 proxy (optional)
+	Socks5User string `yaml:"socks5_user"`
+	Socks5Pass string `yaml:"socks5_pass"`
+	// TLSMinVersion is the lowest tls version used with the controller, "1.0", "1.1", "1.2" (default) or
+	// "1.3", old controllers with an outdated java only speak tls 1.0 or 1.1
+	TLSMinVersion string `yaml:"tls_min_version"`
+	// RefreshJitter is the upper bound of the random duration that is added to each refresh interval
+	RefreshJitter time.Duration `yaml:"refresh_jitter"`
+	// MetricsRefreshInterval is how often the host count is recounted from the records in memory
+	// (0 uses the refresh interval)
+	MetricsRefreshInterval time.Duration `yaml:"metrics_refresh_interval"`
+	// RequestTimeout is how long to wait for the controller on each refresh (defaults to 30 seconds)
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	// MaxRefreshDuration is how long a refresh may take before it is given up, a refresh that finishes
+	// later doesn't change the records (defaults to 60 seconds, 0 doesn't limit it)
+	MaxRefreshDuration time.Duration `yaml:"max_refresh_duration"`
+	// ConnectRetry is how many times a refresh tries the controller again when it can't be reached, the
+	// retries are ConnectRetryDelay apart and end with the request_timeout (defaults to 3)
+	ConnectRetry int `yaml:"connect_retry"`
+	// ConnectRetryDelay is the time between the retries of ConnectRetry (defaults to 5s)
+	ConnectRetryDelay time.Duration `yaml:"connect_retry_delay"`
+	// BatchUpdateThreshold is how many records have to be added or removed before a refresh replaces the
+	// records, fewer changes are deferred until they add up or MaxDeferDuration passed (0 always replaces them)
+	BatchUpdateThreshold int `yaml:"batch_update_threshold"`
+	// MaxDeferDuration is how long the changes below BatchUpdateThreshold are deferred (defaults to 5 minutes)
+	MaxDeferDuration time.Duration `yaml:"max_defer_duration"`
+	// CircuitBreaker stops querying the controller after CircuitFailureThreshold refreshes failed in a row,
+	// after CircuitOpenDuration one refresh tries it again. Only the opening is logged
+	CircuitBreaker bool `yaml:"circuit_breaker"`
+	// CircuitFailureThreshold are the failed refreshes that open the circuit (defaults to 5)
+	CircuitFailureThreshold int `yaml:"circuit_failure_threshold"`
+	// CircuitOpenDuration is how long the circuit stays open (defaults to 5 minutes)
+	CircuitOpenDuration time.Duration `yaml:"circuit_open_duration"`
+	// HTTPTimeout is how long each request to the controller may take (defaults to 30 seconds)
+	HTTPTimeout time.Duration `yaml:"http_timeout"`
+	// MaxStaleRefreshes is how many refreshes may fail in a row before the stale clients are dropped (0 keeps them forever)
+	MaxStaleRefreshes int `yaml:"max_stale_refreshes"`
+	// MaxStaleAge is how old the records may get before the queries for them are answered with SERVFAIL
+	// (0 serves them forever)
+	MaxStaleAge time.Duration `yaml:"max_stale_age"`
+	// UseEventStream follows the event stream of the controller and refreshes the clients as soon as one
+	// connects or disconnects, the clients are still polled every EventStreamReconcileInterval
+	UseEventStream bool `yaml:"use_event_stream"`
+	// EventStreamReconcileInterval is how often the clients are polled with the event stream (defaults
+	// to 5 minutes)
+	EventStreamReconcileInterval time.Duration `yaml:"event_stream_reconcile_interval"`
+	// UnhealthyThreshold is how long the refreshes may fail before Health reports the plugin as unhealthy
+	// (defaults to three refresh intervals)
+	UnhealthyThreshold time.Duration `yaml:"unhealthy_threshold"`
+	// RequireInitialData keeps the plugin from becoming ready until the clients were fetched once
+	RequireInitialData bool `yaml:"require_initial_data"`
+	// LazyLoad makes the plugin ready right away, the clients are fetched once the first query for the
+	// domains arrives which waits up to LazyLoadTimeout (default 5s) for them
+	LazyLoad        bool          `yaml:"lazy_load"`
+	LazyLoadTimeout time.Duration `yaml:"lazy_load_timeout"`
+	// Authoritative answers NXDOMAIN for names in the configured domains that have no record instead of
+	// passing the query to the next plugin
+	Authoritative bool `yaml:"authoritative"`
+	// ViewNetworkMatch only answers the queries from the subnet of a network with the records of the
+	// clients in that network, the names of the other clients get NXDOMAIN. The subnets are fetched from
+	// the controller
+	ViewNetworkMatch bool `yaml:"view_network_match"`
+	// LockFreeRecords answers the A and AAAA queries from a copy of the records that is swapped after each
+	// refresh, so the queries don't wait for the lock while the other records are read or replaced
+	LockFreeRecords bool `yaml:"lock_free_records"`
+	// EDNSSubnetRouting answers the queries with an EDNS0 client subnet option like view_network_match
+	// answers the queries from that subnet, e.g. for the queries forwarded by the resolver of another site
+	EDNSSubnetRouting bool `yaml:"edns_subnet_routing"`
+	// IncludeAdditionalRecords adds the AAAA records of a name to the answers for its A records in the
+	// additional section and the other way round
+	IncludeAdditionalRecords bool `yaml:"include_additional_records"`
+	// NXDomainAction is what the queries for names without a record in the configured domains are
+	// answered with: passthrough to the next plugin, nxdomain or noerror_empty (empty uses authoritative)
+	NXDomainAction string `yaml:"nxdomain_action"`
+	// NSRecords are the nameservers returned for NS queries of the configured domains
+	NSRecords []string `yaml:"ns_records"`
+	// NegativeTTL is how long resolvers may cache the NXDOMAIN answers in authoritative mode, it is the
+	// ttl and minimum of the SOA record that is added to them (0 adds no SOA record, so they aren't cached)
+	NegativeTTL uint32 `yaml:"negative_ttl"`
+	// NXDomainRedirectIP is answered with instead of NXDOMAIN for the names without a record, e.g. for a
+	// "not found" page in the home lab. The A or AAAA record of the ip has negative_ttl as its ttl
+	NXDomainRedirectIP string `yaml:"nxdomain_redirect_ip"`
+	// NXDomainRedirectDomains are the domains nxdomain_redirect_ip applies to (empty are all domains),
+	// the others still get NXDOMAIN
+	NXDomainRedirectDomains []string `yaml:"nxdomain_redirect_domains"`
+	// IPv6PTRZone is the reverse zone the PTR records of the ipv6 clients are served in, e.g. for a
+	// private reverse zone (defaults to ip6.arpa.)
+	IPv6PTRZone string `yaml:"ipv6_ptr_zone"`
+	// HostnameCollisionPolicy decides which records are kept when clients end up with the same name,
+	// "first" (default) keeps the first client, "last" the last one and "all" keeps all of them
+	HostnameCollisionPolicy string `yaml:"hostname_collision_policy"`
+	// NameDedupStrategy gives the clients with another mac a name of their own when they end up with the
+	// same name in networks of the same priority, instead of hostname_collision_policy: "append_mac"
+	// (my-iphone-ab12), "append_index" (my-iphone-2), "skip" skips all of them and "first_wins" the
+	// later ones
+	NameDedupStrategy string `yaml:"name_dedup_strategy"`
+	// LogFormat is the format of the log output, "text" (default) or "json"
+	LogFormat string `yaml:"log_format"`
+	// OverlapCheck is what happens at startup when a domain is a subdomain of another one, "off" (default),
+	// "warn" logs a warning and "error" fails the setup
+	OverlapCheck string `yaml:"overlap_check"`
+	// NameNormalization is how the client names are turned into hostnames before they are sanitized,
+	// "none" (default), "slug" or "camel_to_kebab"
+	NameNormalization string `yaml:"name_normalization"`
+	// TrustedMACsFile is a file of "<mac> <hostname>" lines, the clients with these macs get the hostname
+	// no matter what the controller reports, e.g. for devices with a private mac. It is read on each refresh
+	TrustedMACsFile string `yaml:"trusted_macs"`
+	// ClientType limits the clients that get records to "wired" or "wireless" ones, "all" (default)
+	// doesn't filter them
+	ClientType string `yaml:"client_type"`
+	// IPFilter are the subnets (192.168.1.0/24), ranges (192.168.1.10-192.168.1.99) and ips that
+	// IPFilterMode applies to
+	IPFilter []string `yaml:"ip_filter"`
+	// IPFilterMode is "include" (default) to only create records for the clients with an ip in IPFilter or
+	// "exclude" to skip them
+	IPFilterMode string `yaml:"ip_filter_mode"`
+	// ipFilter are the subnets that cover IPFilter
+	ipFilter []*net.IPNet
+	// OnlineWithin only creates records for the clients the controller saw within this duration, the
+	// clients and devices without a last seen time are kept (0 keeps all clients)
+	OnlineWithin time.Duration `yaml:"online_within"`
+	// RateLimit is how many queries per second are processed, the queries above it are handled by
+	// RateLimitAction (0 is unlimited)
+	RateLimit float64 `yaml:"rate_limit"`
+	// RateLimitAction is what happens to the queries above the rate limit, "drop" (default) answers them
+	// with SERVFAIL and "passthrough" passes them to the next plugin
+	RateLimitAction string `yaml:"rate_limit_action"`
+	// MaxWorkers limits how many queries are processed at the same time (0 is unlimited)
+	MaxWorkers int `yaml:"max_workers"`
+	// WorkerTimeout is how long a query waits for a free worker of MaxWorkers before it is passed to the
+	// next plugin (defaults to 100ms)
+	WorkerTimeout time.Duration `yaml:"worker_timeout"`
+	// ResolveTimeout is how long a query may wait for the records before it is passed to the next plugin,
+	// e.g. while a refresh holds the lock during a DNS flood (defaults to 5ms, 0 waits as long as it takes)
+	ResolveTimeout time.Duration `yaml:"resolve_timeout"`
+	// RedisAddr is the redis server the records are written to after each refresh, as a hash of the names
+	// to their records that expires after the ttl. The other instances load it on startup
+	RedisAddr     string `yaml:"redis_addr"`
+	RedisPassword string `yaml:"redis_password"`
+	// RedisKey is the key of the hash (default is unifi-names)
+	RedisKey string `yaml:"redis_key"`
+	// CacheFile is where the records are stored after each refresh, they are loaded from it on startup
+	CacheFile string `yaml:"cache_file"`
+	// MaxCacheAge is how old the cache file may be to be loaded on startup (defaults to 24 hours)
+	MaxCacheAge time.Duration `yaml:"max_cache_age"`
+	// WildcardClients also creates a wildcard record for each client, so *.printer.lan resolves to the
+	// ip of printer.lan
+	WildcardClients bool `yaml:"wildcard_clients"`
+	// ServeHINFO creates HINFO records with the vendor of the network card of the clients as the cpu, the
+	// os is empty
+	ServeHINFO bool `yaml:"serve_hinfo"`
+	// IncludeSwitchPorts creates TXT records with the switch and the port the wired clients are connected to
+	IncludeSwitchPorts bool `yaml:"include_switch_ports"`
+	// OUIDatabase is a csv or json file with the vendors of the mac prefixes, e.g. the oui.csv of the IEEE.
+	// It is read once by the setup
+	OUIDatabase string `yaml:"oui_database"`
+	// ouiVendors are the vendors of OUIDatabase by the uppercased mac prefix
+	ouiVendors map[string]string
+	// IncludeTXTMetadata creates TXT records with the vendor of the clients, from OUIDatabase or the
+	// controller
+	IncludeTXTMetadata bool `yaml:"include_txt_metadata"`
+	// IncludeAnnotations answers TXT queries for the names with an A or AAAA record with RecordAnnotations
+	IncludeAnnotations bool `yaml:"include_annotations"`
+	// RecordAnnotations are the key=value strings of the TXT records of IncludeAnnotations, e.g.
+	// managed_by=unifi
+	RecordAnnotations map[string]string `yaml:"record_annotations"`
+	// MaxRecords limits how many records are created, the clients after the limit are dropped (0 is unlimited)
+	MaxRecords int `yaml:"max_records"`
+	// AnswerLimit caps the records in an answer, the records of a name take turns. Clients that announce a
+	// larger udp size with EDNS0 get a proportionally larger answer (0 is unlimited)
+	AnswerLimit int `yaml:"answer_limit"`
+	// HostnameMaxLength is the length the hostname labels are truncated to, including the prefix and
+	// the suffix of the network (1-63, defaults to 63)
+	HostnameMaxLength int `yaml:"hostname_max_length"`
+	// NAPTRServices are the templates of the NAPTR records of the clients whose name matches their
+	// pattern, e.g. for the SIP phones
+	NAPTRServices []NAPTRService `yaml:"naptr_services"`
+	// SynthesizeSRV creates SRV records for the clients named like _http._tcp.webserver, they point to the
+	// record of webserver
+	SynthesizeSRV bool `yaml:"synthesize_srv"`
+	// SRVPriority is the priority of the synthesized SRV records
+	SRVPriority uint16 `yaml:"srv_priority"`
+	// SRVWeight is the weight of the synthesized SRV records
+	SRVWeight uint16 `yaml:"srv_weight"`
+	// SRVPort is the port of the synthesized SRV records of services without a well known port (0 creates
+	// no SRV record for them)
+	SRVPort uint16 `yaml:"srv_port"`
+	// DebugFile is where the added, removed and unchanged records are logged to after each refresh
+	DebugFile string `yaml:"debug_file"`
+	// DebugFileMaxSizeMB is the size in megabytes after which the debug file is moved to <debug_file>.1
+	// (0 never rotates it)
+	DebugFileMaxSizeMB int `yaml:"debug_file_max_size_mb"`
+	// ClientMetrics reports when each client was last seen by the controller, it creates a metric per
+	// client so it is off by default
+	ClientMetrics bool `yaml:"client_metrics"`
+	// PerClientMetrics counts the answered queries per client, it creates a metric per client so it is
+	// off by default
+	PerClientMetrics bool `yaml:"per_client_metrics"`
+	// PerClientMetricsMaxCardinality is how many clients are counted at most, the clients after the
+	// limit aren't counted (0 is unlimited)
+	PerClientMetricsMaxCardinality int `yaml:"per_client_metrics_max_cardinality"`
+	// DnsmasqHostsFile is where the records are written to in the address=/hostname/ip format of dnsmasq
+	// after each successful refresh (empty doesn't export them)
+	DnsmasqHostsFile string `yaml:"export_dnsmasq_hosts"`
+	// DnsmasqReloadCommand is run with sh after the dnsmasq hosts file was written, e.g. to send dnsmasq
+	// a SIGHUP
+	DnsmasqReloadCommand string `yaml:"dnsmasq_reload_command"`
+	// OnStartupCommand is run with sh in the background after the first successful refresh, e.g. to start
+	// a service that needs the records
+	OnStartupCommand string `yaml:"on_startup_command"`
+	// OnRefreshCommand is run with sh in the background after each successful refresh after the first one
+	OnRefreshCommand string `yaml:"on_refresh_command"`
+	// TelemetryURL is where a json report of the records and the refresh is posted to after each
+	// successful refresh, e.g. to watch many instances from one place (empty doesn't send it)
+	TelemetryURL string `yaml:"telemetry_url"`
+	// TelemetryToken is sent as the bearer token of the telemetry reports
+	TelemetryToken string `yaml:"telemetry_token"`
+	// ConfigMapName is the ConfigMap the hostnames and ips are written to after each refresh, it needs
+	// the k8s build tag (empty doesn't export them)
+	ConfigMapName string `yaml:"k8s_configmap_name"`
+	// ConfigMapNamespace is the namespace of the ConfigMap (defaults to default)
+	ConfigMapNamespace string `yaml:"k8s_configmap_namespace"`
+	// ConfigMapKubeconfig is the kubeconfig used to reach the cluster (empty uses the in cluster config)
+	ConfigMapKubeconfig string `yaml:"k8s_kubeconfig_path"`
+	// PrometheusLabels are added to all metrics of the plugin, e.g. datacenter=us-east-1
+	PrometheusLabels map[string]string `yaml:"prometheus_labels"`
+	// PrometheusNamespace is the prefix of the names of all metrics of the plugin, e.g. coredns_home when
+	// several deployments are scraped by the same prometheus (defaults to coredns)
+	PrometheusNamespace string `yaml:"prometheus_namespace"`
+	// HTTPAddress is the address the debugging endpoints are served on, e.g. localhost:8053 (empty
+	// doesn't serve them)
+	HTTPAddress string `yaml:"http_address"`
+	// DryRun only logs the records that would be served, all queries are passed to the next plugin
+	DryRun bool `yaml:"dry_run"`
+	// ConfigFile is the yaml file the config is loaded from, the directives in the Corefile override it
+	ConfigFile string `yaml:"-"`
+	// NetworksFile is a file of "<network>,<domain>[,<ttl>]" lines that are added to Networks, the networks
+	// of the Corefile and the config file win. The Corefile is reloaded when it changes like for ConfigFile
+	NetworksFile string `yaml:"networks_file"`
 }
 
 func newConfigFromDispenser(c caddyfile.Dispenser) (*config, error) {
 	config := config{
-		TTL:               60 * 60,
-		Networks:          map[string]string{},
-		UnifiVerifySSL:    false,
-		UseNameAsHostname: false,
+		TTL:                     60 * 60,
+		MinTTL:                  5,
+		HostnameMaxLength:       63,
+		RequestTimeout:          30 * time.Second,
+		MaxRefreshDuration:      60 * time.Second,
+		ConnectRetry:            3,
+		ConnectRetryDelay:       5 * time.Second,
+		MaxDeferDuration:        5 * time.Minute,
+		CircuitFailureThreshold: 5,
+		CircuitOpenDuration:     5 * time.Minute,
+		WorkerTimeout:           100 * time.Millisecond,
+		ResolveTimeout:          5 * time.Millisecond,
+		MaxSiteFailureRatio:     0.5,
+		PrometheusNamespace:     plugin.Namespace,
+		LazyLoadTimeout:         5 * time.Second,
+		RedisKey:                "unifi-names",
+		HTTPTimeout:             30 * time.Second,
+		DiscoveryTimeout:        10 * time.Second,
+		HostnameCollisionPolicy: "first",
+		RateLimitAction:         "drop",
+		ClientType:              "all",
+		IPFilterMode:            "include",
+		NameNormalization:       "none",
+		LogFormat:               "text",
+		OverlapCheck:            "off",
+		IPv6PTRZone:             "ip6.arpa.",
+		ConfigMapNamespace:      "default",
+		ControllerVersion:       "auto",
+		AuthMode:                "session",
+		HostnameSuffixStrip:     []string{".local", ".home", ".lan"},
+		MaxCacheAge:             24 * time.Hour,
+		Networks:                map[string]*NetworkConfig{},
+		VLANNetworks:            map[int]string{},
+		SiteDomains:             map[string]string{},
+		NetworkAliases:          map[string]string{},
+		ClientGroupNetworks:     map[string]string{},
+		ApexRecords:             map[string]string{},
+		UnifiVerifySSL:          false,
+		VerifySSLSystemPool:     true,
+		TLSMinVersion:           "1.2",
+		UseNameAsHostname:       false,
+		DNSOverridePattern:      defaultDNSOverridePattern,
+		DNSPrefixSeparator:      "-",
 	}
 
+	if path := configFilePath(c); path != "" {
+		if err := loadConfigFile(path, &config); err != nil {
+			return nil, err
+		}
+		config.ConfigFile = path
+	}
+
+	// the record_types directives are added to the networks once all of them are known
+	recordTypes := map[string][]string{}
 	for c.NextBlock() {
-		if strings.EqualFold(c.Val(), "network") {
+		if strings.EqualFold(c.Val(), "config_file") {
+			// loaded above so the other directives override it
+			c.NextArg()
+		} else if strings.EqualFold(c.Val(), "network") {
 			if c.NextArg() {
 				network := strings.ToLower(c.Val())
 				if c.NextArg() {
-					domain := strings.ToLower(strings.Trim(c.Val(), "."))
-					if !govalidator.IsDNSName(domain) {
-						return nil, fmt.Errorf("'%s' is not a valid domain name", domain)
+					networkConfig := &NetworkConfig{Domain: c.Val()}
+					// e.g. network LAN lan.local ttl=60 prefix=lan- record_types=A,AAAA vlan=10
+					for _, arg := range c.RemainingArgs() {
+						if err := networkConfig.setOption(arg); err != nil {
+							return nil, err
+						}
+					}
+					if err := networkConfig.normalize(); err != nil {
+						return nil, err
+					}
+					config.Networks[network] = networkConfig
+				}
+			}
+		} else if strings.EqualFold(c.Val(), "networks_file") {
+			if c.NextArg() {
+				config.NetworksFile = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "vlan") {
+			if c.NextArg() {
+				vlan, err := strconv.Atoi(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid vlan value: '%s'", c.Val())
+				}
+				if c.NextArg() {
+					config.VLANNetworks[vlan] = dns.Fqdn(strings.ToLower(strings.Trim(c.Val(), ".")))
+				}
+			}
+		} else if strings.EqualFold(c.Val(), "site_domains") {
+			if c.NextArg() {
+				site := strings.ToLower(c.Val())
+				if c.NextArg() {
+					config.SiteDomains[site] = dns.Fqdn(strings.ToLower(strings.Trim(c.Val(), ".")))
+				}
+			}
+		} else if strings.EqualFold(c.Val(), "network_alias") {
+			if c.NextArg() {
+				from := strings.ToLower(c.Val())
+				if c.NextArg() {
+					config.NetworkAliases[from] = strings.ToLower(c.Val())
+				}
+			}
+		} else if strings.EqualFold(c.Val(), "client_group_network") {
+			if c.NextArg() {
+				group := c.Val()
+				if c.NextArg() {
+					config.ClientGroupNetworks[group] = strings.ToLower(c.Val())
+				}
+			}
+		} else if strings.EqualFold(c.Val(), "exclude_networks") {
+			for c.NextArg() {
+				config.ExcludeNetworks = append(config.ExcludeNetworks, strings.ToLower(c.Val()))
+			}
+		} else if strings.EqualFold(c.Val(), "additional_reserved_names") {
+			for c.NextArg() {
+				config.AdditionalReservedNames = append(config.AdditionalReservedNames, strings.ToLower(c.Val()))
+			}
+		} else if strings.EqualFold(c.Val(), "network_priority") {
+			for c.NextArg() {
+				config.NetworkPriority = append(config.NetworkPriority, strings.ToLower(c.Val()))
+			}
+		} else if strings.EqualFold(c.Val(), "include_sites") {
+			for c.NextArg() {
+				config.IncludeSites = append(config.IncludeSites, strings.ToLower(c.Val()))
+			}
+		} else if strings.EqualFold(c.Val(), "exclude_sites") {
+			for c.NextArg() {
+				config.ExcludeSites = append(config.ExcludeSites, strings.ToLower(c.Val()))
+			}
+		} else if strings.EqualFold(c.Val(), "max_site_failure_ratio") {
+			if c.NextArg() {
+				ratio, err := strconv.ParseFloat(c.Val(), 64)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid max_site_failure_ratio value: '%s'", c.Val())
+				}
+				config.MaxSiteFailureRatio = ratio
+			}
+		} else if strings.EqualFold(c.Val(), "include_devices") {
+			if c.NextArg() {
+				config.IncludeDevices = strings.ToLower(c.Val())
+			}
+		} else if strings.EqualFold(c.Val(), "apex_records") {
+			if c.NextArg() {
+				domain := dns.Fqdn(strings.ToLower(strings.Trim(c.Val(), ".")))
+				if c.NextArg() {
+					config.ApexRecords[domain] = c.Val()
+				}
+			}
+		} else if strings.EqualFold(c.Val(), "record_types") {
+			if c.NextArg() {
+				network := strings.ToLower(c.Val())
+				types := []string{}
+				for c.NextArg() {
+					recordType := strings.ToUpper(c.Val())
+					if recordType != "A" && recordType != "AAAA" {
+						return nil, fmt.Errorf("'%s' is not a supported record type", c.Val())
 					}
-					domain = domain + "."
-					config.Networks[network] = domain
+					types = append(types, recordType)
+				}
+				if len(types) == 0 {
+					return nil, fmt.Errorf("No record types set for network '%s'", network)
+				}
+				recordTypes[network] = types
+			}
+		} else if strings.EqualFold(c.Val(), "ns_records") {
+			for c.NextArg() {
+				config.NSRecords = append(config.NSRecords, dns.Fqdn(strings.ToLower(strings.Trim(c.Val(), "."))))
+			}
+		} else if strings.EqualFold(c.Val(), "negative_ttl") {
+			if c.NextArg() {
+				ttl, err := strconv.ParseUint(c.Val(), 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid negative_ttl value: '%s'", c.Val())
 				}
+				config.NegativeTTL = uint32(ttl)
+			}
+		} else if strings.EqualFold(c.Val(), "nxdomain_redirect_ip") {
+			if c.NextArg() {
+				config.NXDomainRedirectIP = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "nxdomain_redirect_domains") {
+			for c.NextArg() {
+				config.NXDomainRedirectDomains = append(config.NXDomainRedirectDomains, dns.Fqdn(strings.ToLower(strings.Trim(c.Val(), "."))))
+			}
+		} else if strings.EqualFold(c.Val(), "ipv6_ptr_zone") {
+			if c.NextArg() {
+				config.IPv6PTRZone = dns.Fqdn(strings.ToLower(strings.Trim(c.Val(), ".")))
+			}
+		} else if strings.EqualFold(c.Val(), "default_domain") || strings.EqualFold(c.Val(), "domain_fallback") {
+			if c.NextArg() {
+				config.DefaultDomain = dns.Fqdn(strings.ToLower(strings.Trim(c.Val(), ".")))
+			}
+		} else if strings.EqualFold(c.Val(), "vpn_domain") {
+			if c.NextArg() {
+				config.VPNDomain = dns.Fqdn(strings.ToLower(strings.Trim(c.Val(), ".")))
+			}
+		} else if strings.EqualFold(c.Val(), "hostname_collision_policy") {
+			if c.NextArg() {
+				config.HostnameCollisionPolicy = strings.ToLower(c.Val())
+			}
+		} else if strings.EqualFold(c.Val(), "name_dedup_strategy") {
+			if c.NextArg() {
+				config.NameDedupStrategy = strings.ToLower(c.Val())
+			}
+		} else if strings.EqualFold(c.Val(), "log_format") {
+			if c.NextArg() {
+				config.LogFormat = strings.ToLower(c.Val())
+			}
+		} else if strings.EqualFold(c.Val(), "overlap_check") {
+			// the bare directive warns
+			config.OverlapCheck = "warn"
+			if c.NextArg() {
+				config.OverlapCheck = strings.ToLower(c.Val())
+			}
+		} else if strings.EqualFold(c.Val(), "name_normalization") {
+			if c.NextArg() {
+				config.NameNormalization = strings.ToLower(c.Val())
+			}
+		} else if strings.EqualFold(c.Val(), "trusted_macs") {
+			if c.NextArg() {
+				config.TrustedMACsFile = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "online_within") {
+			if c.NextArg() {
+				window, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid online_within value: '%s'", c.Val())
+				}
+				config.OnlineWithin = window
+			}
+		} else if strings.EqualFold(c.Val(), "client_type") {
+			if c.NextArg() {
+				config.ClientType = strings.ToLower(c.Val())
+			}
+		} else if strings.EqualFold(c.Val(), "ip_filter") {
+			config.IPFilter = nil
+			for c.NextArg() {
+				config.IPFilter = append(config.IPFilter, c.Val())
+			}
+		} else if strings.EqualFold(c.Val(), "ip_filter_mode") {
+			if c.NextArg() {
+				config.IPFilterMode = strings.ToLower(c.Val())
+			}
+		} else if strings.EqualFold(c.Val(), "rate_limit") {
+			if c.NextArg() {
+				limit, err := strconv.ParseFloat(c.Val(), 64)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid rate_limit value: '%s'", c.Val())
+				}
+				config.RateLimit = limit
+			}
+		} else if strings.EqualFold(c.Val(), "rate_limit_action") {
+			if c.NextArg() {
+				config.RateLimitAction = strings.ToLower(c.Val())
+			}
+		} else if strings.EqualFold(c.Val(), "max_workers") {
+			if c.NextArg() {
+				workers, err := strconv.Atoi(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid max_workers value: '%s'", c.Val())
+				}
+				config.MaxWorkers = workers
+			}
+		} else if strings.EqualFold(c.Val(), "worker_timeout") {
+			if c.NextArg() {
+				timeout, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid worker_timeout value: '%s'", c.Val())
+				}
+				config.WorkerTimeout = timeout
+			}
+		} else if strings.EqualFold(c.Val(), "resolve_timeout") {
+			if c.NextArg() {
+				timeout, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid resolve_timeout value: '%s'", c.Val())
+				}
+				config.ResolveTimeout = timeout
+			}
+		} else if strings.EqualFold(c.Val(), "circuit_breaker") {
+			config.CircuitBreaker = true
+			// e.g. circuit_breaker failure_threshold=5 open_duration=5m
+			for _, arg := range c.RemainingArgs() {
+				key, value, _ := strings.Cut(arg, "=")
+				switch strings.ToLower(key) {
+				case "failure_threshold":
+					threshold, err := strconv.Atoi(value)
+					if err != nil || threshold < 1 {
+						return nil, fmt.Errorf("Invalid circuit_breaker failure_threshold value: '%s'", value)
+					}
+					config.CircuitFailureThreshold = threshold
+				case "open_duration":
+					duration, err := time.ParseDuration(value)
+					if err != nil || duration <= 0 {
+						return nil, fmt.Errorf("Invalid circuit_breaker open_duration value: '%s'", value)
+					}
+					config.CircuitOpenDuration = duration
+				default:
+					return nil, fmt.Errorf("Invalid circuit_breaker option: '%s'", arg)
+				}
+			}
+		} else if strings.EqualFold(c.Val(), "redis_addr") {
+			if c.NextArg() {
+				config.RedisAddr = c.Val()
+			}
+			// e.g. redis_addr redis:6379 password=secret key=unifi-names
+			for _, arg := range c.RemainingArgs() {
+				key, value, ok := strings.Cut(arg, "=")
+				switch {
+				case ok && strings.EqualFold(key, "password"):
+					config.RedisPassword = value
+				case ok && strings.EqualFold(key, "key") && value != "":
+					config.RedisKey = value
+				default:
+					return nil, fmt.Errorf("Invalid redis_addr option: '%s'", arg)
+				}
+			}
+		} else if strings.EqualFold(c.Val(), "cache_file") {
+			if c.NextArg() {
+				config.CacheFile = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "debug_file") {
+			if c.NextArg() {
+				config.DebugFile = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "debug_file_max_size_mb") {
+			if c.NextArg() {
+				size, err := strconv.Atoi(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid debug_file_max_size_mb value: '%s'", c.Val())
+				}
+				config.DebugFileMaxSizeMB = size
+			}
+		} else if strings.EqualFold(c.Val(), "max_cache_age") {
+			if c.NextArg() {
+				age, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid max_cache_age value: '%s'", c.Val())
+				}
+				config.MaxCacheAge = age
 			}
 		} else if strings.EqualFold(c.Val(), "ttl") {
 			if c.NextArg() {
@@ -68,12 +771,412 @@ func newConfigFromDispenser(c caddyfile.Dispenser) (*config, error) {
 				}
 				config.TTL = uint32(ttl)
 			}
+		} else if strings.EqualFold(c.Val(), "min_ttl") || strings.EqualFold(c.Val(), "answer_ttl_floor") {
+			directive := strings.ToLower(c.Val())
+			if c.NextArg() {
+				ttl, err := strconv.ParseUint(c.Val(), 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid %s value: '%s'", directive, c.Val())
+				}
+				config.MinTTL = uint32(ttl)
+			}
+		} else if strings.EqualFold(c.Val(), "max_ttl") {
+			if c.NextArg() {
+				ttl, err := strconv.ParseUint(c.Val(), 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid max_ttl value: '%s'", c.Val())
+				}
+				config.MaxTTL = uint32(ttl)
+			}
+		} else if strings.EqualFold(c.Val(), "refresh_jitter") {
+			if c.NextArg() {
+				jitter, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid refresh_jitter value: '%s'", c.Val())
+				}
+				config.RefreshJitter = jitter
+			}
+		} else if strings.EqualFold(c.Val(), "metrics_refresh_interval") {
+			if c.NextArg() {
+				interval, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid metrics_refresh_interval value: '%s'", c.Val())
+				}
+				config.MetricsRefreshInterval = interval
+			}
+		} else if strings.EqualFold(c.Val(), "request_timeout") {
+			if c.NextArg() {
+				timeout, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid request_timeout value: '%s'", c.Val())
+				}
+				config.RequestTimeout = timeout
+			}
+		} else if strings.EqualFold(c.Val(), "max_refresh_duration") {
+			if c.NextArg() {
+				duration, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid max_refresh_duration value: '%s'", c.Val())
+				}
+				config.MaxRefreshDuration = duration
+			}
+		} else if strings.EqualFold(c.Val(), "connect_retry") {
+			if c.NextArg() {
+				retry, err := strconv.Atoi(c.Val())
+				if err != nil || retry < 0 {
+					return nil, fmt.Errorf("Invalid connect_retry value: '%s'", c.Val())
+				}
+				config.ConnectRetry = retry
+			}
+		} else if strings.EqualFold(c.Val(), "connect_retry_delay") {
+			if c.NextArg() {
+				delay, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid connect_retry_delay value: '%s'", c.Val())
+				}
+				config.ConnectRetryDelay = delay
+			}
+		} else if strings.EqualFold(c.Val(), "batch_update_threshold") {
+			if c.NextArg() {
+				threshold, err := strconv.Atoi(c.Val())
+				if err != nil || threshold < 0 {
+					return nil, fmt.Errorf("Invalid batch_update_threshold value: '%s'", c.Val())
+				}
+				config.BatchUpdateThreshold = threshold
+			}
+		} else if strings.EqualFold(c.Val(), "max_defer_duration") {
+			if c.NextArg() {
+				duration, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid max_defer_duration value: '%s'", c.Val())
+				}
+				config.MaxDeferDuration = duration
+			}
+		} else if strings.EqualFold(c.Val(), "http_timeout") {
+			if c.NextArg() {
+				timeout, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid http_timeout value: '%s'", c.Val())
+				}
+				config.HTTPTimeout = timeout
+			}
+		} else if strings.EqualFold(c.Val(), "discovery_timeout") {
+			if c.NextArg() {
+				timeout, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid discovery_timeout value: '%s'", c.Val())
+				}
+				config.DiscoveryTimeout = timeout
+			}
+		} else if strings.EqualFold(c.Val(), "max_stale_refreshes") {
+			if c.NextArg() {
+				refreshes, err := strconv.Atoi(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid max_stale_refreshes value: '%s'", c.Val())
+				}
+				config.MaxStaleRefreshes = refreshes
+			}
+		} else if strings.EqualFold(c.Val(), "max_stale_age") {
+			if c.NextArg() {
+				age, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid max_stale_age value: '%s'", c.Val())
+				}
+				config.MaxStaleAge = age
+			}
+		} else if strings.EqualFold(c.Val(), "nxdomain_action") {
+			if c.NextArg() {
+				config.NXDomainAction = strings.ToLower(c.Val())
+			}
+		} else if strings.EqualFold(c.Val(), "view_network_match") {
+			config.ViewNetworkMatch = true
+		} else if strings.EqualFold(c.Val(), "lock_free_records") {
+			config.LockFreeRecords = true
+		} else if strings.EqualFold(c.Val(), "edns_subnet_routing") {
+			config.EDNSSubnetRouting = true
+		} else if strings.EqualFold(c.Val(), "include_additional_records") {
+			config.IncludeAdditionalRecords = true
+		} else if strings.EqualFold(c.Val(), "use_event_stream") {
+			config.UseEventStream = true
+		} else if strings.EqualFold(c.Val(), "event_stream_reconcile_interval") {
+			if c.NextArg() {
+				interval, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid event_stream_reconcile_interval value: '%s'", c.Val())
+				}
+				config.EventStreamReconcileInterval = interval
+			}
+		} else if strings.EqualFold(c.Val(), "unhealthy_threshold") {
+			if c.NextArg() {
+				threshold, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid unhealthy_threshold value: '%s'", c.Val())
+				}
+				config.UnhealthyThreshold = threshold
+			}
+		} else if strings.EqualFold(c.Val(), "max_records") {
+			if c.NextArg() {
+				records, err := strconv.Atoi(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid max_records value: '%s'", c.Val())
+				}
+				config.MaxRecords = records
+			}
+		} else if strings.EqualFold(c.Val(), "answer_limit") {
+			if c.NextArg() {
+				limit, err := strconv.Atoi(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid answer_limit value: '%s'", c.Val())
+				}
+				config.AnswerLimit = limit
+			}
+		} else if strings.EqualFold(c.Val(), "hostname_max_length") {
+			if c.NextArg() {
+				length, err := strconv.Atoi(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid hostname_max_length value: '%s'", c.Val())
+				}
+				config.HostnameMaxLength = length
+			}
+		} else if strings.EqualFold(c.Val(), "prometheus_labels") {
+			// e.g. prometheus_labels datacenter=us-east-1 env=prod
+			for _, arg := range c.RemainingArgs() {
+				name, value, ok := strings.Cut(arg, "=")
+				if !ok {
+					return nil, fmt.Errorf("Invalid prometheus_labels value: '%s'", arg)
+				}
+				if config.PrometheusLabels == nil {
+					config.PrometheusLabels = map[string]string{}
+				}
+				config.PrometheusLabels[name] = value
+			}
+		} else if strings.EqualFold(c.Val(), "prometheus_namespace") {
+			if c.NextArg() {
+				config.PrometheusNamespace = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "http_address") {
+			if c.NextArg() {
+				config.HTTPAddress = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "proxy_url") {
+			if c.NextArg() {
+				config.ProxyURL = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "no_proxy") {
+			config.NoProxy = strings.Join(c.RemainingArgs(), ",")
+		} else if strings.EqualFold(c.Val(), "socks5_proxy") {
+			if c.NextArg() {
+				config.Socks5Proxy = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "socks5_user") {
+			if c.NextArg() {
+				config.Socks5User = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "socks5_pass") {
+			if c.NextArg() {
+				config.Socks5Pass = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "tls_min_version") {
+			if c.NextArg() {
+				config.TLSMinVersion = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "controller_version") {
+			if c.NextArg() {
+				config.ControllerVersion = strings.ToLower(c.Val())
+			}
+		} else if strings.EqualFold(c.Val(), "auth_mode") {
+			if c.NextArg() {
+				config.AuthMode = strings.ToLower(c.Val())
+			}
+		} else if strings.EqualFold(c.Val(), "secrets_backend") {
+			if c.NextArg() {
+				config.SecretsBackend = strings.ToLower(c.Val())
+			}
+		} else if strings.EqualFold(c.Val(), "vault_addr") {
+			if c.NextArg() {
+				config.VaultAddr = strings.TrimRight(c.Val(), "/")
+			}
+		} else if strings.EqualFold(c.Val(), "vault_path") {
+			if c.NextArg() {
+				config.VaultPath = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "vault_token") {
+			if c.NextArg() {
+				config.VaultToken = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "vault_role") {
+			if c.NextArg() {
+				config.VaultRoleID = c.Val()
+				if c.NextArg() {
+					config.VaultSecretID = c.Val()
+				}
+			}
+		} else if strings.EqualFold(c.Val(), "use_env_proxy") {
+			config.UseEnvProxy = true
 		} else if strings.EqualFold(c.Val(), "debug") {
 			config.Debug = true
+		} else if strings.EqualFold(c.Val(), "compact_logging") {
+			config.CompactLogging = true
+		} else if strings.EqualFold(c.Val(), "strict_hostname_validation") {
+			config.StrictHostnameValidation = true
+		} else if strings.EqualFold(c.Val(), "strict_ip_uniqueness") {
+			config.StrictIPUniqueness = true
+		} else if strings.EqualFold(c.Val(), "dns_prefix") {
+			if c.NextArg() {
+				config.DNSPrefix = strings.ToLower(c.Val())
+			}
+		} else if strings.EqualFold(c.Val(), "dns_prefix_separator") {
+			if c.NextArg() {
+				config.DNSPrefixSeparator = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "parse_dns_override") {
+			config.ParseDNSOverride = true
+		} else if strings.EqualFold(c.Val(), "dns_override_pattern") {
+			if c.NextArg() {
+				config.DNSOverridePattern = c.Val()
+			}
 		} else if strings.EqualFold(c.Val(), "use_name_as_hostname") {
 			config.UseNameAsHostname = true
+		} else if strings.EqualFold(c.Val(), "hostname_fields") {
+			config.HostnameFields = nil
+			for c.NextArg() {
+				config.HostnameFields = append(config.HostnameFields, strings.ToLower(c.Val()))
+			}
+		} else if strings.EqualFold(c.Val(), "hostname_suffix_strip") {
+			// without arguments no suffix is stripped
+			config.HostnameSuffixStrip = nil
+			for c.NextArg() {
+				config.HostnameSuffixStrip = append(config.HostnameSuffixStrip, strings.ToLower(c.Val()))
+			}
+		} else if strings.EqualFold(c.Val(), "client_label_field") {
+			if c.NextArg() {
+				config.ClientLabelField = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "preserve_dots") {
+			config.PreserveDots = true
+		} else if strings.EqualFold(c.Val(), "auto_discover") {
+			config.AutoDiscover = true
+		} else if strings.EqualFold(c.Val(), "client_metrics") {
+			config.ClientMetrics = true
+		} else if strings.EqualFold(c.Val(), "export_dnsmasq_hosts") {
+			if c.NextArg() {
+				config.DnsmasqHostsFile = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "dnsmasq_reload_command") {
+			if c.NextArg() {
+				config.DnsmasqReloadCommand = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "on_startup_command") {
+			if c.NextArg() {
+				config.OnStartupCommand = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "on_refresh_command") {
+			if c.NextArg() {
+				config.OnRefreshCommand = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "telemetry_url") {
+			if c.NextArg() {
+				config.TelemetryURL = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "telemetry_token") {
+			if c.NextArg() {
+				config.TelemetryToken = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "per_client_metrics") {
+			config.PerClientMetrics = true
+		} else if strings.EqualFold(c.Val(), "per_client_metrics_max_cardinality") {
+			if c.NextArg() {
+				max, err := strconv.Atoi(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid per_client_metrics_max_cardinality value: '%s'", c.Val())
+				}
+				config.PerClientMetricsMaxCardinality = max
+			}
+		} else if strings.EqualFold(c.Val(), "require_initial_data") {
+			config.RequireInitialData = true
+		} else if strings.EqualFold(c.Val(), "lazy_load") {
+			config.LazyLoad = true
+		} else if strings.EqualFold(c.Val(), "lazy_load_timeout") {
+			if c.NextArg() {
+				timeout, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid lazy_load_timeout value: '%s'", c.Val())
+				}
+				config.LazyLoadTimeout = timeout
+			}
+		} else if strings.EqualFold(c.Val(), "authoritative") {
+			config.Authoritative = true
+		} else if strings.EqualFold(c.Val(), "wildcard_clients") {
+			config.WildcardClients = true
+		} else if strings.EqualFold(c.Val(), "serve_hinfo") {
+			config.ServeHINFO = true
+		} else if strings.EqualFold(c.Val(), "include_switch_ports") {
+			config.IncludeSwitchPorts = true
+		} else if strings.EqualFold(c.Val(), "oui_database") {
+			if c.NextArg() {
+				config.OUIDatabase = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "include_txt_metadata") {
+			config.IncludeTXTMetadata = true
+		} else if strings.EqualFold(c.Val(), "include_annotations") {
+			config.IncludeAnnotations = true
+		} else if strings.EqualFold(c.Val(), "record_annotations") {
+			// e.g. record_annotations env=prod managed_by=unifi
+			for _, arg := range c.RemainingArgs() {
+				key, value, ok := strings.Cut(arg, "=")
+				if !ok {
+					return nil, fmt.Errorf("Invalid record_annotations value: '%s'", arg)
+				}
+				if config.RecordAnnotations == nil {
+					config.RecordAnnotations = map[string]string{}
+				}
+				config.RecordAnnotations[key] = value
+			}
+		} else if strings.EqualFold(c.Val(), "naptr_services") {
+			service, err := parseNAPTRService(c.RemainingArgs())
+			if err != nil {
+				return nil, err
+			}
+			config.NAPTRServices = append(config.NAPTRServices, service)
+		} else if strings.EqualFold(c.Val(), "mail_records") {
+			if err := config.setMailRecord(c.RemainingArgs()); err != nil {
+				return nil, err
+			}
+		} else if strings.EqualFold(c.Val(), "synthesize_srv") {
+			config.SynthesizeSRV = true
+			// e.g. synthesize_srv priority=10 weight=5 port=8080
+			for _, arg := range c.RemainingArgs() {
+				if err := config.setSRVOption(arg); err != nil {
+					return nil, err
+				}
+			}
+		} else if strings.EqualFold(c.Val(), "k8s_configmap_export") {
+			// e.g. k8s_configmap_export namespace=dns name=unifi-names kubeconfig_path=/etc/kubeconfig
+			for _, arg := range c.RemainingArgs() {
+				if err := config.setConfigMapOption(arg); err != nil {
+					return nil, err
+				}
+			}
+			if config.ConfigMapName == "" {
+				return nil, fmt.Errorf("No k8s_configmap_export name set")
+			}
+		} else if strings.EqualFold(c.Val(), "dry_run") {
+			config.DryRun = true
 		} else if strings.EqualFold(c.Val(), "verifyssl") {
 			config.UnifiVerifySSL = true
+		} else if strings.EqualFold(c.Val(), "ca_cert_file") {
+			if c.NextArg() {
+				config.CACertFile = c.Val()
+			}
+		} else if strings.EqualFold(c.Val(), "verify_ssl_system_pool") {
+			config.VerifySSLSystemPool = true
+			if c.NextArg() {
+				systemPool, err := strconv.ParseBool(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("Invalid verify_ssl_system_pool value: '%s'", c.Val())
+				}
+				config.VerifySSLSystemPool = systemPool
+			}
 		} else if strings.EqualFold(c.Val(), "unifi") {
 			if c.NextArg() {
 				config.UnifiControllerURL = strings.TrimRight(c.Val(), "/")
@@ -97,28 +1200,584 @@ func newConfigFromDispenser(c caddyfile.Dispenser) (*config, error) {
 			}
 		}
 	}
+	// the networks of the Corefile and the config file win over the ones of the networks file
+	if config.NetworksFile != "" {
+		networks, err := loadNetworksFile(config.NetworksFile)
+		if err != nil {
+			return nil, err
+		}
+		for network, networkConfig := range networks {
+			if _, ok := config.Networks[network]; !ok {
+				config.Networks[network] = networkConfig
+			}
+		}
+	}
+	// the config file and the directives are validated together so both are held to the same rules
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
 	if config.Debug {
-		log.Println("[unifi-names] Debug Mode is on")
-		log.Printf("[unifi-names] Parsed %d Networks\n", len(config.Networks))
-		log.Printf("[unifi-names] TTL is %d", config.TTL)
-		log.Printf("[unifi-names] Controller URL is `%s'", config.UnifiControllerURL)
-		log.Printf("[unifi-names] VerifySSL is `%s'", map[bool]string{true: "On", false: "Off"}[config.UnifiVerifySSL])
-		// log.Printf("[unifi-names] Controller SSL fingerprint is `%x'", config.UnifiSSLFingerprint)
-	}
-	if len(config.Networks) <= 0 {
+		log.Info("Debug Mode is on")
+		log.Infof("Parsed %d Networks", len(config.Networks))
+		log.Infof("Parsed %d VLANs", len(config.VLANNetworks))
+		log.Infof("TTL is %d", config.TTL)
+		log.Infof("Min TTL is %d", config.MinTTL)
+		log.Infof("Max TTL is %d", config.MaxTTL)
+		log.Infof("Refresh jitter is %s", config.RefreshJitter)
+		log.Infof("Request timeout is %s", config.RequestTimeout)
+		log.Infof("HTTP timeout is %s", config.HTTPTimeout)
+		log.Infof("Controller URL is `%s'", config.UnifiControllerURL)
+		log.Infof("Controller version is `%s'", config.ControllerVersion)
+		log.Infof("AutoDiscover is `%s'", map[bool]string{true: "On", false: "Off"}[config.AutoDiscover])
+		log.Infof("Proxy URL is `%s'", config.ProxyURL)
+		log.Infof("SOCKS5 proxy is `%s'", config.Socks5Proxy)
+		log.Infof("VerifySSL is `%s'", map[bool]string{true: "On", false: "Off"}[config.UnifiVerifySSL])
+		log.Infof("Authoritative is `%s'", map[bool]string{true: "On", false: "Off"}[config.Authoritative])
+		log.Infof("WildcardClients is `%s'", map[bool]string{true: "On", false: "Off"}[config.WildcardClients])
+		log.Infof("SynthesizeSRV is `%s'", map[bool]string{true: "On", false: "Off"}[config.SynthesizeSRV])
+		log.Infof("DryRun is `%s'", map[bool]string{true: "On", false: "Off"}[config.DryRun])
+		// log.Infof("Controller SSL fingerprint is `%x'", config.UnifiSSLFingerprint)
+	}
+	if err := config.parseCIDRNetworks(); err != nil {
+		return nil, err
+	}
+	if err := config.parseIPFilter(); err != nil {
+		return nil, err
+	}
+	if config.OUIDatabase != "" {
+		vendors, err := loadOUIDatabase(config.OUIDatabase)
+		if err != nil {
+			return nil, err
+		}
+		config.ouiVendors = vendors
+	}
+	if config.ParseDNSOverride {
+		pattern, err := regexp.Compile(config.DNSOverridePattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid dns_override_pattern value: '%s'", config.DNSOverridePattern)
+		}
+		config.dnsOverride = pattern
+	}
+	if config.ClientLabelField != "" {
+		index, err := clientFieldIndex(config.ClientLabelField)
+		if err != nil {
+			log.Warningf("ignoring client_label_field, using hostname_fields: %v", err)
+		}
+		config.clientLabelField = index
+	}
+	if config.CACertFile != "" {
+		config.UnifiVerifySSL = true
+	}
+	if config.UnifiVerifySSL && (config.CACertFile != "" || !config.VerifySSLSystemPool) {
+		pool, err := config.loadRootCAs()
+		if err != nil {
+			return nil, err
+		}
+		config.rootCAs = pool
+	}
+	if config.VPNDomain != "" {
+		if _, ok := config.Networks[vpnNetwork]; ok {
+			return nil, fmt.Errorf("The vpn_domain can't be used with a network named '%s'", vpnNetwork)
+		}
+		config.Networks[vpnNetwork] = &NetworkConfig{Domain: config.VPNDomain}
+	}
+	if len(config.Networks) <= 0 && len(config.VLANNetworks) <= 0 && len(config.SiteDomains) <= 0 && config.DefaultDomain == "" {
 		return nil, fmt.Errorf("There are no networks to handle")
 	}
-	if config.UnifiControllerURL == "" {
-		return nil, fmt.Errorf("No controller url set")
+	for network, types := range recordTypes {
+		networkConfig, ok := config.Networks[network]
+		if !ok {
+			return nil, fmt.Errorf("Record types are set for the unknown network '%s'", network)
+		}
+		networkConfig.RecordTypes = types
+	}
+	vlans := map[int]string{}
+	for network, networkConfig := range config.Networks {
+		if networkConfig.VLANID == 0 {
+			continue
+		}
+		if other, ok := vlans[networkConfig.VLANID]; ok {
+			return nil, fmt.Errorf("The networks '%s' and '%s' have the same vlan %d", other, network, networkConfig.VLANID)
+		}
+		vlans[networkConfig.VLANID] = network
+	}
+	if _, ok := config.Networks[config.IncludeDevices]; !ok && config.IncludeDevices != "" {
+		return nil, fmt.Errorf("Devices are included in the unknown network '%s'", config.IncludeDevices)
+	}
+	for alias, network := range config.NetworkAliases {
+		if _, ok := config.Networks[network]; !ok {
+			return nil, fmt.Errorf("Network alias '%s' points to the unknown network '%s'", alias, network)
+		}
+	}
+	for group, network := range config.ClientGroupNetworks {
+		if _, ok := config.Networks[network]; !ok {
+			return nil, fmt.Errorf("Client group '%s' is mapped to the unknown network '%s'", group, network)
+		}
+	}
+	for domain := range config.ApexRecords {
+		found := false
+		for _, networkDomain := range config.domains() {
+			if domain == networkDomain {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Apex record for the unknown domain '%s'", domain)
+		}
+	}
+	staticTXT, err := config.mailTXTRecords()
+	if err != nil {
+		return nil, err
+	}
+	config.staticTXT = staticTXT
+	if config.ConfigMapName != "" && !configMapExportSupported {
+		return nil, fmt.Errorf("k8s_configmap_export requires building with the k8s tag")
+	}
+	if config.ProxyURL != "" && config.Socks5Proxy != "" {
+		return nil, fmt.Errorf("proxy_url and socks5_proxy can't be used together")
+	}
+	if config.SecretsBackend == "vault" {
+		if config.VaultAddr == "" || config.VaultPath == "" {
+			return nil, fmt.Errorf("No vault_addr or vault_path set")
+		}
+		if config.VaultToken == "" && config.VaultRoleID == "" {
+			return nil, fmt.Errorf("No vault_token or vault_role set")
+		}
 	}
 	if config.UnifiSite == "" {
 		return nil, fmt.Errorf("No controller site set")
 	}
-	if config.UnifiUsername == "" {
-		return nil, fmt.Errorf("No controller username set")
-	}
-	if config.UnifiPassword == "" {
-		return nil, fmt.Errorf("No controller password set")
+	// the url and the credentials are fetched from the secrets backend before logging in
+	if config.SecretsBackend == "" {
+		// the url is discovered in setup
+		if config.UnifiControllerURL == "" && !config.AutoDiscover {
+			return nil, fmt.Errorf("No controller url set")
+		}
+		if config.UnifiUsername == "" {
+			return nil, fmt.Errorf("No controller username set")
+		}
+		if config.UnifiPassword == "" {
+			return nil, fmt.Errorf("No controller password set")
+		}
 	}
 	return &config, nil
 }
+
+// validate checks the values of the config file and the directives once both are applied
+func (c *config) validate() error {
+	for vlan, domain := range c.VLANNetworks {
+		if vlan < 1 || vlan > 4094 {
+			return fmt.Errorf("Invalid vlan value: '%d'", vlan)
+		}
+		if !govalidator.IsDNSName(strings.TrimSuffix(domain, ".")) {
+			return fmt.Errorf("'%s' is not a valid domain name", domain)
+		}
+	}
+	for _, domain := range c.SiteDomains {
+		if !govalidator.IsDNSName(strings.TrimSuffix(domain, ".")) {
+			return fmt.Errorf("'%s' is not a valid domain name", domain)
+		}
+	}
+	for _, domain := range []string{c.VPNDomain, c.DefaultDomain} {
+		if domain != "" && !govalidator.IsDNSName(strings.TrimSuffix(domain, ".")) {
+			return fmt.Errorf("'%s' is not a valid domain name", domain)
+		}
+	}
+	for _, ip := range c.ApexRecords {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("'%s' is not a valid ip address", ip)
+		}
+	}
+	for _, ns := range c.NSRecords {
+		if !govalidator.IsDNSName(strings.TrimSuffix(ns, ".")) {
+			return fmt.Errorf("'%s' is not a valid nameserver name", ns)
+		}
+	}
+	if c.NXDomainRedirectIP != "" && net.ParseIP(c.NXDomainRedirectIP) == nil {
+		return fmt.Errorf("Invalid nxdomain_redirect_ip value: '%s'", c.NXDomainRedirectIP)
+	}
+	for _, domain := range c.NXDomainRedirectDomains {
+		if !slices.Contains(c.domains(), domain) {
+			return fmt.Errorf("Invalid nxdomain_redirect_domains value: '%s'", domain)
+		}
+	}
+	if !govalidator.IsDNSName(strings.TrimSuffix(c.IPv6PTRZone, ".")) {
+		return fmt.Errorf("'%s' is not a valid zone name", c.IPv6PTRZone)
+	}
+	// the prefix has to leave room for at least one character of the hostnames
+	if prefix := c.dnsPrefix(); !reHostnameAffix.MatchString(prefix) || len(prefix) >= c.maxHostnameLength() {
+		return fmt.Errorf("Invalid dns_prefix value: '%s'", prefix)
+	}
+	for _, field := range c.HostnameFields {
+		if _, ok := hostnameFields[field]; !ok {
+			return fmt.Errorf("Invalid hostname_fields value: '%s'", field)
+		}
+	}
+	// the floor wins over the cap, a cap below it would never apply
+	if c.MaxTTL > 0 && c.MaxTTL < c.MinTTL {
+		return fmt.Errorf("Invalid max_ttl value: '%d'", c.MaxTTL)
+	}
+
+	if policy := c.HostnameCollisionPolicy; policy != "first" && policy != "last" && policy != "all" {
+		return fmt.Errorf("Invalid hostname_collision_policy value: '%s'", policy)
+	}
+	if strategy := c.NameDedupStrategy; strategy != "" && strategy != "append_mac" && strategy != "append_index" &&
+		strategy != "skip" && strategy != "first_wins" {
+		return fmt.Errorf("Invalid name_dedup_strategy value: '%s'", strategy)
+	}
+	if format := c.LogFormat; format != "text" && format != "json" {
+		return fmt.Errorf("Invalid log_format value: '%s'", format)
+	}
+	if check := c.OverlapCheck; check != "" && check != "off" && check != "warn" && check != "error" {
+		return fmt.Errorf("Invalid overlap_check value: '%s'", check)
+	}
+	if _, ok := nameNormalizers[c.NameNormalization]; !ok {
+		return fmt.Errorf("Invalid name_normalization value: '%s'", c.NameNormalization)
+	}
+	if clientType := c.ClientType; clientType != "all" && clientType != "wired" && clientType != "wireless" {
+		return fmt.Errorf("Invalid client_type value: '%s'", clientType)
+	}
+	if mode := c.IPFilterMode; mode != "include" && mode != "exclude" {
+		return fmt.Errorf("Invalid ip_filter_mode value: '%s'", mode)
+	}
+	if action := c.RateLimitAction; action != "drop" && action != "passthrough" {
+		return fmt.Errorf("Invalid rate_limit_action value: '%s'", action)
+	}
+	if _, ok := nxdomainActions[c.NXDomainAction]; !ok && c.NXDomainAction != "" {
+		return fmt.Errorf("Invalid nxdomain_action value: '%s'", c.NXDomainAction)
+	}
+	if version := c.ControllerVersion; version != "v1" && version != "v2" && version != "auto" {
+		return fmt.Errorf("Invalid controller_version value: '%s'", version)
+	}
+	if mode := c.AuthMode; mode != "session" && mode != "basic" {
+		return fmt.Errorf("Invalid auth_mode value: '%s'", mode)
+	}
+	if c.SecretsBackend != "" && c.SecretsBackend != "vault" {
+		return fmt.Errorf("Invalid secrets_backend value: '%s'", c.SecretsBackend)
+	}
+	if _, ok := tlsVersions[c.TLSMinVersion]; !ok {
+		return fmt.Errorf("Invalid tls_min_version value: '%s'", c.TLSMinVersion)
+	}
+
+	if c.HostnameMaxLength < 1 || c.HostnameMaxLength > 63 {
+		return fmt.Errorf("Invalid hostname_max_length value: '%d'", c.HostnameMaxLength)
+	}
+	for name, value := range map[string]int{
+		"max_stale_refreshes":                c.MaxStaleRefreshes,
+		"max_records":                        c.MaxRecords,
+		"max_workers":                        c.MaxWorkers,
+		"answer_limit":                       c.AnswerLimit,
+		"debug_file_max_size_mb":             c.DebugFileMaxSizeMB,
+		"per_client_metrics_max_cardinality": c.PerClientMetricsMaxCardinality,
+	} {
+		if value < 0 {
+			return fmt.Errorf("Invalid %s value: '%d'", name, value)
+		}
+	}
+	if c.RateLimit < 0 {
+		return fmt.Errorf("Invalid rate_limit value: '%g'", c.RateLimit)
+	}
+	if c.MaxSiteFailureRatio < 0 || c.MaxSiteFailureRatio > 1 {
+		return fmt.Errorf("Invalid max_site_failure_ratio value: '%g'", c.MaxSiteFailureRatio)
+	}
+	for name, timeout := range map[string]time.Duration{
+		"request_timeout":   c.RequestTimeout,
+		"http_timeout":      c.HTTPTimeout,
+		"discovery_timeout": c.DiscoveryTimeout,
+	} {
+		if timeout <= 0 {
+			return fmt.Errorf("Invalid %s value: '%s'", name, timeout)
+		}
+	}
+	for name, duration := range map[string]time.Duration{
+		"online_within":                   c.OnlineWithin,
+		"max_cache_age":                   c.MaxCacheAge,
+		"refresh_jitter":                  c.RefreshJitter,
+		"metrics_refresh_interval":        c.MetricsRefreshInterval,
+		"max_refresh_duration":            c.MaxRefreshDuration,
+		"max_stale_age":                   c.MaxStaleAge,
+		"event_stream_reconcile_interval": c.EventStreamReconcileInterval,
+		"unhealthy_threshold":             c.UnhealthyThreshold,
+		"worker_timeout":                  c.WorkerTimeout,
+		"resolve_timeout":                 c.ResolveTimeout,
+		"connect_retry_delay":             c.ConnectRetryDelay,
+		"max_defer_duration":              c.MaxDeferDuration,
+		"lazy_load_timeout":               c.LazyLoadTimeout,
+	} {
+		if duration < 0 {
+			return fmt.Errorf("Invalid %s value: '%s'", name, duration)
+		}
+	}
+
+	if c.CircuitBreaker && c.CircuitFailureThreshold < 1 {
+		return fmt.Errorf("Invalid circuit_failure_threshold value: '%d'", c.CircuitFailureThreshold)
+	}
+	if c.CircuitBreaker && c.CircuitOpenDuration <= 0 {
+		return fmt.Errorf("Invalid circuit_open_duration value: '%s'", c.CircuitOpenDuration)
+	}
+	if c.TelemetryURL != "" {
+		if u, err := url.Parse(c.TelemetryURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid telemetry_url value: '%s'", c.TelemetryURL)
+		}
+	}
+	if c.HTTPAddress != "" {
+		if _, _, err := net.SplitHostPort(c.HTTPAddress); err != nil {
+			return fmt.Errorf("Invalid http_address value: '%s'", c.HTTPAddress)
+		}
+	}
+	if c.Socks5Proxy != "" {
+		if _, _, err := net.SplitHostPort(c.Socks5Proxy); err != nil {
+			return fmt.Errorf("Invalid socks5_proxy value: '%s'", c.Socks5Proxy)
+		}
+	}
+	if c.ProxyURL != "" {
+		proxy, err := url.Parse(c.ProxyURL)
+		if err != nil || (proxy.Scheme != "http" && proxy.Scheme != "https") || proxy.Host == "" {
+			return fmt.Errorf("Invalid proxy_url value: '%s'", c.ProxyURL)
+		}
+	}
+	if c.VaultAddr != "" {
+		addr, err := url.Parse(c.VaultAddr)
+		if err != nil || (addr.Scheme != "http" && addr.Scheme != "https") || addr.Host == "" {
+			return fmt.Errorf("Invalid vault_addr value: '%s'", c.VaultAddr)
+		}
+	}
+	if c.TrustedMACsFile != "" {
+		if _, err := loadTrustedMACs(c.TrustedMACsFile); err != nil {
+			return err
+		}
+	}
+	if err := validateAnnotations(c.RecordAnnotations); err != nil {
+		return err
+	}
+	if c.IncludeAnnotations && len(c.RecordAnnotations) == 0 {
+		return fmt.Errorf("include_annotations requires record_annotations")
+	}
+	for _, service := range c.NAPTRServices {
+		if err := service.validate(); err != nil {
+			return err
+		}
+	}
+	if c.LazyLoad && c.RequireInitialData {
+		return fmt.Errorf("lazy_load can't be used with require_initial_data")
+	}
+	if !model.IsValidMetricName(model.LabelValue(c.PrometheusNamespace)) {
+		return fmt.Errorf("Invalid prometheus_namespace value: '%s'", c.PrometheusNamespace)
+	}
+	return validatePrometheusLabels(c.PrometheusLabels)
+}
+
+// validatePrometheusLabels checks that labels are valid label names that don't clash with the labels of
+// the metrics
+func validatePrometheusLabels(labels map[string]string) error {
+	for name := range labels {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("'%s' is not a valid prometheus label", name)
+		}
+		if name == "routine" || name == "network" || name == "domain" || name == "hostname" || name == "ip" ||
+			name == "reason" || name == "result" || name == "qtype" || name == "site" {
+			return fmt.Errorf("The prometheus label '%s' is used by the plugin", name)
+		}
+	}
+	return nil
+}
+
+// domains returns the domains of all networks, vlans and sites and the default_domain
+func (c *config) domains() []string {
+	domains := make([]string, 0, len(c.Networks)+len(c.VLANNetworks)+len(c.SiteDomains))
+	for _, network := range c.Networks {
+		domains = append(domains, network.Domain)
+	}
+	for _, domain := range c.VLANNetworks {
+		domains = append(domains, domain)
+	}
+	for _, domain := range c.SiteDomains {
+		domains = append(domains, domain)
+	}
+	if c.DefaultDomain != "" {
+		domains = append(domains, c.DefaultDomain)
+	}
+	return domains
+}
+
+// networkPriority returns the rank of network in network_priority, lower wins, the unlisted networks
+// share the last rank
+func (c *config) networkPriority(network string) int {
+	if i := slices.Index(c.NetworkPriority, network); i >= 0 {
+		return i
+	}
+	return len(c.NetworkPriority)
+}
+
+// overlappingDomains returns the pairs of configured domains where the second one is a subdomain of the
+// first, networks that share a domain don't overlap
+func (c *config) overlappingDomains() [][2]string {
+	domains := c.domains()
+	slices.Sort(domains)
+	domains = slices.Compact(domains)
+	var overlaps [][2]string
+	for _, parent := range domains {
+		for _, child := range domains {
+			if parent != child && dns.IsSubDomain(parent, child) {
+				overlaps = append(overlaps, [2]string{parent, child})
+			}
+		}
+	}
+	return overlaps
+}
+
+// checkOverlap applies overlap_check, the names of a nested domain are answered from the longest domain
+// that matches, so an overlap is usually a typo or a leftover of a renamed network
+func (c *config) checkOverlap() error {
+	if c.OverlapCheck != "warn" && c.OverlapCheck != "error" {
+		return nil
+	}
+	for _, overlap := range c.overlappingDomains() {
+		if c.OverlapCheck == "error" {
+			return fmt.Errorf("The domain '%s' overlaps with '%s'", overlap[1], overlap[0])
+		}
+		log.Warningf("the domain %s overlaps with %s, its names are answered from the longer domain", overlap[1], overlap[0])
+	}
+	return nil
+}
+
+// maxHostnameLength returns hostname_max_length, configs built without newConfigFromDispenser get the
+// dns label limit
+func (c *config) maxHostnameLength() int {
+	if c.HostnameMaxLength <= 0 || c.HostnameMaxLength > 63 {
+		return 63
+	}
+	return c.HostnameMaxLength
+}
+
+// dnsPrefix returns dns_prefix with its separator, it is empty without dns_prefix
+func (c *config) dnsPrefix() string {
+	if c.DNSPrefix == "" {
+		return ""
+	}
+	return c.DNSPrefix + c.DNSPrefixSeparator
+}
+
+// defaultDNSOverridePattern finds the name in notes like "dns:webserver"
+const defaultDNSOverridePattern = `(?i)dns:([a-z0-9-]+)`
+
+// dnsOverrideName returns the name parse_dns_override finds in the note of a client, the first group of
+// dns_override_pattern or the whole match if it has no group
+func (c *config) dnsOverrideName(note string) string {
+	if c.dnsOverride == nil {
+		return ""
+	}
+	match := c.dnsOverride.FindStringSubmatch(note)
+	if len(match) == 0 {
+		return ""
+	}
+	if len(match) > 1 {
+		return match[1]
+	}
+	return match[0]
+}
+
+// hostnameFields returns the fields of the clients that are tried for the hostname, without
+// hostname_fields it is name with use_name_as_hostname and hostname otherwise
+func (c *config) hostnameFields() []string {
+	if len(c.HostnameFields) > 0 {
+		return c.HostnameFields
+	}
+	if c.UseNameAsHostname {
+		return []string{"name"}
+	}
+	return []string{"hostname"}
+}
+
+// ipv6PTRZone returns ipv6_ptr_zone, configs built without newConfigFromDispenser get ip6.arpa.
+func (c *config) ipv6PTRZone() string {
+	if c.IPv6PTRZone == "" {
+		return "ip6.arpa."
+	}
+	return dns.Fqdn(strings.ToLower(c.IPv6PTRZone))
+}
+
+// rateLimiter returns the limiter of rate_limit, the burst is a second worth of queries. It is nil
+// without a limit
+func (c *config) rateLimiter() *rate.Limiter {
+	if c.RateLimit <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(c.RateLimit), max(1, int(math.Ceil(c.RateLimit))))
+}
+
+// workerPool returns the semaphore of max_workers, it is nil without a limit
+func (c *config) workerPool() chan struct{} {
+	if c.MaxWorkers <= 0 {
+		return nil
+	}
+	return make(chan struct{}, c.MaxWorkers)
+}
+
+// leaseTTL returns the network ttl of client, or the seconds that are left of its dhcp lease at now when
+// it ends earlier. The clients with a fixed ip or without a lease end keep the network ttl, an ended
+// lease gets MinTTL as 0 would be the global ttl
+func (c *config) leaseTTL(networkTTL uint32, client *unifi.Client, now time.Time) uint32 {
+	if client.UseFixedIP.Val || client.DhcpendTime.Val == 0 {
+		return networkTTL
+	}
+	ttl := networkTTL
+	if ttl == 0 {
+		ttl = c.TTL
+	}
+	left := int64(client.DhcpendTime.Val) - now.Unix()
+	if left >= int64(ttl) {
+		return networkTTL
+	}
+	return max(uint32(max(left, 0)), c.MinTTL, 1)
+}
+
+// clampTTL returns the ttl that is left of configured after elapsed seconds, at most MaxTTL (if not 0)
+// but at least MinTTL
+func (c *config) clampTTL(configured, elapsed uint32) uint32 {
+	ttl := uint32(0)
+	if elapsed < configured {
+		ttl = configured - elapsed
+	}
+	if c.MaxTTL > 0 {
+		ttl = min(ttl, c.MaxTTL)
+	}
+	if ttl < c.MinTTL {
+		return c.MinTTL
+	}
+	return ttl
+}
+
+// splitSiteName returns the description and the name of a site named "description (name)" by the unifi
+// package, names without the parentheses are only a description
+func splitSiteName(siteName string) (string, string) {
+	if i := strings.LastIndex(siteName, " ("); i >= 0 && strings.HasSuffix(siteName, ")") {
+		return siteName[:i], siteName[i+2 : len(siteName)-1]
+	}
+	return siteName, ""
+}
+
+// clientSite returns the name of the site of client for the site metrics, e.g. default
+func clientSite(client *unifi.Client) string {
+	desc, name := splitSiteName(client.SiteName)
+	if name != "" {
+		return name
+	}
+	return desc
+}
+
+// siteDomain returns the domain of site_domains for the site of client, the unifi package names the
+// sites of the clients "description (name)"
+func (c *config) siteDomain(client *unifi.Client) (string, bool) {
+	if len(c.SiteDomains) == 0 {
+		return "", false
+	}
+	desc, name := splitSiteName(client.SiteName)
+	for _, site := range []string{name, client.SiteID, desc} {
+		if domain, ok := c.SiteDomains[strings.ToLower(site)]; ok && site != "" {
+			return domain, true
+		}
+	}
+	return "", false
+}
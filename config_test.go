@@ -1,7 +1,10 @@
 package unifinames
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"bytes"
 
@@ -14,23 +17,151 @@ func TestNewConfigFromDispenser(t *testing.T) {
 		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
 			{
 				Network LAN example1.com
-				Network VLAN1 example2.com
+				Network VLAN1 example2.com TTL=30 prefix=V1- suffix=-x record_types=a,aaaa vlan=11 weight=10
 				Network VLAN2 example3.com
+				vlan 10 Example4.com.
+				site_domains Site-A Site-A.home.arpa
+				default_domain Other.home.arpa
+				record_types VLAN2 aaaa
+				client_group_network 5f0a1b2c3d4e VLAN1
+				exclude_networks Guest IoT
+				network_priority Wired WiFi
+				network_alias "Old LAN" LAN
+				include_devices lan
+				apex_records Example1.com. 192.168.1.1
 				Unifi https://localhost:8443/ default admin test deadbeef
 				TTL 60
+				min_ttl 10
+				max_ttl 30
+				request_timeout 5s
+				max_refresh_duration 20s
+				http_timeout 10s
+				refresh_jitter 30s
+				max_stale_refreshes 3
+				max_stale_age 3h
+				max_records 1000
+				answer_limit 4
+				hostname_max_length 32
+				proxy_url http://proxy.example.com:3128
+				no_proxy localhost .example.com
+				use_env_proxy
+				controller_version V2
+				auth_mode Basic
+				tls_min_version 1.1
 				Debug
+				authoritative
+				require_initial_data
+				ns_records ns1.example1.com. NS2.example1.com
+				hostname_collision_policy Last
+				name_dedup_strategy Append_MAC
+				preserve_dots
+				hostname_suffix_strip .Local .mdns
+				additional_reserved_names Proxy ntp
+				resolve_timeout 10ms
+				connect_retry 5
+				connect_retry_delay 1s
+				batch_update_threshold 4
+				max_defer_duration 2m
+				circuit_breaker failure_threshold=3 open_duration=1m
+				on_startup_command "touch /run/ready"
+				on_refresh_command "echo refreshed"
+				telemetry_url https://telemetry.example.com/report
+				telemetry_token secret
+				max_site_failure_ratio 0.25
+				cache_file /tmp/unifi-names.json
+				max_cache_age 1h
+				online_within 24h
+				debug_file /tmp/unifi-names.log
+				debug_file_max_size_mb 10
+				dry_run
+				wildcard_clients
+				serve_hinfo
+				include_switch_ports
+				http_address localhost:8053
+				prometheus_labels datacenter=us-east-1 env=prod
+				prometheus_namespace coredns_home
+				synthesize_srv priority=10 weight=5 port=8080
 			}
 		`)))
 		config, err := newConfigFromDispenser(dispenser)
 		require.NoError(t, err)
 		require.NotNil(t, config)
-		require.Equal(t, map[string]string{
-			"lan":   "example1.com.",
-			"vlan1": "example2.com.",
-			"vlan2": "example3.com.",
+		require.Equal(t, map[string]*NetworkConfig{
+			"lan":   {Domain: "example1.com."},
+			"vlan1": {Domain: "example2.com.", TTL: 30, Prefix: "v1-", Suffix: "-x", RecordTypes: []string{"A", "AAAA"}, VLANID: 11, Weight: 10},
+			"vlan2": {Domain: "example3.com.", RecordTypes: []string{"AAAA"}},
 		}, config.Networks)
+		require.Equal(t, map[int]string{
+			10: "example4.com.",
+		}, config.VLANNetworks)
+		require.Equal(t, map[string]string{"site-a": "site-a.home.arpa."}, config.SiteDomains)
+		require.Equal(t, "other.home.arpa.", config.DefaultDomain)
+		require.Equal(t, map[string]string{
+			"5f0a1b2c3d4e": "vlan1",
+		}, config.ClientGroupNetworks)
+		require.Equal(t, []string{"guest", "iot"}, config.ExcludeNetworks)
+		require.Equal(t, []string{"wired", "wifi"}, config.NetworkPriority)
+		require.Equal(t, map[string]string{"old lan": "lan"}, config.NetworkAliases)
+		require.Equal(t, "lan", config.IncludeDevices)
+		require.Equal(t, map[string]string{
+			"example1.com.": "192.168.1.1",
+		}, config.ApexRecords)
 		require.Equal(t, uint32(60), config.TTL)
+		require.Equal(t, uint32(10), config.MinTTL)
+		require.Equal(t, uint32(30), config.MaxTTL)
+		require.Equal(t, 5*time.Second, config.RequestTimeout)
+		require.Equal(t, 20*time.Second, config.MaxRefreshDuration)
+		require.Equal(t, 10*time.Second, config.HTTPTimeout)
+		require.Equal(t, 30*time.Second, config.RefreshJitter)
+		require.Equal(t, 3, config.MaxStaleRefreshes)
+		require.Equal(t, 3*time.Hour, config.MaxStaleAge)
+		require.Equal(t, 1000, config.MaxRecords)
+		require.Equal(t, 4, config.AnswerLimit)
+		require.Equal(t, 32, config.HostnameMaxLength)
+		require.Equal(t, "http://proxy.example.com:3128", config.ProxyURL)
+		require.Equal(t, "localhost,.example.com", config.NoProxy)
+		require.Equal(t, true, config.UseEnvProxy)
+		require.Equal(t, "v2", config.ControllerVersion)
+		require.Equal(t, "basic", config.AuthMode)
+		require.Equal(t, "1.1", config.TLSMinVersion)
 		require.Equal(t, true, config.Debug)
+		require.Equal(t, true, config.DryRun)
+		require.Equal(t, true, config.WildcardClients)
+		require.Equal(t, true, config.ServeHINFO)
+		require.Equal(t, true, config.IncludeSwitchPorts)
+		require.Equal(t, true, config.SynthesizeSRV)
+		require.Equal(t, "localhost:8053", config.HTTPAddress)
+		require.Equal(t, map[string]string{"datacenter": "us-east-1", "env": "prod"}, config.PrometheusLabels)
+		require.Equal(t, "coredns_home", config.PrometheusNamespace)
+		require.Equal(t, uint16(10), config.SRVPriority)
+		require.Equal(t, uint16(5), config.SRVWeight)
+		require.Equal(t, uint16(8080), config.SRVPort)
+		require.Equal(t, true, config.Authoritative)
+		require.Equal(t, true, config.RequireInitialData)
+		require.Equal(t, []string{"ns1.example1.com.", "ns2.example1.com."}, config.NSRecords)
+		require.Equal(t, "last", config.HostnameCollisionPolicy)
+		require.Equal(t, "append_mac", config.NameDedupStrategy)
+		require.Equal(t, true, config.PreserveDots)
+		require.Equal(t, []string{".local", ".mdns"}, config.HostnameSuffixStrip)
+		require.Equal(t, []string{"proxy", "ntp"}, config.AdditionalReservedNames)
+		require.Equal(t, 10*time.Millisecond, config.ResolveTimeout)
+		require.Equal(t, 5, config.ConnectRetry)
+		require.Equal(t, time.Second, config.ConnectRetryDelay)
+		require.Equal(t, 4, config.BatchUpdateThreshold)
+		require.Equal(t, 2*time.Minute, config.MaxDeferDuration)
+		require.Equal(t, true, config.CircuitBreaker)
+		require.Equal(t, 3, config.CircuitFailureThreshold)
+		require.Equal(t, time.Minute, config.CircuitOpenDuration)
+		require.Equal(t, "touch /run/ready", config.OnStartupCommand)
+		require.Equal(t, "echo refreshed", config.OnRefreshCommand)
+		require.Equal(t, "https://telemetry.example.com/report", config.TelemetryURL)
+		require.Equal(t, "secret", config.TelemetryToken)
+		require.Equal(t, 0.25, config.MaxSiteFailureRatio)
+		require.Equal(t, "/tmp/unifi-names.json", config.CacheFile)
+		require.Equal(t, time.Hour, config.MaxCacheAge)
+		require.Equal(t, 24*time.Hour, config.OnlineWithin)
+		require.Equal(t, "/tmp/unifi-names.log", config.DebugFile)
+		require.Equal(t, 10, config.DebugFileMaxSizeMB)
 		require.Equal(t, "https://localhost:8443", config.UnifiControllerURL)
 		require.Equal(t, "default", config.UnifiSite)
 		require.Equal(t, "admin", config.UnifiUsername)
@@ -62,11 +193,34 @@ func TestNewConfigFromDispenser(t *testing.T) {
 		config, err := newConfigFromDispenser(dispenser)
 		require.NoError(t, err)
 		require.NotNil(t, config)
-		require.Equal(t, map[string]string{
-			"lan": "example1.com.",
+		require.Equal(t, map[string]*NetworkConfig{
+			"lan": {Domain: "example1.com."},
 		}, config.Networks)
 		require.Equal(t, uint32(60*60), config.TTL)
+		require.Equal(t, uint32(5), config.MinTTL)
+		require.Equal(t, 30*time.Second, config.RequestTimeout)
+		require.Equal(t, 60*time.Second, config.MaxRefreshDuration)
+		require.Equal(t, 30*time.Second, config.HTTPTimeout)
+		require.Equal(t, time.Duration(0), config.RefreshJitter)
+		require.Equal(t, 0, config.MaxStaleRefreshes)
+		require.Equal(t, 0, config.MaxRecords)
+		require.Equal(t, 0, config.AnswerLimit)
+		require.Equal(t, 63, config.HostnameMaxLength)
 		require.Equal(t, false, config.Debug)
+		require.Equal(t, false, config.DryRun)
+		require.Equal(t, false, config.WildcardClients)
+		require.Equal(t, false, config.ServeHINFO)
+		require.Equal(t, false, config.IncludeSwitchPorts)
+		require.Equal(t, false, config.SynthesizeSRV)
+		require.Equal(t, uint16(0), config.SRVPort)
+		require.Equal(t, false, config.Authoritative)
+		require.Equal(t, "first", config.HostnameCollisionPolicy)
+		require.Equal(t, "auto", config.ControllerVersion)
+		require.Equal(t, "session", config.AuthMode)
+		require.Equal(t, []string{".local", ".home", ".lan"}, config.HostnameSuffixStrip)
+		require.Equal(t, "1.2", config.TLSMinVersion)
+		require.Equal(t, "", config.CacheFile)
+		require.Equal(t, 24*time.Hour, config.MaxCacheAge)
 		require.Equal(t, "https://localhost:8443", config.UnifiControllerURL)
 		require.Equal(t, "default", config.UnifiSite)
 		require.Equal(t, "admin", config.UnifiUsername)
@@ -106,4 +260,458 @@ func TestNewConfigFromDispenser(t *testing.T) {
 		require.Error(t, err)
 		require.Nil(t, config)
 	})
+	t.Run("Invalid Max TTL", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test deadbeef
+				min_ttl 10
+				max_ttl 5
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+	t.Run("Invalid NXDomain Redirect", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test deadbeef
+				nxdomain_redirect_ip 192.168.1.250
+				nxdomain_redirect_domains Example.com.
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, []string{"example.com."}, config.NXDomainRedirectDomains)
+		for _, option := range []string{"nxdomain_redirect_ip 192.168.1", "nxdomain_redirect_domains other.com"} {
+			dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+				{
+					Network LAN example.com
+					Unifi https://localhost:8443/ default admin test deadbeef
+					nxdomain_redirect_ip 192.168.1.250
+					`+option+`
+				}
+			`)))
+			config, err := newConfigFromDispenser(dispenser)
+			require.Error(t, err, option)
+			require.Nil(t, config, option)
+		}
+	})
+	t.Run("Invalid Request Timeout", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test deadbeef
+				request_timeout soon
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+	t.Run("Invalid HTTP Timeout", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test deadbeef
+				http_timeout 0s
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+	t.Run("Invalid Record Type", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test deadbeef
+				record_types LAN A MX
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+	t.Run("Unknown Client Group Network", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test deadbeef
+				client_group_network 5f0a1b2c3d4e VLAN1
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+	t.Run("Unknown Network Alias Target", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test deadbeef
+				network_alias LAN2 VLAN1
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+	t.Run("Invalid TLS Min Version", func(t *testing.T) {
+		for _, version := range []string{"1", "1.4", "tls1.2"} {
+			dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+				{
+					Network LAN example1.com
+					Unifi https://localhost:8443/ default admin test
+					tls_min_version `+version+`
+				}
+			`)))
+			_, err := newConfigFromDispenser(dispenser)
+			require.Error(t, err, version)
+		}
+	})
+	t.Run("Invalid VLAN", func(t *testing.T) {
+		for _, vlan := range []string{"abc", "0", "4095"} {
+			dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test deadbeef
+				vlan `+vlan+` example2.com
+			}
+		`)))
+			config, err := newConfigFromDispenser(dispenser)
+			require.Error(t, err, vlan)
+			require.Nil(t, config, vlan)
+		}
+	})
+	t.Run("Invalid Proxy URL", func(t *testing.T) {
+		for _, proxy := range []string{"proxy.example.com:3128", "ftp://proxy.example.com", "http://"} {
+			dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test deadbeef
+				proxy_url `+proxy+`
+			}
+		`)))
+			config, err := newConfigFromDispenser(dispenser)
+			require.Error(t, err, proxy)
+			require.Nil(t, config, proxy)
+		}
+	})
+	t.Run("Invalid Hostname Max Length", func(t *testing.T) {
+		for _, length := range []string{"0", "64", "abc"} {
+			dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test deadbeef
+				hostname_max_length `+length+`
+			}
+		`)))
+			config, err := newConfigFromDispenser(dispenser)
+			require.Error(t, err, length)
+			require.Nil(t, config, length)
+		}
+	})
+	t.Run("Invalid Name Dedup Strategy", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test deadbeef
+				name_dedup_strategy rename
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+	t.Run("Invalid Telemetry URL", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test deadbeef
+				telemetry_url telemetry.example.com
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+	t.Run("Invalid Circuit Breaker", func(t *testing.T) {
+		for _, option := range []string{"failure_threshold=0", "open_duration=soon", "threshold=5"} {
+			dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test deadbeef
+				circuit_breaker `+option+`
+			}
+		`)))
+			config, err := newConfigFromDispenser(dispenser)
+			require.Error(t, err, option)
+			require.Nil(t, config, option)
+		}
+	})
+	t.Run("Invalid Auth Mode", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test deadbeef
+				auth_mode digest
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+	t.Run("Invalid Prometheus Namespace", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test deadbeef
+				prometheus_namespace coredns-home
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+	t.Run("Invalid SOCKS5 Proxy", func(t *testing.T) {
+		for _, directives := range []string{"socks5_proxy jumphost", "socks5_proxy jumphost:1080\nproxy_url http://proxy.example.com:3128"} {
+			dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test deadbeef
+				`+directives+`
+			}
+		`)))
+			config, err := newConfigFromDispenser(dispenser)
+			require.Error(t, err, directives)
+			require.Nil(t, config, directives)
+		}
+	})
+	t.Run("Invalid Network Options", func(t *testing.T) {
+		for _, options := range []string{"ttl", "ttl=abc", "color=red", "prefix=a.b", "suffix=_x", "record_types=MX", "vlan=0", "vlan=4095", "authoritative=maybe"} {
+			dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com `+options+`
+				Unifi https://localhost:8443/ default admin test deadbeef
+			}
+		`)))
+			config, err := newConfigFromDispenser(dispenser)
+			require.Error(t, err, options)
+			require.Nil(t, config, options)
+		}
+	})
+	t.Run("Duplicate Network VLAN", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com vlan=10
+				Network IOT iot.example.com vlan=10
+				Unifi https://localhost:8443/ default admin test deadbeef
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+	t.Run("Unknown Record Types Network", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				record_types IOT A
+				Unifi https://localhost:8443/ default admin test deadbeef
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.Error(t, err)
+		require.Nil(t, config)
+	})
+	t.Run("Invalid Apex Record", func(t *testing.T) {
+		for _, apex := range []string{"example.com not-an-ip", "example2.com 192.168.1.1"} {
+			dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test deadbeef
+				apex_records `+apex+`
+			}
+		`)))
+			config, err := newConfigFromDispenser(dispenser)
+			require.Error(t, err, apex)
+			require.Nil(t, config, apex)
+		}
+	})
+}
+
+func TestClampTTL(t *testing.T) {
+	c := &config{MinTTL: 5}
+	require.Equal(t, uint32(50), c.clampTTL(60, 10))
+	require.Equal(t, uint32(5), c.clampTTL(60, 58))
+	require.Equal(t, uint32(5), c.clampTTL(60, 60))
+	// a delayed refresh must not underflow
+	require.Equal(t, uint32(5), c.clampTTL(60, 61))
+	require.Equal(t, uint32(0), (&config{}).clampTTL(60, 61))
+	// max_ttl caps the ttl, min_ttl still applies below it
+	c.MaxTTL = 30
+	require.Equal(t, uint32(30), c.clampTTL(60, 10))
+	require.Equal(t, uint32(20), c.clampTTL(60, 40))
+	require.Equal(t, uint32(5), c.clampTTL(60, 58))
+}
+
+func TestAnswerTTLFloor(t *testing.T) {
+	dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+		{
+			Network LAN example.com
+			Unifi https://localhost:8443/ default admin test
+			answer_ttl_floor 15
+		}
+	`)))
+	config, err := newConfigFromDispenser(dispenser)
+	require.NoError(t, err)
+	require.Equal(t, uint32(15), config.MinTTL)
+}
+
+func TestHostnameFieldsConfig(t *testing.T) {
+	dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+		{
+			Network LAN example.com
+			Unifi https://localhost:8443/ default admin test
+			hostname_fields Name hostname
+		}
+	`)))
+	config, err := newConfigFromDispenser(dispenser)
+	require.NoError(t, err)
+	require.Equal(t, []string{"name", "hostname"}, config.hostnameFields())
+
+	dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+		{
+			Network LAN example.com
+			Unifi https://localhost:8443/ default admin test
+			hostname_fields name ssid
+		}
+	`)))
+	_, err = newConfigFromDispenser(dispenser)
+	require.Error(t, err)
+}
+
+func TestMixedCaseDomains(t *testing.T) {
+	dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+		{
+			Network LAN Home.ARPA
+			vlan 10 IoT.Home.ARPA.
+			site_domains Site-A Site-A.Home.ARPA
+			default_domain Other.Home.ARPA
+			vpn_domain VPN.Home.ARPA
+			ns_records NS1.Home.ARPA
+			Unifi https://localhost:8443/ default admin test
+		}
+	`)))
+	config, err := newConfigFromDispenser(dispenser)
+	require.NoError(t, err)
+	require.Equal(t, "home.arpa.", config.Networks["lan"].Domain)
+	require.Equal(t, "iot.home.arpa.", config.VLANNetworks[10])
+	require.Equal(t, "site-a.home.arpa.", config.SiteDomains["site-a"])
+	require.Equal(t, "other.home.arpa.", config.DefaultDomain)
+	require.Equal(t, "vpn.home.arpa.", config.Networks["vpn"].Domain)
+	require.Equal(t, []string{"ns1.home.arpa."}, config.NSRecords)
+
+	p := unifinames{Config: config}
+	require.True(t, p.shouldHandle("printer.home.arpa."))
+	require.True(t, p.shouldHandle("Printer.HOME.arpa."))
+	require.True(t, p.isApex("HOME.ARPA."))
+}
+
+func TestNXDomainActionConfig(t *testing.T) {
+	dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+		{
+			Network LAN example.com nxdomain_action=NOERROR_EMPTY
+			Unifi https://localhost:8443/ default admin test
+			nxdomain_action nxdomain
+		}
+	`)))
+	config, err := newConfigFromDispenser(dispenser)
+	require.NoError(t, err)
+	require.Equal(t, "nxdomain", config.NXDomainAction)
+	require.Equal(t, "noerror_empty", config.Networks["lan"].NXDomainAction)
+
+	for _, directive := range []string{"nxdomain_action refused", "Network IOT iot.com nxdomain_action=refused"} {
+		dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+				`+directive+`
+			}
+		`)))
+		_, err = newConfigFromDispenser(dispenser)
+		require.Error(t, err, directive)
+	}
+}
+
+func TestOverlapCheck(t *testing.T) {
+	parse := func(check string) (*config, error) {
+		return newConfigFromDispenser(caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN home.arpa
+				Network IOT devices.home.arpa
+				Network VLAN1 devices.home.arpa
+				Unifi https://localhost:8443/ default admin test
+				`+check+`
+			}
+		`))))
+	}
+
+	config, err := parse("")
+	require.NoError(t, err)
+	require.Equal(t, "off", config.OverlapCheck)
+	require.NoError(t, config.checkOverlap())
+	// networks sharing a domain don't overlap
+	require.Equal(t, [][2]string{{"home.arpa.", "devices.home.arpa."}}, config.overlappingDomains())
+
+	config, err = parse("overlap_check")
+	require.NoError(t, err)
+	require.Equal(t, "warn", config.OverlapCheck)
+	require.NoError(t, config.checkOverlap())
+
+	config, err = parse("overlap_check Error")
+	require.NoError(t, err)
+	require.Error(t, config.checkOverlap())
+	config.Networks["lan"].Domain = "lan."
+	require.NoError(t, config.checkOverlap())
+
+	_, err = parse("overlap_check fail")
+	require.Error(t, err)
+}
+
+func TestNetworksFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "networks.csv")
+	require.NoError(t, os.WriteFile(path, []byte(`# network,domain,ttl
+LAN,files.home.arpa
+IOT, IoT.home.arpa. ,300
+VLAN1,vlan1.home.arpa,
+broken
+Guest,guest.home.arpa,forever
+,nameless.home.arpa
+`), 0o644))
+	parse := func(networksFile string) (*config, error) {
+		return newConfigFromDispenser(caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN home.arpa
+				Unifi https://localhost:8443/ default admin test
+				networks_file `+networksFile+`
+			}
+		`))))
+	}
+
+	config, err := parse(path)
+	require.NoError(t, err)
+	require.Equal(t, path, config.NetworksFile)
+	// the invalid lines are skipped
+	require.Len(t, config.Networks, 3)
+	// the network directives win
+	require.Equal(t, "home.arpa.", config.Networks["lan"].Domain)
+	require.Equal(t, &NetworkConfig{Domain: "iot.home.arpa.", TTL: 300}, config.Networks["iot"])
+	require.Equal(t, &NetworkConfig{Domain: "vlan1.home.arpa."}, config.Networks["vlan1"])
+
+	_, err = parse(filepath.Join(t.TempDir(), "missing.csv"))
+	require.Error(t, err)
 }
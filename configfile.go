@@ -0,0 +1,224 @@
+package unifinames
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/fsnotify/fsnotify"
+	"github.com/juju/errors"
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+// configFilePath returns the path of the config_file directive, c is a copy so the caller's dispenser
+// doesn't move
+func configFilePath(c caddyfile.Dispenser) string {
+	for c.NextBlock() {
+		if strings.EqualFold(c.Val(), "config_file") && c.NextArg() {
+			return c.Val()
+		}
+	}
+	return ""
+}
+
+// loadConfigFile reads the yaml file at path into config, the values are normalized the same way as
+// the Corefile directives and validated with them. It is loaded before the directives so they override it
+func loadConfigFile(path string, config *config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Annotate(err, "coredns-unifi-names: unable to read config file")
+	}
+
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return errors.Annotate(err, "coredns-unifi-names: unable to parse config file")
+	}
+
+	// the maps are rebuilt with the normalized entries
+	networks, vlanNetworks, clientGroupNetworks, apexRecords := config.Networks, config.VLANNetworks, config.ClientGroupNetworks, config.ApexRecords
+	networkAliases, siteDomains := config.NetworkAliases, config.SiteDomains
+	config.Networks = map[string]*NetworkConfig{}
+	config.VLANNetworks = map[int]string{}
+	config.SiteDomains = map[string]string{}
+	config.NetworkAliases = map[string]string{}
+	config.ClientGroupNetworks = map[string]string{}
+	config.ApexRecords = map[string]string{}
+	for network, networkConfig := range networks {
+		if networkConfig == nil {
+			return fmt.Errorf("No domain set for network '%s'", network)
+		}
+		if err := networkConfig.normalize(); err != nil {
+			return err
+		}
+		config.Networks[strings.ToLower(network)] = networkConfig
+	}
+	for vlan, domain := range vlanNetworks {
+		config.VLANNetworks[vlan] = dns.Fqdn(strings.ToLower(strings.Trim(domain, ".")))
+	}
+	for site, domain := range siteDomains {
+		config.SiteDomains[strings.ToLower(site)] = dns.Fqdn(strings.ToLower(strings.Trim(domain, ".")))
+	}
+	for alias, network := range networkAliases {
+		config.NetworkAliases[strings.ToLower(alias)] = strings.ToLower(network)
+	}
+	for group, network := range clientGroupNetworks {
+		config.ClientGroupNetworks[group] = strings.ToLower(network)
+	}
+	for domain, ip := range apexRecords {
+		config.ApexRecords[dns.Fqdn(strings.ToLower(strings.Trim(domain, ".")))] = ip
+	}
+	mailRecords := config.MailRecords
+	config.MailRecords = map[string]MailRecords{}
+	for domain, records := range mailRecords {
+		dkim := records.DKIM
+		records.DKIM = map[string]string{}
+		for selector, key := range dkim {
+			records.DKIM[strings.ToLower(selector)] = key
+		}
+		config.MailRecords[dns.Fqdn(strings.ToLower(strings.Trim(domain, ".")))] = records
+	}
+
+	for _, domain := range []*string{&config.VPNDomain, &config.DefaultDomain} {
+		if *domain == "" {
+			continue
+		}
+		*domain = dns.Fqdn(strings.ToLower(strings.Trim(*domain, ".")))
+	}
+	config.IncludeDevices = strings.ToLower(config.IncludeDevices)
+	for i, network := range config.ExcludeNetworks {
+		config.ExcludeNetworks[i] = strings.ToLower(network)
+	}
+	for i, name := range config.AdditionalReservedNames {
+		config.AdditionalReservedNames[i] = strings.ToLower(name)
+	}
+	for i, network := range config.NetworkPriority {
+		config.NetworkPriority[i] = strings.ToLower(network)
+	}
+	for i, site := range config.IncludeSites {
+		config.IncludeSites[i] = strings.ToLower(site)
+	}
+	for i, site := range config.ExcludeSites {
+		config.ExcludeSites[i] = strings.ToLower(site)
+	}
+
+	nsRecords := config.NSRecords
+	config.NSRecords = nil
+	for _, ns := range nsRecords {
+		config.NSRecords = append(config.NSRecords, dns.Fqdn(strings.ToLower(strings.Trim(ns, "."))))
+	}
+
+	for i, domain := range config.NXDomainRedirectDomains {
+		config.NXDomainRedirectDomains[i] = dns.Fqdn(strings.ToLower(strings.Trim(domain, ".")))
+	}
+
+	for i, field := range config.HostnameFields {
+		config.HostnameFields[i] = strings.ToLower(field)
+	}
+	for i, suffix := range config.HostnameSuffixStrip {
+		config.HostnameSuffixStrip[i] = strings.ToLower(suffix)
+	}
+	if config.IPv6PTRZone != "" {
+		config.IPv6PTRZone = dns.Fqdn(strings.ToLower(strings.Trim(config.IPv6PTRZone, ".")))
+	}
+	config.NXDomainAction = strings.ToLower(config.NXDomainAction)
+	config.OverlapCheck = strings.ToLower(config.OverlapCheck)
+	config.HostnameCollisionPolicy = strings.ToLower(config.HostnameCollisionPolicy)
+	config.NameDedupStrategy = strings.ToLower(config.NameDedupStrategy)
+	config.ControllerVersion = strings.ToLower(config.ControllerVersion)
+	config.AuthMode = strings.ToLower(config.AuthMode)
+	config.LogFormat = strings.ToLower(config.LogFormat)
+	config.NameNormalization = strings.ToLower(config.NameNormalization)
+	config.ClientType = strings.ToLower(config.ClientType)
+	config.IPFilterMode = strings.ToLower(config.IPFilterMode)
+	config.DNSPrefix = strings.ToLower(config.DNSPrefix)
+	for i := range config.NAPTRServices {
+		config.NAPTRServices[i].Pattern = strings.ToLower(config.NAPTRServices[i].Pattern)
+	}
+	config.RateLimitAction = strings.ToLower(config.RateLimitAction)
+	config.SecretsBackend = strings.ToLower(config.SecretsBackend)
+	config.VaultAddr = strings.TrimRight(config.VaultAddr, "/")
+	config.UnifiControllerURL = strings.TrimRight(config.UnifiControllerURL, "/")
+	return nil
+}
+
+// watchConfigFile calls onChange once the file at path is written, replaced or removed, the directory
+// is watched so files that are replaced by renaming (e.g. by editors or kubernetes) are noticed
+func watchConfigFile(path string, onChange func()) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Annotate(err, "coredns-unifi-names: unable to watch config file")
+	}
+	path = filepath.Clean(path)
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, errors.Annotate(err, "coredns-unifi-names: unable to watch config file")
+	}
+
+	go func() {
+		UnifinamesGoroutines.WithLabelValues("watch").Inc()
+		defer UnifinamesGoroutines.WithLabelValues("watch").Dec()
+		var once sync.Once
+		// keep draining the events until the watcher is closed, an editor writes a file several times
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != path || event.Op == fsnotify.Chmod {
+					continue
+				}
+				once.Do(func() {
+					log.Infof("config file %s changed", path)
+					go onChange()
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("unable to watch config file: %v", err)
+			}
+		}
+	}()
+	return watcher, nil
+}
+
+var (
+	instanceMu      sync.Mutex
+	currentInstance *caddy.Instance
+	registerOnce    sync.Once
+)
+
+// registerInstanceHook keeps track of the running instance so it can be restarted once the config
+// file changes
+func registerInstanceHook() {
+	registerOnce.Do(func() {
+		caddy.RegisterEventHook("unifi-names", func(event caddy.EventName, info interface{}) error {
+			if event != caddy.InstanceStartupEvent {
+				return nil
+			}
+			instanceMu.Lock()
+			currentInstance, _ = info.(*caddy.Instance)
+			instanceMu.Unlock()
+			return nil
+		})
+	})
+}
+
+// restartInstance reloads the Corefile of the running instance, the config file is read again by setup
+func restartInstance() {
+	instanceMu.Lock()
+	instance := currentInstance
+	instanceMu.Unlock()
+	if instance == nil {
+		log.Warning("config file changed before the server was started, ignoring it")
+		return
+	}
+	if _, err := instance.Restart(instance.Caddyfile()); err != nil {
+		log.Errorf("config file changed but reload failed: %v", err)
+	}
+}
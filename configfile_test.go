@@ -0,0 +1,142 @@
+package unifinames
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigFile(t *testing.T) {
+	t.Run("Corefile Overrides", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "unifi-names.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(`
+networks:
+  LAN: example1.com
+  VLAN1: Example2.com.
+  IOT:
+    domain: iot.example1.com
+    ttl: 30
+    prefix: IOT-
+    record_types: [aaaa]
+    vlan: 20
+vlans:
+  10: example4.com
+apex_records:
+  example1.com: 192.168.1.1
+ttl: 120
+request_timeout: 10s
+ns_records: [ns1.example1.com]
+hostname_collision_policy: All
+unifi_url: https://localhost:8443/
+unifi_site: default
+unifi_username: admin
+unifi_password: test
+`), 0o600))
+
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network VLAN1 example3.com
+				TTL 60
+				config_file `+path+`
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, path, config.ConfigFile)
+		require.Equal(t, map[string]*NetworkConfig{
+			"lan":   {Domain: "example1.com."},
+			"vlan1": {Domain: "example3.com."},
+			"iot":   {Domain: "iot.example1.com.", TTL: 30, Prefix: "iot-", RecordTypes: []string{"AAAA"}, VLANID: 20},
+		}, config.Networks)
+		require.Equal(t, map[int]string{10: "example4.com."}, config.VLANNetworks)
+		require.Equal(t, map[string]string{"example1.com.": "192.168.1.1"}, config.ApexRecords)
+		require.Equal(t, uint32(60), config.TTL)
+		require.Equal(t, uint32(5), config.MinTTL)
+		require.Equal(t, 10*time.Second, config.RequestTimeout)
+		require.Equal(t, []string{"ns1.example1.com."}, config.NSRecords)
+		require.Equal(t, "all", config.HostnameCollisionPolicy)
+		require.Equal(t, "https://localhost:8443", config.UnifiControllerURL)
+		require.Equal(t, "default", config.UnifiSite)
+	})
+
+	t.Run("Invalid File", func(t *testing.T) {
+		dir := t.TempDir()
+		for name, content := range map[string]string{
+			"missing.yaml": "",
+			"syntax.yaml":  "networks: [",
+			"domain.yaml":  "networks:\n  lan: not_a_domain!",
+			"policy.yaml":  "hostname_collision_policy: random",
+			"client.yaml":  "client_type: bogus",
+			"names.yaml":   "name_normalization: nope",
+			"log.yaml":     "log_format: xml",
+			"action.yaml":  "rate_limit_action: explode",
+			"timeout.yaml": "request_timeout: -5s",
+			"vlan.yaml":    "vlans:\n  5000: example.com",
+			"proxy.yaml":   "proxy_url: ftp://proxy",
+			"length.yaml":  "hostname_max_length: 0",
+		} {
+			path := filepath.Join(dir, name)
+			if content != "" {
+				require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+			}
+			dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				config_file `+path+`
+				Network LAN example.com
+				Unifi https://localhost:8443/ default admin test
+			}
+		`)))
+			config, err := newConfigFromDispenser(dispenser)
+			require.Error(t, err, name)
+			require.Nil(t, config, name)
+		}
+	})
+
+	t.Run("Watch", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "unifi-names.yaml")
+		require.NoError(t, os.WriteFile(path, []byte("ttl: 60"), 0o600))
+
+		changed := make(chan struct{}, 2)
+		watcher, err := watchConfigFile(path, func() { changed <- struct{}{} })
+		require.NoError(t, err)
+		defer watcher.Close()
+		require.Eventually(t, func() bool {
+			return testutil.ToFloat64(UnifinamesGoroutines.WithLabelValues("watch")) == 1
+		}, time.Second, 10*time.Millisecond)
+
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "other.yaml"), []byte("ttl: 60"), 0o600))
+		select {
+		case <-changed:
+			t.Fatal("other files must not trigger a reload")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		// editors replace the file by renaming a new one
+		tmp := filepath.Join(dir, "unifi-names.yaml.tmp")
+		require.NoError(t, os.WriteFile(tmp, []byte("ttl: 120"), 0o600))
+		require.NoError(t, os.Rename(tmp, path))
+		require.NoError(t, os.WriteFile(path, []byte("ttl: 180"), 0o600))
+		select {
+		case <-changed:
+		case <-time.After(time.Second):
+			t.Fatal("expected a reload")
+		}
+		select {
+		case <-changed:
+			t.Fatal("expected only one reload")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		require.NoError(t, watcher.Close())
+		require.Eventually(t, func() bool {
+			return testutil.ToFloat64(UnifinamesGoroutines.WithLabelValues("watch")) == 0
+		}, time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,54 @@
+package unifinames
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// setConfigMapOption sets a named argument of the k8s_configmap_export directive, e.g. namespace=dns
+func (c *config) setConfigMapOption(arg string) error {
+	key, value, ok := strings.Cut(arg, "=")
+	if !ok || value == "" {
+		return fmt.Errorf("Invalid k8s_configmap_export option: '%s'", arg)
+	}
+	switch strings.ToLower(key) {
+	case "namespace":
+		c.ConfigMapNamespace = value
+	case "name":
+		c.ConfigMapName = value
+	case "kubeconfig_path":
+		c.ConfigMapKubeconfig = value
+	default:
+		return fmt.Errorf("Unknown k8s_configmap_export option: '%s'", key)
+	}
+	return nil
+}
+
+// configMapData returns the hostnames and their ips as the data of the exported ConfigMap, the ips of
+// dual stack clients are separated by commas. The wildcard records are left out as their names aren't
+// valid keys
+func (p *unifinames) configMapData() map[string]string {
+	ips := map[string][]string{}
+	p.mu.Lock()
+	for _, client := range p.aClients {
+		if !strings.HasPrefix(client.Hdr.Name, "*.") {
+			name := strings.TrimSuffix(client.Hdr.Name, ".")
+			ips[name] = append(ips[name], client.A.String())
+		}
+	}
+	for _, client := range p.aaaaClients {
+		if !strings.HasPrefix(client.Hdr.Name, "*.") {
+			name := strings.TrimSuffix(client.Hdr.Name, ".")
+			ips[name] = append(ips[name], client.AAAA.String())
+		}
+	}
+	p.mu.Unlock()
+
+	data := make(map[string]string, len(ips))
+	for name, addresses := range ips {
+		sort.Strings(addresses)
+		data[name] = strings.Join(addresses, ",")
+	}
+	return data
+}
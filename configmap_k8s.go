@@ -0,0 +1,51 @@
+//go:build k8s
+
+package unifinames
+
+import (
+	"github.com/juju/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// configMapExportSupported is whether the plugin was built with the k8s tag
+const configMapExportSupported = true
+
+// exportConfigMap creates or updates the ConfigMap of k8s_configmap_export with the records, it uses the
+// in cluster config when no kubeconfig_path is set
+func (p *unifinames) exportConfigMap() error {
+	var restConfig *rest.Config
+	var err error
+	if p.Config.ConfigMapKubeconfig != "" {
+		restConfig, err = clientcmd.BuildConfigFromFlags("", p.Config.ConfigMapKubeconfig)
+	} else {
+		restConfig, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return errors.Annotate(err, "coredns-unifi-names: unable to load kubernetes config")
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return errors.Annotate(err, "coredns-unifi-names: unable to create kubernetes client")
+	}
+
+	ctx, cancel := p.requestContext()
+	defer cancel()
+	configMaps := client.CoreV1().ConfigMaps(p.Config.ConfigMapNamespace)
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: p.Config.ConfigMapName, Namespace: p.Config.ConfigMapNamespace},
+		Data:       p.configMapData(),
+	}
+	_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return errors.Annotate(err, "coredns-unifi-names: unable to write configmap")
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !k8s
+
+package unifinames
+
+import "fmt"
+
+// configMapExportSupported is whether the plugin was built with the k8s tag
+const configMapExportSupported = false
+
+// exportConfigMap is only available when built with the k8s tag, the config is rejected before
+func (p *unifinames) exportConfigMap() error {
+	return fmt.Errorf("k8s_configmap_export requires building with the k8s tag")
+}
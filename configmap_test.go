@@ -0,0 +1,62 @@
+package unifinames
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigMapData(t *testing.T) {
+	p := newTestPlugin()
+	p.aClients = append(p.aClients, dns.A{
+		Hdr: dns.RR_Header{Name: "*.server1.lan.", Rrtype: dns.TypeA, Class: dns.ClassINET},
+		A:   net.ParseIP("127.0.0.1"),
+	})
+	p.aaaaClients = []dns.AAAA{{
+		Hdr:  dns.RR_Header{Name: "server1.lan.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET},
+		AAAA: net.ParseIP("fd00::1"),
+	}}
+	require.Equal(t, map[string]string{"server1.lan": "127.0.0.1,fd00::1"}, p.configMapData())
+}
+
+func TestConfigMapExportConfig(t *testing.T) {
+	config := &config{}
+	require.NoError(t, config.setConfigMapOption("namespace=dns"))
+	require.NoError(t, config.setConfigMapOption("name=unifi-names"))
+	require.NoError(t, config.setConfigMapOption("kubeconfig_path=/etc/kubeconfig"))
+	require.Equal(t, "dns", config.ConfigMapNamespace)
+	require.Equal(t, "unifi-names", config.ConfigMapName)
+	require.Equal(t, "/etc/kubeconfig", config.ConfigMapKubeconfig)
+	for _, arg := range []string{"namespace", "name=", "color=red"} {
+		require.Error(t, config.setConfigMapOption(arg), arg)
+	}
+
+	dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+		{
+			Network LAN example.com
+			Unifi https://localhost:8443/ default admin test
+			k8s_configmap_export namespace=dns
+		}
+	`)))
+	_, err := newConfigFromDispenser(dispenser)
+	require.Error(t, err)
+
+	dispenser = caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+		{
+			Network LAN example.com
+			Unifi https://localhost:8443/ default admin test
+			k8s_configmap_export name=unifi-names
+		}
+	`)))
+	config, err = newConfigFromDispenser(dispenser)
+	if configMapExportSupported {
+		require.NoError(t, err)
+		require.Equal(t, "default", config.ConfigMapNamespace)
+	} else {
+		require.Error(t, err)
+	}
+}
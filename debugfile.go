@@ -0,0 +1,118 @@
+package unifinames
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/miekg/dns"
+)
+
+// debugRecord is a record as it is written to the debug_file
+type debugRecord struct {
+	Name    string
+	IP      string
+	Network string
+	TTL     uint32
+}
+
+// key identifies the record, a record whose network or ttl changed is logged as removed and added
+func (r debugRecord) key() string {
+	return fmt.Sprintf("%s %s %s %d", r.Name, r.IP, r.Network, r.TTL)
+}
+
+// buildDebugRecords returns the records with the network of their client, networks maps the names to the
+// networks (the apex records have none)
+func (p *unifinames) buildDebugRecords(aClients []dns.A, aaaaClients []dns.AAAA, networks map[string]string) []debugRecord {
+	network := func(name string) string {
+		return networks[strings.TrimPrefix(name, "*.")]
+	}
+	ttl := func(ttl uint32) uint32 {
+		if ttl == 0 {
+			return p.Config.TTL
+		}
+		return ttl
+	}
+	records := make([]debugRecord, 0, len(aClients)+len(aaaaClients))
+	for _, client := range aClients {
+		records = append(records, debugRecord{Name: client.Hdr.Name, IP: client.A.String(), Network: network(client.Hdr.Name), TTL: ttl(client.Hdr.Ttl)})
+	}
+	for _, client := range aaaaClients {
+		records = append(records, debugRecord{Name: client.Hdr.Name, IP: client.AAAA.String(), Network: network(client.Hdr.Name), TTL: ttl(client.Hdr.Ttl)})
+	}
+	return records
+}
+
+// writeDebugFile appends the records that were added, removed or kept by the last refresh to the
+// debug_file, it is moved to <debug_file>.1 once it is larger than debug_file_max_size_mb
+func (p *unifinames) writeDebugFile(previous, current []debugRecord) error {
+	if err := p.rotateDebugFile(); err != nil {
+		return err
+	}
+
+	currentKeys := map[string]bool{}
+	for _, record := range current {
+		currentKeys[record.key()] = true
+	}
+	previousKeys := map[string]bool{}
+	for _, record := range previous {
+		previousKeys[record.key()] = true
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	var lines []string
+	line := func(operation string, record debugRecord) {
+		lines = append(lines, fmt.Sprintf("%s %s %s %s %s %d", now, operation, record.Name, record.IP, record.Network, record.TTL))
+	}
+	for _, record := range previous {
+		if !currentKeys[record.key()] {
+			line("removed", record)
+		}
+	}
+	for _, record := range current {
+		if previousKeys[record.key()] {
+			line("unchanged", record)
+		} else {
+			line("added", record)
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(p.Config.DebugFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return errors.Annotate(err, "coredns-unifi-names: unable to open debug file")
+	}
+	if _, err := f.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		f.Close()
+		return errors.Annotate(err, "coredns-unifi-names: unable to write debug file")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Annotate(err, "coredns-unifi-names: unable to write debug file")
+	}
+	return nil
+}
+
+// rotateDebugFile replaces <debug_file>.1 with the debug_file once it reached debug_file_max_size_mb
+func (p *unifinames) rotateDebugFile() error {
+	if p.Config.DebugFileMaxSizeMB <= 0 {
+		return nil
+	}
+	info, err := os.Stat(p.Config.DebugFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Annotate(err, "coredns-unifi-names: unable to stat debug file")
+	}
+	if info.Size() < int64(p.Config.DebugFileMaxSizeMB)<<20 {
+		return nil
+	}
+	if err := os.Rename(p.Config.DebugFile, p.Config.DebugFile+".1"); err != nil {
+		return errors.Annotate(err, "coredns-unifi-names: unable to rotate debug file")
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package unifinames
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugFile(t *testing.T) {
+	t.Run("Changes", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.1", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "server2", "ip": "192.168.1.2", "network": "lan"},
+		)
+		p := unifinames{Config: newTestConfig(s.URL)}
+		p.Config.DebugFile = filepath.Join(t.TempDir(), "debug.log")
+		require.NoError(t, p.getClients(context.Background()))
+		s.Close()
+
+		s = MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.1", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "server2", "ip": "192.168.1.3", "network": "lan"},
+		)
+		defer s.Close()
+		p.Config.UnifiControllerURL = s.URL
+		p.resetClient()
+		require.NoError(t, p.getClients(context.Background()))
+
+		data, err := os.ReadFile(p.Config.DebugFile)
+		require.NoError(t, err)
+		var operations []string
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			fields := strings.Fields(line)
+			require.Equal(t, 6, len(fields), line)
+			require.Equal(t, "lan", fields[4])
+			require.Equal(t, "3600", fields[5])
+			operations = append(operations, strings.Join(fields[1:4], " "))
+		}
+		require.Equal(t, []string{
+			"added server1.lan. 192.168.1.1",
+			"added server2.lan. 192.168.1.2",
+			"removed server2.lan. 192.168.1.2",
+			"unchanged server1.lan. 192.168.1.1",
+			"added server2.lan. 192.168.1.3",
+		}, operations)
+	})
+
+	t.Run("Rotation", func(t *testing.T) {
+		p := newTestPlugin()
+		p.Config.DebugFile = filepath.Join(t.TempDir(), "debug.log")
+		p.Config.DebugFileMaxSizeMB = 1
+		require.NoError(t, os.WriteFile(p.Config.DebugFile, make([]byte, 1<<20), 0600))
+
+		records := p.buildDebugRecords(p.aClients, nil, map[string]string{"server1.lan.": "lan"})
+		require.NoError(t, p.writeDebugFile(nil, records))
+		rotated, err := os.Stat(p.Config.DebugFile + ".1")
+		require.NoError(t, err)
+		require.Equal(t, int64(1<<20), rotated.Size())
+		data, err := os.ReadFile(p.Config.DebugFile)
+		require.NoError(t, err)
+		require.Contains(t, string(data), "added server1.lan. 127.0.0.1 lan 3600")
+	})
+}
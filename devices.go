@@ -0,0 +1,90 @@
+package unifinames
+
+import (
+	"net"
+	"strings"
+
+	"github.com/unpoller/unifi"
+)
+
+// device is the part of the UniFi devices (access points, switches, gateways, ...) that records are
+// made of, the unifi package has a separate type for each kind of device
+type device struct {
+	Name  string
+	Mac   string
+	IP    string
+	LanIP string
+}
+
+// flattenDevices returns the devices of all kinds
+func flattenDevices(devices *unifi.Devices) []device {
+	if devices == nil {
+		return nil
+	}
+	var flat []device
+	for _, d := range devices.UAPs {
+		flat = append(flat, device{Name: d.Name, Mac: d.Mac, IP: d.IP})
+	}
+	for _, d := range devices.USWs {
+		flat = append(flat, device{Name: d.Name, Mac: d.Mac, IP: d.IP})
+	}
+	for _, d := range devices.USGs {
+		flat = append(flat, device{Name: d.Name, Mac: d.Mac, IP: d.IP})
+	}
+	for _, d := range devices.UDMs {
+		flat = append(flat, device{Name: d.Name, Mac: d.Mac, IP: d.IP, LanIP: d.LanIP})
+	}
+	for _, d := range devices.UXGs {
+		flat = append(flat, device{Name: d.Name, Mac: d.Mac, IP: d.IP})
+	}
+	for _, d := range devices.PDUs {
+		flat = append(flat, device{Name: d.Name, Mac: d.Mac, IP: d.IP})
+	}
+	return flat
+}
+
+// deviceIP returns the address the device is reached at in the lan, gateways report their wan address
+// as IP and the lan one as LanIP, the other devices only have IP
+func deviceIP(d device) net.IP {
+	for _, address := range []string{d.LanIP, d.IP} {
+		if ip := net.ParseIP(address); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// deviceClients returns the devices as clients of network so they get records like the other clients
+func deviceClients(devices []device, network string) []*unifi.Client {
+	clients := make([]*unifi.Client, 0, len(devices))
+	for _, d := range devices {
+		ip := deviceIP(d)
+		if ip == nil {
+			continue
+		}
+		clients = append(clients, &unifi.Client{
+			Name:     d.Name,
+			Hostname: d.Name,
+			Mac:      d.Mac,
+			IP:       ip.String(),
+			Network:  network,
+			// most devices are wired, client_type shouldn't drop them as wireless clients
+			IsWired: unifi.FlexBool{Val: true, Txt: "true"},
+		})
+	}
+	return clients
+}
+
+// setSwitchNames sets the names of the switches the wired clients are connected to, the controller
+// only sends the mac of the switch with a client
+func setSwitchNames(clients []*unifi.Client, devices []device) {
+	names := make(map[string]string, len(devices))
+	for _, d := range devices {
+		names[strings.ToLower(d.Mac)] = d.Name
+	}
+	for _, client := range clients {
+		if name, ok := names[strings.ToLower(client.SwMac)]; ok && client.SwName == "" {
+			client.SwName = name
+		}
+	}
+}
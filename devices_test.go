@@ -0,0 +1,89 @@
+package unifinames
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/unpoller/unifi"
+)
+
+func TestDeviceIP(t *testing.T) {
+	for _, tc := range []struct {
+		device device
+		ip     string
+	}{
+		{device{LanIP: "192.168.1.1", IP: "203.0.113.1"}, "192.168.1.1"},
+		{device{LanIP: "192.168.1.1"}, "192.168.1.1"},
+		{device{IP: "192.168.1.2"}, "192.168.1.2"},
+		{device{LanIP: "invalid", IP: "192.168.1.2"}, "192.168.1.2"},
+		{device{}, ""},
+	} {
+		ip := deviceIP(tc.device)
+		if tc.ip == "" {
+			require.Nil(t, ip, "%+v", tc.device)
+			continue
+		}
+		require.Equal(t, tc.ip, ip.String(), "%+v", tc.device)
+	}
+}
+
+func TestFlattenDevices(t *testing.T) {
+	require.Nil(t, flattenDevices(nil))
+	devices := flattenDevices(&unifi.Devices{
+		UAPs: []*unifi.UAP{{Name: "ap", IP: "192.168.1.2"}},
+		UDMs: []*unifi.UDM{{Name: "gateway", IP: "203.0.113.1", LanIP: "192.168.1.1"}},
+	})
+	require.Equal(t, []device{
+		{Name: "ap", IP: "192.168.1.2"},
+		{Name: "gateway", IP: "203.0.113.1", LanIP: "192.168.1.1"},
+	}, devices)
+
+	clients := deviceClients(append(devices, device{Name: "offline"}), "lan")
+	require.Equal(t, 2, len(clients))
+	require.Equal(t, "192.168.1.1", clients[1].IP)
+	require.Equal(t, "lan", clients[1].Network)
+}
+
+func TestIncludeDevices(t *testing.T) {
+	s := MockUnifiController(nil, "lan", "server1", "192.168.1.10")
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, 1, len(p.aClients))
+
+	p.Config.IncludeDevices = "lan"
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, 3, len(p.aClients))
+	rrs := p.lookup(new(dns.Msg).SetQuestion("gateway.lan.", dns.TypeA))
+	require.Equal(t, 1, len(rrs))
+	require.Equal(t, "192.168.1.254", rrs[0].(*dns.A).A.String())
+	require.Equal(t, 1, len(p.lookup(new(dns.Msg).SetQuestion("ap-office.lan.", dns.TypeA))))
+}
+
+func TestIncludeSwitchPorts(t *testing.T) {
+	s := MockUnifiControllerWithClients(nil,
+		map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "desktop", "ip": "192.168.1.1", "network": "lan", "is_wired": true, "sw_mac": "00:00:00:00:01:03", "sw_port": 7},
+		map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "nas", "ip": "192.168.1.2", "network": "lan", "is_wired": true, "sw_mac": "00:00:00:00:01:99", "sw_port": 2},
+		map[string]interface{}{"mac": "00:00:00:00:00:03", "hostname": "phone", "ip": "192.168.1.3", "network": "lan"},
+	)
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, 0, len(p.lookup(new(dns.Msg).SetQuestion("desktop.lan.", dns.TypeTXT))))
+
+	p.Config.IncludeSwitchPorts = true
+	require.NoError(t, p.getClients(context.Background()))
+	rrs := p.lookup(new(dns.Msg).SetQuestion("Desktop.lan.", dns.TypeTXT))
+	require.Equal(t, 1, len(rrs))
+	require.Equal(t, "Desktop.lan.", rrs[0].Header().Name)
+	require.Equal(t, []string{"switch=Switch Office", "port=7"}, rrs[0].(*dns.TXT).Txt)
+	// the switch isn't known, its mac is used
+	rrs = p.lookup(new(dns.Msg).SetQuestion("nas.lan.", dns.TypeTXT))
+	require.Equal(t, 1, len(rrs))
+	require.Equal(t, []string{"switch=00:00:00:00:01:99", "port=2"}, rrs[0].(*dns.TXT).Txt)
+	require.Equal(t, 0, len(p.lookup(new(dns.Msg).SetQuestion("phone.lan.", dns.TypeTXT))))
+	// the devices are only used for the switch names
+	require.Equal(t, 3, len(p.aClients))
+}
@@ -0,0 +1,71 @@
+package unifinames
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/juju/errors"
+)
+
+// discoveryService is the mDNS service the UniFi controllers announce themselves with
+const discoveryService = "_unifi._tcp"
+
+// browseMDNS returns the first instance of service in the local domain or nil once ctx is done, it is
+// replaced in the tests
+var browseMDNS = func(ctx context.Context, service string) (*zeroconf.ServiceEntry, error) {
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(chan *zeroconf.ServiceEntry)
+	if err := resolver.Browse(ctx, service, "local.", entries); err != nil {
+		return nil, err
+	}
+	for {
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				return nil, nil
+			}
+			if entry != nil {
+				return entry, nil
+			}
+		case <-ctx.Done():
+			return nil, nil
+		}
+	}
+}
+
+// discoverController looks for a controller announced via mDNS for up to timeout and returns its url
+func discoverController(timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	entry, err := browseMDNS(ctx, discoveryService)
+	if err != nil {
+		return "", errors.Annotate(err, "coredns-unifi-names: unable to discover the controller")
+	}
+	if entry == nil {
+		return "", fmt.Errorf("No controller found via mDNS within %s", timeout)
+	}
+	return discoveredURL(entry)
+}
+
+// discoveredURL returns the url of the announced controller, the addresses are preferred over the host
+// name because .local names usually can't be resolved by coredns itself
+func discoveredURL(entry *zeroconf.ServiceEntry) (string, error) {
+	host := strings.TrimSuffix(entry.HostName, ".")
+	if len(entry.AddrIPv4) > 0 {
+		host = entry.AddrIPv4[0].String()
+	} else if len(entry.AddrIPv6) > 0 {
+		host = entry.AddrIPv6[0].String()
+	}
+	if host == "" || entry.Port <= 0 {
+		return "", fmt.Errorf("The controller '%s' was announced without an address", entry.Instance)
+	}
+	return "https://" + net.JoinHostPort(host, strconv.Itoa(entry.Port)), nil
+}
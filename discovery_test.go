@@ -0,0 +1,75 @@
+package unifinames
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/grandcat/zeroconf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscoverController(t *testing.T) {
+	browse := browseMDNS
+	defer func() { browseMDNS = browse }()
+
+	entry := zeroconf.NewServiceEntry("UniFi Controller", discoveryService, "local.")
+	entry.HostName = "unifi.local."
+	entry.Port = 8443
+	browseMDNS = func(ctx context.Context, service string) (*zeroconf.ServiceEntry, error) {
+		require.Equal(t, discoveryService, service)
+		return entry, nil
+	}
+	url, err := discoverController(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "https://unifi.local:8443", url)
+
+	entry.AddrIPv6 = []net.IP{net.ParseIP("fd00::2")}
+	url, err = discoverController(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "https://[fd00::2]:8443", url)
+
+	entry.AddrIPv4 = []net.IP{net.ParseIP("192.168.1.2")}
+	url, err = discoverController(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "https://192.168.1.2:8443", url)
+
+	browseMDNS = func(ctx context.Context, service string) (*zeroconf.ServiceEntry, error) {
+		<-ctx.Done()
+		return nil, nil
+	}
+	_, err = discoverController(10 * time.Millisecond)
+	require.Error(t, err)
+}
+
+func TestAutoDiscoverConfig(t *testing.T) {
+	dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+		{
+			Network LAN example.com
+			Unifi "" default admin test
+			auto_discover
+			discovery_timeout 3s
+		}
+	`)))
+	config, err := newConfigFromDispenser(dispenser)
+	require.NoError(t, err)
+	require.True(t, config.AutoDiscover)
+	require.Equal(t, 3*time.Second, config.DiscoveryTimeout)
+	require.Equal(t, "", config.UnifiControllerURL)
+
+	for _, directives := range []string{"", "auto_discover\ndiscovery_timeout 0s"} {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+		{
+			Network LAN example.com
+			Unifi "" default admin test
+			`+directives+`
+		}
+	`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.Error(t, err, directives)
+		require.Nil(t, config, directives)
+	}
+}
@@ -0,0 +1,52 @@
+package unifinames
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// dnsmasqHosts returns the records in the address=/hostname/ip format of dnsmasq with a header
+// comment, the wildcard records are left out as dnsmasq answers the names below a hostname anyway
+func (p *unifinames) dnsmasqHosts(now time.Time) []byte {
+	p.mu.Lock()
+	var lines []string
+	for _, client := range p.aClients {
+		if !strings.HasPrefix(client.Hdr.Name, "*.") {
+			lines = append(lines, fmt.Sprintf("address=/%s/%s", strings.TrimSuffix(client.Hdr.Name, "."), client.A))
+		}
+	}
+	for _, client := range p.aaaaClients {
+		if !strings.HasPrefix(client.Hdr.Name, "*.") {
+			lines = append(lines, fmt.Sprintf("address=/%s/%s", strings.TrimSuffix(client.Hdr.Name, "."), client.AAAA))
+		}
+	}
+	p.mu.Unlock()
+	sort.Strings(lines)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# generated by unifi-names at %s, %d records\n", now.UTC().Format(time.RFC3339), len(lines))
+	for _, line := range lines {
+		sb.WriteString(line)
+		sb.WriteByte('\n')
+	}
+	return []byte(sb.String())
+}
+
+// exportDnsmasqHosts writes the records to export_dnsmasq_hosts and runs dnsmasq_reload_command
+func (p *unifinames) exportDnsmasqHosts() error {
+	if err := writeFileAtomic(p.Config.DnsmasqHostsFile, p.dnsmasqHosts(time.Now())); err != nil {
+		return errors.Annotate(err, "coredns-unifi-names: unable to write dnsmasq hosts file")
+	}
+	if p.Config.DnsmasqReloadCommand == "" {
+		return nil
+	}
+	if output, err := exec.Command("sh", "-c", p.Config.DnsmasqReloadCommand).CombinedOutput(); err != nil {
+		return errors.Annotatef(err, "coredns-unifi-names: dnsmasq reload command failed: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
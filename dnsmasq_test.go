@@ -0,0 +1,48 @@
+package unifinames
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDnsmasqHosts(t *testing.T) {
+	p := newTestPlugin()
+	p.aClients = append(p.aClients, dns.A{
+		Hdr: dns.RR_Header{Name: "*.server1.lan.", Rrtype: dns.TypeA, Class: dns.ClassINET},
+		A:   net.ParseIP("127.0.0.1"),
+	})
+	p.aaaaClients = []dns.AAAA{{
+		Hdr:  dns.RR_Header{Name: "server1.lan.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET},
+		AAAA: net.ParseIP("fd00::1"),
+	}}
+	now := time.Date(2020, 8, 19, 10, 0, 0, 0, time.UTC)
+	require.Equal(t, "# generated by unifi-names at 2020-08-19T10:00:00Z, 2 records\n"+
+		"address=/server1.lan/127.0.0.1\n"+
+		"address=/server1.lan/fd00::1\n", string(p.dnsmasqHosts(now)))
+}
+
+func TestExportDnsmasqHosts(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestPlugin()
+	p.Config.DnsmasqHostsFile = filepath.Join(dir, "unifi-names.conf")
+	p.Config.DnsmasqReloadCommand = "touch " + filepath.Join(dir, "reloaded")
+	require.NoError(t, p.exportDnsmasqHosts())
+	data, err := os.ReadFile(p.Config.DnsmasqHostsFile)
+	require.NoError(t, err)
+	require.Contains(t, string(data), "address=/server1.lan/127.0.0.1\n")
+	require.FileExists(t, filepath.Join(dir, "reloaded"))
+
+	p.Config.DnsmasqReloadCommand = "echo no dnsmasq; exit 1"
+	err = p.exportDnsmasqHosts()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no dnsmasq")
+
+	p.Config.DnsmasqHostsFile = filepath.Join(dir, "missing", "unifi-names.conf")
+	require.Error(t, p.exportDnsmasqHosts())
+}
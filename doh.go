@@ -0,0 +1,108 @@
+package unifinames
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/pkg/doh"
+	"github.com/coredns/coredns/plugin/pkg/nonwriter"
+	"github.com/miekg/dns"
+)
+
+// jsonMimeType is the content type of the json answers of the dns-query endpoint
+const jsonMimeType = "application/dns-json"
+
+// jsonQuestion and jsonAnswer are the entries of a jsonResponse
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonAnswer struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// jsonResponse is the json answer of the dns-query endpoint in the format of the public DoH resolvers
+type jsonResponse struct {
+	Status    int            `json:"Status"`
+	TC        bool           `json:"TC"`
+	RD        bool           `json:"RD"`
+	RA        bool           `json:"RA"`
+	AD        bool           `json:"AD"`
+	CD        bool           `json:"CD"`
+	Question  []jsonQuestion `json:"Question"`
+	Answer    []jsonAnswer   `json:"Answer,omitempty"`
+	Authority []jsonAnswer   `json:"Authority,omitempty"`
+}
+
+// serveDNSQuery answers DoH requests from the records of the plugin without the other plugins. The
+// wire format is read from the dns parameter or the body (application/dns-message), the name and type
+// parameters are answered with json (application/dns-json)
+func (p *unifinames) serveDNSQuery(w http.ResponseWriter, r *http.Request) {
+	if name := r.URL.Query().Get("name"); name != "" {
+		qtype := dns.TypeA
+		if t := r.URL.Query().Get("type"); t != "" {
+			var ok bool
+			if qtype, ok = dns.StringToType[strings.ToUpper(t)]; !ok {
+				http.Error(w, "invalid type", http.StatusBadRequest)
+				return
+			}
+		}
+		m := p.answerHTTP(new(dns.Msg).SetQuestion(dns.Fqdn(name), qtype))
+		w.Header().Set("Content-Type", jsonMimeType)
+		_ = json.NewEncoder(w).Encode(toJSONResponse(m))
+		return
+	}
+
+	req, err := doh.RequestToMsg(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := p.answerHTTP(req).Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", doh.MimeType)
+	_, _ = w.Write(data)
+}
+
+// answerHTTP returns the answer of the plugin to req, the queries it would pass to the next plugin
+// are refused
+func (p *unifinames) answerHTTP(req *dns.Msg) *dns.Msg {
+	nw := nonwriter.New(nil)
+	if _, ok := p.resolve(nw, req); ok && nw.Msg != nil {
+		return nw.Msg
+	}
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeRefused)
+	return m
+}
+
+// toJSONResponse converts m to the json format
+func toJSONResponse(m *dns.Msg) jsonResponse {
+	response := jsonResponse{
+		Status:   m.Rcode,
+		TC:       m.Truncated,
+		RD:       m.RecursionDesired,
+		RA:       m.RecursionAvailable,
+		AD:       m.AuthenticatedData,
+		CD:       m.CheckingDisabled,
+		Question: []jsonQuestion{},
+	}
+	for _, question := range m.Question {
+		response.Question = append(response.Question, jsonQuestion{Name: question.Name, Type: question.Qtype})
+	}
+	for _, rr := range m.Answer {
+		response.Answer = append(response.Answer, jsonAnswer{Name: rr.Header().Name, Type: rr.Header().Rrtype, TTL: rr.Header().Ttl, Data: rrValue(rr)})
+	}
+	for _, rr := range m.Ns {
+		response.Authority = append(response.Authority, jsonAnswer{Name: rr.Header().Name, Type: rr.Header().Rrtype, TTL: rr.Header().Ttl, Data: rrValue(rr)})
+	}
+	return response
+}
@@ -0,0 +1,64 @@
+package unifinames
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/doh"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeDNSQuery(t *testing.T) {
+	p := newTestPlugin()
+	s := httptest.NewServer(p.httpHandler())
+	defer s.Close()
+
+	t.Run("Wire Format", func(t *testing.T) {
+		for _, method := range []string{http.MethodGet, http.MethodPost} {
+			req, err := doh.NewRequest(method, s.URL, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+			require.NoError(t, err)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			m, err := doh.ResponseToMsg(resp)
+			resp.Body.Close()
+			require.NoError(t, err, method)
+			require.Equal(t, dns.RcodeSuccess, m.Rcode, method)
+			require.Len(t, m.Answer, 1, method)
+			require.Equal(t, "127.0.0.1", m.Answer[0].(*dns.A).A.String(), method)
+		}
+
+		req, err := doh.NewRequest(http.MethodGet, s.URL, new(dns.Msg).SetQuestion("server1.example.com.", dns.TypeA))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		m, err := doh.ResponseToMsg(resp)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, dns.RcodeRefused, m.Rcode)
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		resp, err := http.Get(s.URL + doh.Path + "?name=server1.lan&type=a")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, jsonMimeType, resp.Header.Get("Content-Type"))
+		var response jsonResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+		require.Equal(t, dns.RcodeSuccess, response.Status)
+		require.Equal(t, []jsonQuestion{{Name: "server1.lan.", Type: dns.TypeA}}, response.Question)
+		require.Len(t, response.Answer, 1)
+		require.Equal(t, "127.0.0.1", response.Answer[0].Data)
+	})
+
+	t.Run("Invalid Requests", func(t *testing.T) {
+		for _, query := range []string{"?name=server1.lan&type=BOGUS", "?dns=not-base64!", ""} {
+			resp, err := http.Get(s.URL + doh.Path + query)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+		}
+	})
+}
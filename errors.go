@@ -0,0 +1,65 @@
+package unifinames
+
+import (
+	"encoding/json"
+	"net"
+	"net/url"
+
+	"github.com/juju/errors"
+)
+
+// ErrAuthFailure is returned when the controller rejects the credentials or the session
+type ErrAuthFailure struct{ Err error }
+
+func (e *ErrAuthFailure) Error() string { return "authentication failed: " + e.Err.Error() }
+func (e *ErrAuthFailure) Unwrap() error { return e.Err }
+
+// ErrNetworkError is returned when a request to the controller failed on the way, e.g. timed out
+type ErrNetworkError struct{ Err error }
+
+func (e *ErrNetworkError) Error() string { return "network error: " + e.Err.Error() }
+func (e *ErrNetworkError) Unwrap() error { return e.Err }
+
+// ErrControllerUnreachable is returned when no connection to the controller could be made
+type ErrControllerUnreachable struct{ Err error }
+
+func (e *ErrControllerUnreachable) Error() string { return "controller unreachable: " + e.Err.Error() }
+func (e *ErrControllerUnreachable) Unwrap() error { return e.Err }
+
+// ErrParseFailure is returned when the answer of the controller couldn't be decoded
+type ErrParseFailure struct{ Err error }
+
+func (e *ErrParseFailure) Error() string { return "invalid controller response: " + e.Err.Error() }
+func (e *ErrParseFailure) Unwrap() error { return e.Err }
+
+// classifyError wraps err of a controller query in the error type matching its cause, errors of an
+// unknown cause are returned as is
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if isAuthError(err) {
+		return &ErrAuthFailure{Err: err}
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return &ErrParseFailure{Err: err}
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return &ErrControllerUnreachable{Err: err}
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return &ErrControllerUnreachable{Err: err}
+	}
+	var netErr net.Error
+	var urlErr *url.Error
+	if errors.As(err, &netErr) || errors.As(err, &urlErr) {
+		return &ErrNetworkError{Err: err}
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package unifinames
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/unpoller/unifi"
+)
+
+func TestClassifyError(t *testing.T) {
+	require.Nil(t, classifyError(nil))
+
+	var authErr *ErrAuthFailure
+	require.True(t, errors.As(classifyError(errors.Annotate(unifi.ErrAuthenticationFailed, "login")), &authErr))
+	require.ErrorIs(t, classifyError(unifi.ErrAuthenticationFailed), unifi.ErrAuthenticationFailed)
+
+	var parseErr *ErrParseFailure
+	require.True(t, errors.As(classifyError(errors.Annotate(json.Unmarshal([]byte("{"), &struct{}{}), "clients")), &parseErr))
+
+	other := errors.New("something else")
+	require.Equal(t, other, classifyError(other))
+}
+
+func TestGetClientsErrors(t *testing.T) {
+	t.Run("Unreachable", func(t *testing.T) {
+		s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+		s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		var unreachableErr *ErrControllerUnreachable
+		require.True(t, errors.As(p.getClients(context.Background()), &unreachableErr))
+	})
+
+	t.Run("Network Error", func(t *testing.T) {
+		s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+		}))
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		p.Config.HTTPTimeout = 20 * time.Millisecond
+		var networkErr *ErrNetworkError
+		require.True(t, errors.As(p.getClients(context.Background()), &networkErr))
+	})
+
+	t.Run("Auth Failure", func(t *testing.T) {
+		s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/" {
+				w.WriteHeader(http.StatusFound)
+				return
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		var authErr *ErrAuthFailure
+		require.True(t, errors.As(p.getClients(context.Background()), &authErr))
+	})
+}
+
+func TestNextBackoff(t *testing.T) {
+	require.Equal(t, time.Second, nextBackoff(0, time.Hour))
+	require.Equal(t, 4*time.Second, nextBackoff(2*time.Second, time.Hour))
+	require.Equal(t, time.Minute, nextBackoff(time.Minute, time.Minute))
+	require.Equal(t, 500*time.Millisecond, nextBackoff(0, 500*time.Millisecond))
+}
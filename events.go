@@ -0,0 +1,257 @@
+package unifinames
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"golang.org/x/net/websocket"
+)
+
+// defaultEventStreamReconcileInterval is how often the clients are still polled with use_event_stream
+const defaultEventStreamReconcileInterval = 5 * time.Minute
+
+// eventMessage is a message of the event stream of the controller, the events are sent with the
+// message events
+type eventMessage struct {
+	Meta struct {
+		Message string `json:"message"`
+	} `json:"meta"`
+	Data []struct {
+		Key  string `json:"key"`
+		User string `json:"user"`
+	} `json:"data"`
+}
+
+// clientEvents are the keys of the events that change which clients are connected
+var clientEvents = map[string]bool{
+	"EVT_WU_Connected":    true,
+	"EVT_WU_Disconnected": true,
+	"EVT_WG_Connected":    true,
+	"EVT_WG_Disconnected": true,
+	"EVT_LU_Connected":    true,
+	"EVT_LU_Disconnected": true,
+}
+
+// pollInterval returns how long the refresh goroutine waits for the next refresh, with the event stream
+// it only reconciles the records that were changed by the events
+func (p *unifinames) pollInterval() time.Duration {
+	if !p.Config.UseEventStream {
+		return p.refreshInterval()
+	}
+	if p.Config.EventStreamReconcileInterval > 0 {
+		return p.Config.EventStreamReconcileInterval
+	}
+	return defaultEventStreamReconcileInterval
+}
+
+// triggerRefresh makes the refresh goroutine refresh the clients now, the triggers of a burst of
+// events are merged into one refresh
+func (p *unifinames) triggerRefresh() {
+	select {
+	case p.refreshNow <- struct{}{}:
+	default:
+	}
+}
+
+// watchEvents follows the event stream of the controller until the plugin is shut down, it reconnects
+// with the session of the refreshes when the stream is closed
+func (p *unifinames) watchEvents() {
+	UnifinamesGoroutines.WithLabelValues("events").Inc()
+	defer UnifinamesGoroutines.WithLabelValues("events").Dec()
+	var backoff time.Duration
+	for {
+		connected, err := p.readEvents()
+		if connected {
+			backoff = 0
+		}
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+		backoff = nextBackoff(backoff, time.Minute)
+		log.Warningf("event stream closed, reconnecting in %s: %v", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// readEvents connects to the event streams of the sites and triggers a refresh for each client event
+// until one of the streams is closed or the plugin is shut down, connected is whether all streams were
+// connected before
+func (p *unifinames) readEvents() (bool, error) {
+	p.clientMu.Lock()
+	uni := p.uniClient
+	if uni == nil {
+		p.clientMu.Unlock()
+		return false, errors.New("coredns-unifi-names: no controller session yet")
+	}
+	sites, err := uni.GetSites()
+	// loadSecrets replaces the url under clientMu
+	controllerURL := p.Config.UnifiControllerURL
+	p.clientMu.Unlock()
+	if err != nil {
+		return false, errors.Annotate(err, "coredns-unifi-names: unable to get sites")
+	}
+	sites = filterSites(sites, p.Config.IncludeSites, p.Config.ExcludeSites)
+	if len(sites) == 0 {
+		return false, errors.New("coredns-unifi-names: no sites to follow the events of")
+	}
+
+	base, err := url.Parse(controllerURL)
+	if err != nil {
+		return false, errors.Annotate(err, "coredns-unifi-names: invalid controller url")
+	}
+	roundTripper := uni.Client.Transport
+	if basicAuth, ok := roundTripper.(*basicAuthTransport); ok {
+		roundTripper = basicAuth.next
+	}
+	apiTransport, ok := roundTripper.(*apiPathTransport)
+	if !ok {
+		return false, errors.New("coredns-unifi-names: unexpected transport of the controller session")
+	}
+	transport, ok := apiTransport.next.(*http.Transport)
+	if !ok {
+		return false, errors.New("coredns-unifi-names: unexpected transport of the controller session")
+	}
+
+	var conns []*websocket.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for _, site := range sites {
+		rawURL := eventStreamURL(base, apiTransport.newStyle, site.Name)
+		// the cookie jar only knows the http urls
+		location, _ := url.Parse(strings.Replace(rawURL, "ws", "http", 1))
+		conn, err := dialEvents(rawURL, transport, uni.Client.Jar.Cookies(location), p.Config.basicAuthHeader(), p.Config.HTTPTimeout)
+		if err != nil {
+			return false, err
+		}
+		conns = append(conns, conn)
+	}
+	log.Infof("following the event stream of %d sites", len(conns))
+
+	errs := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func(conn *websocket.Conn) {
+			errs <- p.readEventStream(conn)
+		}(conn)
+	}
+	select {
+	case err := <-errs:
+		return true, err
+	case <-p.stop:
+		// closing the streams makes the readers return into the buffered errs
+		return true, nil
+	}
+}
+
+// eventStreamURL returns the url of the event stream of site, UniFi OS serves it below /proxy/network
+func eventStreamURL(base *url.URL, newStyle bool, site string) string {
+	u := *base
+	u.Scheme = "ws"
+	if base.Scheme == "https" {
+		u.Scheme = "wss"
+	}
+	u.Path = strings.TrimRight(base.Path, "/")
+	if newStyle {
+		u.Path += "/proxy/network"
+	}
+	u.Path += "/wss/s/" + url.PathEscape(site) + "/events"
+	return u.String()
+}
+
+// dialEvents connects to the event stream at rawURL with the dialer and the tls config of transport,
+// so the stream goes through socks5_proxy like the requests. header is added to the handshake, e.g. the
+// Authorization of auth_mode basic. http proxies aren't supported
+func dialEvents(rawURL string, transport *http.Transport, cookies []*http.Cookie, header http.Header, timeout time.Duration) (*websocket.Conn, error) {
+	location, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Annotate(err, "coredns-unifi-names: invalid event stream url")
+	}
+	origin := &url.URL{Scheme: strings.Replace(location.Scheme, "ws", "http", 1), Host: location.Host}
+	config, err := websocket.NewConfig(rawURL, origin.String())
+	if err != nil {
+		return nil, errors.Annotate(err, "coredns-unifi-names: invalid event stream url")
+	}
+	var cookieHeader []string
+	for _, cookie := range cookies {
+		cookieHeader = append(cookieHeader, cookie.Name+"="+cookie.Value)
+	}
+	if len(cookieHeader) > 0 {
+		config.Header.Set("Cookie", strings.Join(cookieHeader, "; "))
+	}
+	for key, values := range header {
+		config.Header[key] = values
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	addr := location.Host
+	if location.Port() == "" {
+		addr = net.JoinHostPort(location.Hostname(), map[string]string{"ws": "80", "wss": "443"}[location.Scheme])
+	}
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, errors.Annotate(err, "coredns-unifi-names: unable to connect to the event stream")
+	}
+	if location.Scheme == "wss" {
+		tlsConfig := &tls.Config{}
+		if transport.TLSClientConfig != nil {
+			tlsConfig = transport.TLSClientConfig.Clone()
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = location.Hostname()
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, errors.Annotate(err, "coredns-unifi-names: unable to connect to the event stream")
+		}
+		conn = tlsConn
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Annotate(err, "coredns-unifi-names: unable to open the event stream")
+	}
+	return ws, nil
+}
+
+// readEventStream triggers a refresh for each client event of conn until it is closed
+func (p *unifinames) readEventStream(conn *websocket.Conn) error {
+	for {
+		var msg eventMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			return errors.Annotate(err, "coredns-unifi-names: unable to read the event stream")
+		}
+		if msg.Meta.Message != "events" {
+			continue
+		}
+		for _, event := range msg.Data {
+			if clientEvents[event.Key] {
+				p.debugf("refreshing after %s of %s", event.Key, event.User)
+				p.triggerRefresh()
+			}
+		}
+	}
+}
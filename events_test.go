@@ -0,0 +1,44 @@
+package unifinames
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventStreamURL(t *testing.T) {
+	base, err := url.Parse("https://unifi.lan:8443/")
+	require.NoError(t, err)
+	require.Equal(t, "wss://unifi.lan:8443/wss/s/default/events", eventStreamURL(base, false, "default"))
+	require.Equal(t, "wss://unifi.lan:8443/proxy/network/wss/s/default/events", eventStreamURL(base, true, "default"))
+	base, err = url.Parse("http://unifi.lan/controller")
+	require.NoError(t, err)
+	require.Equal(t, "ws://unifi.lan/controller/wss/s/default/events", eventStreamURL(base, false, "default"))
+}
+
+func TestReadEvents(t *testing.T) {
+	s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL), refreshNow: make(chan struct{}, 1)}
+	p.Config.UseEventStream = true
+
+	_, err := p.readEvents()
+	require.Error(t, err, "no session")
+
+	require.NoError(t, p.refresh())
+	// the mock sends one event and closes the stream
+	connected, err := p.readEvents()
+	require.True(t, connected)
+	require.Error(t, err)
+	select {
+	case <-p.refreshNow:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the event didn't trigger a refresh")
+	}
+
+	require.Equal(t, defaultEventStreamReconcileInterval, p.pollInterval())
+	p.Config.UseEventStream = false
+	require.Equal(t, time.Hour, p.pollInterval())
+}
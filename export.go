@@ -0,0 +1,84 @@
+package unifinames
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/juju/errors"
+)
+
+// hostsBlock returns the A and AAAA records as a block of the hosts plugin. The names it doesn't know
+// fall through to the next plugin, like the ones unifi-names has no record for. /dev/null keeps the
+// hosts plugin from also serving /etc/hosts, which it reads without a file argument, and the zones
+// limit it to the domains of the networks
+func (p *unifinames) hostsBlock() string {
+	zones := []string{}
+	for _, domain := range p.Config.domains() {
+		zones = append(zones, strings.TrimSuffix(domain, "."))
+	}
+	slices.Sort(zones)
+	zones = slices.Compact(zones)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "hosts /dev/null %s {\n", strings.Join(zones, " "))
+	for _, line := range strings.Split(strings.TrimSuffix(p.ToHostsFormat(), "\n"), "\n") {
+		if line != "" {
+			b.WriteString("    " + line + "\n")
+		}
+	}
+	fmt.Fprintf(&b, "    ttl %d\n", p.Config.TTL)
+	b.WriteString("    fallthrough\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// ExportHostsBlock reads the unifi-names block of the server block with the key server from the
+// Corefile, or of the first one that has it when server is empty, queries the controller once and
+// returns the records as a hosts block that can replace the unifi-names block
+func ExportHostsBlock(ctx context.Context, corefile io.Reader, server string) (string, error) {
+	blocks, err := caddyfile.Parse("Corefile", corefile, nil)
+	if err != nil {
+		return "", errors.Annotate(err, "coredns-unifi-names: unable to parse Corefile")
+	}
+
+	for _, block := range blocks {
+		tokens, ok := block.Tokens["unifi-names"]
+		if !ok || (server != "" && !hasKey(block.Keys, server)) {
+			continue
+		}
+		c := caddyfile.NewDispenserTokens("Corefile", tokens)
+		c.Next()
+		config, err := newConfigFromDispenser(c)
+		if err != nil {
+			return "", err
+		}
+		if config.AutoDiscover && config.UnifiControllerURL == "" && config.SecretsBackend == "" {
+			url, err := discoverController(config.DiscoveryTimeout)
+			if err != nil {
+				return "", err
+			}
+			config.UnifiControllerURL = url
+		}
+
+		p := &unifinames{Config: config}
+		if err := p.getClients(ctx); err != nil {
+			return "", err
+		}
+		return p.hostsBlock(), nil
+	}
+	return "", errors.New("coredns-unifi-names: no unifi-names block found in Corefile")
+}
+
+// hasKey reports whether the server block keys contain key, the keys are compared case insensitive
+func hasKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package unifinames
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportHostsBlock(t *testing.T) {
+	s := MockUnifiController(nil, "lan", "server1", "192.168.1.10")
+	defer s.Close()
+
+	corefile := `
+other:53 {
+	forward . 1.1.1.1
+}
+lan:53 {
+	unifi-names {
+		Network LAN lan
+		Unifi ` + s.URL + ` default admin admin
+		TTL 300
+	}
+}
+`
+	block, err := ExportHostsBlock(context.Background(), strings.NewReader(corefile), "lan:53")
+	require.NoError(t, err)
+	require.Equal(t, "hosts /dev/null lan {\n    192.168.1.10 server1.lan\n    ttl 300\n    fallthrough\n}\n", block)
+
+	_, err = ExportHostsBlock(context.Background(), strings.NewReader(corefile), "other:53")
+	require.Error(t, err)
+}
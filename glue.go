@@ -0,0 +1,63 @@
+package unifinames
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// glueRecords returns the A and AAAA records of the nameservers named by the NS records of m that
+// aren't in its additional section yet, e.g. ns2.home.arpa. of a delegation of sub.home.arpa.
+func (p *unifinames) glueRecords(m *dns.Msg) []dns.RR {
+	have := map[string]bool{}
+	for _, rr := range m.Extra {
+		have[strings.ToLower(rr.Header().Name)+" "+dns.TypeToString[rr.Header().Rrtype]] = true
+	}
+
+	var glue []dns.RR
+	for _, rr := range append(append([]dns.RR{}, m.Answer...), m.Ns...) {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			key := strings.ToLower(ns.Ns) + " " + dns.TypeToString[qtype]
+			if have[key] {
+				continue
+			}
+			have[key] = true
+			glue = append(glue, p.lookup(new(dns.Msg).SetQuestion(ns.Ns, qtype))...)
+		}
+	}
+	return glue
+}
+
+// addGlue adds the glue records to the additional section of m, before the OPT and TSIG records that
+// have to stay last
+func (p *unifinames) addGlue(m *dns.Msg) {
+	if m.Truncated {
+		return
+	}
+	glue := p.glueRecords(m)
+	if len(glue) == 0 {
+		return
+	}
+	i := len(m.Extra)
+	for i > 0 && (m.Extra[i-1].Header().Rrtype == dns.TypeOPT || m.Extra[i-1].Header().Rrtype == dns.TypeTSIG) {
+		i--
+	}
+	m.Extra = append(m.Extra[:i:i], append(glue, m.Extra[i:]...)...)
+}
+
+// glueWriter adds the glue records the plugin knows to the responses of the next plugins, e.g. the
+// delegations of the file plugin
+type glueWriter struct {
+	dns.ResponseWriter
+	p *unifinames
+}
+
+// WriteMsg implements the dns.ResponseWriter interface
+func (w *glueWriter) WriteMsg(m *dns.Msg) error {
+	w.p.addGlue(m)
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,68 @@
+package unifinames
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlueRecords(t *testing.T) {
+	t.Run("NS Answer", func(t *testing.T) {
+		p := newTestPlugin()
+		p.Config.NSRecords = []string{"server1.lan."}
+		d := &dummyResponseWriter{}
+		_, ok := p.resolve(d, new(dns.Msg).SetQuestion("lan.", dns.TypeNS))
+		require.True(t, ok)
+		m := d.GetMsgs()[0]
+		require.Equal(t, 1, len(m.Answer))
+		require.Equal(t, 1, len(m.Extra))
+		require.Equal(t, "server1.lan.", m.Extra[0].Header().Name)
+		require.Equal(t, "127.0.0.1", m.Extra[0].(*dns.A).A.String())
+	})
+
+	t.Run("Delegation Of The Next Plugin", func(t *testing.T) {
+		p := newTestPlugin()
+		p.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Ns = []dns.RR{test.NS("sub.lan. 300 IN NS server1.lan."), test.NS("sub.lan. 300 IN NS ns.example.com.")}
+			m.SetEdns0(4096, false)
+			return dns.RcodeSuccess, w.WriteMsg(m)
+		})
+		d := &dummyResponseWriter{}
+		_, err := p.ServeDNS(context.Background(), d, new(dns.Msg).SetQuestion("host.sub.lan.", dns.TypeA))
+		require.NoError(t, err)
+		m := d.GetMsgs()[0]
+		require.Equal(t, 2, len(m.Extra))
+		require.Equal(t, "server1.lan.", m.Extra[0].Header().Name)
+		require.Equal(t, dns.TypeOPT, m.Extra[1].Header().Rrtype)
+	})
+
+	t.Run("Delegation After Resolve Timeout", func(t *testing.T) {
+		p := newTestPlugin()
+		p.haveRoutine.Store(true)
+		p.Config.ResolveTimeout = time.Millisecond
+		// the glue comes from the records of lock_free_records while a refresh holds the lock
+		p.Config.LockFreeRecords = true
+		p.indexRecords()
+		p.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Ns = []dns.RR{test.NS("sub.lan. 300 IN NS server1.lan.")}
+			return dns.RcodeSuccess, w.WriteMsg(m)
+		})
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		d := &dummyResponseWriter{}
+		_, err := p.ServeDNS(context.Background(), d, new(dns.Msg).SetQuestion("host.sub.lan.", dns.TypeA))
+		require.NoError(t, err)
+		m := d.GetMsgs()[0]
+		require.Equal(t, 1, len(m.Extra))
+		require.Equal(t, "server1.lan.", m.Extra[0].Header().Name)
+	})
+}
@@ -0,0 +1,231 @@
+package unifinames
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/doh"
+	"github.com/juju/errors"
+	"github.com/miekg/dns"
+)
+
+// httpHandler returns the handler of the endpoints that are served on http_address
+func (p *unifinames) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/unifi-names/hosts", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(p.ToHostsFormat()))
+	})
+	// the probes only read the state, unlike Ready they never refresh the clients
+	mux.HandleFunc("/unifi-names/ready", func(w http.ResponseWriter, r *http.Request) {
+		writeProbe(w, p.IsReady.Load() || p.Config.LazyLoad)
+	})
+	mux.HandleFunc("/unifi-names/health", func(w http.ResponseWriter, r *http.Request) {
+		writeProbe(w, p.Health())
+	})
+	mux.HandleFunc("/unifi-names/healthz", p.serveHealthz)
+	mux.HandleFunc("/unifi-names/status", p.serveStatus)
+	mux.HandleFunc("/unifi-names/state", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(p.stateDump()))
+	})
+	mux.HandleFunc(doh.Path, p.serveDNSQuery)
+	return mux
+}
+
+// writeProbe answers a kubernetes probe with 200 OK or 503 Service Unavailable
+func writeProbe(w http.ResponseWriter, ok bool) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write([]byte(http.StatusText(map[bool]int{true: http.StatusOK, false: http.StatusServiceUnavailable}[ok])))
+}
+
+// healthz is the state of the plugin that /unifi-names/healthz returns
+type healthz struct {
+	// Status is ok, degraded while the refreshes fail or stale once they failed for unhealthy_threshold
+	Status              string         `json:"status"`
+	LastUpdate          string         `json:"last_update,omitempty"`
+	RecordCount         map[string]int `json:"record_count"`
+	ConsecutiveFailures int            `json:"consecutive_failures"`
+	ControllerURL       string         `json:"controller_url"`
+	Stale               bool           `json:"stale"`
+}
+
+// healthz returns the healthz of the plugin and its status code, 207 Multi-Status while the refreshes fail
+// and 503 Service Unavailable once the records are stale (like /unifi-names/health)
+func (p *unifinames) healthz() (healthz, int) {
+	state := healthz{
+		Status:              "ok",
+		ConsecutiveFailures: int(p.consecutiveFailures.Load()),
+	}
+	p.mu.Lock()
+	if !p.lastUpdate.IsZero() {
+		state.LastUpdate = p.lastUpdate.UTC().Format(time.RFC3339)
+	}
+	// the PTR records are answered from the AAAA records, the wildcards have none
+	ptr := 0
+	for _, client := range p.aaaaClients {
+		if !strings.HasPrefix(client.Hdr.Name, "*.") {
+			ptr++
+		}
+	}
+	state.RecordCount = map[string]int{"A": len(p.aClients), "AAAA": len(p.aaaaClients), "PTR": ptr}
+	state.Stale = time.Since(p.lastSuccessfulUpdate) > p.unhealthyThreshold()
+	p.mu.Unlock()
+	// loadSecrets replaces the url under clientMu
+	p.clientMu.Lock()
+	state.ControllerURL = p.Config.UnifiControllerURL
+	p.clientMu.Unlock()
+
+	code := http.StatusOK
+	if state.Stale {
+		state.Status, code = "stale", http.StatusServiceUnavailable
+	} else if state.ConsecutiveFailures > 0 {
+		state.Status, code = "degraded", http.StatusMultiStatus
+	}
+	return state, code
+}
+
+// serveHealthz answers with the healthz of the plugin as json
+func (p *unifinames) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	state, code := p.healthz()
+	writeJSON(w, code, state)
+}
+
+// serveStatus answers with the healthz of the plugin if the client accepts json and with the records as
+// "<type> <name> <ip> <ttl> <network>" lines otherwise, e.g. for curl and the browsers
+func (p *unifinames) serveStatus(w http.ResponseWriter, r *http.Request) {
+	state, code := p.healthz()
+	if acceptsJSON(r) {
+		writeJSON(w, code, state)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	_, _ = w.Write([]byte(p.statusRecords()))
+}
+
+// statusRecords returns the A and AAAA records as "<type> <name> <ip> <ttl> <network>" lines
+func (p *unifinames) statusRecords() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	networks := map[string]string{}
+	for _, client := range p.clients {
+		networks[client.Hostname+" "+client.IP] = client.Network
+	}
+	var b strings.Builder
+	line := func(hdr dns.RR_Header, ip net.IP) {
+		// the wildcard records belong to the network of the name they cover
+		network := networks[strings.TrimPrefix(hdr.Name, "*.")+" "+ip.String()]
+		fmt.Fprintf(&b, "%s %s %s %d %s\n", dns.TypeToString[hdr.Rrtype], hdr.Name, ip, p.answerTTL(hdr.Ttl, 0), network)
+	}
+	for _, client := range p.aClients {
+		line(client.Hdr, client.A)
+	}
+	for _, client := range p.aaaaClients {
+		line(client.Hdr, client.AAAA)
+	}
+	return b.String()
+}
+
+// stateDump returns the internal state of the plugin as "key: value" lines for debugging, unlike
+// /unifi-names/healthz it is answered with 200 OK whatever the state is
+func (p *unifinames) stateDump() string {
+	state, _ := p.healthz()
+	p.mu.Lock()
+	skipped := p.skippedClients
+	clients := len(p.clients)
+	lastSuccessfulUpdate := ""
+	if !p.lastSuccessfulUpdate.IsZero() {
+		lastSuccessfulUpdate = p.lastSuccessfulUpdate.UTC().Format(time.RFC3339)
+	}
+	p.mu.Unlock()
+
+	var b strings.Builder
+	line := func(key string, value interface{}) {
+		fmt.Fprintf(&b, "%s: %v\n", key, value)
+	}
+	line("version", Version)
+	line("status", state.Status)
+	line("ready", p.IsReady.Load())
+	line("refresh_started", p.haveRoutine.Load())
+	line("last_update", state.LastUpdate)
+	line("last_successful_update", lastSuccessfulUpdate)
+	line("consecutive_failures", state.ConsecutiveFailures)
+	line("controller_url", state.ControllerURL)
+	for _, rrtype := range []string{"A", "AAAA", "PTR"} {
+		line("records_"+strings.ToLower(rrtype), state.RecordCount[rrtype])
+	}
+	line("clients", clients)
+	line("skipped_clients", skipped)
+	line("goroutines", runtime.NumGoroutine())
+	return b.String()
+}
+
+// acceptsJSON returns whether the Accept header of r asks for application/json
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(accept, ";")
+		if strings.EqualFold(strings.TrimSpace(mediaType), "application/json") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSON answers with v as json
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// startHTTPServer serves the endpoints on addr until the returned server is closed
+func (p *unifinames) startHTTPServer(addr string) (*http.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Annotate(err, "coredns-unifi-names: unable to listen on http address")
+	}
+	server := &http.Server{
+		Handler:           p.httpHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Errorf("unable to serve http: %v", err)
+		}
+	}()
+	return server, nil
+}
+
+// ToHostsFormat returns the A and AAAA records as "ip hostname" lines that can be pasted into a
+// block of the hosts plugin, the wildcard records are left out as the hosts plugin doesn't support them
+func (p *unifinames) ToHostsFormat() string {
+	var lines []string
+	p.mu.Lock()
+	for _, client := range p.aClients {
+		if !strings.HasPrefix(client.Hdr.Name, "*.") {
+			lines = append(lines, client.A.String()+" "+strings.TrimSuffix(client.Hdr.Name, "."))
+		}
+	}
+	for _, client := range p.aaaaClients {
+		if !strings.HasPrefix(client.Hdr.Name, "*.") {
+			lines = append(lines, client.AAAA.String()+" "+strings.TrimSuffix(client.Hdr.Name, "."))
+		}
+	}
+	p.mu.Unlock()
+
+	sort.Strings(lines)
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,251 @@
+package unifinames
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToHostsFormat(t *testing.T) {
+	p := newTestPlugin()
+	p.aaaaClients = []dns.AAAA{{
+		Hdr:  dns.RR_Header{Name: "server1.lan.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET},
+		AAAA: net.ParseIP("fd00::1"),
+	}}
+	p.aClients = append(p.aClients, dns.A{
+		Hdr: dns.RR_Header{Name: "*.server1.lan.", Rrtype: dns.TypeA, Class: dns.ClassINET},
+		A:   net.ParseIP("127.0.0.1"),
+	})
+	require.Equal(t, "127.0.0.1 server1.lan\nfd00::1 server1.lan\n", p.ToHostsFormat())
+	require.Equal(t, "", (&unifinames{Config: newTestConfig("")}).ToHostsFormat())
+
+	s := httptest.NewServer(p.httpHandler())
+	defer s.Close()
+	resp, err := http.Get(s.URL + "/unifi-names/hosts")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, p.ToHostsFormat(), string(body))
+}
+
+func TestProbes(t *testing.T) {
+	p := newTestPlugin()
+	p.Config.UnhealthyThreshold = time.Minute
+	s := httptest.NewServer(p.httpHandler())
+	defer s.Close()
+	status := func(path string) int {
+		resp, err := http.Get(s.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// a fresh plugin is alive before its first refresh, also when no query started the refreshes yet
+	require.Equal(t, http.StatusServiceUnavailable, status("/unifi-names/ready"))
+	require.Equal(t, http.StatusOK, status("/unifi-names/health"))
+	p.mu.Lock()
+	p.refreshStarted = time.Now().Add(-30 * time.Second)
+	p.mu.Unlock()
+	require.Equal(t, http.StatusOK, status("/unifi-names/health"))
+	p.mu.Lock()
+	p.refreshStarted = time.Now().Add(-2 * time.Minute)
+	p.mu.Unlock()
+	require.Equal(t, http.StatusServiceUnavailable, status("/unifi-names/health"))
+
+	p.IsReady.Store(true)
+	p.mu.Lock()
+	p.lastSuccessfulUpdate = time.Now().Add(-30 * time.Second)
+	p.mu.Unlock()
+	require.Equal(t, http.StatusOK, status("/unifi-names/ready"))
+	require.Equal(t, http.StatusOK, status("/unifi-names/health"))
+
+	p.mu.Lock()
+	p.lastSuccessfulUpdate = time.Now().Add(-2 * time.Minute)
+	p.mu.Unlock()
+	require.Equal(t, http.StatusServiceUnavailable, status("/unifi-names/health"))
+
+}
+
+func TestHealthProbeAfterStartup(t *testing.T) {
+	// the controller is gone, the first refresh fails
+	s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+	s.Close()
+	p := &unifinames{
+		Config:       newTestConfig(s.URL),
+		Next:         test.NextHandler(dns.RcodeNameError, nil),
+		refreshNow:   make(chan struct{}, 1),
+		firstRefresh: make(chan struct{}),
+		stop:         make(chan struct{}),
+	}
+	defer p.shutdown()
+	p.Config.UnhealthyThreshold = time.Minute
+	h := httptest.NewServer(p.httpHandler())
+	defer h.Close()
+	status := func() int {
+		resp, err := http.Get(h.URL + "/unifi-names/health")
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// alive while idle and while the first refreshes of the goroutine the first query started fail
+	require.Equal(t, http.StatusOK, status())
+	_, err := p.ServeDNS(context.Background(), &dummyResponseWriter{}, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+	require.NoError(t, err)
+	<-p.firstRefresh
+	require.Equal(t, http.StatusOK, status())
+
+	// not once the threshold passed without a successful refresh
+	p.mu.Lock()
+	p.refreshStarted = time.Now().Add(-2 * time.Minute)
+	p.mu.Unlock()
+	require.Equal(t, http.StatusServiceUnavailable, status())
+}
+
+func TestHealthz(t *testing.T) {
+	p := newTestPlugin()
+	p.Config.UnifiControllerURL = "https://unifi:8443"
+	p.Config.UnhealthyThreshold = time.Minute
+	p.lastUpdate = time.Time{}
+	p.aaaaClients = []dns.AAAA{
+		{Hdr: dns.RR_Header{Name: "server1.lan.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET}, AAAA: net.ParseIP("fd00::1")},
+		{Hdr: dns.RR_Header{Name: "*.server1.lan.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET}, AAAA: net.ParseIP("fd00::1")},
+	}
+	s := httptest.NewServer(p.httpHandler())
+	defer s.Close()
+	get := func() (int, healthz) {
+		resp, err := http.Get(s.URL + "/unifi-names/healthz")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		var state healthz
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&state))
+		return resp.StatusCode, state
+	}
+
+	code, state := get()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, healthz{
+		Status:        "stale",
+		RecordCount:   map[string]int{"A": 1, "AAAA": 2, "PTR": 1},
+		ControllerURL: "https://unifi:8443",
+		Stale:         true,
+	}, state)
+
+	updated := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	p.mu.Lock()
+	p.lastUpdate = updated
+	p.lastSuccessfulUpdate = time.Now()
+	p.mu.Unlock()
+	code, state = get()
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ok", state.Status)
+	require.Equal(t, "2024-01-01T12:00:00Z", state.LastUpdate)
+	require.False(t, state.Stale)
+
+	p.consecutiveFailures.Store(2)
+	code, state = get()
+	require.Equal(t, http.StatusMultiStatus, code)
+	require.Equal(t, "degraded", state.Status)
+	require.Equal(t, 2, state.ConsecutiveFailures)
+}
+
+func TestStatus(t *testing.T) {
+	p := newTestPlugin()
+	p.lastSuccessfulUpdate = time.Now()
+	p.aClients = append(p.aClients, dns.A{
+		Hdr: dns.RR_Header{Name: "*.server1.lan.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("127.0.0.1"),
+	})
+	p.aaaaClients = []dns.AAAA{{
+		Hdr:  dns.RR_Header{Name: "server1.lan.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET},
+		AAAA: net.ParseIP("fd00::1"),
+	}}
+	p.clients = []ClientInfo{
+		{Hostname: "server1.lan.", IP: "127.0.0.1", Network: "lan"},
+		{Hostname: "server1.lan.", IP: "fd00::1", Network: "lan"},
+	}
+	s := httptest.NewServer(p.httpHandler())
+	defer s.Close()
+	get := func(accept string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, s.URL+"/unifi-names/status", nil)
+		require.NoError(t, err)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	for _, accept := range []string{"", "text/plain", "text/html,*/*;q=0.8"} {
+		resp, body := get(accept)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+		require.Equal(t, "A server1.lan. 127.0.0.1 3600 lan\nA *.server1.lan. 127.0.0.1 60 lan\nAAAA server1.lan. fd00::1 3600 lan\n", body)
+	}
+
+	resp, body := get("text/html, application/json;q=0.9")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	var state healthz
+	require.NoError(t, json.Unmarshal([]byte(body), &state))
+	require.Equal(t, "ok", state.Status)
+	require.Equal(t, map[string]int{"A": 2, "AAAA": 1, "PTR": 1}, state.RecordCount)
+}
+
+func TestState(t *testing.T) {
+	p := newTestPlugin()
+	p.lastUpdate = time.Time{}
+	p.consecutiveFailures.Store(3)
+	s := httptest.NewServer(p.httpHandler())
+	defer s.Close()
+	resp, err := http.Get(s.URL + "/unifi-names/state")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	// the state is answered while the records are stale too
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	require.Contains(t, string(body), "status: stale\n")
+	require.Contains(t, string(body), "last_update: \n")
+	require.Contains(t, string(body), "consecutive_failures: 3\n")
+	require.Contains(t, string(body), "records_a: 1\n")
+	require.Contains(t, string(body), "ready: false\n")
+	require.Regexp(t, `goroutines: \d+\n`, string(body))
+}
+
+func TestReadyProbeWithoutReadyPlugin(t *testing.T) {
+	controller := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+	defer controller.Close()
+	p := unifinames{Config: newTestConfig(controller.URL), Next: test.NextHandler(dns.RcodeNameError, nil)}
+	p.Config.RequireInitialData = true
+	s := httptest.NewServer(p.httpHandler())
+	defer s.Close()
+	ready := func() int {
+		resp, err := http.Get(s.URL + "/unifi-names/ready")
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusServiceUnavailable, ready())
+
+	// without the ready plugin only the refresh goroutine of the first query fetches the clients
+	_, _ = p.ServeDNS(context.Background(), &dummyResponseWriter{}, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+	require.Eventually(t, func() bool { return ready() == http.StatusOK }, 5*time.Second, 10*time.Millisecond)
+}
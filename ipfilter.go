@@ -0,0 +1,88 @@
+package unifinames
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"slices"
+	"strings"
+)
+
+// parseIPFilter parses the subnets and the ranges of ip_filter into the subnets that cover them, e.g.
+// 192.168.1.10-192.168.1.13 becomes 192.168.1.10/31 and 192.168.1.12/31
+func (c *config) parseIPFilter() error {
+	c.ipFilter = nil
+	for _, value := range c.IPFilter {
+		if from, to, ok := strings.Cut(value, "-"); ok {
+			subnets, err := rangeSubnets(net.ParseIP(strings.TrimSpace(from)), net.ParseIP(strings.TrimSpace(to)))
+			if err != nil {
+				return fmt.Errorf("Invalid ip_filter value: '%s'", value)
+			}
+			c.ipFilter = append(c.ipFilter, subnets...)
+			continue
+		}
+		if ip := net.ParseIP(value); ip != nil {
+			bits := 8 * len(ipBytes(ip))
+			c.ipFilter = append(c.ipFilter, &net.IPNet{IP: ipBytes(ip), Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(value)
+		if err != nil {
+			return fmt.Errorf("Invalid ip_filter value: '%s'", value)
+		}
+		c.ipFilter = append(c.ipFilter, subnet)
+	}
+	return nil
+}
+
+// ipFiltered returns whether ip_filter drops the clients with ip, ip_filter_mode include keeps the ips in
+// the subnets and exclude drops them
+func (c *config) ipFiltered(ip net.IP) bool {
+	if len(c.ipFilter) == 0 {
+		return false
+	}
+	matched := slices.ContainsFunc(c.ipFilter, func(subnet *net.IPNet) bool { return subnet.Contains(ip) })
+	if c.IPFilterMode == "exclude" {
+		return matched
+	}
+	return !matched
+}
+
+// ipBytes returns the 4 bytes of an ipv4 address and the 16 bytes of an ipv6 address
+func ipBytes(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+// rangeSubnets returns the fewest subnets that cover the addresses from to to
+func rangeSubnets(from, to net.IP) ([]*net.IPNet, error) {
+	if from == nil || to == nil || (from.To4() == nil) != (to.To4() == nil) {
+		return nil, fmt.Errorf("invalid range")
+	}
+	from, to = ipBytes(from), ipBytes(to)
+	bits := 8 * len(from)
+	start, end := new(big.Int).SetBytes(from), new(big.Int).SetBytes(to)
+	if start.Cmp(end) > 0 {
+		return nil, fmt.Errorf("invalid range")
+	}
+
+	var subnets []*net.IPNet
+	one := big.NewInt(1)
+	for start.Cmp(end) <= 0 {
+		// the largest block that starts at start and doesn't go past end
+		size := int(start.TrailingZeroBits())
+		if start.Sign() == 0 {
+			size = bits
+		}
+		for size > 0 && new(big.Int).Add(start, new(big.Int).Sub(new(big.Int).Lsh(one, uint(size)), one)).Cmp(end) > 0 {
+			size--
+		}
+		ip := make(net.IP, len(from))
+		start.FillBytes(ip)
+		subnets = append(subnets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits-size, bits)})
+		start.Add(start, new(big.Int).Lsh(one, uint(size)))
+	}
+	return subnets, nil
+}
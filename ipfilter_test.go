@@ -0,0 +1,80 @@
+package unifinames
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeSubnets(t *testing.T) {
+	subnets := func(from, to string) []string {
+		ranges, err := rangeSubnets(net.ParseIP(from), net.ParseIP(to))
+		require.NoError(t, err)
+		var s []string
+		for _, subnet := range ranges {
+			s = append(s, subnet.String())
+		}
+		return s
+	}
+	require.Equal(t, []string{"192.168.1.10/31", "192.168.1.12/31"}, subnets("192.168.1.10", "192.168.1.13"))
+	require.Equal(t, []string{"192.168.1.0/24"}, subnets("192.168.1.0", "192.168.1.255"))
+	require.Equal(t, []string{"192.168.1.5/32"}, subnets("192.168.1.5", "192.168.1.5"))
+	require.Equal(t, []string{"0.0.0.0/0"}, subnets("0.0.0.0", "255.255.255.255"))
+	require.Equal(t, []string{"fd00::1/128", "fd00::2/127"}, subnets("fd00::1", "fd00::3"))
+
+	for _, r := range [][2]string{{"192.168.1.13", "192.168.1.10"}, {"192.168.1.1", "fd00::1"}, {"x", "192.168.1.1"}} {
+		_, err := rangeSubnets(net.ParseIP(r[0]), net.ParseIP(r[1]))
+		require.Error(t, err, r)
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	s := MockUnifiControllerWithClients(nil,
+		map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.10", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "phone", "ip": "192.168.1.150", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:03", "hostname": "nas", "ip": "192.168.5.3", "network": "lan"},
+	)
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.Config.IPFilter = []string{"192.168.1.10-192.168.1.99", "192.168.5.3"}
+	require.NoError(t, p.Config.parseIPFilter())
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, 2, len(p.aClients))
+	require.Equal(t, "server1.lan.", p.aClients[0].Hdr.Name)
+	require.Equal(t, "nas.lan.", p.aClients[1].Hdr.Name)
+
+	p.Config.IPFilterMode = "exclude"
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, 1, len(p.aClients))
+	require.Equal(t, "phone.lan.", p.aClients[0].Hdr.Name)
+
+	for _, value := range []string{"192.168.1.0/33", "192.168.1.99-192.168.1.10", "lan"} {
+		p.Config.IPFilter = []string{value}
+		require.Error(t, p.Config.parseIPFilter(), value)
+	}
+}
+
+func TestIPFilterConfig(t *testing.T) {
+	parse := func(directives string) (*config, error) {
+		return newConfigFromDispenser(caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN lan
+				Unifi https://localhost:8443/ default admin test
+				`+directives+`
+			}
+		`))))
+	}
+	config, err := parse("ip_filter 192.168.1.0/24 10.0.0.2-10.0.0.3\nip_filter_mode Exclude")
+	require.NoError(t, err)
+	require.Equal(t, "exclude", config.IPFilterMode)
+	require.Len(t, config.ipFilter, 2)
+
+	for _, directives := range []string{"ip_filter_mode both", "ip_filter 10.0.0.2-10.0.0.1"} {
+		_, err := parse(directives)
+		require.Error(t, err, directives)
+	}
+}
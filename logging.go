@@ -0,0 +1,93 @@
+package unifinames
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// logger is the part of clog.P the plugin logs with, log_format json replaces it with a jsonLogger
+type logger interface {
+	Debugf(format string, v ...interface{})
+	Info(v ...interface{})
+	Infof(format string, v ...interface{})
+	Warning(v ...interface{})
+	Warningf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// log is the logger of the plugin, setup swaps the logger it writes to while the goroutines of the
+// running instances keep logging
+var log = &swappableLogger{}
+
+// swappableLogger passes the entries to the logger of the last setLogFormat, clog until it is called
+type swappableLogger struct {
+	current atomic.Pointer[logger]
+}
+
+func (l *swappableLogger) get() logger {
+	if current := l.current.Load(); current != nil {
+		return *current
+	}
+	return clog.NewWithPlugin("unifi-names")
+}
+
+func (l *swappableLogger) Debugf(format string, v ...interface{}) { l.get().Debugf(format, v...) }
+
+func (l *swappableLogger) Info(v ...interface{}) { l.get().Info(v...) }
+
+func (l *swappableLogger) Infof(format string, v ...interface{}) { l.get().Infof(format, v...) }
+
+func (l *swappableLogger) Warning(v ...interface{}) { l.get().Warning(v...) }
+
+func (l *swappableLogger) Warningf(format string, v ...interface{}) { l.get().Warningf(format, v...) }
+
+func (l *swappableLogger) Errorf(format string, v ...interface{}) { l.get().Errorf(format, v...) }
+
+// jsonLogger writes the log entries as json objects with the time, level, plugin, message and fields keys
+type jsonLogger struct {
+	sugar *zap.SugaredLogger
+}
+
+// newJSONLogger returns a jsonLogger writing to w
+func newJSONLogger(w io.Writer) *jsonLogger {
+	encoderConfig := zapcore.EncoderConfig{
+		TimeKey:     "time",
+		LevelKey:    "level",
+		MessageKey:  "message",
+		EncodeTime:  zapcore.RFC3339NanoTimeEncoder,
+		EncodeLevel: zapcore.LowercaseLevelEncoder,
+	}
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), zapcore.AddSync(w), zapcore.DebugLevel)
+	return &jsonLogger{sugar: zap.New(core).With(zap.String("plugin", "unifi-names"), zap.Namespace("fields")).Sugar()}
+}
+
+// setLogFormat switches the logger of the plugin to format, the logger is shared by all server blocks
+func setLogFormat(format string) {
+	var next logger = clog.NewWithPlugin("unifi-names")
+	if format == "json" {
+		next = newJSONLogger(os.Stdout)
+	}
+	log.current.Store(&next)
+}
+
+// Debugf only logs with the debug plugin enabled like clog
+func (l *jsonLogger) Debugf(format string, v ...interface{}) {
+	if clog.D.Value() {
+		l.sugar.Debugf(format, v...)
+	}
+}
+
+func (l *jsonLogger) Info(v ...interface{}) { l.sugar.Info(v...) }
+
+func (l *jsonLogger) Infof(format string, v ...interface{}) { l.sugar.Infof(format, v...) }
+
+func (l *jsonLogger) Warning(v ...interface{}) { l.sugar.Warn(v...) }
+
+func (l *jsonLogger) Warningf(format string, v ...interface{}) { l.sugar.Warnf(format, v...) }
+
+func (l *jsonLogger) Errorf(format string, v ...interface{}) { l.sugar.Errorf(format, v...) }
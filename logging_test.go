@@ -0,0 +1,54 @@
+package unifinames
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := newJSONLogger(&buf)
+	l.Infof("got %d hosts", 3)
+	l.Warning("no clients")
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(lines[0], &entry))
+	require.Equal(t, "info", entry["level"])
+	require.Equal(t, "unifi-names", entry["plugin"])
+	require.Equal(t, "got 3 hosts", entry["message"])
+	require.Equal(t, map[string]interface{}{}, entry["fields"])
+	require.NotEmpty(t, entry["time"])
+	require.NoError(t, json.Unmarshal(lines[1], &entry))
+	require.Equal(t, "warn", entry["level"])
+}
+
+func TestSetLogFormat(t *testing.T) {
+	defer setLogFormat("text")
+	// setup of a reload switches the logger while the old instance is logging
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			setLogFormat("json")
+			setLogFormat("text")
+		}()
+		go func() {
+			defer wg.Done()
+			log.Debugf("got %d hosts", 3)
+		}()
+	}
+	wg.Wait()
+
+	setLogFormat("json")
+	require.IsType(t, &jsonLogger{}, log.get())
+	setLogFormat("text")
+	require.IsType(t, clog.NewWithPlugin("unifi-names"), log.get())
+}
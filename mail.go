@@ -0,0 +1,102 @@
+package unifinames
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// MailRecords are the static TXT records of mail_records for a domain of the plugin, e.g. for a mail
+// server in the home lab
+type MailRecords struct {
+	// SPF is the TXT record of the domain, e.g. "v=spf1 mx -all"
+	SPF string `yaml:"spf"`
+	// DMARC is the TXT record of _dmarc.<domain>, e.g. "v=DMARC1; p=reject"
+	DMARC string `yaml:"dmarc"`
+	// DKIM maps the selectors to the TXT records of <selector>._domainkey.<domain>
+	DKIM map[string]string `yaml:"dkim"`
+}
+
+// setMailRecord sets a record of the mail_records directive, e.g. the arguments spf "v=spf1 mx -all" or
+// dkim mail "v=DKIM1; k=rsa; p=..."
+func (c *config) setMailRecord(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("Invalid mail_records value: '%s'", strings.Join(args, " "))
+	}
+	domain := dns.Fqdn(strings.ToLower(strings.Trim(args[0], ".")))
+	records := c.MailRecords[domain]
+	switch kind := strings.ToLower(args[1]); {
+	case kind == "spf" && len(args) == 3:
+		records.SPF = args[2]
+	case kind == "dmarc" && len(args) == 3:
+		records.DMARC = args[2]
+	case kind == "dkim" && len(args) == 4:
+		if records.DKIM == nil {
+			records.DKIM = map[string]string{}
+		}
+		records.DKIM[strings.ToLower(args[2])] = args[3]
+	default:
+		return fmt.Errorf("Invalid mail_records value: '%s'", strings.Join(args, " "))
+	}
+	if c.MailRecords == nil {
+		c.MailRecords = map[string]MailRecords{}
+	}
+	c.MailRecords[domain] = records
+	return nil
+}
+
+// mailTXTRecords builds the static TXT records of mail_records by their lowercased name, the domains have
+// to be handled by the plugin
+func (c *config) mailTXTRecords() (map[string]dns.TXT, error) {
+	staticTXT := map[string]dns.TXT{}
+	add := func(name, value string) error {
+		if _, ok := dns.IsDomainName(name); !ok {
+			return fmt.Errorf("'%s' is not a valid mail record name", name)
+		}
+		staticTXT[name] = dns.TXT{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: c.TTL},
+			Txt: splitTXT(value),
+		}
+		return nil
+	}
+	for domain, records := range c.MailRecords {
+		handled := false
+		for _, networkDomain := range c.domains() {
+			if dns.IsSubDomain(networkDomain, domain) {
+				handled = true
+				break
+			}
+		}
+		if !handled {
+			return nil, fmt.Errorf("Mail records for the unknown domain '%s'", domain)
+		}
+		if records.SPF != "" {
+			if err := add(domain, records.SPF); err != nil {
+				return nil, err
+			}
+		}
+		if records.DMARC != "" {
+			if err := add("_dmarc."+domain, records.DMARC); err != nil {
+				return nil, err
+			}
+		}
+		for selector, key := range records.DKIM {
+			if err := add(selector+"._domainkey."+domain, key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return staticTXT, nil
+}
+
+// splitTXT splits value into the strings of at most 255 octets a TXT record is made of, e.g. for the
+// 2048 bit DKIM keys
+func splitTXT(value string) []string {
+	var txt []string
+	for len(value) > 255 {
+		txt = append(txt, value[:255])
+		value = value[255:]
+	}
+	return append(txt, value)
+}
@@ -0,0 +1,52 @@
+package unifinames
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMailRecords(t *testing.T) {
+	parse := func(directives string) (*config, error) {
+		return newConfigFromDispenser(caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN home.arpa
+				Unifi https://localhost:8443/ default admin test
+				`+directives+`
+			}
+		`))))
+	}
+	key := "v=DKIM1; k=rsa; p=" + strings.Repeat("A", 300)
+	config, err := parse(`mail_records Home.arpa spf "v=spf1 mx -all"
+		mail_records home.arpa dmarc "v=DMARC1; p=reject"
+		mail_records home.arpa dkim Mail "` + key + `"`)
+	require.NoError(t, err)
+	p := &unifinames{Config: config}
+	txt := func(name string) []string {
+		rrs := p.lookup(new(dns.Msg).SetQuestion(name, dns.TypeTXT))
+		if len(rrs) == 0 {
+			return nil
+		}
+		require.Equal(t, name, rrs[0].Header().Name)
+		return rrs[0].(*dns.TXT).Txt
+	}
+	require.Equal(t, []string{"v=spf1 mx -all"}, txt("home.arpa."))
+	require.Equal(t, []string{"v=DMARC1; p=reject"}, txt("_DMARC.home.arpa."))
+	require.Equal(t, []string{key[:255], key[255:]}, txt("mail._domainkey.home.arpa."))
+	require.Nil(t, txt("other._domainkey.home.arpa."))
+	require.True(t, p.nameExists("_dmarc.home.arpa."))
+
+	for _, directives := range []string{
+		`mail_records example.com spf "v=spf1 mx -all"`,
+		`mail_records home.arpa spf`,
+		`mail_records home.arpa dkim "v=DKIM1"`,
+		`mail_records home.arpa mx mail.home.arpa`,
+	} {
+		_, err := parse(directives)
+		require.Error(t, err, directives)
+	}
+}
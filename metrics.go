@@ -1,25 +1,301 @@
 package unifinames
 
 import (
-	"github.com/coredns/coredns/plugin"
+	"maps"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/miekg/dns"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-// requestCount exports a prometheus metric that is incremented every time a query is seen by the example plugin.
 var (
-	UnifinamesCount = promauto.NewCounter(prometheus.CounterOpts{
-		Namespace: plugin.Namespace,
+	// UnifinamesRequestsTotal counts the queries the plugin resolved by result: hit when it had a record,
+	// miss when the name is in a handled domain but has none and passthrough when the domain isn't handled
+	UnifinamesRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_requests_total",
+		Help:      "Counter of Requests Resolved by the Plugin by Result",
+	}, []string{"result"})
+
+	UnifinamesQueryTypeTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_query_type_total",
+		Help:      "Counter of Questions Seen by the Plugin by Query Type",
+	}, []string{"qtype"})
+
+	UnifinamesAnsweredCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_answered_total",
+		Help:      "Counter of Requests Answered by the Plugin",
+	})
+
+	UnifinamesPassthroughCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_passthrough_total",
+		Help:      "Counter of Requests Passed to the Next Plugin",
+	})
+
+	UnifinamesNoSuchDomainCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_no_such_domain_total",
+		Help:      "Counter of Requests for the Mapped Domains without a Matching Record that were Passed on or Answered with NXDOMAIN",
+	})
+
+	UnifinamesRateLimitedCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_rate_limited_total",
+		Help:      "Counter of Requests above the Rate Limit",
+	})
+
+	UnifinamesReauthCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_reauth_total",
+		Help:      "Counter of Logins after the Controller Session Expired",
+	})
+
+	UnifinamesIPConflictCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_ip_conflicts_total",
+		Help:      "Counter of IPs Shared by Clients with Different MACs",
+	})
+
+	UnifinamesWorkerTimeoutCount = prometheus.NewCounter(prometheus.CounterOpts{
 		Subsystem: "unifinames",
-		Name:      "unifinames_request_count_total",
-		Help:      "Counter of Requests Answered from Unifi Discovered Names",
+		Name:      "unifinames_worker_timeouts_total",
+		Help:      "Counter of Requests Passed on without a Free Worker",
 	})
 
-	UnifinamesHostsCount = promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: plugin.Namespace,
+	UnifinamesConnectRetryCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_connect_retry_total",
+		Help:      "Counter of Retries of the Controller After It Couldn't Be Reached",
+	})
+
+	UnifinamesDeferredUpdatesCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_deferred_updates_total",
+		Help:      "Counter of Refreshes Whose Changes Were Deferred by the Batch Update Threshold",
+	})
+
+	UnifinamesIPChangesCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_ip_changes_total",
+		Help:      "Counter of Hostnames Whose IPs Changed Between Two Refreshes",
+	})
+
+	UnifinamesResolveTimeoutCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_resolve_timeout_total",
+		Help:      "Counter of Requests Passed on after the Resolve Timeout",
+	})
+
+	UnifinamesRefreshChangesCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_refresh_changes_total",
+		Help:      "Counter of Refreshes that Changed the Records",
+	})
+
+	UnifinamesServfailCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_servfail_total",
+		Help:      "Counter of Requests Answered with SERVFAIL because the Records were older than max_stale_age",
+	})
+
+	UnifinamesHostsCount = prometheus.NewGauge(prometheus.GaugeOpts{
 		Subsystem: "unifinames",
 		Name:      "unifinames_host_count",
 		Help:      "Number of Hosts Discovered from Unifi",
 	})
+
+	UnifinamesRecordsTruncated = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_records_truncated",
+		Help:      "Number of Clients Dropped by the Last Refresh because of max_records",
+	})
+
+	UnifinamesTimeoutCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_timeout_total",
+		Help:      "Counter of Unifi Requests that Timed Out",
+	})
+
+	UnifinamesRefreshStuckCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_refresh_stuck_total",
+		Help:      "Counter of Refreshes that were Given Up after max_refresh_duration",
+	})
+
+	UnifinamesConsecutiveFailures = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_consecutive_failures",
+		Help:      "Number of Unifi Refreshes that Failed in a Row",
+	})
+
+	// UnifinamesCircuitState is the state of circuit_breaker: 0 closed, 1 open and 2 half-open
+	UnifinamesCircuitState = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_circuit_state",
+		Help:      "State of the Circuit Breaker of the Controller Requests",
+	})
+
+	UnifinamesLastSuccessfulUpdate = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_last_successful_update_timestamp_seconds",
+		Help:      "Unix Timestamp of the Last Successful Refresh from Unifi",
+	})
+
+	UnifinamesCollisionsCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_hostname_collisions_total",
+		Help:      "Counter of Clients that got the same Hostname as another Client",
+	})
+
+	UnifinamesNamesTruncatedCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_names_truncated_total",
+		Help:      "Counter of Hostnames that were Truncated to hostname_max_length",
+	})
+
+	UnifinamesGoroutines = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_goroutines",
+		Help:      "Number of Running Goroutines Started by the Plugin",
+	}, []string{"routine"})
+
+	UnifinamesNetworkHostsCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_network_host_count",
+		Help:      "Number of Hosts Discovered from Unifi per Network",
+	}, []string{"network", "domain"})
+
+	UnifinamesSiteHostsCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_site_host_count",
+		Help:      "Number of Hosts Discovered from Unifi per Site",
+	}, []string{"site"})
+
+	// UnifinamesSiteQueryCount counts the answered queries by the site of the client the answer is for,
+	// the result is always hit as the names without a record belong to no site
+	UnifinamesSiteQueryCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_site_query_total",
+		Help:      "Counter of Answered Queries per Site",
+	}, []string{"site", "result"})
+
+	UnifinamesClientLastSeen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_client_last_seen_seconds",
+		Help:      "Unix Timestamp of when Unifi Last Saw the Client",
+	}, []string{"hostname", "network", "ip"})
+
+	UnifinamesClientsSkippedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_clients_skipped_total",
+		Help:      "Counter of Clients that got no Record by Reason",
+	}, []string{"reason"})
+
+	UnifinamesClientsFilteredByAgeCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_clients_filtered_by_age_total",
+		Help:      "Counter of Clients that got no Record because they weren't Seen within online_within",
+	})
+
+	UnifinamesClientQueryCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "unifinames",
+		Name:      "unifinames_client_query_total",
+		Help:      "Counter of Answered Queries per Client",
+	}, []string{"hostname", "network"})
 )
+
+// collectors are all metrics of the plugin, they are registered by registerMetrics
+var collectors = []prometheus.Collector{
+	UnifinamesRequestsTotal,
+	UnifinamesQueryTypeTotal,
+	UnifinamesAnsweredCount,
+	UnifinamesPassthroughCount,
+	UnifinamesNoSuchDomainCount,
+	UnifinamesRateLimitedCount,
+	UnifinamesWorkerTimeoutCount,
+	UnifinamesResolveTimeoutCount,
+	UnifinamesConnectRetryCount,
+	UnifinamesDeferredUpdatesCount,
+	UnifinamesIPChangesCount,
+	UnifinamesReauthCount,
+	UnifinamesIPConflictCount,
+	UnifinamesRefreshChangesCount,
+	UnifinamesServfailCount,
+	UnifinamesHostsCount,
+	UnifinamesRecordsTruncated,
+	UnifinamesTimeoutCount,
+	UnifinamesRefreshStuckCount,
+	UnifinamesConsecutiveFailures,
+	UnifinamesCircuitState,
+	UnifinamesLastSuccessfulUpdate,
+	UnifinamesCollisionsCount,
+	UnifinamesNamesTruncatedCount,
+	UnifinamesGoroutines,
+	UnifinamesNetworkHostsCount,
+	UnifinamesSiteHostsCount,
+	UnifinamesSiteQueryCount,
+	UnifinamesClientLastSeen,
+	UnifinamesClientQueryCount,
+	UnifinamesClientsSkippedCount,
+	UnifinamesClientsFilteredByAgeCount,
+}
+
+var (
+	metricsMu sync.Mutex
+	// metricsRegisterer is the registerer the collectors are registered with, nil until setup ran
+	metricsRegisterer prometheus.Registerer
+	metricsNamespace  string
+	metricsLabels     map[string]string
+)
+
+// registerMetrics registers the collectors with the default registry, the names of all metrics start with
+// namespace and labels are added to all of them. The metrics are shared by all instances of the plugin, so
+// the namespace and the labels of the last setup win. The registry doesn't allow the label names of a
+// metric to change, only their values can change on a reload
+func registerMetrics(namespace string, labels map[string]string) error {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if metricsRegisterer != nil {
+		if namespace == metricsNamespace && maps.Equal(labels, metricsLabels) {
+			return nil
+		}
+		for _, collector := range collectors {
+			metricsRegisterer.Unregister(collector)
+		}
+	}
+
+	registerer := prometheus.WrapRegistererWithPrefix(namespace+"_", prometheus.WrapRegistererWith(labels, prometheus.DefaultRegisterer))
+	for i, collector := range collectors {
+		if err := registerer.Register(collector); err != nil {
+			for _, registered := range collectors[:i] {
+				registerer.Unregister(registered)
+			}
+			// keep serving the metrics with the previous labels
+			if metricsRegisterer != nil {
+				for _, collector := range collectors {
+					_ = metricsRegisterer.Register(collector)
+				}
+			}
+			return errors.Annotate(err, "coredns-unifi-names: unable to register metrics, the names of the prometheus_labels can only change with a restart")
+		}
+	}
+	metricsRegisterer = registerer
+	metricsNamespace = namespace
+	metricsLabels = labels
+	return nil
+}
+
+// queryType returns the qtype label of a question, the types other than A, AAAA and PTR are counted as
+// OTHER so the cardinality stays fixed
+func queryType(qtype uint16) string {
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypePTR:
+		return dns.TypeToString[qtype]
+	}
+	return "OTHER"
+}
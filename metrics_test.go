@@ -0,0 +1,65 @@
+package unifinames
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+// hostCountLabels returns the labels of the host count metric in the default registry
+func hostCountLabels(t *testing.T) map[string]string {
+	return namespaceHostCountLabels(t, "coredns")
+}
+
+// namespaceHostCountLabels returns the labels of the host count metric of namespace in the default
+// registry, nil when it isn't registered
+func namespaceHostCountLabels(t *testing.T, namespace string) map[string]string {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != namespace+"_unifinames_unifinames_host_count" {
+			continue
+		}
+		labels := map[string]string{}
+		for _, label := range family.GetMetric()[0].GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		return labels
+	}
+	return nil
+}
+
+func TestRegisterMetrics(t *testing.T) {
+	require.NoError(t, registerMetrics("coredns", map[string]string{"datacenter": "us-east-1", "env": "prod"}))
+	require.Equal(t, map[string]string{"datacenter": "us-east-1", "env": "prod"}, hostCountLabels(t))
+	// registering the same labels again is a no-op
+	require.NoError(t, registerMetrics("coredns", map[string]string{"datacenter": "us-east-1", "env": "prod"}))
+
+	require.NoError(t, registerMetrics("coredns", map[string]string{"datacenter": "eu-west-1", "env": "prod"}))
+	require.Equal(t, map[string]string{"datacenter": "eu-west-1", "env": "prod"}, hostCountLabels(t))
+
+	// the registry keeps the label names of a metric for the lifetime of the process
+	require.Error(t, registerMetrics("coredns", map[string]string{"env": "prod"}))
+	require.Equal(t, map[string]string{"datacenter": "eu-west-1", "env": "prod"}, hostCountLabels(t))
+	require.NoError(t, registerMetrics("coredns", map[string]string{"datacenter": "us-east-1", "env": "prod"}))
+}
+
+func TestRegisterMetricsNamespace(t *testing.T) {
+	labels := map[string]string{"datacenter": "us-east-1", "env": "prod"}
+	require.NoError(t, registerMetrics("coredns_home", labels))
+	require.Equal(t, labels, namespaceHostCountLabels(t, "coredns_home"))
+	require.Nil(t, namespaceHostCountLabels(t, "coredns"))
+
+	require.NoError(t, registerMetrics("coredns", labels))
+	require.Equal(t, labels, hostCountLabels(t))
+	require.Nil(t, namespaceHostCountLabels(t, "coredns_home"))
+}
+
+func TestValidatePrometheusLabels(t *testing.T) {
+	require.NoError(t, validatePrometheusLabels(nil))
+	require.NoError(t, validatePrometheusLabels(map[string]string{"env": "prod"}))
+	for _, name := range []string{"1env", "env-name", "__name", "network", "routine"} {
+		require.Error(t, validatePrometheusLabels(map[string]string{name: "x"}), name)
+	}
+}
@@ -2,243 +2,2124 @@ package unifinames
 
 import (
 	"context"
+	"crypto/rand"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"math/big"
 
-	"log"
 	"net"
+	"net/http"
+	"os/exec"
+	"reflect"
 	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 
 	"strings"
 
 	"time"
 
 	"sync"
+	"sync/atomic"
 
-	dns_val "github.com/THREATINT/go-net"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
 	"github.com/juju/errors"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/unpoller/unifi"
-	"go.uber.org/atomic"
+	"golang.org/x/time/rate"
 )
 
+// Version is the version of the plugin, it is set with -ldflags "-X ...unifinames.Version=v1.2.3"
+var Version = "dev"
+
+// versionName is the CHAOS TXT name that is answered with the version and the state of the plugin
+const versionName = "unifi-names.version."
+
 type unifinames struct {
 	Next        plugin.Handler
 	Config      *config
 	aClients    []dns.A
 	aaaaClients []dns.AAAA
-	lastUpdate  time.Time
-	IsReady     bool
+	// hinfoClients maps the lowercased names to the HINFO records of the clients, it is only filled when
+	// serve_hinfo is set
+	hinfoClients map[string]dns.HINFO
+	// naptrClients maps the lowercased names to the NAPTR records of naptr_services
+	naptrClients map[string][]dns.NAPTR
+	// switchPortClients maps the lowercased names to the TXT records with the switch port of the wired
+	// clients, it is only filled when include_switch_ports is set
+	switchPortClients map[string]dns.TXT
+	// metadataClients maps the lowercased names to the TXT records with the vendor of the clients, it is
+	// only filled when include_txt_metadata is set
+	metadataClients map[string]dns.TXT
+	// srvClients are the SRV records of the clients that announce a service, only filled when
+	// synthesize_srv is set
+	srvClients []dns.SRV
+	lastUpdate time.Time
+	// lastSuccessfulUpdate is when the clients were last fetched from the controller, unlike lastUpdate
+	// it isn't set by loading the cache file
+	lastSuccessfulUpdate time.Time
+	// refreshStarted is when the refresh goroutine was started by the first query, the health is measured
+	// from it until the first refresh succeeds
+	refreshStarted time.Time
+	// IsReady is set once the first refresh was tried, by Ready or by the refresh goroutine of the first
+	// query. With require_initial_data only a successful refresh sets it
+	IsReady     atomic.Bool
 	mu          sync.Mutex
 	haveRoutine atomic.Bool
+	// uniClient is the controller session that is reused across the refreshes, it is guarded by clientMu
+	uniClient *unifi.Unifi
+	clientMu  sync.Mutex
+	// consecutiveFailures counts the refreshes that failed since the last successful one
+	consecutiveFailures atomic.Int32
+	// debugRecords are the records of the last refresh as they were written to the debug_file
+	debugRecords []debugRecord
+	// recordsHash is the clientsHash of the records in memory, it is guarded by mu
+	recordsHash uint64
+	// deferredSince is when the first refresh of batch_update_threshold was deferred, zero when none is
+	// deferred. It is guarded by mu
+	deferredSince time.Time
+	// recordIndex is the copy of the A and AAAA records that the queries read without mu for
+	// lock_free_records, nil without it
+	recordIndex atomic.Pointer[recordIndex]
+	// hostSites maps the lowercased names of the records to the sites of their clients for the site
+	// metrics, it is swapped on each refresh so the queries read it without mu
+	hostSites atomic.Pointer[map[string]string]
+	// recordWeights maps the recordWeightKey of the records to the weight of their network, only the
+	// networks with a weight are in it and it is nil without any. It is swapped like hostSites
+	recordWeights atomic.Pointer[map[string]int]
+	// clients are the clients the records of the last refresh were built from, they are guarded by mu
+	clients []ClientInfo
+	// skippedClients is how many clients of the last refresh got no record because of their name, ip or
+	// network, it is guarded by mu
+	skippedClients int
+	// OnClientsChanged is called in its own goroutine with the clients that were added and removed after
+	// each refresh that changed the records, it can only be set when embedding the plugin
+	OnClientsChanged func(added, removed []ClientInfo)
+	// lastTrustedMACs is the mapping of the last readable trusted_macs file, it is guarded by mu
+	lastTrustedMACs map[string]string
+	// clientQueryLabels are the hostname and network labels of UnifinamesClientQueryCount that were
+	// added, it is guarded by mu
+	clientQueryLabels map[[2]string]bool
+	// firstRefresh is closed once the refresh goroutine refreshed the clients for the first time, the
+	// first queries of lazy_load wait for it
+	firstRefresh     chan struct{}
+	firstRefreshOnce sync.Once
+	// refreshNow makes the refresh goroutine refresh the clients before the refresh interval is over,
+	// e.g. after an event of the event stream
+	refreshNow chan struct{}
+	// networkSubnets maps the lowercased network names to their subnets for view_network_match, it is
+	// guarded by mu
+	networkSubnets map[string][]*net.IPNet
+	// limiter limits the queries per second to rate_limit, nil when there is no limit
+	limiter *rate.Limiter
+	// workers is the semaphore of max_workers, nil when there is no limit
+	workers chan struct{}
+	// answerRotations are the round robin counters of answer_limit by lowercased name, they are guarded
+	// by rotationMu
+	answerRotations map[string]*atomic.Uint64
+	rotationMu      sync.Mutex
+	// stop is closed once the server shuts down so the refresh, event stream and metrics goroutines
+	// return, e.g. when the Corefile is reloaded. nil keeps them running
+	stop     chan struct{}
+	stopOnce sync.Once
+	// startupOnce runs the on_startup_command after the first successful refresh
+	startupOnce sync.Once
+	// circuit is the state of circuit_breaker
+	circuit circuitBreaker
+}
+
+// ServeDNS implements the middleware.Handler interface.
+func (p *unifinames) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	if p.limiter != nil && !p.limiter.Allow() {
+		UnifinamesRateLimitedCount.Inc()
+		if p.Config.RateLimitAction == "passthrough" {
+			UnifinamesPassthroughCount.Inc()
+			return plugin.NextOrFailure(p.Name(), p.Next, ctx, w, r)
+		}
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		writeMsg(w, r, m)
+		return dns.RcodeServerFailure, nil
+	}
+
+	if p.workers != nil {
+		timer := time.NewTimer(p.Config.WorkerTimeout)
+		select {
+		case p.workers <- struct{}{}:
+			timer.Stop()
+			defer func() { <-p.workers }()
+		case <-timer.C:
+			UnifinamesWorkerTimeoutCount.Inc()
+			UnifinamesPassthroughCount.Inc()
+			return plugin.NextOrFailure(p.Name(), p.Next, ctx, w, r)
+		}
+	}
+
+	// CompareAndSwap so concurrent first queries can't both start the refresh
+	if p.haveRoutine.CompareAndSwap(false, true) {
+		p.mu.Lock()
+		p.refreshStarted = time.Now()
+		p.mu.Unlock()
+		go func() {
+			UnifinamesGoroutines.WithLabelValues("refresh").Inc()
+			defer UnifinamesGoroutines.WithLabelValues("refresh").Dec()
+			var backoff time.Duration
+			// update refreshes the clients and returns how long to wait for the next refresh
+			update := func() time.Duration {
+				err := p.refresh()
+				if err == nil {
+					backoff = 0
+					log.Infof("got %d hosts, skipped %d clients", p.recordCount(), p.skippedClientCount())
+					return p.pollInterval()
+				}
+
+				var authErr *ErrAuthFailure
+				var networkErr *ErrNetworkError
+				var unreachableErr *ErrControllerUnreachable
+				switch {
+				case errors.Is(err, errCircuitOpen):
+				case errors.As(err, &authErr):
+					log.Errorf("controller rejected the credentials, reloading them: %v", err)
+					p.reloadCredentials()
+				case errors.As(err, &networkErr) || errors.As(err, &unreachableErr):
+					backoff = nextBackoff(backoff, p.refreshInterval())
+					log.Errorf("unable to reach controller, retrying in %s: %v", backoff, err)
+					return backoff
+				case errors.Is(err, context.DeadlineExceeded):
+					log.Errorf("timed out getting clients after %s", p.Config.RequestTimeout)
+				default:
+					log.Errorf("unable to get clients: %v", err)
+				}
+				return p.pollInterval()
+			}
+			// lazy_load queries wait for the first refresh, it can't be spread out
+			jitter := p.jitter()
+			if p.Config.LazyLoad {
+				jitter = 0
+			}
+			select {
+			case <-time.After(jitter):
+			case <-p.stop:
+				return
+			}
+			wait := update()
+			p.firstRefreshOnce.Do(func() {
+				if p.firstRefresh != nil {
+					close(p.firstRefresh)
+				}
+			})
+			for {
+				// the event stream refreshes the clients right away
+				select {
+				case <-time.After(wait + p.jitter()):
+				case <-p.refreshNow:
+				case <-p.stop:
+					return
+				}
+				wait = update()
+			}
+		}()
+		if p.Config.UseEventStream {
+			go p.watchEvents()
+		}
+		if interval := p.metricsRefreshInterval(); interval > 0 {
+			go func() {
+				UnifinamesGoroutines.WithLabelValues("metrics").Inc()
+				defer UnifinamesGoroutines.WithLabelValues("metrics").Dec()
+				ticker := time.NewTicker(interval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+						UnifinamesHostsCount.Set(float64(p.countHosts()))
+					case <-p.stop:
+						return
+					}
+				}
+			}()
+		}
+	}
+
+	if p.Config.LazyLoad && len(r.Question) > 0 && p.shouldHandle(strings.ToLower(r.Question[0].Name)) {
+		p.waitForFirstRefresh()
+	}
+
+	for _, question := range r.Question {
+		UnifinamesQueryTypeTotal.With(prometheus.Labels{"qtype": queryType(question.Qtype)}).Inc()
+	}
+	if p.Config.DryRun {
+		for _, rr := range p.lookup(r) {
+			log.Infof("[dry-run] would answer %s with %s", rr.Header().Name, rrValue(rr))
+		}
+		UnifinamesRequestsTotal.With(prometheus.Labels{"result": "passthrough"}).Inc()
+		UnifinamesPassthroughCount.Inc()
+		return plugin.NextOrFailure(p.Name(), p.Next, ctx, w, r)
+	}
+
+	if p.Config.ResolveTimeout > 0 && !p.waitForLock(p.Config.ResolveTimeout) {
+		p.debugf("Passing the query on, the records weren't free within %s (resolve_timeout)", p.Config.ResolveTimeout)
+		UnifinamesResolveTimeoutCount.Inc()
+	} else if rcode, ok := p.resolve(w, r); ok {
+		UnifinamesAnsweredCount.Inc()
+		return rcode, nil
+	}
+
+	UnifinamesPassthroughCount.Inc()
+	// a delegation of the next plugins gets the glue the plugin knows
+	return plugin.NextOrFailure(p.Name(), p.Next, ctx, &glueWriter{ResponseWriter: w, p: p}, r)
+}
+
+// waitForLock waits up to timeout for p.mu to be free, e.g. while a refresh replaces the records. It polls
+// with TryLock instead of blocking, so a query that gives up leaves nothing behind that waits for the
+// lock. The lock is released again, resolve takes it for each of its lookups
+func (p *unifinames) waitForLock(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !p.mu.TryLock() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return false
+		}
+		time.Sleep(min(wait, 100*time.Microsecond))
+	}
+	p.mu.Unlock()
+	return true
+}
+
+// waitForFirstRefresh waits up to lazy_load_timeout for the first refresh of the refresh goroutine, the
+// queries are answered with the records there are once it is over
+func (p *unifinames) waitForFirstRefresh() {
+	if p.firstRefresh == nil {
+		return
+	}
+	timer := time.NewTimer(p.Config.LazyLoadTimeout)
+	defer timer.Stop()
+	select {
+	case <-p.firstRefresh:
+	case <-timer.C:
+		log.Warningf("answering without the clients, they weren't fetched within %s (lazy_load_timeout)", p.Config.LazyLoadTimeout)
+	}
+}
+
+// Name implements the Handler interface.
+func (*unifinames) Name() string { return "unifi-names" }
+
+// shutdown stops the goroutines that were started by the first query, it is safe to call more than once
+func (p *unifinames) shutdown() {
+	if p.stop == nil {
+		return
+	}
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// debugf logs the message at info level when debug is set in the config, otherwise it is only
+// shown when the debug plugin is enabled
+func (p *unifinames) debugf(format string, v ...interface{}) {
+	if p.Config.Debug {
+		log.Infof(format, v...)
+		return
+	}
+	log.Debugf(format, v...)
+}
+
+// dedupName returns the name of name_dedup_strategy append_mac or append_index for the client with mac
+// whose name is taken, build returns the name with a label appended to the hostname. It is empty if the
+// name with the mac is taken too
+func (p *unifinames) dedupName(name, mac string, seen map[string][2]string, dedup map[string]int, build func(string) string) string {
+	if p.Config.NameDedupStrategy == "append_mac" {
+		digits := strings.ToLower(strings.NewReplacer(":", "", "-", "", ".", "").Replace(mac))
+		if len(digits) > 4 {
+			digits = digits[len(digits)-4:]
+		}
+		candidate := build("-" + digits)
+		if first, ok := seen[candidate]; ok && first[0] != mac {
+			return ""
+		}
+		return candidate
+	}
+	for {
+		dedup[name]++
+		candidate := build("-" + strconv.Itoa(dedup[name]+1))
+		if _, ok := seen[candidate]; !ok {
+			return candidate
+		}
+	}
+}
+
+// clientAddress returns the ip of a client, the offline clients with a dhcp reservation get their fixed ip
+func clientAddress(entry *unifi.Client) string {
+	if entry.IP == "" {
+		return entry.FixedIP
+	}
+	return entry.IP
+}
+
+// ipConflicts returns the ips that clients with different macs share for strict_ip_uniqueness, each
+// conflict is logged and counted
+func ipConflicts(clients []*unifi.Client) map[string]bool {
+	// seenIPs maps the ips to the mac of the first client that has them
+	seenIPs := map[string]string{}
+	conflicts := map[string]bool{}
+	for _, entry := range clients {
+		ip := net.ParseIP(clientAddress(entry))
+		if ip == nil {
+			continue
+		}
+		first, ok := seenIPs[ip.String()]
+		if !ok {
+			seenIPs[ip.String()] = entry.Mac
+			continue
+		}
+		if strings.EqualFold(first, entry.Mac) {
+			continue
+		}
+		log.Warningf("skipping the clients %s and %s, they share the ip %s (strict_ip_uniqueness)", first, entry.Mac, ip)
+		if !conflicts[ip.String()] {
+			UnifinamesIPConflictCount.Inc()
+		}
+		conflicts[ip.String()] = true
+	}
+	return conflicts
+}
+
+// refreshSummary describes the clients of a refresh for compact_logging, e.g. "487 added, 13 skipped
+// (8 empty_name, 3 unknown_network, 2 invalid_ip)" with the most frequent reasons first
+func refreshSummary(added, skipped int, reasons map[string]int) string {
+	summary := fmt.Sprintf("%d added, %d skipped", added, skipped)
+	if len(reasons) == 0 {
+		return summary
+	}
+	names := make([]string, 0, len(reasons))
+	for reason := range reasons {
+		names = append(names, reason)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if reasons[names[i]] != reasons[names[j]] {
+			return reasons[names[i]] > reasons[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	counts := make([]string, len(names))
+	for i, reason := range names {
+		counts[i] = fmt.Sprintf("%d %s", reasons[reason], reason)
+	}
+	return summary + " (" + strings.Join(counts, ", ") + ")"
+}
+
+// resolve answers r if there are matching records, unless the nxdomain_action of the zone is passthrough
+// it also answers questions for the handled domains that have no matching records
+func (p *unifinames) resolve(w dns.ResponseWriter, r *dns.Msg) (int, bool) {
+	for _, question := range r.Question {
+		if question.Qclass == dns.ClassCHAOS && strings.EqualFold(question.Name, versionName) &&
+			(question.Qtype == dns.TypeTXT || question.Qtype == dns.TypeANY) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Answer = []dns.RR{p.versionRecord(question.Name)}
+			UnifinamesRequestsTotal.With(prometheus.Labels{"result": "hit"}).Inc()
+			writeMsg(w, r, m)
+			return dns.RcodeSuccess, true
+		}
+	}
+
+	if p.isStale() {
+		for _, question := range r.Question {
+			if !handlesClass(question.Qclass) || !p.shouldHandle(strings.ToLower(question.Name)) {
+				continue
+			}
+			p.debugf("Answering %s with SERVFAIL, the records are older than %s", question.Name, p.Config.MaxStaleAge)
+			UnifinamesServfailCount.Inc()
+			UnifinamesRequestsTotal.With(prometheus.Labels{"result": "miss"}).Inc()
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeServerFailure)
+			writeMsg(w, r, m)
+			return dns.RcodeServerFailure, true
+		}
+	}
+
+	rrs := p.lookup(r)
+	ip := p.viewIP(w, r)
+	rrs = p.viewRecords(rrs, ip)
+	if p.Config.AnswerLimit > 0 {
+		rrs = p.limitAnswer(rrs, r)
+	}
+	// answer_limit picks the records before they are ordered by the weights of their networks
+	rrs = p.weightAnswer(rrs)
+	if len(rrs) > 0 {
+		p.debugf("Answering with %d rr's", len(rrs))
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = rrs
+		// the plugin is the authority of its domains (RFC 1035 4.1.1)
+		for _, question := range r.Question {
+			if p.shouldHandle(strings.ToLower(question.Name)) {
+				m.Authoritative = true
+				break
+			}
+		}
+		if p.Config.IncludeAdditionalRecords {
+			m.Extra = p.additionalRecords(rrs)
+		}
+		if p.Config.PerClientMetrics {
+			p.countClientQueries(rrs)
+		}
+		p.countSiteQueries(rrs)
+		p.addGlue(m)
+		UnifinamesRequestsTotal.With(prometheus.Labels{"result": "hit"}).Inc()
+		writeMsg(w, r, m)
+		return dns.RcodeSuccess, true
+	}
+
+	// the first question for the handled domains decides the answer
+	for _, question := range r.Question {
+		if !handlesClass(question.Qclass) || !p.shouldHandle(strings.ToLower(question.Name)) {
+			continue
+		}
+		UnifinamesRequestsTotal.With(prometheus.Labels{"result": "miss"}).Inc()
+		zone := p.zone(strings.ToLower(question.Name))
+		// the clients of the other networks don't exist for view_network_match, whatever the action
+		hidden := p.hiddenFromView(question.Name, ip)
+		if action := p.Config.nxdomainAction(zone); hidden || action != "passthrough" {
+			// a name that only has records of another type exists, answering NXDOMAIN would deny all types
+			rcode := dns.RcodeSuccess
+			var redirect []dns.RR
+			if hidden || (action == "nxdomain" && !p.nameExists(question.Name)) {
+				// the names of the other networks stay hidden from the view instead of being redirected
+				if ip := p.Config.nxdomainRedirect(zone); ip != nil && !hidden {
+					p.debugf("Redirecting %s to %s", question.Name, ip)
+					redirect = p.redirectRecords(question, ip)
+				} else {
+					rcode = dns.RcodeNameError
+					UnifinamesNoSuchDomainCount.Inc()
+				}
+			}
+			p.debugf("Answering %s with %s", question.Name, dns.RcodeToString[rcode])
+			m := new(dns.Msg)
+			m.SetRcode(r, rcode)
+			m.Authoritative = true
+			m.Answer = redirect
+			m.Ns = p.nsRecords(zone)
+			// negative answers without a SOA record aren't cached (RFC 2308 5)
+			if p.Config.NegativeTTL > 0 && len(m.Answer) == 0 {
+				m.Ns = append([]dns.RR{p.soaRecord(zone)}, m.Ns...)
+			}
+			p.addGlue(m)
+			writeMsg(w, r, m)
+			return rcode, true
+		}
+		UnifinamesNoSuchDomainCount.Inc()
+		return dns.RcodeSuccess, false
+	}
+	UnifinamesRequestsTotal.With(prometheus.Labels{"result": "passthrough"}).Inc()
+	return dns.RcodeSuccess, false
+}
+
+// limitAnswer returns at most answer_limit of rrs, scaled up by the EDNS0 udp size of r over the 512 bytes
+// of plain dns. Each answer starts one record further so the records of a name take turns
+func (p *unifinames) limitAnswer(rrs []dns.RR, r *dns.Msg) []dns.RR {
+	limit := p.Config.AnswerLimit
+	if opt := r.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		limit = limit * int(opt.UDPSize()) / dns.MinMsgSize
+	}
+	if len(rrs) <= limit {
+		return rrs
+	}
+
+	name := strings.ToLower(rrs[0].Header().Name)
+	p.rotationMu.Lock()
+	if p.answerRotations == nil {
+		p.answerRotations = map[string]*atomic.Uint64{}
+	}
+	counter, ok := p.answerRotations[name]
+	if !ok {
+		counter = new(atomic.Uint64)
+		p.answerRotations[name] = counter
+	}
+	p.rotationMu.Unlock()
+
+	start := int((counter.Add(1) - 1) % uint64(len(rrs)))
+	return append(slices.Clone(rrs[start:]), rrs[:start]...)[:limit]
+}
+
+// additionalRecords returns the AAAA records of the names of the A records in rrs and the other way round
+func (p *unifinames) additionalRecords(rrs []dns.RR) []dns.RR {
+	var extra []dns.RR
+	looked := map[string]bool{}
+	for _, rr := range rrs {
+		other := map[uint16]uint16{dns.TypeA: dns.TypeAAAA, dns.TypeAAAA: dns.TypeA}[rr.Header().Rrtype]
+		key := strings.ToLower(rr.Header().Name) + " " + dns.TypeToString[other]
+		if other == 0 || looked[key] {
+			continue
+		}
+		looked[key] = true
+		extra = append(extra, p.lookup(new(dns.Msg).SetQuestion(rr.Header().Name, other))...)
+	}
+	return extra
+}
+
+// ednsPayloadSize is the largest udp payload the answers advertise, a client that asks for less gets its
+// own size
+const ednsPayloadSize = 4096
+
+// writeMsg answers r with m, a server that receives an OPT record responds with one (RFC 6891 7), so
+// the OPT record of r is added to m with the DO bit it asked for and at most the ednsPayloadSize. The
+// plugin doesn't recurse, so recursion isn't available
+func writeMsg(w dns.ResponseWriter, r, m *dns.Msg) {
+	state := request.Request{W: w, Req: r}
+	if state.SizeAndDo(m) {
+		opt := m.IsEdns0()
+		opt.SetUDPSize(max(dns.MinMsgSize, min(opt.UDPSize(), ednsPayloadSize)))
+	}
+	m.RecursionAvailable = false
+	w.WriteMsg(m)
+}
+
+// isStale returns whether the records are older than max_stale_age, records that were never loaded
+// aren't stale
+func (p *unifinames) isStale() bool {
+	if p.Config.MaxStaleAge <= 0 {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.lastUpdate.IsZero() && time.Since(p.lastUpdate) > p.Config.MaxStaleAge
+}
+
+// versionRecord returns the CHAOS TXT record with the version, the last update and the number of records
+func (p *unifinames) versionRecord(name string) dns.RR {
+	p.mu.Lock()
+	lastUpdate := p.lastUpdate
+	records := len(p.aClients) + len(p.aaaaClients)
+	p.mu.Unlock()
+
+	updated := "never"
+	if !lastUpdate.IsZero() {
+		updated = lastUpdate.UTC().Format(time.RFC3339)
+	}
+	return &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassCHAOS,
+		},
+		Txt: []string{
+			"version=" + Version,
+			"last_update=" + updated,
+			"records=" + strconv.Itoa(records),
+		},
+	}
+}
+
+// nameExists returns whether there is a record of any type for name, a matching wildcard record counts
+func (p *unifinames) nameExists(name string) bool {
+	name = dns.Fqdn(name)
+	if p.isApex(strings.ToLower(name)) {
+		return true
+	}
+	if _, ok := p.Config.staticTXT[strings.ToLower(name)]; ok {
+		return true
+	}
+	wildcard := wildcardName(name)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, client := range p.aClients {
+		if strings.EqualFold(client.Hdr.Name, name) || (wildcard != "" && strings.EqualFold(client.Hdr.Name, wildcard)) {
+			return true
+		}
+	}
+	for _, client := range p.aaaaClients {
+		if strings.EqualFold(client.Hdr.Name, name) || (wildcard != "" && strings.EqualFold(client.Hdr.Name, wildcard)) {
+			return true
+		}
+	}
+	for _, client := range p.srvClients {
+		if strings.EqualFold(client.Hdr.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardName returns the wildcard name that covers name, e.g. *.printer.lan. for admin.printer.lan.
+func wildcardName(name string) string {
+	labels := dns.SplitDomainName(name)
+	if len(labels) < 2 {
+		return ""
+	}
+	return "*." + dns.Fqdn(strings.Join(labels[1:], "."))
+}
+
+// lookup returns the records matching the questions in r, names are compared case-insensitively
+// (RFC 4343) everywhere: the records are built lowercased, the configured domains are lowercased and the
+// questions are compared with strings.EqualFold and dns.IsSubDomain. The names of the questions are
+// made fqdns like the names of the records, e.g. for the DoH queries
+func (p *unifinames) lookup(r *dns.Msg) []dns.RR {
+	if len(r.Question) <= 0 {
+		return nil
+	}
+
+	var rrs []dns.RR
+	// the answers to all questions of the message get the same ttl
+	index := p.recordIndex.Load()
+	var elapsed uint32
+	if index != nil {
+		elapsed = uint32(time.Since(index.lastUpdate).Seconds())
+	} else {
+		p.mu.Lock()
+		elapsed = uint32(time.Since(p.lastUpdate).Seconds())
+		p.mu.Unlock()
+	}
+
+	for i := 0; i < len(r.Question); i++ {
+		question := r.Question[i]
+		question.Name = dns.Fqdn(question.Name)
+		if !handlesClass(question.Qclass) {
+			continue
+		}
+
+		switch question.Qtype {
+		case dns.TypeA:
+			if p.shouldHandle(strings.ToLower(question.Name)) && index != nil {
+				rrs = append(rrs, p.indexedAnswers(index, question, elapsed)...)
+			} else if p.shouldHandle(strings.ToLower(question.Name)) {
+				p.mu.Lock()
+				matched := false
+				for _, client := range p.aClients {
+					if strings.EqualFold(client.Hdr.Name, question.Name) {
+						rr := client
+						rr.Hdr.Ttl = p.answerTTL(client.Hdr.Ttl, elapsed)
+						rrs = append(rrs, &rr)
+						matched = true
+					}
+				}
+				if wildcard := wildcardName(question.Name); !matched && wildcard != "" {
+					for _, client := range p.aClients {
+						if strings.EqualFold(client.Hdr.Name, wildcard) {
+							rr := client
+							rr.Hdr.Name = question.Name
+							rr.Hdr.Ttl = p.answerTTL(client.Hdr.Ttl, elapsed)
+							rrs = append(rrs, &rr)
+						}
+					}
+				}
+				p.mu.Unlock()
+			}
+		case dns.TypeAAAA:
+			if p.shouldHandle(strings.ToLower(question.Name)) && index != nil {
+				rrs = append(rrs, p.indexedAnswers(index, question, elapsed)...)
+			} else if p.shouldHandle(strings.ToLower(question.Name)) {
+				p.mu.Lock()
+				matched := false
+				for _, client := range p.aaaaClients {
+					if strings.EqualFold(client.Hdr.Name, question.Name) {
+						rr := client
+						rr.Hdr.Ttl = p.answerTTL(client.Hdr.Ttl, elapsed)
+						rrs = append(rrs, &rr)
+						matched = true
+					}
+				}
+				if wildcard := wildcardName(question.Name); !matched && wildcard != "" {
+					for _, client := range p.aaaaClients {
+						if strings.EqualFold(client.Hdr.Name, wildcard) {
+							rr := client
+							rr.Hdr.Name = question.Name
+							rr.Hdr.Ttl = p.answerTTL(client.Hdr.Ttl, elapsed)
+							rrs = append(rrs, &rr)
+						}
+					}
+				}
+				p.mu.Unlock()
+			}
+		case dns.TypeHINFO:
+			if p.shouldHandle(strings.ToLower(question.Name)) {
+				p.mu.Lock()
+				if client, ok := p.hinfoClients[strings.ToLower(question.Name)]; ok {
+					rr := client
+					rr.Hdr.Name = question.Name
+					rr.Hdr.Ttl = p.answerTTL(client.Hdr.Ttl, elapsed)
+					rrs = append(rrs, &rr)
+				}
+				p.mu.Unlock()
+			}
+		case dns.TypeTXT:
+			if p.shouldHandle(strings.ToLower(question.Name)) {
+				p.mu.Lock()
+				if client, ok := p.switchPortClients[strings.ToLower(question.Name)]; ok {
+					rr := client
+					rr.Hdr.Name = question.Name
+					rr.Hdr.Ttl = p.answerTTL(client.Hdr.Ttl, elapsed)
+					rrs = append(rrs, &rr)
+				}
+				if client, ok := p.metadataClients[strings.ToLower(question.Name)]; ok {
+					rr := client
+					rr.Hdr.Name = question.Name
+					rr.Hdr.Ttl = p.answerTTL(client.Hdr.Ttl, elapsed)
+					rrs = append(rrs, &rr)
+				}
+				if static, ok := p.Config.staticTXT[strings.ToLower(question.Name)]; ok {
+					rr := static
+					rr.Hdr.Name = question.Name
+					rrs = append(rrs, &rr)
+				}
+				if ttl, ok := p.addressTTL(question.Name); ok && p.Config.IncludeAnnotations {
+					rr := p.Config.annotationRecord(question.Name, p.answerTTL(ttl, elapsed))
+					rrs = append(rrs, &rr)
+				}
+				p.mu.Unlock()
+			}
+		case dns.TypeNAPTR:
+			if p.shouldHandle(strings.ToLower(question.Name)) {
+				p.mu.Lock()
+				for _, client := range p.naptrClients[strings.ToLower(question.Name)] {
+					rr := client
+					rr.Hdr.Name = question.Name
+					rr.Hdr.Ttl = p.answerTTL(client.Hdr.Ttl, elapsed)
+					rrs = append(rrs, &rr)
+				}
+				p.mu.Unlock()
+			}
+		case dns.TypeSRV:
+			if p.shouldHandle(strings.ToLower(question.Name)) {
+				p.mu.Lock()
+				for _, client := range p.srvClients {
+					if strings.EqualFold(client.Hdr.Name, question.Name) {
+						rr := client
+						rr.Hdr.Name = question.Name
+						rr.Hdr.Ttl = p.answerTTL(client.Hdr.Ttl, elapsed)
+						rrs = append(rrs, &rr)
+					}
+				}
+				p.mu.Unlock()
+			}
+		case dns.TypePTR:
+			zone := p.Config.ipv6PTRZone()
+			if dns.IsSubDomain(zone, strings.ToLower(question.Name)) {
+				p.mu.Lock()
+				for _, client := range p.aaaaClients {
+					if strings.HasPrefix(client.Hdr.Name, "*.") {
+						continue
+					}
+					if strings.EqualFold(ptrName(client.AAAA, zone), question.Name) {
+						rrs = append(rrs, &dns.PTR{
+							Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: p.answerTTL(client.Hdr.Ttl, elapsed)},
+							Ptr: client.Hdr.Name,
+						})
+					}
+				}
+				p.mu.Unlock()
+			}
+		case dns.TypeNS:
+			if p.isApex(strings.ToLower(question.Name)) {
+				rrs = append(rrs, p.nsRecords(question.Name)...)
+			}
+		}
+	}
+
+	return rrs
+}
+
+// answerTTL returns the TTL that is left until the records are refreshed elapsed seconds after the last
+// update, a network TTL (if not 0) can only lower it
+func (p *unifinames) answerTTL(networkTTL, elapsed uint32) uint32 {
+	ttl := p.Config.clampTTL(p.Config.TTL, elapsed)
+	if networkTTL > 0 && networkTTL < ttl {
+		return max(networkTTL, p.Config.MinTTL)
+	}
+	return ttl
+}
+
+// redirectRecords returns the record of nxdomain_redirect_ip for question, the A record for the A
+// questions of an ipv4 and the AAAA record for the AAAA questions of an ipv6. The other questions get no
+// records, the name exists but has none of their type
+func (p *unifinames) redirectRecords(question dns.Question, ip net.IP) []dns.RR {
+	hdr := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: question.Name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: p.Config.NegativeTTL}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if question.Qtype == dns.TypeA || question.Qtype == dns.TypeANY {
+			return []dns.RR{&dns.A{Hdr: hdr(dns.TypeA), A: ip4}}
+		}
+		return nil
+	}
+	if question.Qtype == dns.TypeAAAA || question.Qtype == dns.TypeANY {
+		return []dns.RR{&dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: ip}}
+	}
+	return nil
+}
+
+// nsRecords returns the configured NS records for zone
+func (p *unifinames) nsRecords(zone string) []dns.RR {
+	var rrs []dns.RR
+	for _, ns := range p.Config.NSRecords {
+		rrs = append(rrs, &dns.NS{
+			Hdr: dns.RR_Header{
+				Name:   zone,
+				Rrtype: dns.TypeNS,
+				Class:  dns.ClassINET,
+				Ttl:    p.Config.TTL,
+			},
+			Ns: ns,
+		})
+	}
+	return rrs
+}
+
+// soaRecord returns the SOA record that is added to the negative answers for zone, its ttl and minimum
+// are negative_ttl so resolvers cache the NXDOMAIN answers that long (RFC 2308)
+func (p *unifinames) soaRecord(zone string) dns.RR {
+	ns := "ns." + zone
+	if len(p.Config.NSRecords) > 0 {
+		ns = p.Config.NSRecords[0]
+	}
+	p.mu.Lock()
+	serial := uint32(p.lastUpdate.Unix())
+	p.mu.Unlock()
+	refresh := uint32(p.refreshInterval().Seconds())
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    p.Config.NegativeTTL,
+		},
+		Ns:      ns,
+		Mbox:    "hostmaster." + zone,
+		Serial:  serial,
+		Refresh: refresh,
+		Retry:   refresh,
+		Expire:  refresh,
+		Minttl:  p.Config.NegativeTTL,
+	}
+}
+
+// rrValue returns the data part of rr, e.g. the ip of an A record
+func rrValue(rr dns.RR) string {
+	switch v := rr.(type) {
+	case *dns.A:
+		return v.A.String()
+	case *dns.AAAA:
+		return v.AAAA.String()
+	}
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// shouldHandle returns whether name is one of the configured domains or below one of them
+func (p *unifinames) shouldHandle(name string) bool {
+	for _, domain := range p.Config.domains() {
+		if dns.IsSubDomain(dns.Fqdn(domain), dns.Fqdn(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// handlesClass returns whether questions of qclass are answered, ANY is answered with the INET records
+// (RFC 1035 3.2.5)
+func handlesClass(qclass uint16) bool {
+	return qclass == dns.ClassINET || qclass == dns.ClassANY
+}
+
+// isApex returns whether name is one of the configured domains
+func (p *unifinames) isApex(name string) bool {
+	for _, domain := range p.Config.domains() {
+		if strings.EqualFold(name, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// zone returns the configured domain name belongs to, the longest one wins if domains are nested
+func (p *unifinames) zone(name string) string {
+	zone := ""
+	for _, domain := range p.Config.domains() {
+		if dns.IsSubDomain(domain, name) && len(domain) > len(zone) {
+			zone = domain
+		}
+	}
+	return zone
+}
+
+// refreshInterval returns how often the clients are refreshed, they are refreshed once they expire
+func (p *unifinames) refreshInterval() time.Duration {
+	return time.Duration(p.Config.TTL) * time.Second
+}
+
+// metricsRefreshInterval returns how often the host count is recounted, it defaults to the refresh interval
+func (p *unifinames) metricsRefreshInterval() time.Duration {
+	if p.Config.MetricsRefreshInterval > 0 {
+		return p.Config.MetricsRefreshInterval
+	}
+	return p.refreshInterval()
+}
+
+// countHosts returns the number of client records in memory, the wildcard and apex records aren't hosts
+func (p *unifinames) countHosts() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	hosts := 0
+	for _, client := range p.aClients {
+		if !strings.HasPrefix(client.Hdr.Name, "*.") && !p.isApex(client.Hdr.Name) {
+			hosts++
+		}
+	}
+	for _, client := range p.aaaaClients {
+		if !strings.HasPrefix(client.Hdr.Name, "*.") && !p.isApex(client.Hdr.Name) {
+			hosts++
+		}
+	}
+	return hosts
+}
+
+// jitter returns a random duration in [0, refresh_jitter) that is added to the refresh interval so
+// several instances don't query the controller at the same time
+func (p *unifinames) jitter() time.Duration {
+	if p.Config.RefreshJitter <= 0 {
+		return 0
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(p.Config.RefreshJitter)))
+	if err != nil {
+		return 0
+	}
+	return time.Duration(n.Int64())
+}
+
+// refresh updates the clients from the controller, once more than max_stale_refreshes refreshes
+// failed in a row the stale clients are dropped
+func (p *unifinames) refresh() error {
+	p.debugf("updating clients")
+
+	p.mu.Lock()
+	previousHash := p.recordsHash
+	previousClients := p.clients
+	p.mu.Unlock()
+
+	if !p.circuitAllows() {
+		p.debugf("skipping the refresh, the circuit breaker is open")
+		return errCircuitOpen
+	}
+	ctx, cancel := p.requestContext()
+	defer cancel()
+	started := time.Now()
+	err := p.getClientsWithin(ctx)
+	p.circuitResult(err)
+	if err != nil {
+		if !p.Config.RequireInitialData {
+			p.IsReady.Store(true)
+		}
+		failures := p.consecutiveFailures.Add(1)
+		UnifinamesConsecutiveFailures.Set(float64(failures))
+		if p.Config.MaxStaleRefreshes > 0 && int(failures) >= p.Config.MaxStaleRefreshes {
+			log.Warningf("dropping stale clients after %d failed refreshes", failures)
+			p.clearClients()
+		}
+		return err
+	}
+
+	duration := time.Since(started)
+	p.IsReady.Store(true)
+	failures := p.consecutiveFailures.Swap(0)
+	UnifinamesConsecutiveFailures.Set(0)
+	now := time.Now()
+	p.mu.Lock()
+	p.lastSuccessfulUpdate = now
+	changed := p.recordsHash != previousHash
+	currentClients := p.clients
+	p.mu.Unlock()
+	UnifinamesLastSuccessfulUpdate.Set(float64(now.Unix()))
+	if p.Config.TelemetryURL != "" {
+		report := newTelemetryReport(currentClients, duration, failures)
+		go func() {
+			if err := p.Config.sendTelemetry(report); err != nil {
+				log.Warningf("unable to send telemetry report: %v", err)
+			}
+		}()
+	}
+	// the ConfigMap is written on every refresh, it could have been changed outside of the plugin
+	if p.Config.ConfigMapName != "" {
+		if err := p.exportConfigMap(); err != nil {
+			log.Errorf("unable to export configmap: %v", err)
+		}
+	}
+	if p.Config.RedisAddr != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), p.Config.RequestTimeout)
+		err := p.exportRedis(ctx)
+		cancel()
+		if err != nil {
+			log.Errorf("unable to export to redis: %v", err)
+		}
+	}
+	if p.Config.DnsmasqHostsFile != "" {
+		if err := p.exportDnsmasqHosts(); err != nil {
+			log.Errorf("unable to export dnsmasq hosts: %v", err)
+		}
+	}
+	// the commands run after the exports, e.g. to pick up the dnsmasq hosts file
+	startup := false
+	p.startupOnce.Do(func() {
+		startup = true
+		if p.Config.OnStartupCommand != "" {
+			go p.runCommand("on_startup_command", p.Config.OnStartupCommand)
+		}
+	})
+	if !startup && p.Config.OnRefreshCommand != "" {
+		go p.runCommand("on_refresh_command", p.Config.OnRefreshCommand)
+	}
+	if !changed {
+		p.debugf("no changes detected")
+		return nil
+	}
+	UnifinamesRefreshChangesCount.Inc()
+	if p.OnClientsChanged != nil {
+		added, removed := diffClients(previousClients, currentClients)
+		go p.OnClientsChanged(added, removed)
+	}
+	if p.Config.CacheFile != "" {
+		if err := p.writeCache(); err != nil {
+			log.Errorf("unable to write cache file: %v", err)
+		}
+	}
+	return nil
+}
+
+// runCommand runs the command of the directive with sh, its output is logged at the debug level
+func (p *unifinames) runCommand(directive, command string) {
+	output, err := exec.Command("sh", "-c", command).CombinedOutput()
+	if len(output) > 0 {
+		p.debugf("%s: %s", directive, strings.TrimSpace(string(output)))
+	}
+	if err != nil {
+		log.Warningf("%s failed: %v", directive, err)
+	}
+}
+
+// getClientsWithin runs getClients in its own goroutine and gives up after max_refresh_duration, e.g. when
+// the controller accepted the connection but never answers. The goroutine is cancelled and its result is
+// dropped into the buffered channel, getClients doesn't store the records once ctx is done
+func (p *unifinames) getClientsWithin(parent context.Context) error {
+	if p.Config.MaxRefreshDuration <= 0 {
+		return p.getClients(parent)
+	}
+	ctx, cancel := context.WithTimeout(parent, p.Config.MaxRefreshDuration)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		UnifinamesGoroutines.WithLabelValues("get_clients").Inc()
+		defer UnifinamesGoroutines.WithLabelValues("get_clients").Dec()
+		done <- p.getClients(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+	}
+	// getClients can also return first with the error of the cancelled context, the request timeout of
+	// the parent isn't a stuck refresh
+	if ctx.Err() != nil && parent.Err() == nil {
+		UnifinamesRefreshStuckCount.Inc()
+		return errors.Annotatef(ctx.Err(), "coredns-unifi-names: refresh took longer than %s", p.Config.MaxRefreshDuration)
+	}
+	return err
+}
+
+var reSetCookieToken = regexp.MustCompile(`unifises=([0-9a-zA-Z]+)`)
+
+// requestContext returns a context that is bounded by the configured request timeout
+func (p *unifinames) requestContext() (context.Context, context.CancelFunc) {
+	if p.Config.RequestTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), p.Config.RequestTimeout)
+}
+
+// fetchClients queries the controller for its clients, the unifi package doesn't support contexts so it
+// gives up waiting for the controller once ctx is done
+func (p *unifinames) fetchClients(ctx context.Context) ([]*unifi.Client, error) {
+	type result struct {
+		clients []*unifi.Client
+		err     error
+	}
+	for retry := 0; ; retry++ {
+		done := make(chan result, 1)
+		go func() {
+			UnifinamesGoroutines.WithLabelValues("query").Inc()
+			defer UnifinamesGoroutines.WithLabelValues("query").Dec()
+			clients, err := p.queryController()
+			done <- result{clients: clients, err: err}
+		}()
+
+		var r result
+		select {
+		case <-ctx.Done():
+			return nil, errors.Annotate(ctx.Err(), "coredns-unifi-names: unable to get clients")
+		case r = <-done:
+		}
+		// connect_retry tries again while the controller can't be reached, e.g. while it reboots
+		var networkErr *ErrNetworkError
+		var unreachableErr *ErrControllerUnreachable
+		if r.err == nil || retry >= p.Config.ConnectRetry || !errors.As(r.err, &networkErr) && !errors.As(r.err, &unreachableErr) {
+			if r.err == nil && retry > 0 {
+				log.Infof("recovered after %d retries", retry)
+			}
+			return r.clients, r.err
+		}
+		p.debugf("unable to reach the controller, retrying in %s: %v", p.Config.ConnectRetryDelay, r.err)
+		UnifinamesConnectRetryCount.Inc()
+		timer := time.NewTimer(p.Config.ConnectRetryDelay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, errors.Annotate(ctx.Err(), "coredns-unifi-names: unable to get clients")
+		case <-timer.C:
+		}
+	}
+}
+
+// queryController gets the clients of all sites, the session is logged in again right away once the
+// controller rejects it
+func (p *unifinames) queryController() ([]*unifi.Client, error) {
+	p.clientMu.Lock()
+	defer p.clientMu.Unlock()
+
+	clients, err := p.queryControllerSession()
+	if isAuthError(err) {
+		log.Infof("controller session expired, logging in again: %v", err)
+		UnifinamesReauthCount.Inc()
+		p.resetClient()
+		clients, err = p.queryControllerSession()
+	}
+	if err != nil {
+		// start with a new session once the controller is back, e.g. after it was restarted
+		p.resetClient()
+	}
+	return clients, classifyError(err)
+}
+
+// reloadCredentials drops the controller session and fetches the credentials from the secrets backend
+// again, without a secrets backend the next refresh just logs in again
+func (p *unifinames) reloadCredentials() {
+	p.clientMu.Lock()
+	defer p.clientMu.Unlock()
+	p.resetClient()
+	if err := p.Config.loadSecrets(); err != nil {
+		log.Errorf("unable to reload credentials: %v", err)
+	}
 }
 
-// ServeDNS implements the middleware.Handler interface.
-func (p *unifinames) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
-	if !p.haveRoutine.Load() {
-		p.haveRoutine.Store(true)
-		go func() {
-			update := func() {
-				p.mu.Lock()
-				if p.Config.Debug {
-					log.Println("[unifi-names] updating clients")
+// nextBackoff doubles the time to wait after the controller couldn't be reached, starting with a second
+// and up to the refresh interval
+func nextBackoff(backoff, limit time.Duration) time.Duration {
+	backoff *= 2
+	if backoff < time.Second {
+		backoff = time.Second
+	}
+	return min(backoff, limit)
+}
+
+// resetClient drops the controller session so the next query logs in again, clientMu has to be held
+func (p *unifinames) resetClient() {
+	p.uniClient = nil
+}
+
+// isAuthError returns whether err is the controller rejecting the login or the session
+func isAuthError(err error) bool {
+	if errors.Is(err, unifi.ErrAuthenticationFailed) {
+		return true
+	}
+	return errors.Is(err, unifi.ErrInvalidStatusCode) && strings.Contains(err.Error(), strconv.Itoa(http.StatusUnauthorized))
+}
+
+func (p *unifinames) queryControllerSession() ([]*unifi.Client, error) {
+	if p.uniClient == nil {
+		if err := p.Config.loadSecrets(); err != nil {
+			return nil, errors.Annotate(err, "coredns-unifi-names: unable to load secrets")
+		}
+		uni, err := p.newUnifiClient()
+		if err != nil {
+			return nil, errors.Annotate(err, "coredns-unifi-names: unable to create unifi client")
+		}
+		p.uniClient = uni
+	}
+	uni := p.uniClient
+
+	sites, err := uni.GetSites()
+	if err != nil {
+		return nil, errors.Annotate(err, "coredns-unifi-names: unable to get sites")
+	}
+
+	sites = filterSites(sites, p.Config.IncludeSites, p.Config.ExcludeSites)
+
+	clients, err := p.getSiteClients(uni, sites)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Config.IncludeDevices != "" || p.Config.IncludeSwitchPorts {
+		unifiDevices, err := uni.GetDevices(sites)
+		if err != nil {
+			return nil, errors.Annotate(err, "coredns-unifi-names: unable to get devices")
+		}
+		devices := flattenDevices(unifiDevices)
+		if p.Config.IncludeSwitchPorts {
+			setSwitchNames(clients, devices)
+		}
+		if p.Config.IncludeDevices != "" {
+			clients = append(clients, deviceClients(devices, p.Config.IncludeDevices)...)
+		}
+	}
+
+	if p.Config.VPNDomain != "" {
+		vpn, err := getVPNClients(uni, sites)
+		if err != nil {
+			log.Warningf("unable to get vpn clients, skipping them: %v", err)
+		}
+		clients = append(clients, vpn...)
+	}
+
+	// some controllers, mostly UniFi OS, leave the network name out and only send its id
+	needNames := slices.ContainsFunc(clients, func(client *unifi.Client) bool { return client.Network == "" && client.NetworkID != "" })
+	if needNames || p.Config.ViewNetworkMatch || p.Config.EDNSSubnetRouting {
+		networks, err := uni.GetNetworks(sites)
+		if err != nil {
+			log.Warningf("unable to get networks, skipping the clients without a network name: %v", err)
+			return clients, nil
+		}
+		if p.Config.ViewNetworkMatch || p.Config.EDNSSubnetRouting {
+			subnets := networkSubnets(networks, p.Config.NetworkAliases)
+			p.mu.Lock()
+			p.networkSubnets = subnets
+			p.mu.Unlock()
+		}
+		if needNames {
+			networkIDToName := networkNames(networks)
+			for _, client := range clients {
+				if client.Network == "" {
+					client.Network = networkIDToName[client.NetworkID]
+				}
+			}
+		}
+	}
+	return clients, nil
+}
+
+// getSiteClients gets the clients of each site in parallel, the sites that fail are left out with a
+// warning unless more than max_site_failure_ratio of them or all of them fail. The error is the one of
+// the first site that failed, e.g. for the session that expired
+func (p *unifinames) getSiteClients(uni *unifi.Unifi, sites []*unifi.Site) ([]*unifi.Client, error) {
+	siteClients := make([][]*unifi.Client, len(sites))
+	siteErrs := make([]error, len(sites))
+	var wg sync.WaitGroup
+	for i, site := range sites {
+		wg.Add(1)
+		go func(i int, site *unifi.Site) {
+			defer wg.Done()
+			siteClients[i], siteErrs[i] = uni.GetClients([]*unifi.Site{site})
+		}(i, site)
+	}
+	wg.Wait()
+
+	var clients []*unifi.Client
+	var firstErr error
+	failed := 0
+	for i, err := range siteErrs {
+		if err != nil {
+			log.Warningf("unable to get the clients of site %s: %v", sites[i].Name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+			continue
+		}
+		clients = append(clients, siteClients[i]...)
+	}
+	if failed > 0 && (failed == len(sites) || float64(failed)/float64(len(sites)) > p.Config.MaxSiteFailureRatio) {
+		return nil, errors.Annotatef(firstErr, "coredns-unifi-names: unable to get clients of %d of %d sites", failed, len(sites))
+	}
+	return clients, nil
+}
+
+// filterSites returns the sites whose name, id or description is in include, or without include the
+// ones that aren't in exclude, include and exclude are lowercased
+func filterSites(sites []*unifi.Site, include, exclude []string) []*unifi.Site {
+	if len(include) == 0 && len(exclude) == 0 {
+		return sites
+	}
+	matches := func(site *unifi.Site, names []string) bool {
+		return slices.Contains(names, strings.ToLower(site.Name)) || slices.Contains(names, strings.ToLower(site.ID)) ||
+			slices.Contains(names, strings.ToLower(site.Desc))
+	}
+	var filtered []*unifi.Site
+	for _, site := range sites {
+		if len(include) > 0 && matches(site, include) || len(include) == 0 && !matches(site, exclude) {
+			filtered = append(filtered, site)
+		}
+	}
+	return filtered
+}
+
+// networkNames maps the ids of networks to their names
+func networkNames(networks []unifi.Network) map[string]string {
+	names := make(map[string]string, len(networks))
+	for _, network := range networks {
+		names[network.ID] = network.Name
+	}
+	return names
+}
+
+// hostnameFields are the fields of the clients hostname_fields can use, alias is the name the client
+// was given in the controller like name
+var hostnameFields = map[string]func(*unifi.Client) string{
+	"name":     func(client *unifi.Client) string { return client.Name },
+	"alias":    func(client *unifi.Client) string { return client.Name },
+	"hostname": func(client *unifi.Client) string { return client.Hostname },
+	"note":     func(client *unifi.Client) string { return client.Note },
+	"mac":      func(client *unifi.Client) string { return client.Mac },
+}
+
+// clientFieldIndex returns the index of the string field of unifi.Client with the go name field, the name
+// is compared case-insensitively
+func clientFieldIndex(field string) ([]int, error) {
+	structField, ok := reflect.TypeOf(unifi.Client{}).FieldByNameFunc(func(name string) bool {
+		return strings.EqualFold(name, field)
+	})
+	if !ok {
+		return nil, fmt.Errorf("the clients have no field '%s'", field)
+	}
+	if structField.Type.Kind() != reflect.String {
+		return nil, fmt.Errorf("the field '%s' of the clients isn't a string", field)
+	}
+	return structField.Index, nil
+}
+
+// clientLabel returns the value of client_label_field of client, empty without one
+func (c *config) clientLabel(client *unifi.Client) string {
+	if c.clientLabelField == nil {
+		return ""
+	}
+	return reflect.ValueOf(client).Elem().FieldByIndex(c.clientLabelField).String()
+}
+
+// getClients fetches the clients from the controller and replaces the records, the records are only
+// replaced once all of them have been built so a failed refresh keeps the previous ones
+func (p *unifinames) getClients(ctx context.Context) error {
+	clients, err := p.fetchClients(ctx)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			UnifinamesTimeoutCount.Inc()
+		}
+		return err
+	}
+
+	var aClients []dns.A
+	var aaaaClients []dns.AAAA
+	hinfoClients := map[string]dns.HINFO{}
+	switchPortClients := map[string]dns.TXT{}
+	metadataClients := map[string]dns.TXT{}
+	naptrClients := map[string][]dns.NAPTR{}
+	var srvClients []dns.SRV
+	networkHosts := map[string]int{}
+	siteHosts := map[string]int{}
+	hostSites := map[string]string{}
+	recordWeights := map[string]int{}
+	// seen maps the names to the mac and network of the client that got them first
+	seen := map[string][2]string{}
+	// lastSeen maps the hostname, network and ip labels to the last seen timestamp of the client
+	lastSeen := map[[3]string]float64{}
+	var clientInfos []ClientInfo
+	trusted := p.trustedMACs()
+	truncated := 0
+	skipped := 0
+	skipReasons := map[string]int{}
+	// clientDebugf logs a line per client unless compact_logging sums them up once the refresh is done
+	clientDebugf := func(format string, v ...interface{}) {
+		if !p.Config.CompactLogging {
+			p.debugf(format, v...)
+		}
+	}
+	countSkip := func(reason string) {
+		UnifinamesClientsSkippedCount.WithLabelValues(reason).Inc()
+		skipReasons[reason]++
+		skipped++
+	}
+	skip := func(entry *unifi.Client, reason string) {
+		clientDebugf("skipping client %s (%s): %s", entry.Mac, entry.Name, reason)
+		countSkip(reason)
+	}
+	// removeName drops the records of name that were added for a client of network and returns how many
+	// A and AAAA records it had
+	removeName := func(name, network string) int {
+		removed := 0
+		aClients = slices.DeleteFunc(aClients, func(rr dns.A) bool {
+			if rr.Hdr.Name == name {
+				removed++
+				return true
+			}
+			return rr.Hdr.Name == "*."+name
+		})
+		aaaaClients = slices.DeleteFunc(aaaaClients, func(rr dns.AAAA) bool {
+			if rr.Hdr.Name == name {
+				removed++
+				return true
+			}
+			return rr.Hdr.Name == "*."+name
+		})
+		networkHosts[network] -= removed
+		siteHosts[hostSites[strings.ToLower(name)]] -= removed
+		delete(hostSites, strings.ToLower(name))
+		for key := range recordWeights {
+			if strings.HasPrefix(key, strings.ToLower(name)+" ") {
+				delete(recordWeights, key)
+			}
+		}
+		delete(hinfoClients, strings.ToLower(name))
+		delete(switchPortClients, strings.ToLower(name))
+		delete(metadataClients, strings.ToLower(name))
+		delete(naptrClients, strings.ToLower(name))
+		srvClients = slices.DeleteFunc(srvClients, func(rr dns.SRV) bool {
+			return rr.Target == name
+		})
+		maps.DeleteFunc(lastSeen, func(labels [3]string, _ float64) bool {
+			return labels[0] == strings.TrimSuffix(name, ".")
+		})
+		clientInfos = slices.DeleteFunc(clientInfos, func(client ClientInfo) bool {
+			return client.Hostname == name
+		})
+		return removed
+	}
+	// dedup counts the clients that got an index of name_dedup_strategy append_index for a name and
+	// renamed maps the names and macs of the clients to the names they got
+	dedup := map[string]int{}
+	renamed := map[[2]string]string{}
+
+	var conflicts map[string]bool
+	if p.Config.StrictIPUniqueness {
+		conflicts = ipConflicts(clients)
+	}
+
+	now := time.Now()
+	for _, entry := range clients {
+		// client_label_field is tried before hostname_fields
+		rawName := p.Config.clientLabel(entry)
+		if normalizeName(p.Config.NameNormalization, rawName) == "" {
+			rawName = ""
+			for _, field := range p.Config.hostnameFields() {
+				if value := hostnameFields[field](entry); normalizeName(p.Config.NameNormalization, value) != "" {
+					rawName = value
+					break
+				}
+			}
+		}
+		if override := p.Config.dnsOverrideName(entry.Note); override != "" {
+			rawName = override
+		}
+		if mac, err := net.ParseMAC(entry.Mac); err == nil && trusted[mac.String()] != "" {
+			rawName = trusted[mac.String()]
+		}
+		if rawName == "" {
+			skip(entry, "empty_name")
+			continue
+		}
+		if (p.Config.ClientType == "wired" && !entry.IsWired.Val) || (p.Config.ClientType == "wireless" && entry.IsWired.Val) {
+			continue
+		}
+		if p.Config.OnlineWithin > 0 && entry.LastSeen.Val > 0 && time.Since(time.Unix(int64(entry.LastSeen.Val), 0)) >= p.Config.OnlineWithin {
+			clientDebugf("skipping client %s (%s): not seen within %s", entry.Mac, entry.Name, p.Config.OnlineWithin)
+			UnifinamesClientsFilteredByAgeCount.Inc()
+			continue
+		}
+
+		// _http._tcp.webserver gets the records of webserver and a SRV record for the service
+		service, proto := "", ""
+		if p.Config.SynthesizeSRV {
+			if s, pr, host, ok := parseServiceName(rawName); ok {
+				service, proto, rawName = s, pr, host
+			}
+		}
+		if rawName = p.Config.stripHostnameSuffix(rawName); rawName == "" {
+			skip(entry, "empty_name")
+			continue
+		}
+		dns_name := strings.ToLower(normalizeName(p.Config.NameNormalization, rawName))
+		if p.Config.PreserveDots {
+			dns_name = strings.ToLower(normalizeLabels(p.Config.NameNormalization, rawName))
+		}
+
+		if dns_name == "" {
+			skip(entry, "sanitize_empty")
+			continue
+		}
+		if p.Config.StrictHostnameValidation && !isStrictHostname(dns_name) {
+			skip(entry, "rfc1123_violation")
+			continue
+		}
+		// the raw name finds the reserved names that sanitizing changes, e.g. _gateway
+		if p.Config.isReservedName(dns_name) || p.Config.isReservedName(strings.ToLower(strings.TrimSpace(rawName))) {
+			skip(entry, "reserved_name")
+			continue
+		}
+
+		// offline clients with a dhcp reservation are still reachable once they come back
+		address := clientAddress(entry)
+		ip := net.ParseIP(address)
+		if ip == nil {
+			skip(entry, "missing_ip")
+			continue
+		}
+		if p.Config.ipFiltered(ip) {
+			continue
+		}
+		if conflicts[ip.String()] {
+			skip(entry, "ip_conflict")
+			continue
+		}
+
+		network := strings.ToLower(entry.Network)
+		if slices.Contains(p.Config.ExcludeNetworks, network) {
+			continue
+		}
+		if alias, ok := p.Config.NetworkAliases[network]; ok {
+			network = alias
+		}
+		if groupNetwork, ok := p.Config.ClientGroupNetworks[entry.UserGroupID]; ok && entry.UserGroupID != "" {
+			network = groupNetwork
+		}
+		network, networkConfig, ok := p.Config.network(network, int(entry.Vlan.Val), ip)
+		// the domain of the site wins over the one of the network, the other options of the network stay
+		if siteDomain, siteOK := p.Config.siteDomain(entry); siteOK {
+			siteConfig := NetworkConfig{}
+			if ok {
+				siteConfig = *networkConfig
+			}
+			siteConfig.Domain = siteDomain
+			networkConfig, ok = &siteConfig, true
+		}
+		if !ok {
+			skip(entry, "unknown_network")
+			continue
+		}
+		// configs that weren't parsed can have domains without the trailing dot
+		domain := dns.Fqdn(networkConfig.Domain)
+
+		rrtype := dns.TypeAAAA
+		if ip.To4() != nil {
+			rrtype = dns.TypeA
+		}
+		if !networkConfig.allowsRecordType(rrtype) {
+			continue
+		}
+
+		// a dns label can't be longer than 63 octets, miekg/dns would reject the longer names
+		maxLength := p.Config.maxHostnameLength() - len(p.Config.dnsPrefix()) - len(networkConfig.Prefix) - len(networkConfig.Suffix)
+		truncatedName := dns_name
+		if p.Config.PreserveDots {
+			truncatedName = truncateLabels(dns_name, p.Config.maxHostnameLength(), len(p.Config.dnsPrefix())+len(networkConfig.Prefix), len(networkConfig.Suffix))
+		} else if len(dns_name) > maxLength {
+			truncatedName = truncateName(dns_name, maxLength)
+		}
+		if truncatedName != dns_name {
+			p.debugf("truncating %s to %s", dns_name, truncatedName)
+			UnifinamesNamesTruncatedCount.Inc()
+			if truncatedName == "" {
+				continue
+			}
+			dns_name = truncatedName
+		}
+		name := dns.Fqdn(p.Config.dnsPrefix() + networkConfig.Prefix + dns_name + networkConfig.Suffix + "." + domain)
+		// the labels of preserve_dots can add up to more than a name can have (RFC 1035 2.3.4)
+		if len(name) > maxNameLength {
+			skip(entry, "name_too_long")
+			continue
+		}
+		if p.Config.MaxRecords > 0 {
+			records := 1
+			if p.Config.WildcardClients {
+				records = 2
+			}
+			if len(aClients)+len(aaaaClients)+records > p.Config.MaxRecords {
+				truncated++
+				continue
+			}
+		}
+		// network_priority also decides between the records a client has in networks of different priority
+		firstPriority, priority := p.Config.networkPriority(seen[name][1]), p.Config.networkPriority(network)
+		if first, ok := seen[name]; ok && first[0] != entry.Mac && firstPriority == priority && p.Config.NameDedupStrategy != "" {
+			log.Warningf("hostname collision for %s in network %s between %s and %s", name, entry.Network, first[0], entry.Mac)
+			UnifinamesCollisionsCount.Inc()
+			switch p.Config.NameDedupStrategy {
+			case "skip":
+				if removeName(name, first[1]) > 0 {
+					countSkip("duplicate_name")
 				}
-				if err := p.getClients(context.Background()); err != nil {
-					p.mu.Unlock()
-					log.Printf("[unifi-names] unable to get clients: %v\n", err)
-					return
+				skip(entry, "duplicate_name")
+				continue
+			case "first_wins":
+				skip(entry, "duplicate_name")
+				continue
+			default:
+				// the records of a dual stack client get the same name
+				key := [2]string{name, entry.Mac}
+				if _, ok := renamed[key]; !ok {
+					renamed[key] = p.dedupName(name, entry.Mac, seen, dedup, func(label string) string {
+						return dns.Fqdn(p.Config.dnsPrefix() + networkConfig.Prefix + truncateName(dns_name, maxLength-len(label)) + label + networkConfig.Suffix + "." + domain)
+					})
 				}
-				p.mu.Unlock()
-				log.Printf("[unifi-names] got %d hosts", len(p.aClients)+len(p.aaaaClients))
-				p.lastUpdate = time.Now()
+				if renamed[key] == "" {
+					skip(entry, "duplicate_name")
+					continue
+				}
+				name = renamed[key]
 			}
-			update()
-			t := time.NewTicker(time.Duration(p.Config.TTL) * time.Second)
-			for range t.C {
-				update()
+		}
+		if first, ok := seen[name]; ok && (first[0] != entry.Mac || firstPriority != priority) {
+			policy := p.Config.HostnameCollisionPolicy
+			if first[0] != entry.Mac {
+				log.Warningf("hostname collision for %s in network %s between %s and %s", name, entry.Network, first[0], entry.Mac)
+				UnifinamesCollisionsCount.Inc()
 			}
-		}()
-	}
+			if priority < firstPriority {
+				policy = "last"
+			} else if priority > firstPriority {
+				policy = "first"
+			}
+			switch policy {
+			case "last":
+				removeName(name, first[1])
+			case "all":
+			default:
+				continue
+			}
+		}
+		seen[name] = [2]string{entry.Mac, network}
+		networkHosts[network]++
+		site := clientSite(entry)
+		siteHosts[site]++
+		hostSites[strings.ToLower(name)] = site
+		if networkConfig.Weight != 0 {
+			recordWeights[recordWeightKey(name, ip.String())] = networkConfig.Weight
+		}
+		clientInfos = append(clientInfos, ClientInfo{Hostname: name, IP: ip.String(), Network: network, MAC: entry.Mac})
+		if p.Config.ClientMetrics {
+			lastSeen[[3]string{strings.TrimSuffix(name, "."), network, ip.String()}] = entry.LastSeen.Val
+		}
 
-	UnifinamesCount.Inc()
-	if p.resolve(w, r) {
-		return dns.RcodeSuccess, nil
-	}
+		clientDebugf("adding %s %s", name, address)
 
-	return plugin.NextOrFailure(p.Name(), p.Next, ctx, w, r)
-}
+		// the records of a client whose lease ends before the next refresh expire with the lease
+		ttl := p.Config.leaseTTL(networkConfig.TTL, entry, now)
+		hdr := dns.RR_Header{
+			Name:     name,
+			Rrtype:   rrtype,
+			Class:    dns.ClassINET,
+			Ttl:      ttl,
+			Rdlength: 0,
+		}
 
-// Name implements the Handler interface.
-func (*unifinames) Name() string { return "unifi-names" }
+		if rrtype == dns.TypeA {
+			aClients = append(aClients, dns.A{
+				Hdr: hdr,
+				A:   ip,
+			})
+		} else {
+			aaaaClients = append(aaaaClients, dns.AAAA{
+				Hdr:  hdr,
+				AAAA: ip,
+			})
+		}
 
-func (p *unifinames) resolve(w dns.ResponseWriter, r *dns.Msg) bool {
-	if len(r.Question) <= 0 {
-		return false
-	}
+		// the controller only has a numeric fingerprint id for the os, e.g. 56, so the os is left empty
+		if vendor := p.Config.vendor(entry.Mac, entry.Oui); p.Config.ServeHINFO && vendor != "" {
+			hinfoClients[strings.ToLower(name)] = dns.HINFO{
+				Hdr: dns.RR_Header{
+					Name:   name,
+					Rrtype: dns.TypeHINFO,
+					Class:  dns.ClassINET,
+					Ttl:    ttl,
+				},
+				Cpu: vendor,
+			}
+		}
 
-	var rrs []dns.RR
+		if p.Config.IncludeSwitchPorts && entry.IsWired.Val && entry.SwPort.Val > 0 {
+			// switches without a name in the controller are shown with their mac
+			switchName := entry.SwName
+			if switchName == "" {
+				switchName = entry.SwMac
+			}
+			switchPortClients[strings.ToLower(name)] = dns.TXT{
+				Hdr: dns.RR_Header{
+					Name:   name,
+					Rrtype: dns.TypeTXT,
+					Class:  dns.ClassINET,
+					Ttl:    ttl,
+				},
+				Txt: []string{"switch=" + switchName, "port=" + strconv.Itoa(entry.SwPort.Int())},
+			}
+		}
 
-	for i := 0; i < len(r.Question); i++ {
-		question := r.Question[i]
-		if question.Qclass != dns.ClassINET {
-			continue
+		if vendor := p.Config.vendor(entry.Mac, entry.Oui); p.Config.IncludeTXTMetadata && vendor != "" {
+			metadataClients[strings.ToLower(name)] = dns.TXT{
+				Hdr: dns.RR_Header{
+					Name:   name,
+					Rrtype: dns.TypeTXT,
+					Class:  dns.ClassINET,
+					Ttl:    ttl,
+				},
+				Txt: []string{"vendor=" + vendor},
+			}
 		}
 
-		switch question.Qtype {
-		case dns.TypeA:
-			if p.shouldHandle(strings.ToLower(question.Name)) {
-				p.mu.Lock()
-				for _, client := range p.aClients {
-					if strings.EqualFold(client.Hdr.Name, question.Name) {
-						client.Hdr.Ttl = p.Config.TTL - uint32(time.Now().Sub(p.lastUpdate).Seconds())
-						rrs = append(rrs, &client)
-						break
-					}
-				}
-				p.mu.Unlock()
+		if naptr := p.Config.naptrRecords(name, rawName, dns_name, ttl); len(naptr) > 0 {
+			naptrClients[strings.ToLower(name)] = naptr
+		}
+
+		if service != "" {
+			srv, ok := p.Config.srvRecord(service, proto, name, ttl)
+			// a dual stack client has the same SRV record for both of its addresses
+			duplicate := slices.ContainsFunc(srvClients, func(rr dns.SRV) bool {
+				return rr.Hdr.Name == srv.Hdr.Name && rr.Target == srv.Target
+			})
+			if ok && !duplicate {
+				srvClients = append(srvClients, srv)
 			}
-		case dns.TypeAAAA:
-			if p.shouldHandle(strings.ToLower(question.Name)) {
-				p.mu.Lock()
-				for _, client := range p.aaaaClients {
-					if strings.EqualFold(client.Hdr.Name, question.Name) {
-						client.Hdr.Ttl = p.Config.TTL - uint32(time.Now().Sub(p.lastUpdate).Seconds())
-						rrs = append(rrs, &client)
-						break
-					}
-				}
-				p.mu.Unlock()
+		}
+
+		if p.Config.WildcardClients {
+			hdr.Name = "*." + name
+			if rrtype == dns.TypeA {
+				aClients = append(aClients, dns.A{Hdr: hdr, A: ip})
+			} else {
+				aaaaClients = append(aaaaClients, dns.AAAA{Hdr: hdr, AAAA: ip})
 			}
 		}
 	}
 
-	if len(rrs) > 0 {
-		if p.Config.Debug {
-			log.Printf("[unifi-names] Answering with %d rr's\n", len(rrs))
-		}
-		m := new(dns.Msg)
-		m.SetReply(r)
-		m.Answer = rrs
-		w.WriteMsg(m)
-		return true
+	if truncated > 0 {
+		log.Warningf("dropped %d clients after reaching the limit of %d records", truncated, p.Config.MaxRecords)
 	}
-	return false
-}
+	UnifinamesRecordsTruncated.Set(float64(truncated))
 
-func (p *unifinames) shouldHandle(name string) bool {
-	for _, domain := range p.Config.Networks {
-		if strings.HasSuffix(name, domain) {
-			return true
-		}
+	hosts := 0
+	for _, count := range networkHosts {
+		hosts += count
 	}
-	return false
-}
+	aClients, aaaaClients = p.appendApexRecords(aClients, aaaaClients)
 
-var reSetCookieToken = regexp.MustCompile(`unifises=([0-9a-zA-Z]+)`)
+	var debugRecords []debugRecord
+	if p.Config.DebugFile != "" {
+		networks := map[string]string{}
+		for name, first := range seen {
+			networks[name] = first[1]
+		}
+		debugRecords = p.buildDebugRecords(aClients, aaaaClients, networks)
+	}
 
-func (p *unifinames) getClients(ctx context.Context) error {
-	var c unifi.Config
+	p.mu.Lock()
+	// a refresh that was given up must not replace the records of a later one
+	if err := ctx.Err(); err != nil {
+		p.mu.Unlock()
+		return errors.Annotate(err, "coredns-unifi-names: unable to get clients")
+	}
+	if p.deferUpdate(aClients, aaaaClients) {
+		p.mu.Unlock()
+		return nil
+	}
+	changedIPs := ipChanges(p.aClients, p.aaaaClients, aClients, aaaaClients)
+	p.aClients = aClients
+	p.aaaaClients = aaaaClients
+	p.hinfoClients = hinfoClients
+	p.switchPortClients = switchPortClients
+	p.metadataClients = metadataClients
+	p.naptrClients = naptrClients
+	p.srvClients = srvClients
+	p.clients = clientInfos
+	p.skippedClients = skipped
+	p.recordsHash = clientsHash(aClients, aaaaClients)
+	p.lastUpdate = time.Now()
+	p.indexRecords()
+	p.hostSites.Store(&hostSites)
+	if len(recordWeights) > 0 {
+		p.recordWeights.Store(&recordWeights)
+	} else {
+		p.recordWeights.Store(nil)
+	}
+	previousDebugRecords := p.debugRecords
+	p.debugRecords = debugRecords
+	p.mu.Unlock()
 
-	c = unifi.Config{
-		User:      p.Config.UnifiUsername,
-		Pass:      p.Config.UnifiPassword,
-		URL:       p.Config.UnifiControllerURL,
-		VerifySSL: p.Config.UnifiVerifySSL,
+	for _, change := range changedIPs {
+		log.Infof("IP changed for %s", change)
 	}
+	UnifinamesIPChangesCount.Add(float64(len(changedIPs)))
 
-	uni, err := unifi.NewUnifi(&c)
-	if err != nil {
-		return errors.Annotate(err, "coredns-unifi-names: unable to create unifi client")
+	if p.Config.CompactLogging {
+		p.debugf("refresh complete: %s", refreshSummary(len(clientInfos), skipped, skipReasons))
 	}
 
-	sites, err := uni.GetSites()
-	if err != nil {
-		return errors.Annotate(err, "coredns-unifi-names: unable to get sites")
+	if p.Config.DebugFile != "" {
+		if err := p.writeDebugFile(previousDebugRecords, debugRecords); err != nil {
+			log.Errorf("unable to write debug file: %v", err)
+		}
 	}
 
-	clients, err := uni.GetClients(sites)
-	if err != nil {
-		return errors.Annotate(err, "coredns-unifi-names: unable to get clients")
+	p.updateHostMetrics(hosts, networkHosts)
+	updateSiteMetrics(siteHosts)
+	if p.Config.ClientMetrics {
+		updateClientMetrics(lastSeen)
 	}
+	return nil
 
-	p.aClients = nil
-	p.aaaaClients = nil
+}
 
-	for _, entry := range clients {
-		dns_name := ""
+// deferUpdate returns whether the records of a refresh are dropped for batch_update_threshold, p.mu has to
+// be held. The records are compared to the ones in memory, so the deferred changes add up until they reach
+// the threshold or the first of them was deferred max_defer_duration ago
+func (p *unifinames) deferUpdate(aClients []dns.A, aaaaClients []dns.AAAA) bool {
+	if p.Config.BatchUpdateThreshold <= 0 || len(p.aClients)+len(p.aaaaClients) == 0 {
+		return false
+	}
+	changes := recordChanges(p.aClients, p.aaaaClients, aClients, aaaaClients)
+	if changes == 0 || changes >= p.Config.BatchUpdateThreshold {
+		p.deferredSince = time.Time{}
+		return false
+	}
+	if p.deferredSince.IsZero() {
+		p.deferredSince = time.Now()
+	} else if time.Since(p.deferredSince) >= p.Config.MaxDeferDuration {
+		p.debugf("updating %d deferred changes after %s", changes, p.Config.MaxDeferDuration)
+		p.deferredSince = time.Time{}
+		return false
+	}
+	p.debugf("deferring %d changes below the batch_update_threshold of %d", changes, p.Config.BatchUpdateThreshold)
+	UnifinamesDeferredUpdatesCount.Inc()
+	return true
+}
 
-		if p.Config.UseNameAsHostname {
-			dns_name = strings.ToLower(sanitizeName(entry.Name))
-			if entry.Name == "" {
-				continue
-			}
-		} else {
-			dns_name = strings.ToLower(sanitizeName(entry.Hostname))
-			if entry.Hostname == "" {
-				continue
-			}
-		}
+// recordChanges returns how many of the A and AAAA records were added and removed between the old and the
+// new records
+func recordChanges(oldA []dns.A, oldAAAA []dns.AAAA, newA []dns.A, newAAAA []dns.AAAA) int {
+	records := map[string]int{}
+	for _, client := range oldA {
+		records[strings.ToLower(client.Hdr.Name)+" "+client.A.String()]--
+	}
+	for _, client := range oldAAAA {
+		records[strings.ToLower(client.Hdr.Name)+" "+client.AAAA.String()]--
+	}
+	for _, client := range newA {
+		records[strings.ToLower(client.Hdr.Name)+" "+client.A.String()]++
+	}
+	for _, client := range newAAAA {
+		records[strings.ToLower(client.Hdr.Name)+" "+client.AAAA.String()]++
+	}
+	changes := 0
+	for _, count := range records {
+		changes += max(count, -count)
+	}
+	return changes
+}
 
-		if dns_name == "" {
-			continue
+// ipChanges returns the names that kept their A or AAAA records but not their ips between the old and the
+// new records, e.g. "mydevice.lan: 192.168.1.50 → 192.168.1.51". The names that were added or removed are
+// no changes
+func ipChanges(oldA []dns.A, oldAAAA []dns.AAAA, newA []dns.A, newAAAA []dns.AAAA) []string {
+	// the ips of each name and type, [0] are the old and [1] the new ones
+	ips := map[string]*[2][]string{}
+	add := func(i int, name, rrtype, ip string) {
+		key := strings.ToLower(strings.TrimSuffix(name, ".")) + " " + rrtype
+		if ips[key] == nil {
+			ips[key] = &[2][]string{}
 		}
-
-		if dns_val.IsFQDN(dns_name) {
+		ips[key][i] = append(ips[key][i], ip)
+	}
+	for _, client := range oldA {
+		add(0, client.Hdr.Name, "A", client.A.String())
+	}
+	for _, client := range oldAAAA {
+		add(0, client.Hdr.Name, "AAAA", client.AAAA.String())
+	}
+	for _, client := range newA {
+		add(1, client.Hdr.Name, "A", client.A.String())
+	}
+	for _, client := range newAAAA {
+		add(1, client.Hdr.Name, "AAAA", client.AAAA.String())
+	}
+	var changes []string
+	for key, addresses := range ips {
+		if len(addresses[0]) == 0 || len(addresses[1]) == 0 {
 			continue
 		}
-
-		ip := net.ParseIP(entry.IP)
-		if ip == nil {
+		sort.Strings(addresses[0])
+		sort.Strings(addresses[1])
+		if slices.Equal(addresses[0], addresses[1]) {
 			continue
 		}
+		name, _, _ := strings.Cut(key, " ")
+		changes = append(changes, fmt.Sprintf("%s: %s → %s", name, strings.Join(addresses[0], ", "), strings.Join(addresses[1], ", ")))
+	}
+	sort.Strings(changes)
+	return changes
+}
 
-		domain, ok := p.Config.Networks[strings.ToLower(entry.Network)]
-		if !ok {
-			continue
-		}
+// clientsHash returns a hash of the names and ips of the records that doesn't depend on their order
+func clientsHash(a []dns.A, aaaa []dns.AAAA) uint64 {
+	records := make([]string, 0, len(a)+len(aaaa))
+	for _, client := range a {
+		records = append(records, strings.ToLower(client.Hdr.Name)+" "+client.A.String())
+	}
+	for _, client := range aaaa {
+		records = append(records, strings.ToLower(client.Hdr.Name)+" "+client.AAAA.String())
+	}
+	sort.Strings(records)
 
-		if p.Config.Debug {
-			log.Printf("[unifi-names] adding %s %s\n", entry.Name+"."+domain, entry.IP)
-		}
+	h := fnv.New64a()
+	for _, record := range records {
+		h.Write([]byte(record))
+		h.Write([]byte{'\n'})
+	}
+	return h.Sum64()
+}
 
+// appendApexRecords adds the configured apex records to the client records
+func (p *unifinames) appendApexRecords(aClients []dns.A, aaaaClients []dns.AAAA) ([]dns.A, []dns.AAAA) {
+	for domain, value := range p.Config.ApexRecords {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			continue
+		}
 		hdr := dns.RR_Header{
-			Name:     dns_name + "." + domain,
-			Rrtype:   0,
-			Class:    dns.ClassINET,
-			Ttl:      0,
-			Rdlength: 0,
+			Name:  domain,
+			Class: dns.ClassINET,
 		}
-
 		if ip.To4() != nil {
 			hdr.Rrtype = dns.TypeA
-			p.aClients = append(p.aClients, dns.A{
-				Hdr: hdr,
-				A:   ip,
-			})
+			aClients = append(aClients, dns.A{Hdr: hdr, A: ip})
 		} else {
 			hdr.Rrtype = dns.TypeAAAA
-			p.aaaaClients = append(p.aaaaClients, dns.AAAA{
-				Hdr:  hdr,
-				AAAA: ip,
-			})
+			aaaaClients = append(aaaaClients, dns.AAAA{Hdr: hdr, AAAA: ip})
 		}
 	}
+	return aClients, aaaaClients
+}
 
-	UnifinamesHostsCount.Set(float64(len(p.aClients) + len(p.aaaaClients)))
-	return nil
+// clearClients drops all records, getClients always builds the records from scratch so this is only
+// needed to get rid of records that should not be served anymore
+func (p *unifinames) clearClients() {
+	p.mu.Lock()
+	p.aClients = nil
+	p.aaaaClients = nil
+	p.hinfoClients = nil
+	p.switchPortClients = nil
+	p.metadataClients = nil
+	p.naptrClients = nil
+	p.srvClients = nil
+	p.clients = nil
+	p.recordsHash = clientsHash(nil, nil)
+	p.indexRecords()
+	p.hostSites.Store(nil)
+	p.recordWeights.Store(nil)
+	p.mu.Unlock()
 
+	p.updateHostMetrics(0, nil)
+	updateSiteMetrics(nil)
+	updateClientMetrics(nil)
 }
 
-func isAllowedRune(allowedRunes []rune, r rune) bool {
-	for _, a := range allowedRunes {
-		if a == r {
-			return true
+// updateHostMetrics sets the host gauges, configured networks without any hosts are reported as 0
+func (p *unifinames) updateHostMetrics(total int, networkHosts map[string]int) {
+	UnifinamesHostsCount.Set(float64(total))
+	// reset so networks that disappeared from the config don't keep reporting
+	UnifinamesNetworkHostsCount.Reset()
+	for network, networkConfig := range p.Config.Networks {
+		UnifinamesNetworkHostsCount.WithLabelValues(network, networkConfig.Domain).Set(float64(networkHosts[network]))
+	}
+	if p.Config.DefaultDomain != "" {
+		UnifinamesNetworkHostsCount.WithLabelValues(defaultNetwork, p.Config.DefaultDomain).Set(float64(networkHosts[defaultNetwork]))
+	}
+}
+
+// updateClientMetrics replaces the last seen gauges with the ones of lastSeen, so the clients that are
+// gone don't keep reporting
+func updateClientMetrics(lastSeen map[[3]string]float64) {
+	UnifinamesClientLastSeen.Reset()
+	for labels, timestamp := range lastSeen {
+		UnifinamesClientLastSeen.WithLabelValues(labels[0], labels[1], labels[2]).Set(timestamp)
+	}
+}
+
+// updateSiteMetrics replaces the site host gauges with the ones of siteHosts, so the sites that are gone
+// don't keep reporting
+func updateSiteMetrics(siteHosts map[string]int) {
+	UnifinamesSiteHostsCount.Reset()
+	for site, count := range siteHosts {
+		UnifinamesSiteHostsCount.WithLabelValues(site).Set(float64(count))
+	}
+}
+
+// countSiteQueries increments UnifinamesSiteQueryCount for the site of the client answered with rrs, the
+// names answered by a wildcard record count for the client of the wildcard
+func (p *unifinames) countSiteQueries(rrs []dns.RR) {
+	hostSites := p.hostSites.Load()
+	if hostSites == nil || len(rrs) == 0 {
+		return
+	}
+	name := strings.ToLower(rrs[0].Header().Name)
+	site, ok := (*hostSites)[name]
+	if !ok {
+		site, ok = (*hostSites)[strings.TrimPrefix(wildcardName(name), "*.")]
+	}
+	if ok {
+		UnifinamesSiteQueryCount.WithLabelValues(site, "hit").Inc()
+	}
+}
+
+// countClientQueries increments UnifinamesClientQueryCount for the clients answered with rrs, once the
+// counter has per_client_metrics_max_cardinality label values the clients without one aren't counted
+func (p *unifinames) countClientQueries(rrs []dns.RR) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	counted := map[string]bool{}
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		if counted[name] {
+			continue
+		}
+		counted[name] = true
+		for _, client := range p.clients {
+			if client.Hostname != name {
+				continue
+			}
+			labels := [2]string{strings.TrimSuffix(name, "."), client.Network}
+			if !p.clientQueryLabels[labels] {
+				if max := p.Config.PerClientMetricsMaxCardinality; max > 0 && len(p.clientQueryLabels) >= max {
+					break
+				}
+				if p.clientQueryLabels == nil {
+					p.clientQueryLabels = map[[2]string]bool{}
+				}
+				p.clientQueryLabels[labels] = true
+			}
+			UnifinamesClientQueryCount.WithLabelValues(labels[0], labels[1]).Inc()
+			break
 		}
 	}
-	return false
+}
+
+// allowedRunes are the runes a sanitized name can contain, all of them are ascii so they are looked up
+// by their value
+var allowedRunes = func() (allowed [128]bool) {
+	for _, r := range "abcdefghijklmnopqrstuvwxyz0123456789-" {
+		allowed[r] = true
+	}
+	return allowed
+}()
+
+func isAllowedRune(r rune) bool {
+	return r >= 0 && r < rune(len(allowedRunes)) && allowedRunes[r]
 }
 
 func sanitizeName(s string) string {
-	var allowedRunes = []rune("abcdefghijklmnopqrstuvwxyz12345679-")
 	if s == "" {
 		return ""
 	}
@@ -248,34 +2129,159 @@ func sanitizeName(s string) string {
 	r := []rune(s)
 	size := len(r)
 	for i := 0; i < size; i++ {
-		if isAllowedRune(allowedRunes, r[i]) {
+		if isAllowedRune(r[i]) {
 			sb.WriteRune(r[i])
 		} else {
 			sb.WriteRune('-')
 		}
 	}
-
 	// remove --
 	return strings.Join(strings.FieldsFunc(sb.String(), func(r rune) bool {
 		return r == '-'
 	}), "-")
 }
 
-func (p *unifinames) Ready() bool {
-	if p.IsReady == false {
-		p.mu.Lock()
-		if p.Config.Debug {
-			log.Println("[unifi-names] updating clients")
+// reservedNames are the labels that have a special meaning for the resolvers or the other hosts, a client
+// with one of them, e.g. a device named wpad, would answer their queries. The special use domains of
+// RFC 6761 are left out of the names too
+var reservedNames = []string{
+	"localhost", "localdomain", "broadcasthost", "wpad", "isatap", "_gateway", "_outbound",
+	"ip6-localhost", "ip6-loopback", "ip6-localnet", "ip6-mcastprefix", "ip6-allnodes", "ip6-allrouters",
+	"ip6-allhosts", "local", "invalid", "test", "example", "onion", "arpa",
+}
+
+// isReservedName reports whether the lowercased name is one of the reservedNames or the
+// additional_reserved_names
+func (c *config) isReservedName(name string) bool {
+	return slices.Contains(reservedNames, name) || slices.Contains(c.AdditionalReservedNames, name)
+}
+
+// isStrictHostname reports whether the labels of name are hostname labels of RFC 1123 that don't confuse
+// the tools that take digits for an ip: no hyphen at the start or the end, not only digits and at least
+// 2 characters
+func isStrictHostname(name string) bool {
+	for _, label := range strings.Split(name, ".") {
+		if len(label) < 2 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
 		}
-		if err := p.getClients(context.Background()); err != nil {
-			log.Printf("[unifi-names] unable to get clients: %v\n", err)
-			p.IsReady = true
+		if strings.Trim(label, "0123456789") == "" {
+			return false
 		}
-		p.mu.Unlock()
-		log.Printf("[unifi-names] got %d hosts", len(p.aClients)+len(p.aaaaClients))
-		p.lastUpdate = time.Now()
-		p.IsReady = true
 	}
+	return true
+}
+
+// truncateName cuts name to length octets, a trailing hyphen is removed so the label stays valid
+func truncateName(name string, length int) string {
+	if length <= 0 {
+		return ""
+	}
+	if len(name) > length {
+		name = name[:length]
+	}
+	return strings.TrimRight(name, "-")
+}
+
+// stripHostnameSuffix removes the suffixes of hostname_suffix_strip from name until none of them matches,
+// e.g. mydevice.local.lan becomes mydevice. The suffixes are compared case-insensitively
+func (c *config) stripHostnameSuffix(name string) string {
+	for stripped := true; stripped; {
+		stripped = false
+		for _, suffix := range c.HostnameSuffixStrip {
+			if suffix != "" && len(name) >= len(suffix) && strings.EqualFold(name[len(name)-len(suffix):], suffix) {
+				name, stripped = name[:len(name)-len(suffix)], true
+			}
+		}
+	}
+	return name
+}
+
+// maxNameLength is the longest fqdn in its presentation format with the final dot, 253 octets without it
+const maxNameLength = 254
+
+// truncateLabels truncates each label of name for preserve_dots to length, the first label loses the
+// octets of the prefix in front of it and the last one the octets of the suffix. It is empty when a label
+// doesn't fit
+func truncateLabels(name string, length, prefix, suffix int) string {
+	labels := strings.Split(name, ".")
+	for i := range labels {
+		limit := length
+		if i == 0 {
+			limit -= prefix
+		}
+		if i == len(labels)-1 {
+			limit -= suffix
+		}
+		if labels[i] = truncateName(labels[i], limit); labels[i] == "" {
+			return ""
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// Ready implements the ready.Readiness interface, the clients are fetched on the first call. With
+// require_initial_data the plugin isn't ready until that succeeded, every call tries again
+func (p *unifinames) Ready() bool {
+	// lazy_load fetches the clients on the first query
+	if p.Config.LazyLoad {
+		p.IsReady.Store(true)
+	}
+	if !p.IsReady.Load() {
+		if err := p.refresh(); err != nil {
+			var authErr *ErrAuthFailure
+			if errors.As(err, &authErr) {
+				log.Errorf("controller rejected the credentials, check the unifi directive: %v", err)
+			} else if !errors.Is(err, errCircuitOpen) {
+				log.Errorf("unable to get clients: %v", err)
+			}
+			if p.Config.RequireInitialData {
+				log.Warning("not ready until the clients could be fetched from the controller (require_initial_data)")
+				return false
+			}
+		} else {
+			log.Infof("got %d hosts, skipped %d clients", p.recordCount(), p.skippedClientCount())
+		}
+		p.IsReady.Store(true)
+	}
+
+	return p.IsReady.Load()
+}
+
+// recordCount returns the number of A and AAAA records
+func (p *unifinames) recordCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.aClients) + len(p.aaaaClients)
+}
+
+// skippedClientCount returns how many clients of the last refresh got no record
+func (p *unifinames) skippedClientCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.skippedClients
+}
+
+// Health returns false once the clients couldn't be fetched from the controller for unhealthy_threshold
+// (three refresh intervals by default), e.g. because the refresh goroutine died or the controller is
+// gone for good. The refreshes get unhealthy_threshold from the start of the refresh goroutine to succeed a
+// first time, and an idle plugin whose goroutine wasn't started by a query yet has no refresh that is due
+func (p *unifinames) Health() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.refreshStarted.IsZero() {
+		return true
+	}
+	since := p.lastSuccessfulUpdate
+	if p.refreshStarted.After(since) {
+		since = p.refreshStarted
+	}
+	return time.Since(since) <= p.unhealthyThreshold()
+}
 
-	return p.IsReady
+// unhealthyThreshold returns how long the refreshes may fail before the plugin is unhealthy
+func (p *unifinames) unhealthyThreshold() time.Duration {
+	if p.Config.UnhealthyThreshold > 0 {
+		return p.Config.UnhealthyThreshold
+	}
+	return 3 * p.refreshInterval()
 }
@@ -2,11 +2,19 @@ package unifinames
 
 import (
 	"context"
+	"encoding/json"
 	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"testing"
 
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"fmt"
 
@@ -14,8 +22,13 @@ import (
 
 	"time"
 
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/plugin/test"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
+	"github.com/unpoller/unifi"
+	"golang.org/x/net/websocket"
 )
 
 type dummyResponseWriter struct {
@@ -47,18 +60,7 @@ func (d *dummyResponseWriter) GetBytes() []byte { return d.bytes }
 func (d *dummyResponseWriter) ClearBytes()      { d.bytes = nil }
 
 func MockUnifiController(fingerprint *[]byte, lan, name, ip string) *httptest.Server {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/api/login", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Set-Cookie", "unifises=deadbeef")
-		w.WriteHeader(http.StatusOK)
-	})
-	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
-	mux.HandleFunc("/api/s/default/stat/sta", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `{
-  "data": [
+	return mockUnifiController(fingerprint, fmt.Sprintf(`[
     {
       "_id": "eeeeeeeeeeeeeeeeeeeeeeee",
       "_is_guest_by_uap": false,
@@ -75,11 +77,11 @@ func MockUnifiController(fingerprint *[]byte, lan, name, ip string) *httptest.Se
       "bytes-r": 124,
       "ccq": 333,
       "channel": 44,
-      "dhcpend_time": 3800,
+      "dhcpend_time": 4102444800,
       "essid": "PublicWifi",
       "first_seen": 1582216621,
       "gw_mac": "aa:bb:cc:dd:ee:ff",
-      "hostname": "debian",
+      "hostname": "%s",
       "idletime": 16,
       "ip": "%s",
       "is_11r": false,
@@ -119,14 +121,20 @@ func MockUnifiController(fingerprint *[]byte, lan, name, ip string) *httptest.Se
       "vlan": 0,
       "wifi_tx_attempts": 25915
     }
-  ],
-  "meta": {
-    "rc": "ok"
-  }
-}`, ip, name, lan)
-	})
+  ]`, name, ip, name, lan))
+}
 
-	s := httptest.NewTLSServer(mux)
+// MockUnifiControllerWithClients serves clients, each client is marshaled as is
+func MockUnifiControllerWithClients(fingerprint *[]byte, clients ...map[string]interface{}) *httptest.Server {
+	data, err := json.Marshal(clients)
+	if err != nil {
+		panic(err)
+	}
+	return mockUnifiController(fingerprint, string(data))
+}
+
+func mockUnifiController(fingerprint *[]byte, clients string) *httptest.Server {
+	s := httptest.NewTLSServer(mockUnifiMux(clients))
 	if len(s.TLS.Certificates) != 1 {
 		panic("expected 1 certificate")
 	}
@@ -141,6 +149,61 @@ func MockUnifiController(fingerprint *[]byte, lan, name, ip string) *httptest.Se
 	return s
 }
 
+// mockUnifiMux is the handler of the controller of mockUnifiController
+func mockUnifiMux(clients string) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/login", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "unifises=deadbeef; Path=/")
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{"meta": {"rc": "ok", "server_version": "7.4.162", "up": true}}`)
+	})
+	mux.HandleFunc("/api/stat/sites", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{"data": [{"_id": "eeeeeeeeeeeeeeeeeeeeeeee", "name": "default", "desc": "Default"}], "meta": {"rc": "ok"}}`)
+	})
+	mux.HandleFunc("/api/s/default/stat/sta", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"data": %s, "meta": {"rc": "ok"}}`, clients)
+	})
+	mux.HandleFunc("/api/s/default/rest/networkconf", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{"data": [
+			{"_id": "aaaaaaaaaaaaaaaaaaaaaaa1", "name": "LAN", "ip_subnet": "192.168.1.1/24"},
+			{"_id": "aaaaaaaaaaaaaaaaaaaaaaa2", "name": "VLAN1", "ip_subnet": "192.168.10.1/24"}
+		], "meta": {"rc": "ok"}}`)
+	})
+	mux.HandleFunc("/api/s/default/stat/device", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{"data": [
+			{"type": "udm", "name": "Gateway", "mac": "00:00:00:00:01:01", "ip": "203.0.113.1", "lan_ip": "192.168.1.254"},
+			{"type": "uap", "name": "AP Office", "mac": "00:00:00:00:01:02", "ip": "192.168.1.253"},
+			{"type": "usw", "name": "Switch Office", "mac": "00:00:00:00:01:03"}
+		], "meta": {"rc": "ok"}}`)
+	})
+
+	mux.HandleFunc("/api/s/default/stat/remoteuservpn", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{"data": [{"name": "roadwarrior", "ip": "10.8.0.2"}], "meta": {"rc": "ok"}}`)
+	})
+
+	mux.Handle("/wss/s/default/events", websocket.Handler(func(ws *websocket.Conn) {
+		if cookie, err := ws.Request().Cookie("unifises"); err != nil || cookie.Value != "deadbeef" {
+			return
+		}
+		_ = websocket.JSON.Send(ws, map[string]interface{}{
+			"meta": map[string]string{"rc": "ok", "message": "events"},
+			"data": []map[string]string{{"key": "EVT_WU_Connected", "user": "00:00:00:00:00:01"}},
+		})
+	}))
+	return mux
+}
+
 func TestServeDNS(t *testing.T) {
 	t.Run("A", func(t *testing.T) {
 		var fp []byte
@@ -148,8 +211,8 @@ func TestServeDNS(t *testing.T) {
 		defer s.Close()
 		p := unifinames{
 			Config: &config{
-				Networks: map[string]string{
-					"lan": "lan.",
+				Networks: map[string]*NetworkConfig{
+					"lan": {Domain: "lan."},
 				},
 				TTL:                 60 * 60,
 				Debug:               true,
@@ -187,8 +250,8 @@ func TestServeDNS(t *testing.T) {
 		defer s.Close()
 		p := unifinames{
 			Config: &config{
-				Networks: map[string]string{
-					"lan": "lan.",
+				Networks: map[string]*NetworkConfig{
+					"lan": {Domain: "lan."},
 				},
 				TTL:                 60 * 60,
 				Debug:               true,
@@ -226,8 +289,8 @@ func TestServeDNS(t *testing.T) {
 		defer s.Close()
 		p := unifinames{
 			Config: &config{
-				Networks: map[string]string{
-					"lan": "lan.",
+				Networks: map[string]*NetworkConfig{
+					"lan": {Domain: "lan."},
 				},
 				TTL:                 60 * 60,
 				Debug:               true,
@@ -259,8 +322,8 @@ func TestServeDNS(t *testing.T) {
 		defer s.Close()
 		p := unifinames{
 			Config: &config{
-				Networks: map[string]string{
-					"lan": "lan.",
+				Networks: map[string]*NetworkConfig{
+					"lan": {Domain: "lan."},
 				},
 				TTL:                 60 * 60,
 				Debug:               true,
@@ -284,8 +347,8 @@ func TestServeDNS(t *testing.T) {
 		defer s.Close()
 		p := unifinames{
 			Config: &config{
-				Networks: map[string]string{
-					"lan": "lan.",
+				Networks: map[string]*NetworkConfig{
+					"lan": {Domain: "lan."},
 				},
 				TTL:                 60 * 60,
 				Debug:               true,
@@ -303,11 +366,46 @@ func TestServeDNS(t *testing.T) {
 			Question: []dns.Question{
 				{
 					Name:   "server1.lan.",
-					Qclass: dns.ClassANY,
+					Qclass: dns.ClassCHAOS,
+					Qtype:  dns.TypeA,
+				},
+			},
+		})
+		require.Equal(t, 0, len(d.GetMsgs()))
+	})
+
+	t.Run("Dry Run", func(t *testing.T) {
+		s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+		defer s.Close()
+		p := unifinames{
+			Next: test.NextHandler(dns.RcodeNameError, nil),
+			Config: &config{
+				Networks: map[string]*NetworkConfig{
+					"lan": {Domain: "lan."},
+				},
+				TTL:                60 * 60,
+				Debug:              true,
+				UnifiControllerURL: s.URL,
+				UnifiSite:          "default",
+				UnifiUsername:      "admin",
+				UnifiPassword:      "admin",
+				DryRun:             true,
+			},
+		}
+		d := &dummyResponseWriter{}
+		p.ServeDNS(context.Background(), &dummyResponseWriter{}, &dns.Msg{})
+		time.Sleep(time.Millisecond * 500)
+		rcode, err := p.ServeDNS(context.Background(), d, &dns.Msg{
+			Question: []dns.Question{
+				{
+					Name:   "server1.lan.",
+					Qclass: dns.ClassINET,
 					Qtype:  dns.TypeA,
 				},
 			},
 		})
+		require.NoError(t, err)
+		require.Equal(t, dns.RcodeNameError, rcode)
 		require.Equal(t, 0, len(d.GetMsgs()))
 	})
 
@@ -320,8 +418,8 @@ func TestServeDNS(t *testing.T) {
 		defer s.Close()
 		p := unifinames{
 			Config: &config{
-				Networks: map[string]string{
-					"lan": "lan.",
+				Networks: map[string]*NetworkConfig{
+					"lan": {Domain: "lan."},
 				},
 				TTL:                 60 * 60,
 				Debug:               true,
@@ -329,6 +427,7 @@ func TestServeDNS(t *testing.T) {
 				UnifiSite:           "default",
 				UnifiUsername:       "admin",
 				UnifiPassword:       "admin",
+				UnifiVerifySSL:      true,
 				UnifiSSLFingerprint: fp,
 			},
 		}
@@ -352,8 +451,8 @@ func TestServeDNS(t *testing.T) {
 		defer s.Close()
 		p := unifinames{
 			Config: &config{
-				Networks: map[string]string{
-					"lan": "lan.",
+				Networks: map[string]*NetworkConfig{
+					"lan": {Domain: "lan."},
 				},
 				TTL:                 60 * 60,
 				Debug:               true,
@@ -361,6 +460,7 @@ func TestServeDNS(t *testing.T) {
 				UnifiSite:           "default",
 				UnifiUsername:       "admin",
 				UnifiPassword:       "admin",
+				UnifiVerifySSL:      true,
 				UnifiSSLFingerprint: nil,
 			},
 		}
@@ -379,3 +479,2354 @@ func TestServeDNS(t *testing.T) {
 		require.Equal(t, 0, len(d.GetMsgs()))
 	})
 }
+
+// newTestConfig returns a config that maps the "lan" network to "lan." using the controller at url
+func newTestConfig(url string) *config {
+	return &config{
+		Networks: map[string]*NetworkConfig{
+			"lan": {Domain: "lan."},
+		},
+		TTL:                60 * 60,
+		UnifiControllerURL: url,
+		UnifiSite:          "default",
+		UnifiUsername:      "admin",
+		UnifiPassword:      "admin",
+	}
+}
+
+func TestGetClients(t *testing.T) {
+	t.Run("Network Host Count", func(t *testing.T) {
+		s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+		defer s.Close()
+		p := unifinames{
+			Config: &config{
+				Networks: map[string]*NetworkConfig{
+					"lan":   {Domain: "lan."},
+					"vlan1": {Domain: "vlan1."},
+				},
+				TTL:                60 * 60,
+				UnifiControllerURL: s.URL,
+				UnifiSite:          "default",
+				UnifiUsername:      "admin",
+				UnifiPassword:      "admin",
+			},
+		}
+		UnifinamesNetworkHostsCount.WithLabelValues("vlan1", "vlan1.").Set(5)
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, float64(1), testutil.ToFloat64(UnifinamesNetworkHostsCount.WithLabelValues("lan", "lan.")))
+		require.Equal(t, float64(0), testutil.ToFloat64(UnifinamesNetworkHostsCount.WithLabelValues("vlan1", "vlan1.")))
+	})
+
+	t.Run("Client Metrics", func(t *testing.T) {
+		s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+		defer s.Close()
+		config := newTestConfig(s.URL)
+		p := unifinames{Config: config}
+		UnifinamesClientLastSeen.Reset()
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 0, testutil.CollectAndCount(UnifinamesClientLastSeen))
+
+		config.ClientMetrics = true
+		UnifinamesClientLastSeen.WithLabelValues("gone.lan", "lan", "127.0.0.2").Set(1)
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 1, testutil.CollectAndCount(UnifinamesClientLastSeen))
+		require.Equal(t, float64(1597826986), testutil.ToFloat64(UnifinamesClientLastSeen.WithLabelValues("server1.lan", "lan", "127.0.0.1")))
+
+		p.clearClients()
+		require.Equal(t, 0, testutil.CollectAndCount(UnifinamesClientLastSeen))
+	})
+
+	t.Run("Request Timeout", func(t *testing.T) {
+		s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(time.Millisecond * 500)
+		}))
+		defer s.Close()
+		p := unifinames{
+			Config: &config{
+				Networks: map[string]*NetworkConfig{
+					"lan": {Domain: "lan."},
+				},
+				TTL:                60 * 60,
+				RequestTimeout:     time.Millisecond * 50,
+				UnifiControllerURL: s.URL,
+				UnifiSite:          "default",
+				UnifiUsername:      "admin",
+				UnifiPassword:      "admin",
+			},
+		}
+		timeouts := testutil.ToFloat64(UnifinamesTimeoutCount)
+		ctx, cancel := p.requestContext()
+		defer cancel()
+		err := p.getClients(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Equal(t, timeouts+1, testutil.ToFloat64(UnifinamesTimeoutCount))
+	})
+
+	t.Run("HTTP Timeout", func(t *testing.T) {
+		s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(time.Millisecond * 500)
+		}))
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		p.Config.HTTPTimeout = time.Millisecond * 50
+		start := time.Now()
+		err := p.getClients(context.Background())
+		require.Error(t, err)
+		require.Less(t, time.Since(start), time.Millisecond*400)
+	})
+
+	t.Run("Max Stale Refreshes", func(t *testing.T) {
+		s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+		p := unifinames{
+			Config: &config{
+				Networks: map[string]*NetworkConfig{
+					"lan": {Domain: "lan."},
+				},
+				TTL:                60 * 60,
+				MaxStaleRefreshes:  2,
+				UnifiControllerURL: s.URL,
+				UnifiSite:          "default",
+				UnifiUsername:      "admin",
+				UnifiPassword:      "admin",
+			},
+		}
+		require.NoError(t, p.refresh())
+		require.Equal(t, 1, len(p.aClients))
+		s.Close()
+
+		require.Error(t, p.refresh())
+		require.Equal(t, int32(1), p.consecutiveFailures.Load())
+		require.Equal(t, 1, len(p.aClients))
+
+		require.Error(t, p.refresh())
+		require.Equal(t, int32(2), p.consecutiveFailures.Load())
+		require.Equal(t, float64(2), testutil.ToFloat64(UnifinamesConsecutiveFailures))
+		require.Equal(t, 0, len(p.aClients))
+
+		s = MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+		defer s.Close()
+		p.Config.UnifiControllerURL = s.URL
+		require.NoError(t, p.refresh())
+		require.Equal(t, int32(0), p.consecutiveFailures.Load())
+		require.Equal(t, float64(0), testutil.ToFloat64(UnifinamesConsecutiveFailures))
+		require.Equal(t, 1, len(p.aClients))
+	})
+
+	t.Run("Cancelled Context", func(t *testing.T) {
+		s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+		defer s.Close()
+		p := unifinames{
+			Config: &config{
+				Networks: map[string]*NetworkConfig{
+					"lan": {Domain: "lan."},
+				},
+				TTL:                60 * 60,
+				UnifiControllerURL: s.URL,
+				UnifiSite:          "default",
+				UnifiUsername:      "admin",
+				UnifiPassword:      "admin",
+			},
+		}
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 1, len(p.aClients))
+		lastUpdate := p.lastUpdate
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.ErrorIs(t, p.getClients(ctx), context.Canceled)
+		require.Equal(t, 1, len(p.aClients))
+		require.Equal(t, "server1.lan.", p.aClients[0].Hdr.Name)
+		require.Equal(t, lastUpdate, p.lastUpdate)
+	})
+
+	t.Run("Record Types", func(t *testing.T) {
+		s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+		defer s.Close()
+		p := unifinames{
+			Config: &config{
+				Networks: map[string]*NetworkConfig{
+					"lan": {Domain: "lan.", RecordTypes: []string{"AAAA"}},
+				},
+				TTL:                60 * 60,
+				UnifiControllerURL: s.URL,
+				UnifiSite:          "default",
+				UnifiUsername:      "admin",
+				UnifiPassword:      "admin",
+			},
+		}
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 0, len(p.aClients))
+		require.Equal(t, 0, len(p.aaaaClients))
+		require.Equal(t, float64(0), testutil.ToFloat64(UnifinamesNetworkHostsCount.WithLabelValues("lan", "lan.")))
+	})
+
+	t.Run("Hostname Collision", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.1", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "Server1", "ip": "192.168.1.2", "network": "lan"},
+		)
+		defer s.Close()
+		for policy, ips := range map[string][]string{
+			"first": {"192.168.1.1"},
+			"last":  {"192.168.1.2"},
+			"all":   {"192.168.1.1", "192.168.1.2"},
+		} {
+			p := unifinames{Config: newTestConfig(s.URL)}
+			p.Config.HostnameCollisionPolicy = policy
+			collisions := testutil.ToFloat64(UnifinamesCollisionsCount)
+			require.NoError(t, p.getClients(context.Background()))
+			require.Equal(t, collisions+1, testutil.ToFloat64(UnifinamesCollisionsCount))
+			var got []string
+			for _, rr := range p.lookup(new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA)) {
+				got = append(got, rr.(*dns.A).A.String())
+			}
+			require.Equal(t, ips, got, policy)
+			require.Equal(t, float64(len(ips)), testutil.ToFloat64(UnifinamesNetworkHostsCount.WithLabelValues("lan", "lan.")), policy)
+		}
+	})
+
+	t.Run("Name Dedup Strategy", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:ab:01", "hostname": "my-iphone", "ip": "192.168.1.1", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:AB:12", "hostname": "My-iPhone", "ip": "192.168.1.2", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:ab:13", "hostname": "my iphone", "ip": "192.168.1.3", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:ab:14", "hostname": "my-iphone-2", "ip": "192.168.1.4", "network": "lan"},
+		)
+		defer s.Close()
+		for strategy, names := range map[string]map[string]string{
+			"append_mac": {"my-iphone.lan.": "192.168.1.1", "my-iphone-ab12.lan.": "192.168.1.2", "my-iphone-ab13.lan.": "192.168.1.3", "my-iphone-2.lan.": "192.168.1.4"},
+			// my-iphone-2 is taken when the third client is renamed
+			"append_index": {"my-iphone.lan.": "192.168.1.1", "my-iphone-2.lan.": "192.168.1.2", "my-iphone-3.lan.": "192.168.1.3", "my-iphone-4.lan.": ""},
+			"first_wins":   {"my-iphone.lan.": "192.168.1.1", "my-iphone-2.lan.": "192.168.1.4"},
+			"skip":         {"my-iphone.lan.": "", "my-iphone-2.lan.": "192.168.1.4"},
+		} {
+			p := unifinames{Config: newTestConfig(s.URL)}
+			p.Config.NameDedupStrategy = strategy
+			skipped := testutil.ToFloat64(UnifinamesClientsSkippedCount.WithLabelValues("duplicate_name"))
+			require.NoError(t, p.getClients(context.Background()))
+			for name, ip := range names {
+				rrs := p.lookup(new(dns.Msg).SetQuestion(name, dns.TypeA))
+				if ip == "" {
+					require.Empty(t, rrs, strategy+" "+name)
+					continue
+				}
+				require.Len(t, rrs, 1, strategy+" "+name)
+				require.Equal(t, ip, rrs[0].(*dns.A).A.String(), strategy+" "+name)
+			}
+			if strategy == "skip" {
+				require.Equal(t, skipped+3, testutil.ToFloat64(UnifinamesClientsSkippedCount.WithLabelValues("duplicate_name")))
+			}
+		}
+	})
+
+	t.Run("Online Within", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.1", "network": "lan", "last_seen": time.Now().Add(-time.Hour).Unix()},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "server2", "ip": "192.168.1.2", "network": "lan", "last_seen": time.Now().Add(-48 * time.Hour).Unix()},
+			map[string]interface{}{"mac": "00:00:00:00:00:03", "hostname": "server3", "ip": "192.168.1.3", "network": "lan"},
+		)
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 3, len(p.aClients))
+
+		p.Config.OnlineWithin = 24 * time.Hour
+		filtered := testutil.ToFloat64(UnifinamesClientsFilteredByAgeCount)
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 2, len(p.aClients))
+		require.Equal(t, 0, len(p.lookup(new(dns.Msg).SetQuestion("server2.lan.", dns.TypeA))))
+		require.Equal(t, filtered+1, testutil.ToFloat64(UnifinamesClientsFilteredByAgeCount))
+	})
+
+	t.Run("Network Priority", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "laptop", "ip": "192.168.20.1", "network": "wifi"},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "laptop", "ip": "192.168.10.1", "network": "wired"},
+			map[string]interface{}{"mac": "00:00:00:00:00:03", "hostname": "phone", "ip": "192.168.20.3", "network": "wifi"},
+			map[string]interface{}{"mac": "00:00:00:00:00:03", "hostname": "phone", "ip": "192.168.30.3", "network": "other"},
+		)
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		p.Config.Networks = map[string]*NetworkConfig{
+			"wifi":  {Domain: "home.arpa."},
+			"wired": {Domain: "home.arpa."},
+			"other": {Domain: "home.arpa."},
+		}
+		lookup := func(name string) []string {
+			var got []string
+			for _, rr := range p.lookup(new(dns.Msg).SetQuestion(name, dns.TypeA)) {
+				got = append(got, rr.(*dns.A).A.String())
+			}
+			return got
+		}
+
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, []string{"192.168.20.1"}, lookup("laptop.home.arpa."))
+		require.Equal(t, []string{"192.168.20.3", "192.168.30.3"}, lookup("phone.home.arpa."))
+
+		p.Config.NetworkPriority = []string{"wired", "wifi"}
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, []string{"192.168.10.1"}, lookup("laptop.home.arpa."))
+		// the unlisted networks come last, also for the records of the same client
+		require.Equal(t, []string{"192.168.20.3"}, lookup("phone.home.arpa."))
+		require.Equal(t, float64(1), testutil.ToFloat64(UnifinamesNetworkHostsCount.WithLabelValues("wifi", "home.arpa.")))
+	})
+
+	t.Run("Clear Clients", func(t *testing.T) {
+		s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+		p := unifinames{Config: newTestConfig(s.URL)}
+		require.NoError(t, p.getClients(context.Background()))
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 1, len(p.aClients))
+		s.Close()
+		require.Error(t, p.getClients(context.Background()))
+		require.Equal(t, 1, len(p.aClients))
+		require.Equal(t, float64(1), testutil.ToFloat64(UnifinamesHostsCount))
+
+		p.clearClients()
+		require.Equal(t, 0, len(p.aClients))
+		require.Equal(t, 0, len(p.aaaaClients))
+		require.Equal(t, float64(0), testutil.ToFloat64(UnifinamesHostsCount))
+		require.Equal(t, float64(0), testutil.ToFloat64(UnifinamesNetworkHostsCount.WithLabelValues("lan", "lan.")))
+	})
+
+	t.Run("Client Group Network", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.1", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "server2", "ip": "192.168.1.2", "network": "lan", "usergroup_id": "staff"},
+		)
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		p.Config.Networks["staff"] = &NetworkConfig{Domain: "staff.lan."}
+		p.Config.ClientGroupNetworks = map[string]string{"staff": "staff"}
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 2, len(p.aClients))
+		require.Equal(t, "server1.lan.", p.aClients[0].Hdr.Name)
+		require.Equal(t, "server2.staff.lan.", p.aClients[1].Hdr.Name)
+	})
+
+	t.Run("Domain Without Trailing Dot", func(t *testing.T) {
+		s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		p.Config.Networks["lan"].Domain = "home.arpa"
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 1, len(p.aClients))
+		require.Equal(t, "server1.home.arpa.", p.aClients[0].Hdr.Name)
+	})
+
+	t.Run("Client Type", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.1", "network": "lan", "is_wired": true},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "phone1", "ip": "192.168.1.2", "network": "lan", "is_wired": false},
+		)
+		defer s.Close()
+		for clientType, names := range map[string][]string{
+			"all":      {"server1.lan.", "phone1.lan."},
+			"wired":    {"server1.lan."},
+			"wireless": {"phone1.lan."},
+		} {
+			p := unifinames{Config: newTestConfig(s.URL)}
+			p.Config.ClientType = clientType
+			require.NoError(t, p.getClients(context.Background()))
+			var got []string
+			for _, rr := range p.aClients {
+				got = append(got, rr.Hdr.Name)
+			}
+			require.Equal(t, names, got, clientType)
+		}
+	})
+
+	t.Run("Network ID", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.1", "network_id": "aaaaaaaaaaaaaaaaaaaaaaa1"},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "server2", "ip": "192.168.1.2", "network_id": "unknown"},
+		)
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 1, len(p.aClients))
+		require.Equal(t, "server1.lan.", p.aClients[0].Hdr.Name)
+	})
+
+	t.Run("Dual Stack", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.1", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "fd00::1", "network": "lan"},
+		)
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		collisions := testutil.ToFloat64(UnifinamesCollisionsCount)
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, collisions, testutil.ToFloat64(UnifinamesCollisionsCount))
+		require.Equal(t, 1, len(p.aClients))
+		require.Equal(t, 1, len(p.aaaaClients))
+
+		rrs := p.lookup(new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+		require.Equal(t, 1, len(rrs))
+		require.Equal(t, "192.168.1.1", rrs[0].(*dns.A).A.String())
+		rrs = p.lookup(new(dns.Msg).SetQuestion("server1.lan.", dns.TypeAAAA))
+		require.Equal(t, 1, len(rrs))
+		require.Equal(t, "fd00::1", rrs[0].(*dns.AAAA).AAAA.String())
+	})
+
+	t.Run("Query Goroutines", func(t *testing.T) {
+		s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		require.NoError(t, p.getClients(context.Background()))
+		require.Eventually(t, func() bool {
+			return testutil.ToFloat64(UnifinamesGoroutines.WithLabelValues("query")) == 0
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Session Reuse", func(t *testing.T) {
+		s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+		defer s.Close()
+		logins := 0
+		expired := false
+		next := s.Config.Handler
+		s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/login" {
+				logins++
+				expired = false
+			}
+			if r.URL.Path == "/api/s/default/stat/sta" && expired {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+
+		p := unifinames{Config: newTestConfig(s.URL)}
+		require.NoError(t, p.getClients(context.Background()))
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 1, logins)
+
+		reauths := testutil.ToFloat64(UnifinamesReauthCount)
+		expired = true
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 2, logins)
+		require.Equal(t, 1, len(p.aClients))
+		require.Equal(t, reauths+1, testutil.ToFloat64(UnifinamesReauthCount))
+	})
+
+	t.Run("Max Records", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.1", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "server2", "ip": "fd00::2", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:00:03", "hostname": "server3", "ip": "192.168.1.3", "network": "lan"},
+		)
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		p.Config.MaxRecords = 2
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 1, len(p.aClients))
+		require.Equal(t, "server1.lan.", p.aClients[0].Hdr.Name)
+		require.Equal(t, 1, len(p.aaaaClients))
+		require.Equal(t, float64(1), testutil.ToFloat64(UnifinamesRecordsTruncated))
+
+		p.Config.MaxRecords = 0
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 2, len(p.aClients))
+		require.Equal(t, float64(0), testutil.ToFloat64(UnifinamesRecordsTruncated))
+	})
+
+	t.Run("Fixed IP", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "", "fixed_ip": "192.168.1.50", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "server2", "ip": "192.168.1.2", "fixed_ip": "192.168.1.51", "network": "lan"},
+		)
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 2, len(p.aClients))
+		require.Equal(t, "192.168.1.50", p.aClients[0].A.String())
+		require.Equal(t, "192.168.1.2", p.aClients[1].A.String())
+	})
+
+	t.Run("Network Options", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "printer", "ip": "192.168.1.1", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "camera", "ip": "192.168.20.2", "network": "renamed", "vlan": 20},
+		)
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		p.Config.MinTTL = 5
+		p.Config.Networks["lan"] = &NetworkConfig{Domain: "lan.", Prefix: "iot-", Suffix: "-1", TTL: 60}
+		p.Config.Networks["cameras"] = &NetworkConfig{Domain: "cameras.lan.", VLANID: 20}
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 2, len(p.aClients))
+
+		rrs := p.lookup(new(dns.Msg).SetQuestion("iot-printer-1.lan.", dns.TypeA))
+		require.Equal(t, 1, len(rrs))
+		require.Equal(t, uint32(60), rrs[0].Header().Ttl)
+
+		rrs = p.lookup(new(dns.Msg).SetQuestion("camera.cameras.lan.", dns.TypeA))
+		require.Equal(t, 1, len(rrs))
+		require.Equal(t, uint32(3600), rrs[0].Header().Ttl)
+		require.Equal(t, float64(1), testutil.ToFloat64(UnifinamesNetworkHostsCount.WithLabelValues("cameras", "cameras.lan.")))
+	})
+
+	t.Run("VLAN Networks", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.1", "network": "lan", "vlan": 10},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "server2", "ip": "192.168.10.2", "network": "renamed", "vlan": 10},
+			map[string]interface{}{"mac": "00:00:00:00:00:03", "hostname": "server3", "ip": "192.168.20.3", "network": "other", "vlan": 20},
+		)
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		p.Config.VLANNetworks = map[int]string{10: "vlan10."}
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 2, len(p.aClients))
+		// the network name wins over the vlan
+		require.Equal(t, "server1.lan.", p.aClients[0].Hdr.Name)
+		require.Equal(t, "server2.vlan10.", p.aClients[1].Hdr.Name)
+		require.Equal(t, 1, len(p.lookup(new(dns.Msg).SetQuestion("server2.vlan10.", dns.TypeA))))
+	})
+
+	t.Run("Default Domain", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "printer", "ip": "192.168.1.1", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "camera", "ip": "192.168.20.2", "network": "other"},
+		)
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 1, len(p.aClients))
+
+		p.Config.DefaultDomain = "other.lan."
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 2, len(p.aClients))
+		require.Equal(t, "printer.lan.", p.aClients[0].Hdr.Name)
+		require.Equal(t, "camera.other.lan.", p.aClients[1].Hdr.Name)
+		require.True(t, p.shouldHandle("camera.other.lan."))
+		require.Equal(t, float64(1), testutil.ToFloat64(UnifinamesNetworkHostsCount.WithLabelValues(defaultNetwork, "other.lan.")))
+	})
+
+	t.Run("CIDR Networks", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "printer", "ip": "192.168.20.1", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "camera", "ip": "192.168.20.2", "network": "192.168.20.1"},
+			map[string]interface{}{"mac": "00:00:00:00:00:03", "hostname": "sensor", "ip": "192.168.20.130", "network": "192.168.20.1"},
+		)
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		p.Config.Networks["192.168.20.0/24"] = &NetworkConfig{Domain: "remote.lan."}
+		p.Config.Networks["192.168.20.128/25"] = &NetworkConfig{Domain: "iot.remote.lan."}
+		require.NoError(t, p.Config.parseCIDRNetworks())
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 3, len(p.aClients))
+		// the network name wins over the subnets
+		require.Equal(t, "printer.lan.", p.aClients[0].Hdr.Name)
+		require.Equal(t, "camera.remote.lan.", p.aClients[1].Hdr.Name)
+		require.Equal(t, "sensor.iot.remote.lan.", p.aClients[2].Hdr.Name)
+
+		p.Config.Networks["192.168.20.0/33"] = &NetworkConfig{Domain: "remote.lan."}
+		require.Error(t, p.Config.parseCIDRNetworks())
+	})
+
+	t.Run("Mixed Case Networks", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "printer", "ip": "192.168.1.1", "network": "default"},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "camera", "ip": "192.168.1.2", "network": "DEFAULT"},
+		)
+		defer s.Close()
+		config, err := newConfigFromDispenser(caddyfile.NewDispenser("", strings.NewReader(`
+			{
+				Network Default home.arpa
+				Unifi `+s.URL+` default admin admin
+			}
+		`)))
+		require.NoError(t, err)
+		p := unifinames{Config: config}
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 2, len(p.aClients))
+		require.Equal(t, "printer.home.arpa.", p.aClients[0].Hdr.Name)
+		require.Equal(t, "camera.home.arpa.", p.aClients[1].Hdr.Name)
+	})
+
+	t.Run("Site Domains", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "printer", "ip": "192.168.1.1", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "camera", "ip": "192.168.20.2", "network": "other"},
+		)
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		p.Config.Networks["lan"].TTL = 60
+		p.Config.SiteDomains = map[string]string{"default": "site.lan."}
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 2, len(p.aClients))
+		require.Equal(t, "printer.site.lan.", p.aClients[0].Hdr.Name)
+		require.Equal(t, "camera.site.lan.", p.aClients[1].Hdr.Name)
+
+		rrs := p.lookup(new(dns.Msg).SetQuestion("printer.site.lan.", dns.TypeA))
+		require.Equal(t, 1, len(rrs))
+		// the ttl of the network still applies
+		require.Equal(t, uint32(60), rrs[0].Header().Ttl)
+		require.Equal(t, 0, len(p.lookup(new(dns.Msg).SetQuestion("printer.lan.", dns.TypeA))))
+	})
+
+	t.Run("Wildcard Clients", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "printer", "ip": "192.168.1.1", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "admin", "ip": "192.168.1.2", "network": "lan"},
+		)
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 0, len(p.lookup(new(dns.Msg).SetQuestion("admin.printer.lan.", dns.TypeA))))
+
+		p.Config.WildcardClients = true
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, float64(2), testutil.ToFloat64(UnifinamesHostsCount))
+
+		rrs := p.lookup(new(dns.Msg).SetQuestion("Admin.Printer.lan.", dns.TypeA))
+		require.Equal(t, 1, len(rrs))
+		require.Equal(t, "Admin.Printer.lan.", rrs[0].Header().Name)
+		require.Equal(t, "192.168.1.1", rrs[0].(*dns.A).A.String())
+		require.Equal(t, rrs[0].Header().Ttl, p.lookup(new(dns.Msg).SetQuestion("printer.lan.", dns.TypeA))[0].Header().Ttl)
+		require.True(t, p.nameExists("admin.printer.lan."))
+
+		rrs = p.lookup(new(dns.Msg).SetQuestion("x.admin.lan.", dns.TypeA))
+		require.Equal(t, 1, len(rrs))
+		require.Equal(t, "192.168.1.2", rrs[0].(*dns.A).A.String())
+		// a wildcard only covers one label
+		require.Equal(t, 0, len(p.lookup(new(dns.Msg).SetQuestion("a.admin.printer.lan.", dns.TypeA))))
+	})
+
+	t.Run("HINFO", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.1", "network": "lan", "oui": "Apple", "os_name": 24},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "server2", "ip": "192.168.1.2", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:00:03", "hostname": "server3", "ip": "192.168.1.3", "network": "lan", "os_name": 56},
+		)
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 0, len(p.lookup(new(dns.Msg).SetQuestion("server1.lan.", dns.TypeHINFO))))
+
+		p.Config.ServeHINFO = true
+		require.NoError(t, p.getClients(context.Background()))
+		rrs := p.lookup(new(dns.Msg).SetQuestion("Server1.lan.", dns.TypeHINFO))
+		require.Equal(t, 1, len(rrs))
+		require.Equal(t, "Server1.lan.", rrs[0].Header().Name)
+		require.Equal(t, "Apple", rrs[0].(*dns.HINFO).Cpu)
+		// the fingerprint id of the os isn't served
+		require.Equal(t, "", rrs[0].(*dns.HINFO).Os)
+		require.Equal(t, "Server1.lan.\t3600\tIN\tHINFO\t\"Apple\" \"\"", rrs[0].String())
+		// nothing is known about server2, only the fingerprint id about server3
+		require.Equal(t, 0, len(p.lookup(new(dns.Msg).SetQuestion("server2.lan.", dns.TypeHINFO))))
+		require.Equal(t, 0, len(p.lookup(new(dns.Msg).SetQuestion("server3.lan.", dns.TypeHINFO))))
+	})
+
+	t.Run("Synthesize SRV", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "_http._tcp.webserver", "ip": "192.168.1.1", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "_http._tcp.webserver", "ip": "fd00::1", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "_grafana._tcp.metrics", "ip": "192.168.1.2", "network": "lan"},
+		)
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		p.Config.SynthesizeSRV = true
+		require.NoError(t, p.getClients(context.Background()))
+
+		require.Equal(t, 1, len(p.lookup(new(dns.Msg).SetQuestion("webserver.lan.", dns.TypeA))))
+		require.Equal(t, 1, len(p.lookup(new(dns.Msg).SetQuestion("webserver.lan.", dns.TypeAAAA))))
+		rrs := p.lookup(new(dns.Msg).SetQuestion("_HTTP._tcp.webserver.lan.", dns.TypeSRV))
+		require.Equal(t, 1, len(rrs))
+		require.Equal(t, uint16(80), rrs[0].(*dns.SRV).Port)
+		require.Equal(t, "webserver.lan.", rrs[0].(*dns.SRV).Target)
+		require.True(t, p.nameExists("_http._tcp.webserver.lan."))
+		// the port of unknown services has to be configured
+		require.Equal(t, 1, len(p.lookup(new(dns.Msg).SetQuestion("metrics.lan.", dns.TypeA))))
+		require.Equal(t, 0, len(p.lookup(new(dns.Msg).SetQuestion("_grafana._tcp.metrics.lan.", dns.TypeSRV))))
+
+		p.Config.SRVPort = 3000
+		p.Config.SRVPriority = 10
+		require.NoError(t, p.getClients(context.Background()))
+		rrs = p.lookup(new(dns.Msg).SetQuestion("_grafana._tcp.metrics.lan.", dns.TypeSRV))
+		require.Equal(t, 1, len(rrs))
+		require.Equal(t, uint16(3000), rrs[0].(*dns.SRV).Port)
+		require.Equal(t, uint16(10), rrs[0].(*dns.SRV).Priority)
+	})
+
+	t.Run("Hostname Max Length", func(t *testing.T) {
+		long := strings.Repeat("a", 60) + "-" + strings.Repeat("b", 39)
+		s := MockUnifiController(nil, "lan", long, "192.168.1.1")
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		before := testutil.ToFloat64(UnifinamesNamesTruncatedCount)
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 1, len(p.aClients))
+		require.Equal(t, strings.Repeat("a", 60)+"-bb.lan.", p.aClients[0].Hdr.Name)
+		require.Equal(t, before+1, testutil.ToFloat64(UnifinamesNamesTruncatedCount))
+
+		// the trailing hyphen is removed and the prefix counts
+		p.Config.HostnameMaxLength = 61
+		p.Config.Networks["lan"].Prefix = "x"
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, "x"+strings.Repeat("a", 60)+".lan.", p.aClients[0].Hdr.Name)
+		_, ok := dns.IsDomainName(p.aClients[0].Hdr.Name)
+		require.True(t, ok)
+	})
+
+	t.Run("Network Alias", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.1", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "server2", "ip": "192.168.1.2", "network": "Old LAN"},
+			map[string]interface{}{"mac": "00:00:00:00:00:03", "hostname": "server3", "ip": "192.168.1.3", "network": "LAN (legacy)"},
+		)
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 1, len(p.aClients))
+
+		p.Config.NetworkAliases = map[string]string{"old lan": "lan", "lan (legacy)": "lan"}
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 3, len(p.aClients))
+		require.Equal(t, 1, len(p.lookup(new(dns.Msg).SetQuestion("server2.lan.", dns.TypeA))))
+		require.Equal(t, float64(3), testutil.ToFloat64(UnifinamesNetworkHostsCount.WithLabelValues("lan", "lan.")))
+	})
+
+	t.Run("Exclude Networks", func(t *testing.T) {
+		s := MockUnifiControllerWithClients(nil,
+			map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.1", "network": "lan"},
+			map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "phone", "ip": "192.168.2.1", "network": "Guest", "vlan": 20},
+		)
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		p.Config.VLANNetworks = map[int]string{20: "lan."}
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 2, len(p.aClients))
+
+		// the vlan would map the guest network to lan.
+		p.Config.ExcludeNetworks = []string{"guest"}
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 1, len(p.aClients))
+		require.Equal(t, "server1.lan.", p.aClients[0].Hdr.Name)
+	})
+
+	t.Run("Apex Records", func(t *testing.T) {
+		s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		p.Config.ApexRecords = map[string]string{"lan.": "192.168.1.1"}
+		require.NoError(t, p.getClients(context.Background()))
+
+		rrs := p.lookup(new(dns.Msg).SetQuestion("LAN.", dns.TypeA))
+		require.Equal(t, 1, len(rrs))
+		require.Equal(t, "192.168.1.1", rrs[0].(*dns.A).A.String())
+		require.Equal(t, 0, len(p.lookup(new(dns.Msg).SetQuestion("lan.", dns.TypeAAAA))))
+		// the apex is not a client
+		require.Equal(t, float64(1), testutil.ToFloat64(UnifinamesHostsCount))
+
+		p.Config.ApexRecords = map[string]string{"lan.": "fd00::1"}
+		require.NoError(t, p.getClients(context.Background()))
+		rrs = p.lookup(new(dns.Msg).SetQuestion("lan.", dns.TypeAAAA))
+		require.Equal(t, 1, len(rrs))
+		require.Equal(t, "fd00::1", rrs[0].(*dns.AAAA).AAAA.String())
+	})
+}
+
+func TestServeDNSCounters(t *testing.T) {
+	p := newTestPlugin()
+	p.Next = test.NextHandler(dns.RcodeNameError, nil)
+	// don't start the refresh, there is no controller
+	p.haveRoutine.Store(true)
+
+	answered := testutil.ToFloat64(UnifinamesAnsweredCount)
+	passthrough := testutil.ToFloat64(UnifinamesPassthroughCount)
+	noSuchDomain := testutil.ToFloat64(UnifinamesNoSuchDomainCount)
+	results := map[string]float64{}
+	for _, result := range []string{"hit", "miss", "passthrough"} {
+		results[result] = testutil.ToFloat64(UnifinamesRequestsTotal.WithLabelValues(result))
+	}
+	queryTypes := map[string]float64{}
+	for _, qtype := range []string{"A", "MX", "OTHER"} {
+		queryTypes[qtype] = testutil.ToFloat64(UnifinamesQueryTypeTotal.WithLabelValues(qtype))
+	}
+
+	for _, name := range []string{"server1.lan.", "server2.lan.", "server1.example.com."} {
+		_, err := p.ServeDNS(context.Background(), &dummyResponseWriter{}, new(dns.Msg).SetQuestion(name, dns.TypeA))
+		require.NoError(t, err)
+	}
+	_, err := p.ServeDNS(context.Background(), &dummyResponseWriter{}, new(dns.Msg).SetQuestion("server1.example.com.", dns.TypeMX))
+	require.NoError(t, err)
+	require.Equal(t, answered+1, testutil.ToFloat64(UnifinamesAnsweredCount))
+	require.Equal(t, passthrough+3, testutil.ToFloat64(UnifinamesPassthroughCount))
+	require.Equal(t, noSuchDomain+1, testutil.ToFloat64(UnifinamesNoSuchDomainCount))
+	require.Equal(t, results["hit"]+1, testutil.ToFloat64(UnifinamesRequestsTotal.WithLabelValues("hit")))
+	require.Equal(t, results["miss"]+1, testutil.ToFloat64(UnifinamesRequestsTotal.WithLabelValues("miss")))
+	require.Equal(t, results["passthrough"]+2, testutil.ToFloat64(UnifinamesRequestsTotal.WithLabelValues("passthrough")))
+	require.Equal(t, queryTypes["A"]+3, testutil.ToFloat64(UnifinamesQueryTypeTotal.WithLabelValues("A")))
+	require.Equal(t, queryTypes["OTHER"]+1, testutil.ToFloat64(UnifinamesQueryTypeTotal.WithLabelValues("OTHER")))
+	require.Equal(t, queryTypes["MX"], testutil.ToFloat64(UnifinamesQueryTypeTotal.WithLabelValues("MX")))
+
+	p.Config.Authoritative = true
+	_, err = p.ServeDNS(context.Background(), &dummyResponseWriter{}, new(dns.Msg).SetQuestion("server2.lan.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, answered+2, testutil.ToFloat64(UnifinamesAnsweredCount))
+	require.Equal(t, noSuchDomain+2, testutil.ToFloat64(UnifinamesNoSuchDomainCount))
+}
+
+func TestServeDNSRateLimit(t *testing.T) {
+	p := newTestPlugin()
+	p.Next = test.NextHandler(dns.RcodeNameError, nil)
+	p.haveRoutine.Store(true)
+	p.Config.RateLimit = 2
+	p.Config.RateLimitAction = "drop"
+	p.limiter = p.Config.rateLimiter()
+	limited := testutil.ToFloat64(UnifinamesRateLimitedCount)
+
+	for i := 0; i < 2; i++ {
+		rcode, err := p.ServeDNS(context.Background(), &dummyResponseWriter{}, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+		require.NoError(t, err)
+		require.Equal(t, dns.RcodeSuccess, rcode)
+	}
+	w := &dummyResponseWriter{}
+	rcode, err := p.ServeDNS(context.Background(), w, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, rcode)
+	require.Equal(t, dns.RcodeServerFailure, w.GetMsgs()[0].Rcode)
+
+	p.Config.RateLimitAction = "passthrough"
+	rcode, err = p.ServeDNS(context.Background(), &dummyResponseWriter{}, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, rcode)
+	require.Equal(t, limited+2, testutil.ToFloat64(UnifinamesRateLimitedCount))
+
+	require.Nil(t, (&config{}).rateLimiter())
+}
+
+func TestServeDNSMaxWorkers(t *testing.T) {
+	p := newTestPlugin()
+	p.Next = test.NextHandler(dns.RcodeNameError, nil)
+	p.haveRoutine.Store(true)
+	p.Config.MaxWorkers = 1
+	p.Config.WorkerTimeout = 10 * time.Millisecond
+	p.workers = p.Config.workerPool()
+	timeouts := testutil.ToFloat64(UnifinamesWorkerTimeoutCount)
+
+	rcode, err := p.ServeDNS(context.Background(), &dummyResponseWriter{}, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, rcode)
+
+	// the only worker is busy
+	p.workers <- struct{}{}
+	rcode, err = p.ServeDNS(context.Background(), &dummyResponseWriter{}, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, rcode)
+	require.Equal(t, timeouts+1, testutil.ToFloat64(UnifinamesWorkerTimeoutCount))
+	<-p.workers
+
+	rcode, err = p.ServeDNS(context.Background(), &dummyResponseWriter{}, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, rcode)
+	require.Empty(t, p.workers)
+
+	require.Nil(t, (&config{}).workerPool())
+}
+
+func TestServeDNSResolveTimeout(t *testing.T) {
+	p := newTestPlugin()
+	p.Next = test.NextHandler(dns.RcodeNameError, nil)
+	p.haveRoutine.Store(true)
+	p.Config.ResolveTimeout = 10 * time.Millisecond
+	timeouts := testutil.ToFloat64(UnifinamesResolveTimeoutCount)
+
+	w := &dummyResponseWriter{}
+	rcode, err := p.ServeDNS(context.Background(), w, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, rcode)
+	require.Len(t, w.msgs, 1)
+	require.Len(t, w.msgs[0].Answer, 1)
+
+	// a refresh holds the lock
+	p.mu.Lock()
+	w = &dummyResponseWriter{}
+	rcode, err = p.ServeDNS(context.Background(), w, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, rcode)
+	require.Equal(t, timeouts+1, testutil.ToFloat64(UnifinamesResolveTimeoutCount))
+	require.Empty(t, w.msgs)
+
+	// the queries that timed out leave no goroutines behind that wait for the lock
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		_, err = p.ServeDNS(context.Background(), &dummyResponseWriter{}, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+		require.NoError(t, err)
+	}
+	require.LessOrEqual(t, runtime.NumGoroutine(), goroutines)
+	require.Equal(t, timeouts+21, testutil.ToFloat64(UnifinamesResolveTimeoutCount))
+	p.mu.Unlock()
+}
+
+// TestConcurrentServeDNS answers queries while the clients are refreshed, run with -race to find the
+// fields that are accessed without the locks
+func TestConcurrentServeDNS(t *testing.T) {
+	s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+	defer s.Close()
+	p := &unifinames{Config: newTestConfig(s.URL), Next: test.NextHandler(dns.RcodeNameError, nil)}
+	// the refresh goroutine of the first query would outlive the test
+	p.haveRoutine.Store(true)
+	require.NoError(t, p.getClients(context.Background()))
+
+	done := make(chan struct{})
+	refreshed := make(chan struct{})
+	go func() {
+		defer close(refreshed)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				_ = p.refresh()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var failed atomic.Int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				d := &dummyResponseWriter{}
+				rcode, err := p.ServeDNS(context.Background(), d, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+				if err != nil || rcode != dns.RcodeSuccess {
+					failed.Add(1)
+				}
+				_ = p.Ready()
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-refreshed
+	require.Zero(t, failed.Load())
+}
+
+func TestLazyLoad(t *testing.T) {
+	s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+	defer s.Close()
+	p := &unifinames{
+		Config:       newTestConfig(s.URL),
+		Next:         test.NextHandler(dns.RcodeNameError, nil),
+		firstRefresh: make(chan struct{}),
+		stop:         make(chan struct{}),
+	}
+	defer p.shutdown()
+	p.Config.LazyLoad = true
+	p.Config.LazyLoadTimeout = 5 * time.Second
+	require.True(t, p.Ready())
+	require.Empty(t, p.aClients)
+
+	// the first query waits for the clients
+	d := &dummyResponseWriter{}
+	rcode, err := p.ServeDNS(context.Background(), d, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, rcode)
+	require.Equal(t, "127.0.0.1", d.GetMsgs()[0].Answer[0].(*dns.A).A.String())
+
+	// the queries are answered without the clients once lazy_load_timeout is over
+	p = &unifinames{Config: newTestConfig(s.URL), Next: test.NextHandler(dns.RcodeNameError, nil), firstRefresh: make(chan struct{})}
+	p.haveRoutine.Store(true)
+	p.Config.LazyLoad = true
+	p.Config.LazyLoadTimeout = 10 * time.Millisecond
+	rcode, err = p.ServeDNS(context.Background(), &dummyResponseWriter{}, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, rcode)
+
+	_, err = newConfigFromDispenser(caddyfile.NewDispenser("", strings.NewReader(`
+		{
+			Network LAN lan
+			Unifi https://localhost:8443/ default admin admin
+			lazy_load
+			require_initial_data
+		}
+	`)))
+	require.Error(t, err)
+}
+
+// TestTTLUnderflow makes sure records answered long after the last refresh don't get a ttl of ~136 years
+func TestTTLUnderflow(t *testing.T) {
+	p := newTestPlugin()
+	p.Config.TTL = 60
+	p.lastUpdate = time.Now().Add(-time.Hour)
+
+	d := &dummyResponseWriter{}
+	_, ok := p.resolve(d, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+	require.True(t, ok)
+	require.Len(t, d.GetMsgs()[0].Answer, 1)
+	require.LessOrEqual(t, d.GetMsgs()[0].Answer[0].Header().Ttl, p.Config.TTL)
+}
+
+func TestClientsHash(t *testing.T) {
+	a := []dns.A{
+		{Hdr: dns.RR_Header{Name: "server1.lan."}, A: net.ParseIP("192.168.1.1")},
+		{Hdr: dns.RR_Header{Name: "server2.lan."}, A: net.ParseIP("192.168.1.2")},
+	}
+	aaaa := []dns.AAAA{{Hdr: dns.RR_Header{Name: "server1.lan."}, AAAA: net.ParseIP("fd00::1")}}
+	hash := clientsHash(a, aaaa)
+	require.Equal(t, hash, clientsHash([]dns.A{a[1], a[0]}, aaaa))
+	require.NotEqual(t, hash, clientsHash(a, nil))
+	require.NotEqual(t, hash, clientsHash([]dns.A{a[0], {Hdr: a[1].Hdr, A: net.ParseIP("192.168.1.3")}}, aaaa))
+	require.NotEqual(t, clientsHash(nil, nil), uint64(0))
+}
+
+func TestRefreshDetectsChanges(t *testing.T) {
+	s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+	defer s.Close()
+	config := newTestConfig(s.URL)
+	config.CacheFile = filepath.Join(t.TempDir(), "cache.json")
+	p := unifinames{Config: config}
+	changes := testutil.ToFloat64(UnifinamesRefreshChangesCount)
+
+	require.NoError(t, p.refresh())
+	require.FileExists(t, config.CacheFile)
+	require.Equal(t, changes+1, testutil.ToFloat64(UnifinamesRefreshChangesCount))
+
+	require.NoError(t, os.Remove(config.CacheFile))
+	require.NoError(t, p.refresh())
+	require.NoFileExists(t, config.CacheFile)
+	require.Equal(t, changes+1, testutil.ToFloat64(UnifinamesRefreshChangesCount))
+}
+
+func TestMaxRefreshDuration(t *testing.T) {
+	s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+	defer s.Close()
+	// the controller accepts the connection but doesn't answer for the clients until release is closed
+	release := make(chan struct{})
+	mock := s.Config.Handler
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/s/default/stat/sta" {
+			<-release
+		}
+		mock.ServeHTTP(w, r)
+	})
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.Config.RequestTimeout = time.Minute
+	p.Config.MaxRefreshDuration = 100 * time.Millisecond
+	stuck := testutil.ToFloat64(UnifinamesRefreshStuckCount)
+
+	require.ErrorIs(t, p.refresh(), context.DeadlineExceeded)
+	require.Equal(t, stuck+1, testutil.ToFloat64(UnifinamesRefreshStuckCount))
+	require.Equal(t, 0, len(p.aClients))
+
+	close(release)
+	require.NoError(t, p.refresh())
+	require.Equal(t, 1, len(p.aClients))
+	require.Equal(t, stuck+1, testutil.ToFloat64(UnifinamesRefreshStuckCount))
+}
+
+func TestCountHosts(t *testing.T) {
+	p := newTestPlugin()
+	p.aClients = append(p.aClients,
+		dns.A{Hdr: dns.RR_Header{Name: "*.server1.lan.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.ParseIP("127.0.0.1")},
+		dns.A{Hdr: dns.RR_Header{Name: "lan.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.ParseIP("192.168.1.1")},
+	)
+	p.aaaaClients = []dns.AAAA{{Hdr: dns.RR_Header{Name: "server1.lan.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET}, AAAA: net.ParseIP("fd00::1")}}
+	require.Equal(t, 2, p.countHosts())
+
+	require.Equal(t, time.Hour, p.metricsRefreshInterval())
+	p.Config.MetricsRefreshInterval = time.Minute
+	require.Equal(t, time.Minute, p.metricsRefreshInterval())
+}
+
+func TestServeDNSStartsRefreshOnce(t *testing.T) {
+	s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL), Next: test.NextHandler(dns.RcodeNameError, nil)}
+	refreshes := testutil.ToFloat64(UnifinamesGoroutines.WithLabelValues("refresh"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = p.ServeDNS(context.Background(), &dummyResponseWriter{}, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+		}()
+	}
+	wg.Wait()
+
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(UnifinamesGoroutines.WithLabelValues("refresh")) > refreshes
+	}, time.Second, 10*time.Millisecond)
+	// give a second goroutine the time to show up
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, refreshes+1, testutil.ToFloat64(UnifinamesGoroutines.WithLabelValues("refresh")))
+}
+
+func TestShutdownStopsGoroutines(t *testing.T) {
+	s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+	defer s.Close()
+	p := unifinames{
+		Config:     newTestConfig(s.URL),
+		Next:       test.NextHandler(dns.RcodeNameError, nil),
+		refreshNow: make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+	p.Config.UseEventStream = true
+	p.Config.MetricsRefreshInterval = 10 * time.Millisecond
+
+	routines := []string{"refresh", "events", "metrics"}
+	before := map[string]float64{}
+	for _, routine := range routines {
+		before[routine] = testutil.ToFloat64(UnifinamesGoroutines.WithLabelValues(routine))
+	}
+	_, _ = p.ServeDNS(context.Background(), &dummyResponseWriter{}, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+	for _, routine := range routines {
+		require.Eventually(t, func() bool {
+			return testutil.ToFloat64(UnifinamesGoroutines.WithLabelValues(routine)) == before[routine]+1
+		}, 5*time.Second, 10*time.Millisecond, routine)
+	}
+
+	p.shutdown()
+	p.shutdown()
+	for _, routine := range routines {
+		require.Eventually(t, func() bool {
+			return testutil.ToFloat64(UnifinamesGoroutines.WithLabelValues(routine)) == before[routine]
+		}, 5*time.Second, 10*time.Millisecond, routine)
+	}
+}
+
+// newTestPlugin returns a plugin that serves server1.lan. without a controller
+func newTestPlugin() *unifinames {
+	return &unifinames{
+		Config: &config{
+			Networks: map[string]*NetworkConfig{
+				"lan": {Domain: "lan."},
+			},
+			TTL: 60 * 60,
+		},
+		aClients: []dns.A{
+			{
+				Hdr: dns.RR_Header{Name: "server1.lan.", Rrtype: dns.TypeA, Class: dns.ClassINET},
+				A:   net.ParseIP("127.0.0.1"),
+			},
+		},
+		lastUpdate: time.Now(),
+	}
+}
+
+func TestResolve(t *testing.T) {
+	t.Run("Answer Limit", func(t *testing.T) {
+		p := newTestPlugin()
+		for _, ip := range []string{"127.0.0.2", "127.0.0.3"} {
+			p.aClients = append(p.aClients, dns.A{
+				Hdr: dns.RR_Header{Name: "server1.lan.", Rrtype: dns.TypeA, Class: dns.ClassINET},
+				A:   net.ParseIP(ip),
+			})
+		}
+		p.Config.AnswerLimit = 1
+		answer := func(r *dns.Msg) []string {
+			d := &dummyResponseWriter{}
+			_, ok := p.resolve(d, r)
+			require.True(t, ok)
+			var ips []string
+			for _, rr := range d.GetMsgs()[0].Answer {
+				ips = append(ips, rr.(*dns.A).A.String())
+			}
+			return ips
+		}
+		// the records take turns
+		for _, ip := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3", "127.0.0.1"} {
+			require.Equal(t, []string{ip}, answer(new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA)))
+		}
+		// 1232 bytes of EDNS0 fit twice as many records
+		require.Equal(t, []string{"127.0.0.2", "127.0.0.3"}, answer(new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA).SetEdns0(1232, false)))
+
+		p.Config.AnswerLimit = 3
+		require.Equal(t, 3, len(answer(new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))))
+	})
+
+	t.Run("Multiple Questions", func(t *testing.T) {
+		p := newTestPlugin()
+		p.aaaaClients = []dns.AAAA{{
+			Hdr:  dns.RR_Header{Name: "server2.lan.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET},
+			AAAA: net.ParseIP("fd00::2"),
+		}}
+		p.lastUpdate = time.Now().Add(-90 * time.Second)
+		r := new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA)
+		r.Question = append(r.Question, dns.Question{Name: "server2.lan.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+
+		d := &dummyResponseWriter{}
+		rcode, ok := p.resolve(d, r)
+		require.True(t, ok)
+		require.Equal(t, dns.RcodeSuccess, rcode)
+		require.Equal(t, 1, len(d.GetMsgs()))
+		answer := d.GetMsgs()[0].Answer
+		require.Equal(t, 2, len(answer))
+		require.Equal(t, "127.0.0.1", answer[0].(*dns.A).A.String())
+		require.Equal(t, "fd00::2", answer[1].(*dns.AAAA).AAAA.String())
+		require.Equal(t, uint32(3600-90), answer[0].Header().Ttl)
+		require.Equal(t, answer[0].Header().Ttl, answer[1].Header().Ttl)
+	})
+
+	t.Run("Authoritative Unknown Name", func(t *testing.T) {
+		p := newTestPlugin()
+		p.Config.Authoritative = true
+		d := &dummyResponseWriter{}
+		rcode, ok := p.resolve(d, new(dns.Msg).SetQuestion("server2.lan.", dns.TypeA))
+		require.True(t, ok)
+		require.Equal(t, dns.RcodeNameError, rcode)
+		require.Equal(t, 1, len(d.GetMsgs()))
+		require.Equal(t, dns.RcodeNameError, d.GetMsgs()[0].Rcode)
+		require.True(t, d.GetMsgs()[0].Authoritative)
+		require.Equal(t, 0, len(d.GetMsgs()[0].Answer))
+		require.Equal(t, 0, len(d.GetMsgs()[0].Ns))
+	})
+
+	t.Run("Per Client Metrics", func(t *testing.T) {
+		UnifinamesClientQueryCount.Reset()
+		defer UnifinamesClientQueryCount.Reset()
+		p := newTestPlugin()
+		p.Config.PerClientMetrics = true
+		p.Config.PerClientMetricsMaxCardinality = 1
+		p.aClients = append(p.aClients, dns.A{
+			Hdr: dns.RR_Header{Name: "server2.lan.", Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   net.ParseIP("127.0.0.2"),
+		})
+		p.clients = []ClientInfo{
+			{Hostname: "server1.lan.", IP: "127.0.0.1", Network: "lan"},
+			{Hostname: "server2.lan.", IP: "127.0.0.2", Network: "lan"},
+		}
+		d := &dummyResponseWriter{}
+		for _, name := range []string{"server1.lan.", "SERVER1.lan.", "server2.lan."} {
+			_, ok := p.resolve(d, new(dns.Msg).SetQuestion(name, dns.TypeA))
+			require.True(t, ok, name)
+		}
+		require.Equal(t, float64(2), testutil.ToFloat64(UnifinamesClientQueryCount.WithLabelValues("server1.lan", "lan")))
+		// server2 is above the cardinality limit
+		require.Equal(t, 1, testutil.CollectAndCount(UnifinamesClientQueryCount))
+	})
+
+	t.Run("Answer TTL Floor", func(t *testing.T) {
+		p := newTestPlugin()
+		p.Config.TTL = 60
+		p.Config.MinTTL = 15
+		p.aClients[0].Hdr.Ttl = 30
+		// a refresh that is an hour late
+		p.lastUpdate = time.Now().Add(-time.Hour)
+		d := &dummyResponseWriter{}
+		_, ok := p.resolve(d, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+		require.True(t, ok)
+		require.Equal(t, uint32(15), d.GetMsgs()[0].Answer[0].Header().Ttl)
+	})
+
+	t.Run("EDNS0", func(t *testing.T) {
+		p := newTestPlugin()
+		p.Config.Authoritative = true
+		d := &dummyResponseWriter{}
+		for _, name := range []string{"server1.lan.", "server2.lan."} {
+			r := new(dns.Msg).SetQuestion(name, dns.TypeA)
+			r.SetEdns0(1232, true)
+			_, ok := p.resolve(d, r)
+			require.True(t, ok, name)
+		}
+		for _, m := range d.GetMsgs() {
+			opt := m.IsEdns0()
+			require.NotNil(t, opt)
+			require.Equal(t, uint16(1232), opt.UDPSize())
+			require.True(t, opt.Do())
+		}
+
+		_, _ = p.resolve(d, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+		require.Nil(t, d.GetMsgs()[2].IsEdns0())
+
+		// the advertised size is capped, the smaller ones are raised to 512
+		for size, want := range map[uint16]uint16{65535: 4096, 256: 512} {
+			r := new(dns.Msg).SetQuestion("missing.lan.", dns.TypeA)
+			r.SetEdns0(size, false)
+			r.RecursionDesired = true
+			_, _ = p.resolve(d, r)
+			m := d.GetMsgs()[len(d.GetMsgs())-1]
+			require.Equal(t, want, m.IsEdns0().UDPSize(), size)
+			require.True(t, m.Authoritative)
+			require.False(t, m.RecursionAvailable)
+		}
+	})
+
+	t.Run("Additional Records", func(t *testing.T) {
+		p := newTestPlugin()
+		p.aaaaClients = []dns.AAAA{{
+			Hdr:  dns.RR_Header{Name: "server1.lan.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET},
+			AAAA: net.ParseIP("fd00::1"),
+		}}
+		d := &dummyResponseWriter{}
+		_, ok := p.resolve(d, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+		require.True(t, ok)
+		require.Equal(t, 0, len(d.GetMsgs()[0].Extra))
+
+		p.Config.IncludeAdditionalRecords = true
+		_, ok = p.resolve(d, new(dns.Msg).SetQuestion("SERVER1.lan.", dns.TypeA))
+		require.True(t, ok)
+		extra := d.GetMsgs()[1].Extra
+		require.Equal(t, 1, len(extra))
+		require.Equal(t, "fd00::1", extra[0].(*dns.AAAA).AAAA.String())
+
+		_, ok = p.resolve(d, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeAAAA))
+		require.True(t, ok)
+		extra = d.GetMsgs()[2].Extra
+		require.Equal(t, 1, len(extra))
+		require.Equal(t, "127.0.0.1", extra[0].(*dns.A).A.String())
+	})
+
+	t.Run("Authoritative Flag", func(t *testing.T) {
+		p := newTestPlugin()
+		p.Config.Authoritative = true
+		d := &dummyResponseWriter{}
+		rcode, ok := p.resolve(d, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+		require.True(t, ok)
+		require.Equal(t, dns.RcodeSuccess, rcode)
+		require.True(t, d.GetMsgs()[0].Authoritative)
+
+		_, ok = p.resolve(d, new(dns.Msg).SetQuestion("server2.lan.", dns.TypeA))
+		require.True(t, ok)
+		require.Equal(t, dns.RcodeNameError, d.GetMsgs()[1].Rcode)
+		require.True(t, d.GetMsgs()[1].Authoritative)
+	})
+
+	t.Run("Authoritative NS In Authority", func(t *testing.T) {
+		p := newTestPlugin()
+		p.Config.Authoritative = true
+		p.Config.NSRecords = []string{"ns1.lan."}
+		d := &dummyResponseWriter{}
+		_, ok := p.resolve(d, new(dns.Msg).SetQuestion("server2.lan.", dns.TypeA))
+		require.True(t, ok)
+		require.Equal(t, 1, len(d.GetMsgs()[0].Ns))
+		require.Equal(t, "lan.", d.GetMsgs()[0].Ns[0].Header().Name)
+		require.Equal(t, "ns1.lan.", d.GetMsgs()[0].Ns[0].(*dns.NS).Ns)
+	})
+
+	t.Run("Authoritative Negative TTL", func(t *testing.T) {
+		p := newTestPlugin()
+		p.Config.Authoritative = true
+		p.Config.NegativeTTL = 30
+		p.Config.NSRecords = []string{"ns1.lan."}
+		d := &dummyResponseWriter{}
+		_, ok := p.resolve(d, new(dns.Msg).SetQuestion("server2.lan.", dns.TypeA))
+		require.True(t, ok)
+		require.True(t, d.GetMsgs()[0].Authoritative)
+		require.Equal(t, 2, len(d.GetMsgs()[0].Ns))
+		soa := d.GetMsgs()[0].Ns[0].(*dns.SOA)
+		require.Equal(t, "lan.", soa.Hdr.Name)
+		require.Equal(t, uint32(30), soa.Hdr.Ttl)
+		require.Equal(t, uint32(30), soa.Minttl)
+		require.Equal(t, "ns1.lan.", soa.Ns)
+		require.Equal(t, "hostmaster.lan.", soa.Mbox)
+		require.Equal(t, uint32(p.lastUpdate.Unix()), soa.Serial)
+	})
+
+	t.Run("Authoritative NXDOMAIN Redirect", func(t *testing.T) {
+		p := newTestPlugin()
+		p.Config.Authoritative = true
+		p.Config.NegativeTTL = 30
+		p.Config.NXDomainRedirectIP = "192.168.1.250"
+		d := &dummyResponseWriter{}
+		rcode, ok := p.resolve(d, new(dns.Msg).SetQuestion("server2.lan.", dns.TypeA))
+		require.True(t, ok)
+		require.Equal(t, dns.RcodeSuccess, rcode)
+		m := d.GetMsgs()[0]
+		require.True(t, m.Authoritative)
+		require.Equal(t, 1, len(m.Answer))
+		require.Equal(t, "192.168.1.250", m.Answer[0].(*dns.A).A.String())
+		require.Equal(t, uint32(30), m.Answer[0].Header().Ttl)
+		require.Empty(t, m.Ns)
+
+		// the other types of the redirected names have no records
+		_, ok = p.resolve(d, new(dns.Msg).SetQuestion("server2.lan.", dns.TypeAAAA))
+		require.True(t, ok)
+		require.Equal(t, dns.RcodeSuccess, d.GetMsgs()[1].Rcode)
+		require.Empty(t, d.GetMsgs()[1].Answer)
+
+		// the domains that aren't in nxdomain_redirect_domains still get NXDOMAIN
+		p.Config.NXDomainRedirectDomains = []string{"iot."}
+		rcode, ok = p.resolve(d, new(dns.Msg).SetQuestion("server2.lan.", dns.TypeA))
+		require.True(t, ok)
+		require.Equal(t, dns.RcodeNameError, rcode)
+		require.Empty(t, d.GetMsgs()[2].Answer)
+	})
+
+	t.Run("NS", func(t *testing.T) {
+		p := newTestPlugin()
+		p.Config.NSRecords = []string{"ns1.lan.", "ns2.lan."}
+		d := &dummyResponseWriter{}
+		rcode, ok := p.resolve(d, new(dns.Msg).SetQuestion("lan.", dns.TypeNS))
+		require.True(t, ok)
+		require.Equal(t, dns.RcodeSuccess, rcode)
+		require.Equal(t, 2, len(d.GetMsgs()[0].Answer))
+		require.Equal(t, "ns1.lan.", d.GetMsgs()[0].Answer[0].(*dns.NS).Ns)
+		require.Equal(t, "ns2.lan.", d.GetMsgs()[0].Answer[1].(*dns.NS).Ns)
+		require.Equal(t, uint32(3600), d.GetMsgs()[0].Answer[0].Header().Ttl)
+	})
+
+	t.Run("NS Below Apex", func(t *testing.T) {
+		p := newTestPlugin()
+		p.Config.NSRecords = []string{"ns1.lan."}
+		d := &dummyResponseWriter{}
+		_, ok := p.resolve(d, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeNS))
+		require.False(t, ok)
+	})
+
+	t.Run("Authoritative Other Type", func(t *testing.T) {
+		p := newTestPlugin()
+		p.Config.Authoritative = true
+		d := &dummyResponseWriter{}
+		rcode, ok := p.resolve(d, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeAAAA))
+		require.True(t, ok)
+		require.Equal(t, dns.RcodeSuccess, rcode)
+		require.Equal(t, 1, len(d.GetMsgs()))
+		require.Equal(t, dns.RcodeSuccess, d.GetMsgs()[0].Rcode)
+		require.Equal(t, 0, len(d.GetMsgs()[0].Answer))
+	})
+
+	t.Run("Authoritative Other Domain", func(t *testing.T) {
+		p := newTestPlugin()
+		p.Config.Authoritative = true
+		d := &dummyResponseWriter{}
+		_, ok := p.resolve(d, new(dns.Msg).SetQuestion("server1.example.com.", dns.TypeA))
+		require.False(t, ok)
+		require.Equal(t, 0, len(d.GetMsgs()))
+	})
+
+	t.Run("NXDOMAIN Action", func(t *testing.T) {
+		p := newTestPlugin()
+		p.Config.NXDomainAction = "noerror_empty"
+		p.Config.Networks["iot"] = &NetworkConfig{Domain: "iot.lan.", NXDomainAction: "nxdomain"}
+		p.Config.Networks["guest"] = &NetworkConfig{Domain: "guest.", NXDomainAction: "passthrough"}
+		noSuchDomain := testutil.ToFloat64(UnifinamesNoSuchDomainCount)
+
+		d := &dummyResponseWriter{}
+		rcode, ok := p.resolve(d, new(dns.Msg).SetQuestion("server2.lan.", dns.TypeA))
+		require.True(t, ok)
+		require.Equal(t, dns.RcodeSuccess, rcode)
+		require.True(t, d.GetMsgs()[0].Authoritative)
+		require.Equal(t, 0, len(d.GetMsgs()[0].Answer))
+		require.Equal(t, noSuchDomain, testutil.ToFloat64(UnifinamesNoSuchDomainCount))
+
+		rcode, ok = p.resolve(d, new(dns.Msg).SetQuestion("server2.iot.lan.", dns.TypeA))
+		require.True(t, ok)
+		require.Equal(t, dns.RcodeNameError, rcode)
+		require.Equal(t, noSuchDomain+1, testutil.ToFloat64(UnifinamesNoSuchDomainCount))
+
+		_, ok = p.resolve(d, new(dns.Msg).SetQuestion("server2.guest.", dns.TypeA))
+		require.False(t, ok)
+		require.Equal(t, noSuchDomain+2, testutil.ToFloat64(UnifinamesNoSuchDomainCount))
+
+		// authoritative=false of a network overrides the global nxdomain_action
+		notAuthoritative := false
+		p.Config.Networks["lan"].Authoritative = &notAuthoritative
+		require.Equal(t, "passthrough", p.Config.nxdomainAction("lan."))
+	})
+
+	t.Run("Per Network Authoritative", func(t *testing.T) {
+		p := newTestPlugin()
+		authoritative, notAuthoritative := true, false
+		p.Config.Networks["lan"].Authoritative = &authoritative
+		p.Config.Networks["iot"] = &NetworkConfig{Domain: "iot.lan.", Authoritative: &notAuthoritative}
+		p.Config.Networks["guest"] = &NetworkConfig{Domain: "guest."}
+
+		d := &dummyResponseWriter{}
+		rcode, ok := p.resolve(d, new(dns.Msg).SetQuestion("server2.lan.", dns.TypeA))
+		require.True(t, ok)
+		require.Equal(t, dns.RcodeNameError, rcode)
+
+		_, ok = p.resolve(&dummyResponseWriter{}, new(dns.Msg).SetQuestion("server2.iot.lan.", dns.TypeA))
+		require.False(t, ok)
+		_, ok = p.resolve(&dummyResponseWriter{}, new(dns.Msg).SetQuestion("server2.guest.", dns.TypeA))
+		require.False(t, ok)
+
+		p.Config.Authoritative = true
+		_, ok = p.resolve(&dummyResponseWriter{}, new(dns.Msg).SetQuestion("server2.guest.", dns.TypeA))
+		require.True(t, ok)
+		_, ok = p.resolve(&dummyResponseWriter{}, new(dns.Msg).SetQuestion("server2.iot.lan.", dns.TypeA))
+		require.False(t, ok)
+	})
+
+	t.Run("Max Stale Age", func(t *testing.T) {
+		p := newTestPlugin()
+		p.Config.MaxStaleAge = time.Hour
+		servfails := testutil.ToFloat64(UnifinamesServfailCount)
+		d := &dummyResponseWriter{}
+		_, ok := p.resolve(d, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+		require.True(t, ok)
+		require.Equal(t, dns.RcodeSuccess, d.GetMsgs()[0].Rcode)
+
+		p.lastUpdate = time.Now().Add(-2 * time.Hour)
+		d = &dummyResponseWriter{}
+		rcode, ok := p.resolve(d, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+		require.True(t, ok)
+		require.Equal(t, dns.RcodeServerFailure, rcode)
+		require.Equal(t, dns.RcodeServerFailure, d.GetMsgs()[0].Rcode)
+		require.Equal(t, 0, len(d.GetMsgs()[0].Answer))
+		require.Equal(t, servfails+1, testutil.ToFloat64(UnifinamesServfailCount))
+
+		// the other domains are still passed on
+		_, ok = p.resolve(&dummyResponseWriter{}, new(dns.Msg).SetQuestion("server1.example.com.", dns.TypeA))
+		require.False(t, ok)
+	})
+
+	t.Run("Not Authoritative", func(t *testing.T) {
+		p := newTestPlugin()
+		d := &dummyResponseWriter{}
+		_, ok := p.resolve(d, new(dns.Msg).SetQuestion("server2.lan.", dns.TypeA))
+		require.False(t, ok)
+		require.Equal(t, 0, len(d.GetMsgs()))
+	})
+}
+
+func TestVersionRecord(t *testing.T) {
+	p := newTestPlugin()
+	d := &dummyResponseWriter{}
+	m := new(dns.Msg).SetQuestion("Unifi-Names.Version.", dns.TypeTXT)
+	m.Question[0].Qclass = dns.ClassCHAOS
+	rcode, ok := p.resolve(d, m)
+	require.True(t, ok)
+	require.Equal(t, dns.RcodeSuccess, rcode)
+	require.Equal(t, 1, len(d.GetMsgs()))
+	txt := d.GetMsgs()[0].Answer[0].(*dns.TXT)
+	require.Equal(t, uint16(dns.ClassCHAOS), txt.Hdr.Class)
+	require.Equal(t, "version="+Version, txt.Txt[0])
+	require.Equal(t, "last_update="+p.lastUpdate.UTC().Format(time.RFC3339), txt.Txt[1])
+	require.Equal(t, "records=1", txt.Txt[2])
+
+	// only CHAOS TXT questions are answered
+	m.Question[0].Qclass = dns.ClassINET
+	_, ok = p.resolve(d, m)
+	require.False(t, ok)
+	m.Question[0].Qclass = dns.ClassCHAOS
+	m.Question[0].Qtype = dns.TypeA
+	_, ok = p.resolve(d, m)
+	require.False(t, ok)
+
+	p.lastUpdate = time.Time{}
+	require.Equal(t, "last_update=never", p.versionRecord(versionName).(*dns.TXT).Txt[1])
+}
+
+func TestShouldHandle(t *testing.T) {
+	networks := map[string]string{
+		"lan":  "lan.",
+		"home": "home.arpa.",
+	}
+	for _, tc := range []struct {
+		name     string
+		query    string
+		networks map[string]string
+		expected bool
+	}{
+		{name: "exact domain", query: "lan.", networks: networks, expected: true},
+		{name: "exact nested domain", query: "home.arpa.", networks: networks, expected: true},
+		{name: "subdomain", query: "server1.lan.", networks: networks, expected: true},
+		{name: "subdomain of nested domain", query: "server1.home.arpa.", networks: networks, expected: true},
+		{name: "sub subdomain", query: "www.server1.lan.", networks: networks, expected: true},
+		{name: "sibling sharing a suffix", query: "notlan.", networks: networks, expected: false},
+		{name: "subdomain of sibling sharing a suffix", query: "server1.notlan.", networks: networks, expected: false},
+		{name: "nested sibling sharing a suffix", query: "server1.nothome.arpa.", networks: networks, expected: false},
+		{name: "parent domain", query: "arpa.", networks: networks, expected: false},
+		{name: "unrelated domain", query: "example.com.", networks: networks, expected: false},
+		{name: "root", query: ".", networks: networks, expected: false},
+		{name: "empty name", query: "", networks: networks, expected: false},
+		{name: "empty domain list", query: "server1.lan.", networks: map[string]string{}, expected: false},
+		{name: "nil domain list", query: "server1.lan.", networks: nil, expected: false},
+		{name: "domain without trailing dot", query: "server1.lan.", networks: map[string]string{"lan": "lan"}, expected: true},
+		{name: "domain with trailing dot", query: "server1.lan.", networks: map[string]string{"lan": "lan."}, expected: true},
+		{name: "query without trailing dot", query: "server1.lan", networks: networks, expected: true},
+		{name: "lowercased uppercase query", query: strings.ToLower("SERVER1.LAN."), networks: networks, expected: true},
+	} {
+		p := unifinames{Config: &config{Networks: map[string]*NetworkConfig{}}}
+		for network, domain := range tc.networks {
+			p.Config.Networks[network] = &NetworkConfig{Domain: domain}
+		}
+		require.Equal(t, tc.expected, p.shouldHandle(tc.query), tc.name)
+	}
+}
+
+func TestHandlesClass(t *testing.T) {
+	for qclass, expected := range map[uint16]bool{
+		dns.ClassINET:   true,
+		dns.ClassANY:    true,
+		dns.ClassCSNET:  false,
+		dns.ClassCHAOS:  false,
+		dns.ClassHESIOD: false,
+		dns.ClassNONE:   false,
+	} {
+		t.Run(dns.ClassToString[qclass], func(t *testing.T) {
+			require.Equal(t, expected, handlesClass(qclass))
+
+			m := new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA)
+			m.Question[0].Qclass = qclass
+			rrs := newTestPlugin().lookup(m)
+			if expected {
+				require.Equal(t, 1, len(rrs))
+				require.Equal(t, uint16(dns.ClassINET), rrs[0].Header().Class)
+			} else {
+				require.Equal(t, 0, len(rrs))
+			}
+		})
+	}
+}
+
+func TestJitter(t *testing.T) {
+	p := newTestPlugin()
+	require.Equal(t, time.Duration(0), p.jitter())
+
+	p.Config.RefreshJitter = 10 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		jitter := p.jitter()
+		require.GreaterOrEqual(t, jitter, time.Duration(0))
+		require.Less(t, jitter, p.Config.RefreshJitter)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.Config.TTL = 1
+	// an idle plugin has no refresh that is due, a started one gets the threshold for the first refresh
+	require.True(t, p.Health())
+	p.refreshStarted = time.Now().Add(-4 * time.Second)
+	require.False(t, p.Health())
+	p.refreshStarted = time.Now()
+	require.True(t, p.Health())
+
+	require.NoError(t, p.refresh())
+	require.True(t, p.Health())
+	updated := testutil.ToFloat64(UnifinamesLastSuccessfulUpdate)
+	require.Equal(t, float64(p.lastSuccessfulUpdate.Unix()), updated)
+
+	s.Close()
+	require.Error(t, p.refresh())
+	require.True(t, p.Health())
+	// failures don't touch the timestamp
+	require.Equal(t, updated, testutil.ToFloat64(UnifinamesLastSuccessfulUpdate))
+
+	p.refreshStarted = time.Now().Add(-5 * time.Second)
+	p.lastSuccessfulUpdate = time.Now().Add(-4 * time.Second)
+	require.False(t, p.Health())
+}
+
+func TestReady(t *testing.T) {
+	t.Run("Failed Refresh", func(t *testing.T) {
+		s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+		s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		require.True(t, p.Ready())
+	})
+
+	t.Run("Require Initial Data", func(t *testing.T) {
+		s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+		defer s.Close()
+		p := unifinames{Config: newTestConfig("https://127.0.0.1:1")}
+		p.Config.RequireInitialData = true
+		require.False(t, p.Ready())
+		require.False(t, p.Ready())
+
+		p.Config.UnifiControllerURL = s.URL
+		require.True(t, p.Ready())
+		require.Equal(t, 1, len(p.aClients))
+	})
+
+	// run with -race, Ready runs on the goroutine of the ready plugin while queries are served
+	t.Run("Concurrent Queries", func(t *testing.T) {
+		s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL), Next: test.NextHandler(dns.RcodeNameError, nil)}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				require.True(t, p.Ready())
+			}()
+			go func() {
+				defer wg.Done()
+				_, _ = p.ServeDNS(context.Background(), &dummyResponseWriter{}, new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+			}()
+		}
+		wg.Wait()
+		require.True(t, p.IsReady.Load())
+	})
+}
+
+func TestCaseInsensitivity(t *testing.T) {
+	t.Run("All Caps Query", func(t *testing.T) {
+		p := newTestPlugin()
+		rrs := p.lookup(new(dns.Msg).SetQuestion("SERVER1.LAN.", dns.TypeA))
+		require.Equal(t, 1, len(rrs))
+		require.True(t, p.nameExists("SERVER1.LAN."))
+		require.True(t, p.isApex("LAN."))
+		require.Equal(t, "lan.", p.zone("SERVER1.LAN."))
+	})
+
+	t.Run("Mixed Case Record Name", func(t *testing.T) {
+		p := newTestPlugin()
+		p.aClients[0].Hdr.Name = "Server1.Lan."
+		for _, name := range []string{"server1.lan.", "SERVER1.LAN.", "sErVeR1.lAn."} {
+			require.Equal(t, 1, len(p.lookup(new(dns.Msg).SetQuestion(name, dns.TypeA))), name)
+		}
+	})
+
+	t.Run("Uppercase Config Domain", func(t *testing.T) {
+		s := MockUnifiController(nil, "LAN", "Server1", "127.0.0.1")
+		defer s.Close()
+		p := unifinames{Config: newTestConfig(s.URL)}
+		p.Config.Networks = map[string]*NetworkConfig{"lan": {Domain: "Home.LAN."}}
+		require.NoError(t, p.getClients(context.Background()))
+		require.True(t, p.shouldHandle("server1.home.lan."))
+		require.True(t, p.isApex("home.lan."))
+		require.Equal(t, 1, len(p.lookup(new(dns.Msg).SetQuestion("server1.home.lan.", dns.TypeA))))
+		require.Equal(t, 1, len(p.lookup(new(dns.Msg).SetQuestion("SERVER1.HOME.LAN.", dns.TypeA))))
+	})
+}
+
+func TestSiteFailures(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/login", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "unifises=deadbeef; Path=/")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"meta": {"rc": "ok", "server_version": "7.4.162", "up": true}}`)
+	})
+	mux.HandleFunc("/api/stat/sites", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": [
+			{"_id": "eeeeeeeeeeeeeeeeeeeeeeee", "name": "default", "desc": "Default"},
+			{"_id": "ffffffffffffffffffffffff", "name": "lab", "desc": "Lab"},
+			{"_id": "dddddddddddddddddddddddd", "name": "shop", "desc": "Shop"}
+		], "meta": {"rc": "ok"}}`)
+	})
+	for site, client := range map[string]string{
+		"default": `{"mac": "00:00:00:00:00:01", "hostname": "default-server", "ip": "192.168.1.1", "network": "lan"}`,
+		"lab":     `{"mac": "00:00:00:00:00:02", "hostname": "lab-server", "ip": "192.168.1.2", "network": "lan"}`,
+	} {
+		client := client
+		mux.HandleFunc("/api/s/"+site+"/stat/sta", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"data": [%s], "meta": {"rc": "ok"}}`, client)
+		})
+	}
+	mux.HandleFunc("/api/s/shop/stat/sta", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGatewayTimeout)
+	})
+	s := httptest.NewTLSServer(mux)
+	defer s.Close()
+
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.Config.MaxSiteFailureRatio = 0.5
+	require.NoError(t, p.getClients(context.Background()))
+	require.Len(t, p.lookup(new(dns.Msg).SetQuestion("default-server.lan.", dns.TypeA)), 1)
+	require.Len(t, p.lookup(new(dns.Msg).SetQuestion("lab-server.lan.", dns.TypeA)), 1)
+
+	// the site metrics are by the name of the site
+	require.Equal(t, float64(1), testutil.ToFloat64(UnifinamesSiteHostsCount.WithLabelValues("lab")))
+	require.Equal(t, 2, testutil.CollectAndCount(UnifinamesSiteHostsCount))
+	hits := testutil.ToFloat64(UnifinamesSiteQueryCount.WithLabelValues("lab", "hit"))
+	p.Config.WildcardClients = true
+	require.NoError(t, p.getClients(context.Background()))
+	for _, name := range []string{"lab-server.lan.", "www.lab-server.lan.", "missing.lan."} {
+		_, _ = p.resolve(&dummyResponseWriter{}, new(dns.Msg).SetQuestion(name, dns.TypeA))
+	}
+	require.Equal(t, hits+2, testutil.ToFloat64(UnifinamesSiteQueryCount.WithLabelValues("lab", "hit")))
+	p.clearClients()
+	require.Equal(t, 0, testutil.CollectAndCount(UnifinamesSiteHostsCount))
+	require.NoError(t, p.getClients(context.Background()))
+
+	// 1 of 3 sites is above the ratio
+	p.Config.MaxSiteFailureRatio = 0.3
+	require.Error(t, p.getClients(context.Background()))
+
+	// all sites failing is an error whatever the ratio is
+	p.Config.MaxSiteFailureRatio = 1
+	p.Config.IncludeSites = []string{"shop"}
+	require.Error(t, p.getClients(context.Background()))
+}
+
+func TestHostWeight(t *testing.T) {
+	s := MockUnifiControllerWithClients(nil,
+		map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server", "ip": "192.168.1.1", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "server", "ip": "192.168.10.1", "network": "wifi"},
+		map[string]interface{}{"mac": "00:00:00:00:00:03", "hostname": "server", "ip": "192.168.10.2", "network": "wifi"},
+		map[string]interface{}{"mac": "00:00:00:00:00:04", "hostname": "server", "ip": "192.168.20.1", "network": "iot"},
+	)
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.Config.HostnameCollisionPolicy = "all"
+	p.Config.WildcardClients = true
+	p.Config.Networks = map[string]*NetworkConfig{
+		"lan":  {Domain: "lan."},
+		"wifi": {Domain: "lan.", Weight: 10},
+		"iot":  {Domain: "lan.", Weight: -1},
+	}
+	require.NoError(t, p.getClients(context.Background()))
+
+	answer := func(name string) []string {
+		d := &dummyResponseWriter{}
+		_, ok := p.resolve(d, new(dns.Msg).SetQuestion(name, dns.TypeA))
+		require.True(t, ok)
+		var ips []string
+		for _, rr := range d.GetMsgs()[0].Answer {
+			ips = append(ips, rr.(*dns.A).A.String())
+		}
+		return ips
+	}
+	shuffled := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		for _, name := range []string{"server.lan.", "www.server.lan."} {
+			ips := answer(name)
+			require.ElementsMatch(t, []string{"192.168.10.1", "192.168.10.2"}, ips[:2], name)
+			require.Equal(t, []string{"192.168.1.1", "192.168.20.1"}, ips[2:], name)
+			shuffled[ips[0]] = true
+		}
+	}
+	require.Len(t, shuffled, 2)
+
+	// without weights the records keep their order
+	p.Config.Networks["wifi"].Weight = 0
+	p.Config.Networks["iot"].Weight = 0
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, []string{"192.168.1.1", "192.168.10.1", "192.168.10.2", "192.168.20.1"}, answer("server.lan."))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	// the port of a controller that is down
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	p := unifinames{Config: newTestConfig("https://" + addr)}
+	p.Config.CircuitBreaker = true
+	p.Config.CircuitFailureThreshold = 2
+	p.Config.CircuitOpenDuration = 50 * time.Millisecond
+	for i := 0; i < 2; i++ {
+		err := p.refresh()
+		require.Error(t, err)
+		require.NotErrorIs(t, err, errCircuitOpen)
+	}
+	require.Equal(t, float64(circuitOpen), testutil.ToFloat64(UnifinamesCircuitState))
+
+	// the open circuit doesn't query the controller
+	require.ErrorIs(t, p.refresh(), errCircuitOpen)
+	require.Equal(t, int32(2), p.consecutiveFailures.Load())
+
+	// the refresh of the half-open circuit fails and opens it again
+	time.Sleep(p.Config.CircuitOpenDuration)
+	require.NotErrorIs(t, p.refresh(), errCircuitOpen)
+	require.ErrorIs(t, p.refresh(), errCircuitOpen)
+
+	// the controller is back
+	s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+	defer s.Close()
+	p.Config.UnifiControllerURL = s.URL
+	time.Sleep(p.Config.CircuitOpenDuration)
+	require.NoError(t, p.refresh())
+	require.Equal(t, float64(circuitClosed), testutil.ToFloat64(UnifinamesCircuitState))
+	require.Len(t, p.lookup(new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA)), 1)
+}
+
+func TestConnectRetry(t *testing.T) {
+	// the port of a controller that is down
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	p := unifinames{Config: newTestConfig("https://" + addr)}
+	p.Config.ConnectRetry = 2
+	p.Config.ConnectRetryDelay = time.Millisecond
+	retries := testutil.ToFloat64(UnifinamesConnectRetryCount)
+	require.Error(t, p.getClients(context.Background()))
+	require.Equal(t, retries+2, testutil.ToFloat64(UnifinamesConnectRetryCount))
+
+	// the controller comes back during the retries
+	p.Config.ConnectRetry = 50
+	p.Config.ConnectRetryDelay = 20 * time.Millisecond
+	s := httptest.NewUnstartedServer(mockUnifiMux(`[{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.1", "network": "lan"}]`))
+	started := make(chan struct{})
+	go func() {
+		defer close(started)
+		time.Sleep(50 * time.Millisecond)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		s.Listener.Close()
+		s.Listener = l
+		s.StartTLS()
+	}()
+	require.NoError(t, p.getClients(context.Background()))
+	require.Len(t, p.aClients, 1)
+	<-started
+	s.Close()
+
+	// the retries end with the context
+	p.Config.ConnectRetryDelay = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, p.getClients(ctx), context.DeadlineExceeded)
+}
+
+func TestFilterSites(t *testing.T) {
+	sites := []*unifi.Site{
+		{ID: "eeeeeeeeeeeeeeeeeeeeeeee", Name: "default", Desc: "Default"},
+		{ID: "ffffffffffffffffffffffff", Name: "x7k2p9", Desc: "Customer A"},
+		{ID: "dddddddddddddddddddddddd", Name: "lab", Desc: "Lab"},
+	}
+	names := func(sites []*unifi.Site) []string {
+		var names []string
+		for _, site := range sites {
+			names = append(names, site.Name)
+		}
+		return names
+	}
+	require.Equal(t, []string{"default", "x7k2p9", "lab"}, names(filterSites(sites, nil, nil)))
+	require.Equal(t, []string{"default", "x7k2p9"}, names(filterSites(sites, []string{"default", "customer a"}, nil)))
+	require.Equal(t, []string{"x7k2p9"}, names(filterSites(sites, nil, []string{"eeeeeeeeeeeeeeeeeeeeeeee", "lab"})))
+	// include_sites wins
+	require.Equal(t, []string{"lab"}, names(filterSites(sites, []string{"lab"}, []string{"lab"})))
+
+	s := MockUnifiController(nil, "lan", "server1", "192.168.1.1")
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.Config.ExcludeSites = []string{"default"}
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, 0, len(p.aClients))
+}
+
+func TestHostnameFields(t *testing.T) {
+	s := MockUnifiControllerWithClients(nil,
+		map[string]interface{}{"mac": "00:00:00:00:00:01", "name": "Printer", "hostname": "hp-1234", "ip": "192.168.1.1", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "camera", "ip": "192.168.1.2", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:03", "name": "!!!", "note": "nas", "ip": "192.168.1.3", "network": "lan"},
+	)
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.Config.HostnameFields = []string{"name", "hostname", "note"}
+	require.NoError(t, p.getClients(context.Background()))
+	var names []string
+	for _, client := range p.aClients {
+		names = append(names, client.Hdr.Name)
+	}
+	require.Equal(t, []string{"printer.lan.", "camera.lan.", "nas.lan."}, names)
+
+	p.Config.HostnameFields = nil
+	p.Config.UseNameAsHostname = true
+	require.Equal(t, []string{"name"}, p.Config.hostnameFields())
+}
+
+func TestStartupCommand(t *testing.T) {
+	s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+	defer s.Close()
+	file := filepath.Join(t.TempDir(), "commands")
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.Config.OnStartupCommand = "echo startup >> " + file
+	p.Config.OnRefreshCommand = "echo refresh >> " + file
+	contents := func(want string) func() bool {
+		return func() bool {
+			data, _ := os.ReadFile(file)
+			return string(data) == want
+		}
+	}
+
+	require.NoError(t, p.refresh())
+	require.Eventually(t, contents("startup\n"), time.Second, 10*time.Millisecond)
+	require.NoError(t, p.refresh())
+	require.Eventually(t, contents("startup\nrefresh\n"), time.Second, 10*time.Millisecond)
+
+	// a failed command is only logged
+	p.Config.OnRefreshCommand = "exit 1"
+	require.NoError(t, p.refresh())
+}
+
+func TestBatchUpdateThreshold(t *testing.T) {
+	record := func(name string, ip byte) dns.A {
+		return dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.IPv4(192, 168, 1, ip)}
+	}
+	p := newTestPlugin()
+	p.Config.BatchUpdateThreshold = 3
+	p.Config.MaxDeferDuration = time.Hour
+	p.aClients = []dns.A{record("server1.lan.", 1), record("server2.lan.", 2)}
+	p.aaaaClients = nil
+	deferred := testutil.ToFloat64(UnifinamesDeferredUpdatesCount)
+
+	// one changed ip is an addition and a removal
+	changed := []dns.A{record("SERVER1.lan.", 1), record("server2.lan.", 3)}
+	require.Equal(t, 2, recordChanges(p.aClients, nil, changed, nil))
+	require.True(t, p.deferUpdate(changed, nil))
+	require.False(t, p.deferredSince.IsZero())
+	require.Equal(t, deferred+1, testutil.ToFloat64(UnifinamesDeferredUpdatesCount))
+
+	// the changes add up until they reach the threshold
+	changed = append(changed, record("server3.lan.", 4))
+	require.False(t, p.deferUpdate(changed, nil))
+	require.True(t, p.deferredSince.IsZero())
+
+	// no changes and the changes that waited max_defer_duration aren't deferred
+	require.False(t, p.deferUpdate(p.aClients, nil))
+	require.True(t, p.deferUpdate(changed[:1], nil))
+	p.deferredSince = time.Now().Add(-time.Hour)
+	require.False(t, p.deferUpdate(changed[:1], nil))
+	require.Equal(t, deferred+2, testutil.ToFloat64(UnifinamesDeferredUpdatesCount))
+
+	// the first records are never deferred
+	p.aClients = nil
+	require.False(t, p.deferUpdate(changed[:1], nil))
+}
+
+func TestIPChanges(t *testing.T) {
+	record := func(name string, ip byte) dns.A {
+		return dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.IPv4(192, 168, 1, ip)}
+	}
+	old := []dns.A{record("server1.lan.", 1), record("server2.lan.", 2), record("server3.lan.", 3)}
+	// server1 moved, server2 got a second ip, server3 was removed and server4 added
+	changed := []dns.A{record("SERVER1.lan.", 5), record("server2.lan.", 2), record("server2.lan.", 6), record("server4.lan.", 4)}
+	require.Equal(t, []string{
+		"server1.lan: 192.168.1.1 → 192.168.1.5",
+		"server2.lan: 192.168.1.2 → 192.168.1.2, 192.168.1.6",
+	}, ipChanges(old, nil, changed, nil))
+	require.Empty(t, ipChanges(old, nil, old, nil))
+	require.Empty(t, ipChanges(nil, nil, changed, nil))
+
+	s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.aClients = []dns.A{record("server1.lan.", 1)}
+	changes := testutil.ToFloat64(UnifinamesIPChangesCount)
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, changes+1, testutil.ToFloat64(UnifinamesIPChangesCount))
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, changes+1, testutil.ToFloat64(UnifinamesIPChangesCount))
+}
+
+func TestHostnameSuffixStrip(t *testing.T) {
+	s := MockUnifiControllerWithClients(nil,
+		map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "MyDevice.LOCAL", "ip": "192.168.1.1", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "printer.local.lan", "ip": "192.168.1.2", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:03", "hostname": ".local", "ip": "192.168.1.3", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:04", "hostname": "localhost.home", "ip": "192.168.1.4", "network": "lan"},
+	)
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.Config.HostnameSuffixStrip = []string{".local", ".home", ".lan"}
+	skipped := testutil.ToFloat64(UnifinamesClientsSkippedCount.WithLabelValues("empty_name"))
+	require.NoError(t, p.getClients(context.Background()))
+	var names []string
+	for _, client := range p.aClients {
+		names = append(names, client.Hdr.Name)
+	}
+	// the reserved names are found after stripping
+	require.Equal(t, []string{"mydevice.lan.", "printer.lan."}, names)
+	require.Equal(t, skipped+1, testutil.ToFloat64(UnifinamesClientsSkippedCount.WithLabelValues("empty_name")))
+
+	p.Config.HostnameSuffixStrip = nil
+	require.NoError(t, p.getClients(context.Background()))
+	require.Len(t, p.lookup(new(dns.Msg).SetQuestion("mydevice-local.lan.", dns.TypeA)), 1)
+}
+
+func TestLeaseTTL(t *testing.T) {
+	leaseEnd := time.Now().Unix() + 60
+	s := MockUnifiControllerWithClients(nil,
+		map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "expiring", "ip": "192.168.1.1", "network": "lan", "dhcpend_time": leaseEnd},
+		map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "fixed", "ip": "192.168.1.2", "network": "lan", "dhcpend_time": leaseEnd, "use_fixedip": true},
+		map[string]interface{}{"mac": "00:00:00:00:00:03", "hostname": "nolease", "ip": "192.168.1.3", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:04", "hostname": "ended", "ip": "192.168.1.4", "network": "lan", "dhcpend_time": leaseEnd - 120},
+	)
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.Config.MinTTL = 5
+	require.NoError(t, p.getClients(context.Background()))
+	ttl := func(name string) uint32 {
+		rrs := p.lookup(new(dns.Msg).SetQuestion(name, dns.TypeA))
+		require.Len(t, rrs, 1, name)
+		return rrs[0].Header().Ttl
+	}
+
+	// the lease that ends before the next refresh lowers the ttl
+	require.InDelta(t, 60, ttl("expiring.lan."), 2)
+	// the fixed ips and the clients without a lease end keep the ttl
+	require.Equal(t, uint32(3600), ttl("fixed.lan."))
+	require.Equal(t, uint32(3600), ttl("nolease.lan."))
+	// min_ttl still applies to the leases that ended
+	require.Equal(t, uint32(5), ttl("ended.lan."))
+
+	// max_ttl still caps the ttl
+	p.Config.MaxTTL = 30
+	require.Equal(t, uint32(30), ttl("expiring.lan."))
+	require.Equal(t, uint32(30), ttl("fixed.lan."))
+}
+
+func TestPreserveDots(t *testing.T) {
+	long := strings.Repeat("a", 70)
+	s := MockUnifiControllerWithClients(nil,
+		map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "Printer.2nd..Floor.", "ip": "192.168.1.1", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": long + ".b", "ip": "192.168.1.2", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:03", "hostname": strings.Repeat(strings.Repeat("c", 60)+".", 5), "ip": "192.168.1.3", "network": "lan"},
+	)
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	require.NoError(t, p.getClients(context.Background()))
+	require.Len(t, p.lookup(new(dns.Msg).SetQuestion("printer-2nd-floor.lan.", dns.TypeA)), 1)
+
+	p.Config.PreserveDots = true
+	skipped := testutil.ToFloat64(UnifinamesClientsSkippedCount.WithLabelValues("name_too_long"))
+	require.NoError(t, p.getClients(context.Background()))
+	var names []string
+	for _, client := range p.aClients {
+		names = append(names, client.Hdr.Name)
+	}
+	// each label is truncated on its own
+	require.Equal(t, []string{"printer.2nd.floor.lan.", strings.Repeat("a", 63) + ".b.lan."}, names)
+	require.Equal(t, skipped+1, testutil.ToFloat64(UnifinamesClientsSkippedCount.WithLabelValues("name_too_long")))
+
+	require.Equal(t, "abc.de", truncateLabels("abcd.def", 4, 1, 2))
+	require.Equal(t, "", truncateLabels("abcd.--", 4, 0, 2))
+	require.Equal(t, "a.b", normalizeLabels("none", "A..B."))
+}
+
+func TestReservedNames(t *testing.T) {
+	s := MockUnifiControllerWithClients(nil,
+		map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "WPAD", "ip": "192.168.1.1", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "_gateway", "ip": "192.168.1.2", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:03", "hostname": "proxy", "ip": "192.168.1.3", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:04", "hostname": "wpad-server", "ip": "192.168.1.4", "network": "lan"},
+	)
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.Config.AdditionalReservedNames = []string{"proxy"}
+	skipped := testutil.ToFloat64(UnifinamesClientsSkippedCount.WithLabelValues("reserved_name"))
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, skipped+3, testutil.ToFloat64(UnifinamesClientsSkippedCount.WithLabelValues("reserved_name")))
+	require.Len(t, p.aClients, 1)
+	require.Equal(t, "wpad-server.lan.", p.aClients[0].Hdr.Name)
+	require.GreaterOrEqual(t, len(reservedNames), 15)
+}
+
+func TestClientLabelField(t *testing.T) {
+	s := MockUnifiControllerWithClients(nil,
+		map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "hp-1234", "radio_name": "wifi0", "ip": "192.168.1.1", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "camera", "ip": "192.168.1.2", "network": "lan"},
+	)
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	index, err := clientFieldIndex("radioname")
+	require.NoError(t, err)
+	p.Config.clientLabelField = index
+	require.NoError(t, p.getClients(context.Background()))
+	var names []string
+	for _, client := range p.aClients {
+		names = append(names, client.Hdr.Name)
+	}
+	// the clients without the field fall back to hostname_fields
+	require.Equal(t, []string{"wifi0.lan.", "camera.lan."}, names)
+
+	for _, field := range []string{"Radio_Name", "LastSeen"} {
+		_, err := clientFieldIndex(field)
+		require.Error(t, err, field)
+	}
+	_, err = newConfigFromDispenser(caddyfile.NewDispenser("", strings.NewReader(`
+		{
+			Network LAN example.com
+			Unifi https://localhost:8443/ default admin test
+			client_label_field DeviceName
+		}
+	`)))
+	// an unknown field is only logged
+	require.NoError(t, err)
+}
+
+func TestSkippedClients(t *testing.T) {
+	UnifinamesClientsSkippedCount.Reset()
+	s := MockUnifiControllerWithClients(nil,
+		map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.1", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:03", "hostname": "!!!", "ip": "192.168.1.3", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:04", "hostname": "offline", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:05", "hostname": "guest", "ip": "192.168.2.5", "network": "guest"},
+	)
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, 1, len(p.aClients))
+	require.Equal(t, 3, p.skippedClientCount())
+	require.Equal(t, float64(1), testutil.ToFloat64(UnifinamesClientsSkippedCount.WithLabelValues("empty_name")))
+	require.Equal(t, float64(1), testutil.ToFloat64(UnifinamesClientsSkippedCount.WithLabelValues("missing_ip")))
+	require.Equal(t, float64(1), testutil.ToFloat64(UnifinamesClientsSkippedCount.WithLabelValues("unknown_network")))
+}
+
+func TestStrictHostnameValidation(t *testing.T) {
+	UnifinamesClientsSkippedCount.Reset()
+	s := MockUnifiControllerWithClients(nil,
+		map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.1", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "42", "ip": "192.168.1.2", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:03", "hostname": "x", "ip": "192.168.1.3", "network": "lan"},
+	)
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, 3, len(p.aClients))
+
+	p.Config.StrictHostnameValidation = true
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, 1, len(p.aClients))
+	require.Equal(t, "server1.lan.", p.aClients[0].Hdr.Name)
+	require.Equal(t, float64(2), testutil.ToFloat64(UnifinamesClientsSkippedCount.WithLabelValues("rfc1123_violation")))
+
+	require.True(t, isStrictHostname("a1"))
+	require.True(t, isStrictHostname("printer-0815"))
+	require.False(t, isStrictHostname("-printer"))
+	require.False(t, isStrictHostname("printer-"))
+	require.False(t, isStrictHostname("0815"))
+	require.False(t, isStrictHostname("x"))
+}
+
+func TestDNSOverride(t *testing.T) {
+	s := MockUnifiControllerWithClients(nil,
+		map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "ubuntu", "ip": "192.168.1.1", "network": "lan", "note": "rack 2, DNS:webserver"},
+		map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "printer", "ip": "192.168.1.2", "network": "lan", "note": "2nd floor"},
+		map[string]interface{}{"mac": "00:00:00:00:00:03", "ip": "192.168.1.3", "network": "lan", "note": "dns:camera"},
+	)
+	defer s.Close()
+	config, err := newConfigFromDispenser(caddyfile.NewDispenser("", strings.NewReader(`
+		{
+			Network LAN lan
+			Unifi `+s.URL+` default admin admin
+			parse_dns_override
+		}
+	`)))
+	require.NoError(t, err)
+	p := unifinames{Config: config}
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, 3, len(p.aClients))
+	require.Equal(t, "webserver.lan.", p.aClients[0].Hdr.Name)
+	require.Equal(t, "printer.lan.", p.aClients[1].Hdr.Name)
+	require.Equal(t, "camera.lan.", p.aClients[2].Hdr.Name)
+
+	p.Config.dnsOverride = regexp.MustCompile(`host=[a-z]+`)
+	require.Equal(t, "host=nas", p.Config.dnsOverrideName("host=nas"))
+	require.Equal(t, "", p.Config.dnsOverrideName("dns:nas"))
+
+	_, err = newConfigFromDispenser(caddyfile.NewDispenser("", strings.NewReader(`
+		{
+			Network LAN lan
+			Unifi https://localhost:8443/ default admin admin
+			parse_dns_override
+			dns_override_pattern dns:(
+		}
+	`)))
+	require.Error(t, err)
+}
+
+func TestFqdnNames(t *testing.T) {
+	s := MockUnifiController(nil, "lan", "Server1", "127.0.0.1")
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	// configs that weren't parsed can have domains without the trailing dot
+	p.Config.Networks["lan"].Domain = "lan"
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, "server1.lan.", p.aClients[0].Hdr.Name)
+
+	// the questions that aren't fqdns match the records, e.g. the ones that aren't parsed from the wire
+	r := new(dns.Msg)
+	r.Question = []dns.Question{{Name: "SERVER1.lan", Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+	rrs := p.lookup(r)
+	require.Len(t, rrs, 1)
+	require.Equal(t, "server1.lan.", rrs[0].Header().Name)
+	r.Question[0].Qtype = dns.TypeTXT
+	p.Config.IncludeAnnotations = true
+	p.Config.RecordAnnotations = map[string]string{"env": "prod"}
+	rrs = p.lookup(r)
+	require.Len(t, rrs, 1)
+	require.Equal(t, "SERVER1.lan.", rrs[0].Header().Name)
+	require.True(t, p.nameExists("server1.lan"))
+	require.False(t, p.nameExists("server2.lan"))
+}
+
+func TestStrictIPUniqueness(t *testing.T) {
+	s := MockUnifiControllerWithClients(nil,
+		map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.1", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "camera", "ip": "192.168.1.2", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:03", "hostname": "sensor", "ip": "192.168.1.2", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:04", "hostname": "plug", "fixed_ip": "192.168.1.2", "network": "lan"},
+	)
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, 4, len(p.aClients))
+
+	conflicts := testutil.ToFloat64(UnifinamesIPConflictCount)
+	p.Config.StrictIPUniqueness = true
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, 1, len(p.aClients))
+	require.Equal(t, "server1.lan.", p.aClients[0].Hdr.Name)
+	require.Equal(t, 3, p.skippedClients)
+	require.Equal(t, conflicts+1, testutil.ToFloat64(UnifinamesIPConflictCount))
+}
+
+func TestDNSPrefix(t *testing.T) {
+	s := MockUnifiController(nil, "lan", "iphone", "192.168.1.5")
+	defer s.Close()
+	parse := func(directives string) (*config, error) {
+		return newConfigFromDispenser(caddyfile.NewDispenser("", strings.NewReader(`
+			{
+				Network LAN home.arpa prefix=lan-
+				Unifi `+s.URL+` default admin admin
+				`+directives+`
+			}
+		`)))
+	}
+	config, err := parse("dns_prefix WiFi")
+	require.NoError(t, err)
+	p := unifinames{Config: config}
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, "wifi-lan-iphone.home.arpa.", p.aClients[0].Hdr.Name)
+
+	// the prefix counts towards the 63 octets of the label
+	p.Config.DNSPrefix, p.Config.DNSPrefixSeparator = strings.Repeat("w", 55), ""
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, strings.Repeat("w", 55)+"lan-ipho.home.arpa.", p.aClients[0].Hdr.Name)
+
+	for _, directives := range []string{"dns_prefix wi_fi", "dns_prefix wifi\ndns_prefix_separator .", "dns_prefix " + strings.Repeat("w", 63)} {
+		_, err := parse(directives)
+		require.Error(t, err, directives)
+	}
+}
+
+func TestRefreshSummary(t *testing.T) {
+	require.Equal(t, "3 added, 0 skipped", refreshSummary(3, 0, map[string]int{}))
+	require.Equal(t, "487 added, 13 skipped (8 empty_name, 3 unknown_network, 1 invalid_ip, 1 rfc1123_violation)",
+		refreshSummary(487, 13, map[string]int{"invalid_ip": 1, "unknown_network": 3, "rfc1123_violation": 1, "empty_name": 8}))
+}
+
+func TestSanitizeName(t *testing.T) {
+	require.Equal(t, "printer-0815", sanitizeName("Printer 0815"))
+	require.Equal(t, "00-11-22-33-44-88", sanitizeName("00:11:22:33:44:88"))
+	require.Equal(t, "caf", sanitizeName("Café"))
+	require.Equal(t, "a-b", sanitizeName("--a__b--"))
+	require.Equal(t, "", sanitizeName("!!!"))
+	require.False(t, isAllowedRune('é'))
+	require.False(t, isAllowedRune(-1))
+}
+
+// FuzzSanitizeName checks that the names of any client are turned into a hostname label, run with
+// go test -fuzz FuzzSanitizeName
+func FuzzSanitizeName(f *testing.F) {
+	for _, name := range []string{
+		"John's iPhone", "Printer 0815", "00:11:22:33:44:88", "Café", "--a__b--", "!!!", "", "-", "FamilyTV",
+		"Galaxy-S23 (2)", "living room.tv", "日本語", "İstanbul", "\u212a", "a\x00b", "\xff\xfe",
+	} {
+		f.Add(name)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		sanitized := sanitizeName(name)
+		for _, r := range sanitized {
+			require.True(t, isAllowedRune(r), "%q: %q", name, sanitized)
+		}
+		require.LessOrEqual(t, len(sanitized), len(name), "%q: %q", name, sanitized)
+		require.False(t, strings.HasPrefix(sanitized, "-"), "%q: %q", name, sanitized)
+		require.False(t, strings.HasSuffix(sanitized, "-"), "%q: %q", name, sanitized)
+		require.NotContains(t, sanitized, "--", "%q: %q", name, sanitized)
+		// the label doesn't change when it is sanitized again
+		require.Equal(t, sanitized, sanitizeName(sanitized), name)
+	})
+}
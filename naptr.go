@@ -0,0 +1,109 @@
+package unifinames
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// NAPTRService is a NAPTR record template of naptr_services for the clients whose name matches Pattern,
+// {name} in Regexp and Replacement is replaced with the name of the client, e.g. for SIP phones
+type NAPTRService struct {
+	// Pattern is a glob like voip_* that is matched against the lowercased name of the client and its
+	// hostname
+	Pattern     string `yaml:"pattern"`
+	Order       uint16 `yaml:"order"`
+	Preference  uint16 `yaml:"preference"`
+	Flags       string `yaml:"flags"`
+	Service     string `yaml:"service"`
+	Regexp      string `yaml:"regexp"`
+	Replacement string `yaml:"replacement"`
+}
+
+// reNAPTRFlags matches the flags of a NAPTR record (RFC 3403 4.1)
+var reNAPTRFlags = regexp.MustCompile(`^[A-Za-z0-9]*$`)
+
+// parseNAPTRService parses the arguments of a naptr_services directive, e.g.
+// voip_* 100 10 S SIP+D2U "" _sip._udp.{name}
+func parseNAPTRService(args []string) (NAPTRService, error) {
+	if len(args) != 7 {
+		return NAPTRService{}, fmt.Errorf("Invalid naptr_services value: '%s'", strings.Join(args, " "))
+	}
+	order, err := strconv.ParseUint(args[1], 10, 16)
+	if err != nil {
+		return NAPTRService{}, fmt.Errorf("Invalid naptr_services order value: '%s'", args[1])
+	}
+	preference, err := strconv.ParseUint(args[2], 10, 16)
+	if err != nil {
+		return NAPTRService{}, fmt.Errorf("Invalid naptr_services preference value: '%s'", args[2])
+	}
+	return NAPTRService{
+		Pattern:     strings.ToLower(args[0]),
+		Order:       uint16(order),
+		Preference:  uint16(preference),
+		Flags:       args[3],
+		Service:     args[4],
+		Regexp:      args[5],
+		Replacement: args[6],
+	}, nil
+}
+
+// validate checks the pattern, the flags and the replacement of the template
+func (s NAPTRService) validate() error {
+	if _, err := path.Match(s.Pattern, ""); err != nil || s.Pattern == "" {
+		return fmt.Errorf("Invalid naptr_services pattern value: '%s'", s.Pattern)
+	}
+	if !reNAPTRFlags.MatchString(s.Flags) {
+		return fmt.Errorf("Invalid naptr_services flags value: '%s'", s.Flags)
+	}
+	// the replacement is either "." or a domain name once {name} is replaced, e.g. _sip._udp.{name}
+	if _, ok := dns.IsDomainName(strings.ReplaceAll(s.Replacement, "{name}", "client.lan")); !ok || s.Replacement == "" {
+		return fmt.Errorf("Invalid naptr_services replacement value: '%s'", s.Replacement)
+	}
+	return nil
+}
+
+// matches returns whether the template applies to the client with the names, e.g. the name in the
+// controller and the hostname of its record
+func (s NAPTRService) matches(names ...string) bool {
+	for _, name := range names {
+		if ok, _ := path.Match(s.Pattern, strings.ToLower(name)); ok && name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// naptrRecords returns the NAPTR records of naptr_services for the record name of a client whose names
+// are rawName and hostname
+func (c *config) naptrRecords(name, rawName, hostname string, ttl uint32) []dns.NAPTR {
+	var rrs []dns.NAPTR
+	for _, service := range c.NAPTRServices {
+		if !service.matches(rawName, hostname) {
+			continue
+		}
+		replacement := "."
+		if service.Replacement != "." {
+			replacement = dns.Fqdn(strings.ToLower(strings.ReplaceAll(service.Replacement, "{name}", strings.TrimSuffix(name, "."))))
+		}
+		rrs = append(rrs, dns.NAPTR{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeNAPTR,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			Order:       service.Order,
+			Preference:  service.Preference,
+			Flags:       service.Flags,
+			Service:     service.Service,
+			Regexp:      strings.ReplaceAll(service.Regexp, "{name}", strings.TrimSuffix(name, ".")),
+			Replacement: replacement,
+		})
+	}
+	return rrs
+}
@@ -0,0 +1,63 @@
+package unifinames
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNAPTRServices(t *testing.T) {
+	s := MockUnifiControllerWithClients(nil,
+		map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "VoIP_Desk1", "ip": "192.168.1.5", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "printer", "ip": "192.168.1.6", "network": "lan"},
+	)
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.Config.NAPTRServices = []NAPTRService{
+		{Pattern: "voip_*", Order: 100, Preference: 10, Flags: "S", Service: "SIP+D2U", Replacement: "_sip._udp.{name}"},
+		{Pattern: "voip-*", Order: 100, Preference: 20, Flags: "U", Service: "E2U+sip", Regexp: "!^.*$!sip:{name}!", Replacement: "."},
+	}
+	require.NoError(t, p.getClients(context.Background()))
+
+	rrs := p.lookup(new(dns.Msg).SetQuestion("VoIP-Desk1.lan.", dns.TypeNAPTR))
+	require.Len(t, rrs, 2)
+	naptr := rrs[0].(*dns.NAPTR)
+	require.Equal(t, "VoIP-Desk1.lan.", naptr.Hdr.Name)
+	require.Equal(t, "SIP+D2U", naptr.Service)
+	require.Equal(t, "_sip._udp.voip-desk1.lan.", naptr.Replacement)
+	naptr = rrs[1].(*dns.NAPTR)
+	require.Equal(t, "!^.*$!sip:voip-desk1.lan!", naptr.Regexp)
+	require.Equal(t, ".", naptr.Replacement)
+	require.Empty(t, p.lookup(new(dns.Msg).SetQuestion("printer.lan.", dns.TypeNAPTR)))
+}
+
+func TestNAPTRServicesConfig(t *testing.T) {
+	parse := func(directives string) (*config, error) {
+		return newConfigFromDispenser(caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN lan
+				Unifi https://localhost:8443/ default admin test
+				`+directives+`
+			}
+		`))))
+	}
+	config, err := parse(`naptr_services VoIP_* 100 10 S SIP+D2U "" _sip._udp.{name}`)
+	require.NoError(t, err)
+	require.Equal(t, []NAPTRService{{Pattern: "voip_*", Order: 100, Preference: 10, Flags: "S", Service: "SIP+D2U", Replacement: "_sip._udp.{name}"}}, config.NAPTRServices)
+
+	for _, directives := range []string{
+		`naptr_services voip_* 100 10 S SIP+D2U ""`,
+		`naptr_services voip_* 70000 10 S SIP+D2U "" .`,
+		`naptr_services voip_* 100 x S SIP+D2U "" .`,
+		`naptr_services voip_[ 100 10 S SIP+D2U "" .`,
+		`naptr_services voip_* 100 10 S+ SIP+D2U "" .`,
+		`naptr_services voip_* 100 10 S SIP+D2U "" ""`,
+	} {
+		_, err := parse(directives)
+		require.Error(t, err, directives)
+	}
+}
@@ -0,0 +1,310 @@
+package unifinames
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/juju/errors"
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+// NetworkConfig is the config of a network, only the domain is required
+type NetworkConfig struct {
+	// Domain is the domain the clients of the network are put in
+	Domain string `yaml:"domain"`
+	// TTL lowers the TTL of the records of the network (0 uses the global ttl)
+	TTL uint32 `yaml:"ttl"`
+	// Prefix is put in front of the hostnames, e.g. "iot-" makes iot-printer.lan
+	Prefix string `yaml:"prefix"`
+	// Suffix is appended to the hostnames, e.g. "-iot" makes printer-iot.lan
+	Suffix string `yaml:"suffix"`
+	// RecordTypes limits which record types are created, e.g. ["AAAA"] creates no A records (empty is all types)
+	RecordTypes []string `yaml:"record_types"`
+	// VLANID maps the clients with this vlan id to the network when their network name doesn't match any
+	VLANID int `yaml:"vlan"`
+	// Authoritative overrides the global authoritative setting for the domain of the network (nil uses
+	// the global setting)
+	Authoritative *bool `yaml:"authoritative"`
+	// NXDomainAction overrides the global nxdomain_action for the domain of the network (empty uses the
+	// global setting)
+	NXDomainAction string `yaml:"nxdomain_action"`
+	// Weight puts the records of the network in front of the ones of the networks with a lower weight
+	// when a name has records in several networks, e.g. with hostname_collision_policy all (default 0)
+	Weight int `yaml:"weight"`
+}
+
+var reHostnameAffix = regexp.MustCompile(`^[a-z0-9-]*$`)
+
+// UnmarshalYAML accepts the domain on its own as well as the full network config
+func (n *NetworkConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&n.Domain)
+	}
+	type plain NetworkConfig
+	return value.Decode((*plain)(n))
+}
+
+// normalize lowercases the domain and adds the trailing dot and validates the other fields
+func (n *NetworkConfig) normalize() error {
+	domain := strings.ToLower(strings.Trim(n.Domain, "."))
+	if !govalidator.IsDNSName(domain) {
+		return fmt.Errorf("'%s' is not a valid domain name", domain)
+	}
+	n.Domain = dns.Fqdn(domain)
+
+	n.Prefix = strings.ToLower(n.Prefix)
+	if !reHostnameAffix.MatchString(n.Prefix) {
+		return fmt.Errorf("'%s' is not a valid prefix", n.Prefix)
+	}
+	n.Suffix = strings.ToLower(n.Suffix)
+	if !reHostnameAffix.MatchString(n.Suffix) {
+		return fmt.Errorf("'%s' is not a valid suffix", n.Suffix)
+	}
+
+	for i, recordType := range n.RecordTypes {
+		n.RecordTypes[i] = strings.ToUpper(recordType)
+		if n.RecordTypes[i] != "A" && n.RecordTypes[i] != "AAAA" {
+			return fmt.Errorf("'%s' is not a supported record type", recordType)
+		}
+	}
+
+	if n.VLANID < 0 || n.VLANID > 4094 {
+		return fmt.Errorf("Invalid vlan value: '%d'", n.VLANID)
+	}
+
+	n.NXDomainAction = strings.ToLower(n.NXDomainAction)
+	if _, ok := nxdomainActions[n.NXDomainAction]; !ok && n.NXDomainAction != "" {
+		return fmt.Errorf("Invalid nxdomain_action value: '%s'", n.NXDomainAction)
+	}
+	return nil
+}
+
+// setOption sets a named argument of the network directive, e.g. ttl=60
+func (n *NetworkConfig) setOption(arg string) error {
+	key, value, ok := strings.Cut(arg, "=")
+	if !ok {
+		return fmt.Errorf("Invalid network option: '%s'", arg)
+	}
+	switch strings.ToLower(key) {
+	case "ttl":
+		ttl, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("Invalid TTL value: '%s'", value)
+		}
+		n.TTL = uint32(ttl)
+	case "prefix":
+		n.Prefix = value
+	case "suffix":
+		n.Suffix = value
+	case "record_types":
+		n.RecordTypes = strings.Split(value, ",")
+	case "vlan":
+		vlan, err := strconv.Atoi(value)
+		if err != nil || vlan < 1 {
+			return fmt.Errorf("Invalid vlan value: '%s'", value)
+		}
+		n.VLANID = vlan
+	case "authoritative":
+		authoritative, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("Invalid authoritative value: '%s'", value)
+		}
+		n.Authoritative = &authoritative
+	case "nxdomain_action":
+		n.NXDomainAction = value
+	case "weight":
+		weight, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("Invalid weight value: '%s'", value)
+		}
+		n.Weight = weight
+	default:
+		return fmt.Errorf("Unknown network option: '%s'", key)
+	}
+	return nil
+}
+
+// loadNetworksFile reads the "<network>,<domain>[,<ttl>]" lines of networks_file, empty lines and lines
+// starting with # are skipped. The invalid lines are logged and skipped so one typo doesn't drop all the
+// networks
+func loadNetworksFile(path string) (map[string]*NetworkConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Annotate(err, "coredns-unifi-names: unable to read networks file")
+	}
+	defer f.Close()
+
+	networks := map[string]*NetworkConfig{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" {
+			log.Errorf("skipping invalid networks file line %d: '%s'", line, text)
+			continue
+		}
+		networkConfig := &NetworkConfig{Domain: fields[1]}
+		if len(fields) == 3 && fields[2] != "" {
+			if err := networkConfig.setOption("ttl=" + fields[2]); err != nil {
+				log.Errorf("skipping networks file line %d: %v", line, err)
+				continue
+			}
+		}
+		if err := networkConfig.normalize(); err != nil {
+			log.Errorf("skipping networks file line %d: %v", line, err)
+			continue
+		}
+		networks[strings.ToLower(fields[0])] = networkConfig
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Annotate(err, "coredns-unifi-names: unable to read networks file")
+	}
+	return networks, nil
+}
+
+// allowsRecordType returns whether records of rrtype should be created for the clients of the network
+func (n *NetworkConfig) allowsRecordType(rrtype uint16) bool {
+	if len(n.RecordTypes) == 0 {
+		return true
+	}
+	for _, recordType := range n.RecordTypes {
+		if recordType == dns.TypeToString[rrtype] {
+			return true
+		}
+	}
+	return false
+}
+
+// isAuthoritative returns whether the names of zone that have no record are answered with NXDOMAIN,
+// the networks of the zone can override the global setting. When the networks sharing the zone
+// disagree it is authoritative
+func (c *config) isAuthoritative(zone string) bool {
+	set, authoritative := false, false
+	for _, network := range c.Networks {
+		if network.Authoritative != nil && strings.EqualFold(network.Domain, zone) {
+			set = true
+			authoritative = authoritative || *network.Authoritative
+		}
+	}
+	if !set {
+		return c.Authoritative
+	}
+	return authoritative
+}
+
+// defaultNetwork is the network the clients of default_domain are handled as, e.g. in the metrics
+const defaultNetwork = "__default__"
+
+// cidrNetwork is a network of Networks whose name is a subnet
+type cidrNetwork struct {
+	name   string
+	subnet *net.IPNet
+}
+
+// parseCIDRNetworks parses the networks whose name has a slash into cidrNetworks, e.g. for the UDM setups
+// that route between the sites by ip
+func (c *config) parseCIDRNetworks() error {
+	c.cidrNetworks = nil
+	for name := range c.Networks {
+		if !strings.Contains(name, "/") {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(name)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a valid subnet", name)
+		}
+		c.cidrNetworks = append(c.cidrNetworks, cidrNetwork{name: name, subnet: subnet})
+	}
+	// the most specific subnet wins
+	slices.SortFunc(c.cidrNetworks, func(a, b cidrNetwork) int {
+		aOnes, _ := a.subnet.Mask.Size()
+		bOnes, _ := b.subnet.Mask.Size()
+		if aOnes != bOnes {
+			return bOnes - aOnes
+		}
+		return strings.Compare(a.name, b.name)
+	})
+	return nil
+}
+
+// network returns the network a client of the network name, the vlan id and the ip belongs to, the name
+// wins over the subnets and the vlan ids of the networks which win over the vlan directives,
+// default_domain catches the rest
+func (c *config) network(name string, vlan int, ip net.IP) (string, *NetworkConfig, bool) {
+	if network, ok := c.Networks[name]; ok {
+		return name, network, true
+	}
+	for _, network := range c.cidrNetworks {
+		if network.subnet.Contains(ip) {
+			return network.name, c.Networks[network.name], true
+		}
+	}
+	// network names can be renamed in the controller, vlan ids are more stable
+	for networkName, network := range c.Networks {
+		if network.VLANID != 0 && network.VLANID == vlan {
+			return networkName, network, true
+		}
+	}
+	if domain, ok := c.VLANNetworks[vlan]; ok {
+		return name, &NetworkConfig{Domain: domain}, true
+	}
+	if c.DefaultDomain != "" {
+		return defaultNetwork, &NetworkConfig{Domain: c.DefaultDomain}, true
+	}
+	return "", nil, false
+}
+
+// nxdomainActions are the values of nxdomain_action, when the networks of a zone disagree the higher
+// one wins like authoritative
+var nxdomainActions = map[string]int{"passthrough": 1, "noerror_empty": 2, "nxdomain": 3}
+
+// nxdomainAction returns what the queries for the names of zone without a record are answered with,
+// the nxdomain_action of the networks wins over their authoritative, which wins over the global
+// nxdomain_action and then the global authoritative
+func (c *config) nxdomainAction(zone string) string {
+	action, override := "", false
+	for _, network := range c.Networks {
+		if !strings.EqualFold(network.Domain, zone) {
+			continue
+		}
+		if nxdomainActions[network.NXDomainAction] > nxdomainActions[action] {
+			action = network.NXDomainAction
+		}
+		override = override || network.Authoritative != nil
+	}
+	switch {
+	case action != "":
+		return action
+	case c.NXDomainAction != "" && !override:
+		return c.NXDomainAction
+	case c.isAuthoritative(zone):
+		return "nxdomain"
+	}
+	return "passthrough"
+}
+
+// nxdomainRedirect returns the nxdomain_redirect_ip the names of zone without a record are answered with
+// instead of NXDOMAIN, nil when there is none or zone isn't one of nxdomain_redirect_domains
+func (c *config) nxdomainRedirect(zone string) net.IP {
+	if c.NXDomainRedirectIP == "" {
+		return nil
+	}
+	if len(c.NXDomainRedirectDomains) > 0 && !slices.Contains(c.NXDomainRedirectDomains, strings.ToLower(zone)) {
+		return nil
+	}
+	return net.ParseIP(c.NXDomainRedirectIP)
+}
@@ -0,0 +1,68 @@
+package unifinames
+
+import (
+	"strings"
+	"unicode"
+)
+
+// nameNormalizers are the steps of the name_normalization modes, sanitizeName runs after them so
+// the names always end up as valid labels
+var nameNormalizers = map[string][]func(string) string{
+	"none":           nil,
+	"slug":           {stripSpecialChars, collapseWhitespace, strings.ToLower},
+	"camel_to_kebab": {camelToKebab, strings.ToLower},
+}
+
+// normalizeName runs the steps of mode and sanitizeName on name
+func normalizeName(mode, name string) string {
+	for _, normalize := range nameNormalizers[mode] {
+		name = normalize(name)
+	}
+	return sanitizeName(name)
+}
+
+// normalizeLabels runs normalizeName on each label of name for preserve_dots, e.g. printer.2nd.floor stays
+// a name of 3 labels. The empty labels are dropped
+func normalizeLabels(mode, name string) string {
+	var labels []string
+	for _, label := range strings.Split(name, ".") {
+		if label = normalizeName(mode, label); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// stripSpecialChars removes everything but ascii letters, digits, hyphens, underscores and whitespace,
+// e.g. John's iPhone becomes Johns iPhone
+func stripSpecialChars(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) || r == '-' || r == '_' || unicode.IsSpace(r) {
+			return r
+		}
+		return -1
+	}, name)
+}
+
+// collapseWhitespace replaces each run of whitespace with a single hyphen
+func collapseWhitespace(name string) string {
+	return strings.Join(strings.Fields(name), "-")
+}
+
+// camelToKebab puts a hyphen in front of the uppercase letters that start a word, e.g. FamilyTV
+// becomes Family-TV and iPhone i-Phone
+func camelToKebab(name string) string {
+	r := []rune(name)
+	var sb strings.Builder
+	for i, c := range r {
+		if i > 0 && unicode.IsUpper(c) {
+			previous := r[i-1]
+			nextLower := i+1 < len(r) && unicode.IsLower(r[i+1])
+			if unicode.IsLower(previous) || unicode.IsDigit(previous) || (unicode.IsUpper(previous) && nextLower) {
+				sb.WriteRune('-')
+			}
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
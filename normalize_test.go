@@ -0,0 +1,37 @@
+package unifinames
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		mode     string
+		name     string
+		expected string
+	}{
+		{mode: "none", name: "John's iPhone", expected: "john-s-iphone"},
+		{mode: "none", name: "Family-TV-2", expected: "family-tv-2"},
+		{mode: "slug", name: "John's iPhone", expected: "johns-iphone"},
+		{mode: "slug", name: "  Living   Room\tSpeaker ", expected: "living-room-speaker"},
+		{mode: "slug", name: "Family - TV", expected: "family-tv"},
+		{mode: "slug", name: "ANDROID-ABC123", expected: "android-abc123"},
+		{mode: "slug", name: "Café Display", expected: "caf-display"},
+		{mode: "camel_to_kebab", name: "FamilyTV", expected: "family-tv"},
+		{mode: "camel_to_kebab", name: "JohnsIPhone", expected: "johns-i-phone"},
+		{mode: "camel_to_kebab", name: "iPhone", expected: "i-phone"},
+		{mode: "camel_to_kebab", name: "ANDROID-ABC123", expected: "android-abc123"},
+		{mode: "camel_to_kebab", name: "Office Printer2Go", expected: "office-printer2-go"},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.expected, normalizeName(tt.mode, tt.name), tt.mode+" "+tt.name)
+	}
+}
+
+func TestNameNormalizers(t *testing.T) {
+	require.Equal(t, "Johns iPhone", stripSpecialChars("John's iPhone"))
+	require.Equal(t, "a-b-c", collapseWhitespace(" a  b\tc "))
+	require.Equal(t, "Family-TV", camelToKebab("FamilyTV"))
+}
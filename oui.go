@@ -0,0 +1,93 @@
+package unifinames
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// loadOUIDatabase reads the vendors of the mac prefixes from path, a .json file is an object of prefix to
+// vendor, any other file is a csv like the oui.csv of the IEEE (Registry,Assignment,Organization Name,...)
+// or of "<prefix>,<vendor>" lines. The prefixes are the uppercased first 6 hex digits
+func loadOUIDatabase(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Annotate(err, "coredns-unifi-names: unable to read oui database")
+	}
+	defer f.Close()
+
+	vendors := map[string]string{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		var entries map[string]string
+		if err := json.NewDecoder(f).Decode(&entries); err != nil {
+			return nil, errors.Annotate(err, "coredns-unifi-names: unable to parse oui database")
+		}
+		for prefix, vendor := range entries {
+			oui, ok := ouiPrefix(prefix)
+			if !ok {
+				return nil, fmt.Errorf("Invalid oui database prefix: '%s'", prefix)
+			}
+			vendors[oui] = strings.TrimSpace(vendor)
+		}
+		return vendors, nil
+	}
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	prefixColumn, vendorColumn := 0, 1
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Annotate(err, "coredns-unifi-names: unable to parse oui database")
+		}
+		// the header of the IEEE file names the columns
+		if line == 1 && len(record) > 2 && strings.EqualFold(record[1], "Assignment") {
+			prefixColumn, vendorColumn = 1, 2
+			continue
+		}
+		if len(record) <= vendorColumn {
+			return nil, fmt.Errorf("Invalid oui database line %d", line)
+		}
+		oui, ok := ouiPrefix(record[prefixColumn])
+		if !ok {
+			return nil, fmt.Errorf("Invalid oui database prefix on line %d: '%s'", line, record[prefixColumn])
+		}
+		vendors[oui] = strings.TrimSpace(record[vendorColumn])
+	}
+	return vendors, nil
+}
+
+// ouiPrefix returns the uppercased first 6 hex digits of a mac or a prefix like 00:1A:2B or 001A2B
+func ouiPrefix(mac string) (string, bool) {
+	digits := strings.NewReplacer(":", "", "-", "", ".", "").Replace(strings.TrimSpace(mac))
+	if len(digits) < 6 {
+		return "", false
+	}
+	digits = strings.ToUpper(digits[:6])
+	for _, c := range digits {
+		if !strings.ContainsRune("0123456789ABCDEF", c) {
+			return "", false
+		}
+	}
+	return digits, true
+}
+
+// vendor returns the vendor of mac from oui_database, the vendor the controller detected is used for the
+// macs that aren't in it
+func (c *config) vendor(mac, controllerVendor string) string {
+	if oui, ok := ouiPrefix(mac); ok {
+		if vendor, ok := c.ouiVendors[oui]; ok {
+			return vendor
+		}
+	}
+	return controllerVendor
+}
@@ -0,0 +1,74 @@
+package unifinames
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOUIDatabase(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+
+	vendors, err := loadOUIDatabase(write("oui.csv", `Registry,Assignment,Organization Name,Organization Address
+MA-L,00000C,"Cisco Systems, Inc",170 WEST TASMAN DRIVE SAN JOSE CA US 95134
+MA-L,3C22FB,"Apple, Inc.",1 Infinite Loop Cupertino CA US 95014
+`))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"00000C": "Cisco Systems, Inc", "3C22FB": "Apple, Inc."}, vendors)
+
+	vendors, err = loadOUIDatabase(write("plain.csv", "00:00:0c,Cisco\n3c-22-fb,Apple\n"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"00000C": "Cisco", "3C22FB": "Apple"}, vendors)
+
+	vendors, err = loadOUIDatabase(write("oui.json", `{"3c:22:fb": "Apple"}`))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"3C22FB": "Apple"}, vendors)
+
+	for name, content := range map[string]string{
+		"prefix.csv":  "xyz,Vendor\n",
+		"columns.csv": "00000C\n",
+		"syntax.json": "[",
+		"prefix.json": `{"12": "Vendor"}`,
+	} {
+		_, err := loadOUIDatabase(write(name, content))
+		require.Error(t, err, name)
+	}
+	_, err = loadOUIDatabase(filepath.Join(dir, "missing.csv"))
+	require.Error(t, err)
+}
+
+func TestTXTMetadata(t *testing.T) {
+	s := MockUnifiControllerWithClients(nil,
+		map[string]interface{}{"mac": "3c:22:fb:00:00:01", "hostname": "laptop", "ip": "192.168.1.5", "network": "LAN", "oui": "Apple"},
+		map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "printer", "ip": "192.168.1.6", "network": "LAN", "oui": "Brother"},
+		map[string]interface{}{"mac": "00:00:00:00:00:03", "hostname": "camera", "ip": "192.168.1.7", "network": "LAN"},
+	)
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.Config.ouiVendors = map[string]string{"3C22FB": "Apple, Inc."}
+	require.NoError(t, p.getClients(context.Background()))
+	require.Empty(t, p.lookup(new(dns.Msg).SetQuestion("laptop.lan.", dns.TypeTXT)))
+
+	p.Config.IncludeTXTMetadata = true
+	require.NoError(t, p.getClients(context.Background()))
+	txt := func(name string) []string {
+		rrs := p.lookup(new(dns.Msg).SetQuestion(name, dns.TypeTXT))
+		if len(rrs) == 0 {
+			return nil
+		}
+		return rrs[0].(*dns.TXT).Txt
+	}
+	require.Equal(t, []string{"vendor=Apple, Inc."}, txt("laptop.lan."))
+	// the vendor of the controller is used for the macs that aren't in the database
+	require.Equal(t, []string{"vendor=Brother"}, txt("printer.lan."))
+	require.Nil(t, txt("camera.lan."))
+}
@@ -0,0 +1,21 @@
+package unifinames
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ptrName returns the reverse name of the ipv6 address ip in nibble notation under zone, e.g.
+// 1.0.0.0.[...].0.d.f.ip6.arpa. for fd00::1 in ip6.arpa. It is empty for ipv4 addresses
+func ptrName(ip net.IP, zone string) string {
+	if ip == nil || ip.To4() != nil || ip.To16() == nil {
+		return ""
+	}
+	reverse, err := dns.ReverseAddr(ip.To16().String())
+	if err != nil || !strings.HasSuffix(reverse, ".ip6.arpa.") {
+		return ""
+	}
+	return strings.TrimSuffix(reverse, "ip6.arpa.") + dns.Fqdn(zone)
+}
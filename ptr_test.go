@@ -0,0 +1,50 @@
+package unifinames
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPTRName(t *testing.T) {
+	tests := []struct {
+		ip       string
+		zone     string
+		expected string
+	}{
+		{ip: "2001:db8::567:89ab", zone: "ip6.arpa.", expected: "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+		{ip: "fd00::1", zone: "ip6.arpa.", expected: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa."},
+		{ip: "::1", zone: "ip6.arpa", expected: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa."},
+		{ip: "fd00::1", zone: "reverse.lan.", expected: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.reverse.lan."},
+		{ip: "192.168.1.1", zone: "ip6.arpa.", expected: ""},
+		{ip: "::ffff:192.168.1.1", zone: "ip6.arpa.", expected: ""},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.expected, ptrName(net.ParseIP(tt.ip), tt.zone), tt.ip)
+	}
+	require.Equal(t, "", ptrName(nil, "ip6.arpa."))
+}
+
+func TestLookupIPv6PTR(t *testing.T) {
+	p := newTestPlugin()
+	p.aaaaClients = []dns.AAAA{
+		{Hdr: dns.RR_Header{Name: "server1.lan.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET}, AAAA: net.ParseIP("fd00::1")},
+		{Hdr: dns.RR_Header{Name: "*.server1.lan.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET}, AAAA: net.ParseIP("fd00::1")},
+	}
+	name := "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.D.F.ip6.arpa."
+
+	rrs := p.lookup(new(dns.Msg).SetQuestion(name, dns.TypePTR))
+	require.Len(t, rrs, 1)
+	require.Equal(t, "server1.lan.", rrs[0].(*dns.PTR).Ptr)
+	require.Equal(t, name, rrs[0].Header().Name)
+
+	require.Empty(t, p.lookup(new(dns.Msg).SetQuestion("2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", dns.TypePTR)))
+	require.Empty(t, p.lookup(new(dns.Msg).SetQuestion("1.1.168.192.in-addr.arpa.", dns.TypePTR)))
+
+	p.Config.IPv6PTRZone = "reverse.lan"
+	require.Empty(t, p.lookup(new(dns.Msg).SetQuestion(name, dns.TypePTR)))
+	rrs = p.lookup(new(dns.Msg).SetQuestion("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.reverse.lan.", dns.TypePTR))
+	require.Len(t, rrs, 1)
+}
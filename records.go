@@ -0,0 +1,104 @@
+package unifinames
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// recordIndex holds the A and AAAA records of lock_free_records, the queries read it without p.mu. Each
+// update builds a new index and swaps the pointer to it
+type recordIndex struct {
+	// names maps the lowercased names to their *indexedRecords
+	names sync.Map
+	// lastUpdate is the lastUpdate of the plugin when the index was built, for the ttls of the answers
+	lastUpdate time.Time
+}
+
+// indexedRecords are the records of a name in the recordIndex
+type indexedRecords struct {
+	a    []dns.A
+	aaaa []dns.AAAA
+}
+
+// newRecordIndex returns the index of the records
+func newRecordIndex(aClients []dns.A, aaaaClients []dns.AAAA, lastUpdate time.Time) *recordIndex {
+	names := map[string]*indexedRecords{}
+	records := func(name string) *indexedRecords {
+		name = strings.ToLower(name)
+		if names[name] == nil {
+			names[name] = &indexedRecords{}
+		}
+		return names[name]
+	}
+	for _, client := range aClients {
+		r := records(client.Hdr.Name)
+		r.a = append(r.a, client)
+	}
+	for _, client := range aaaaClients {
+		r := records(client.Hdr.Name)
+		r.aaaa = append(r.aaaa, client)
+	}
+	index := &recordIndex{lastUpdate: lastUpdate}
+	for name, r := range names {
+		index.names.Store(name, r)
+	}
+	return index
+}
+
+// records returns the records of the lowercased name, nil when there are none
+func (index *recordIndex) records(name string) *indexedRecords {
+	if r, ok := index.names.Load(name); ok {
+		return r.(*indexedRecords)
+	}
+	return nil
+}
+
+// indexRecords replaces the recordIndex with one of the current records for lock_free_records, p.mu has
+// to be held
+func (p *unifinames) indexRecords() {
+	if !p.Config.LockFreeRecords {
+		return
+	}
+	p.recordIndex.Store(newRecordIndex(p.aClients, p.aaaaClients, p.lastUpdate))
+}
+
+// indexedAnswers returns the A or AAAA records for question from index like lookup does from the slices,
+// the records of the wildcard that covers the name are answered when it has none of the type
+func (p *unifinames) indexedAnswers(index *recordIndex, question dns.Question, elapsed uint32) []dns.RR {
+	answers := func(r *indexedRecords, name string) []dns.RR {
+		if r == nil {
+			return nil
+		}
+		var rrs []dns.RR
+		if question.Qtype == dns.TypeA {
+			for _, client := range r.a {
+				rr := client
+				if name != "" {
+					rr.Hdr.Name = name
+				}
+				rr.Hdr.Ttl = p.answerTTL(client.Hdr.Ttl, elapsed)
+				rrs = append(rrs, &rr)
+			}
+			return rrs
+		}
+		for _, client := range r.aaaa {
+			rr := client
+			if name != "" {
+				rr.Hdr.Name = name
+			}
+			rr.Hdr.Ttl = p.answerTTL(client.Hdr.Ttl, elapsed)
+			rrs = append(rrs, &rr)
+		}
+		return rrs
+	}
+	if rrs := answers(index.records(strings.ToLower(question.Name)), ""); len(rrs) > 0 {
+		return rrs
+	}
+	if wildcard := wildcardName(question.Name); wildcard != "" {
+		return answers(index.records(strings.ToLower(wildcard)), question.Name)
+	}
+	return nil
+}
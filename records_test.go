@@ -0,0 +1,80 @@
+package unifinames
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockFreeRecords(t *testing.T) {
+	s := MockUnifiControllerWithClients(nil,
+		map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.1", "network": "lan"},
+		map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "server2", "ip": "fd00::2", "network": "lan"},
+	)
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.Config.WildcardClients = true
+	require.NoError(t, p.getClients(context.Background()))
+	require.Nil(t, p.recordIndex.Load())
+
+	var questions []*dns.Msg
+	for _, name := range []string{"server1.lan.", "SERVER1.lan", "admin.server1.lan.", "server2.lan.", "admin.server2.lan.", "missing.lan."} {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			questions = append(questions, new(dns.Msg).SetQuestion(name, qtype))
+		}
+	}
+	var want []string
+	for _, r := range questions {
+		want = append(want, fmt.Sprint(p.lookup(r)))
+	}
+
+	// the answers from the index are the ones from the slices
+	p.Config.LockFreeRecords = true
+	require.NoError(t, p.getClients(context.Background()))
+	require.NotNil(t, p.recordIndex.Load())
+	for i, r := range questions {
+		require.Equal(t, want[i], fmt.Sprint(p.lookup(r)), r.Question[0].String())
+	}
+
+	p.clearClients()
+	require.Empty(t, p.lookup(new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA)))
+}
+
+// BenchmarkLookup compares the lookups of 100 goroutines with the lock and with lock_free_records, e.g.
+// go test -run '^$' -bench BenchmarkLookup
+func BenchmarkLookup(b *testing.B) {
+	p := newTestPlugin()
+	p.aClients = nil
+	for i := 0; i < 1000; i++ {
+		p.aClients = append(p.aClients, dns.A{
+			Hdr: dns.RR_Header{Name: fmt.Sprintf("server%d.lan.", i), Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   net.IPv4(10, 0, byte(i/256), byte(i%256)),
+		})
+	}
+	p.lastUpdate = time.Now()
+	r := new(dns.Msg).SetQuestion("server999.lan.", dns.TypeA)
+
+	for _, lockFree := range []bool{false, true} {
+		b.Run(map[bool]string{false: "mutex", true: "lock_free"}[lockFree], func(b *testing.B) {
+			p.Config.LockFreeRecords = lockFree
+			p.recordIndex.Store(nil)
+			p.mu.Lock()
+			p.indexRecords()
+			p.mu.Unlock()
+			b.SetParallelism(max(1, 100/runtime.GOMAXPROCS(0)))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if len(p.lookup(r)) != 1 {
+						b.Error("expected 1 answer")
+					}
+				}
+			})
+		})
+	}
+}
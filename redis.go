@@ -0,0 +1,176 @@
+package unifinames
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/miekg/dns"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisRecord is the value of a name in the redis hash of redis_addr
+type redisRecord struct {
+	// TTL is the ttl of the network of the records, 0 uses the global ttl
+	TTL  uint32   `json:"ttl,omitempty"`
+	A    []string `json:"a,omitempty"`
+	AAAA []string `json:"aaaa,omitempty"`
+	// TXT are the strings of the switch_port and the metadata TXT records
+	TXT map[string][]string `json:"txt,omitempty"`
+}
+
+// redisClient returns a client of redis_addr
+func (c *config) redisClient() *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:        c.RedisAddr,
+		Password:    c.RedisPassword,
+		DialTimeout: c.RequestTimeout,
+	})
+}
+
+// redisRecords returns the records by name as the fields of the redis hash
+func (p *unifinames) redisRecords() (map[string]interface{}, error) {
+	records := map[string]*redisRecord{}
+	record := func(name string, ttl uint32) *redisRecord {
+		name = strings.ToLower(name)
+		if records[name] == nil {
+			records[name] = &redisRecord{TTL: ttl}
+		}
+		return records[name]
+	}
+	p.mu.Lock()
+	for _, client := range p.aClients {
+		r := record(client.Hdr.Name, client.Hdr.Ttl)
+		r.A = append(r.A, client.A.String())
+	}
+	for _, client := range p.aaaaClients {
+		r := record(client.Hdr.Name, client.Hdr.Ttl)
+		r.AAAA = append(r.AAAA, client.AAAA.String())
+	}
+	for kind, clients := range map[string]map[string]dns.TXT{"switch_port": p.switchPortClients, "metadata": p.metadataClients} {
+		for name, client := range clients {
+			r := record(name, client.Hdr.Ttl)
+			if r.TXT == nil {
+				r.TXT = map[string][]string{}
+			}
+			r.TXT[kind] = client.Txt
+		}
+	}
+	p.mu.Unlock()
+
+	fields := make(map[string]interface{}, len(records))
+	for name, r := range records {
+		value, err := json.Marshal(r)
+		if err != nil {
+			return nil, errors.Annotate(err, "coredns-unifi-names: unable to encode redis record")
+		}
+		fields[name] = value
+	}
+	return fields, nil
+}
+
+// exportRedis replaces the redis hash of redis_key with the records in one transaction, the hash expires
+// after the ttl so the other instances don't pick up records that nobody refreshes anymore
+func (p *unifinames) exportRedis(ctx context.Context) error {
+	fields, err := p.redisRecords()
+	if err != nil {
+		return err
+	}
+	client := p.Config.redisClient()
+	defer client.Close()
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, p.Config.RedisKey)
+		if len(fields) > 0 {
+			pipe.HSet(ctx, p.Config.RedisKey, fields)
+			pipe.Expire(ctx, p.Config.RedisKey, time.Duration(p.Config.TTL)*time.Second)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Annotate(err, "coredns-unifi-names: unable to write redis records")
+	}
+	return nil
+}
+
+// loadRedis loads the records another instance wrote to the redis hash, they are served until the first
+// refresh replaces them like the ones of the cache_file
+func (p *unifinames) loadRedis(ctx context.Context) error {
+	client := p.Config.redisClient()
+	defer client.Close()
+	fields, err := client.HGetAll(ctx, p.Config.RedisKey).Result()
+	if err != nil {
+		return errors.Annotate(err, "coredns-unifi-names: unable to read redis records")
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	count, err := p.applyRedisRecords(fields)
+	if err != nil {
+		return err
+	}
+	log.Infof("loaded %d hosts from redis", count)
+	return nil
+}
+
+// applyRedisRecords replaces the records with the fields of the redis hash and returns the number of
+// A and AAAA records
+func (p *unifinames) applyRedisRecords(fields map[string]string) (int, error) {
+	var aClients []dns.A
+	var aaaaClients []dns.AAAA
+	switchPortClients := map[string]dns.TXT{}
+	metadataClients := map[string]dns.TXT{}
+	for name, value := range fields {
+		var record redisRecord
+		if err := json.Unmarshal([]byte(value), &record); err != nil {
+			return 0, errors.Annotatef(err, "coredns-unifi-names: unable to parse redis record of %s", name)
+		}
+		hdr := func(rrtype uint16) dns.RR_Header {
+			return dns.RR_Header{Name: dns.Fqdn(name), Rrtype: rrtype, Class: dns.ClassINET, Ttl: record.TTL}
+		}
+		for _, address := range record.A {
+			if ip := net.ParseIP(address); ip != nil {
+				aClients = append(aClients, dns.A{Hdr: hdr(dns.TypeA), A: ip})
+			}
+		}
+		for _, address := range record.AAAA {
+			if ip := net.ParseIP(address); ip != nil {
+				aaaaClients = append(aaaaClients, dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: ip})
+			}
+		}
+		if txt, ok := record.TXT["switch_port"]; ok {
+			switchPortClients[name] = dns.TXT{Hdr: hdr(dns.TypeTXT), Txt: txt}
+		}
+		if txt, ok := record.TXT["metadata"]; ok {
+			metadataClients[name] = dns.TXT{Hdr: hdr(dns.TypeTXT), Txt: txt}
+		}
+	}
+	// the hash has no order, the records are sorted so the answers don't change between the loads
+	slices.SortFunc(aClients, func(a, b dns.A) int {
+		if a.Hdr.Name != b.Hdr.Name {
+			return strings.Compare(a.Hdr.Name, b.Hdr.Name)
+		}
+		return bytes.Compare(a.A.To16(), b.A.To16())
+	})
+	slices.SortFunc(aaaaClients, func(a, b dns.AAAA) int {
+		if a.Hdr.Name != b.Hdr.Name {
+			return strings.Compare(a.Hdr.Name, b.Hdr.Name)
+		}
+		return bytes.Compare(a.AAAA.To16(), b.AAAA.To16())
+	})
+
+	p.mu.Lock()
+	p.aClients = aClients
+	p.aaaaClients = aaaaClients
+	p.switchPortClients = switchPortClients
+	p.metadataClients = metadataClients
+	p.recordsHash = clientsHash(aClients, aaaaClients)
+	p.lastUpdate = time.Now()
+	p.indexRecords()
+	p.mu.Unlock()
+	return len(aClients) + len(aaaaClients), nil
+}
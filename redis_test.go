@@ -0,0 +1,70 @@
+package unifinames
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisRecords(t *testing.T) {
+	p := newTestPlugin()
+	p.aClients[0].Hdr.Ttl = 60
+	p.aaaaClients = []dns.AAAA{{
+		Hdr:  dns.RR_Header{Name: "server1.lan.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
+		AAAA: net.ParseIP("fd00::1"),
+	}}
+	p.metadataClients = map[string]dns.TXT{"server1.lan.": {
+		Hdr: dns.RR_Header{Name: "server1.lan.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{"vendor=Apple"},
+	}}
+	fields, err := p.redisRecords()
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{
+		"server1.lan.": []byte(`{"ttl":60,"a":["127.0.0.1"],"aaaa":["fd00::1"],"txt":{"metadata":["vendor=Apple"]}}`),
+	}, fields)
+
+	// another instance serves them
+	other := &unifinames{Config: newTestConfig("")}
+	count, err := other.applyRedisRecords(map[string]string{"server1.lan.": string(fields["server1.lan."].([]byte))})
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	rrs := other.lookup(new(dns.Msg).SetQuestion("server1.lan.", dns.TypeA))
+	require.Len(t, rrs, 1)
+	require.Equal(t, "127.0.0.1", rrs[0].(*dns.A).A.String())
+	rrs = other.lookup(new(dns.Msg).SetQuestion("server1.lan.", dns.TypeTXT))
+	require.Len(t, rrs, 1)
+	require.Equal(t, []string{"vendor=Apple"}, rrs[0].(*dns.TXT).Txt)
+
+	_, err = other.applyRedisRecords(map[string]string{"server1.lan.": "{"})
+	require.Error(t, err)
+}
+
+func TestRedisConfig(t *testing.T) {
+	parse := func(directives string) (*config, error) {
+		return newConfigFromDispenser(caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN lan
+				Unifi https://localhost:8443/ default admin test
+				`+directives+`
+			}
+		`))))
+	}
+	config, err := parse("redis_addr redis:6379")
+	require.NoError(t, err)
+	require.Equal(t, "redis:6379", config.RedisAddr)
+	require.Equal(t, "unifi-names", config.RedisKey)
+
+	config, err = parse("redis_addr redis:6379 password=secret key=dns")
+	require.NoError(t, err)
+	require.Equal(t, "secret", config.RedisPassword)
+	require.Equal(t, "dns", config.RedisKey)
+
+	for _, directives := range []string{"redis_addr redis:6379 db=1", "redis_addr redis:6379 key="} {
+		_, err := parse(directives)
+		require.Error(t, err, directives)
+	}
+}
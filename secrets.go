@@ -0,0 +1,125 @@
+package unifinames
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// vaultResponse is the part of the vault responses that is used, data is the secret of a kv v1 mount or
+// the wrapper of the secret of a kv v2 mount
+type vaultResponse struct {
+	Data json.RawMessage `json:"data"`
+	Auth struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// loadSecrets fetches the controller url and credentials from the secrets backend, it is called every
+// time a new controller session is created so rotated credentials are picked up
+func (c *config) loadSecrets() error {
+	switch c.SecretsBackend {
+	case "":
+		return nil
+	case "vault":
+		return c.loadVaultSecrets()
+	}
+	return fmt.Errorf("Unknown secrets backend: '%s'", c.SecretsBackend)
+}
+
+// loadVaultSecrets reads the username, password and url keys of vault_path, the keys that are missing
+// keep the values of the Corefile
+func (c *config) loadVaultSecrets() error {
+	client := &http.Client{Timeout: c.HTTPTimeout}
+	token := c.VaultToken
+	if c.VaultRoleID != "" {
+		var err error
+		token, err = c.vaultAppRoleLogin(client)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.VaultAddr+"/v1/"+strings.TrimLeft(c.VaultPath, "/"), nil)
+	if err != nil {
+		return errors.Annotate(err, "coredns-unifi-names: invalid vault request")
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := vaultDo(client, req)
+	if err != nil {
+		return errors.Annotate(err, "coredns-unifi-names: unable to read vault secret")
+	}
+
+	var secret map[string]interface{}
+	if err := json.Unmarshal(resp.Data, &secret); err != nil {
+		return errors.Annotate(err, "coredns-unifi-names: unable to parse vault secret")
+	}
+	// kv v2 wraps the secret with its metadata
+	if data, ok := secret["data"].(map[string]interface{}); ok {
+		if _, ok := secret["metadata"]; ok {
+			secret = data
+		}
+	}
+
+	if url, ok := secret["url"].(string); ok && url != "" {
+		c.UnifiControllerURL = strings.TrimRight(url, "/")
+	}
+	if username, ok := secret["username"].(string); ok && username != "" {
+		c.UnifiUsername = username
+	}
+	if password, ok := secret["password"].(string); ok && password != "" {
+		c.UnifiPassword = password
+	}
+	if c.UnifiControllerURL == "" || c.UnifiUsername == "" || c.UnifiPassword == "" {
+		return fmt.Errorf("The vault secret '%s' has no url, username or password", c.VaultPath)
+	}
+	return nil
+}
+
+// vaultAppRoleLogin logs in with vault_role and returns the client token
+func (c *config) vaultAppRoleLogin(client *http.Client) (string, error) {
+	body, err := json.Marshal(map[string]string{"role_id": c.VaultRoleID, "secret_id": c.VaultSecretID})
+	if err != nil {
+		return "", errors.Annotate(err, "coredns-unifi-names: unable to encode vault login")
+	}
+	req, err := http.NewRequest(http.MethodPost, c.VaultAddr+"/v1/auth/approle/login", bytes.NewReader(body))
+	if err != nil {
+		return "", errors.Annotate(err, "coredns-unifi-names: invalid vault request")
+	}
+	resp, err := vaultDo(client, req)
+	if err != nil {
+		return "", errors.Annotate(err, "coredns-unifi-names: unable to log into vault")
+	}
+	if resp.Auth.ClientToken == "" {
+		return "", fmt.Errorf("Vault returned no client token for the role '%s'", c.VaultRoleID)
+	}
+	return resp.Auth.ClientToken, nil
+}
+
+// vaultDo sends req and decodes the response, the errors vault returns are passed on
+func vaultDo(client *http.Client, req *http.Request) (*vaultResponse, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var response vaultResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("invalid response from vault: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.Join(response.Errors, ", "))
+	}
+	return &response, nil
+}
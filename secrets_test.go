@@ -0,0 +1,113 @@
+package unifinames
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/stretchr/testify/require"
+)
+
+func mockVault(t *testing.T, secret string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/approle/login", func(w http.ResponseWriter, r *http.Request) {
+		var login map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&login))
+		if login["role_id"] != "role" || login["secret_id"] != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors": ["invalid role or secret ID"]}`))
+			return
+		}
+		w.Write([]byte(`{"auth": {"client_token": "approle-token"}}`))
+	})
+	mux.HandleFunc("/v1/secret/data/unifi", func(w http.ResponseWriter, r *http.Request) {
+		if token := r.Header.Get("X-Vault-Token"); token != "token" && token != "approle-token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors": ["permission denied"]}`))
+			return
+		}
+		w.Write([]byte(secret))
+	})
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestLoadSecrets(t *testing.T) {
+	t.Run("KV v2", func(t *testing.T) {
+		s := mockVault(t, `{"data": {"data": {"username": "admin", "password": "secret1234", "url": "https://unifi.lan:8443/"}, "metadata": {"version": 1}}}`)
+		c := &config{SecretsBackend: "vault", VaultAddr: s.URL, VaultPath: "secret/data/unifi", VaultToken: "token"}
+		require.NoError(t, c.loadSecrets())
+		require.Equal(t, "https://unifi.lan:8443", c.UnifiControllerURL)
+		require.Equal(t, "admin", c.UnifiUsername)
+		require.Equal(t, "secret1234", c.UnifiPassword)
+	})
+
+	t.Run("KV v1 AppRole", func(t *testing.T) {
+		s := mockVault(t, `{"data": {"username": "admin", "password": "secret1234"}}`)
+		c := &config{SecretsBackend: "vault", VaultAddr: s.URL, VaultPath: "/secret/data/unifi", VaultRoleID: "role", VaultSecretID: "secret", UnifiControllerURL: "https://localhost:8443"}
+		require.NoError(t, c.loadSecrets())
+		require.Equal(t, "https://localhost:8443", c.UnifiControllerURL)
+		require.Equal(t, "admin", c.UnifiUsername)
+
+		c.VaultSecretID = "wrong"
+		require.ErrorContains(t, c.loadSecrets(), "invalid role or secret ID")
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		s := mockVault(t, `{"data": {"username": "admin"}}`)
+		c := &config{SecretsBackend: "vault", VaultAddr: s.URL, VaultPath: "secret/data/unifi", VaultToken: "wrong"}
+		require.ErrorContains(t, c.loadSecrets(), "permission denied")
+		c.VaultToken = "token"
+		require.Error(t, c.loadSecrets())
+		require.NoError(t, (&config{}).loadSecrets())
+	})
+
+	t.Run("Before Login", func(t *testing.T) {
+		controller := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+		defer controller.Close()
+		s := mockVault(t, `{"data": {"data": {"username": "admin", "password": "admin", "url": "`+controller.URL+`"}, "metadata": {}}}`)
+		p := unifinames{Config: newTestConfig("")}
+		p.Config.UnifiUsername, p.Config.UnifiPassword = "", ""
+		p.Config.SecretsBackend, p.Config.VaultAddr, p.Config.VaultPath, p.Config.VaultToken = "vault", s.URL, "secret/data/unifi", "token"
+		require.NoError(t, p.getClients(context.Background()))
+		require.Equal(t, 1, len(p.aClients))
+	})
+
+	t.Run("Config", func(t *testing.T) {
+		dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default
+				secrets_backend Vault
+				vault_addr https://vault.lan:8200/
+				vault_path secret/data/unifi
+				vault_role role secret
+			}
+		`)))
+		config, err := newConfigFromDispenser(dispenser)
+		require.NoError(t, err)
+		require.Equal(t, "vault", config.SecretsBackend)
+		require.Equal(t, "https://vault.lan:8200", config.VaultAddr)
+		require.Equal(t, "secret/data/unifi", config.VaultPath)
+		require.Equal(t, "role", config.VaultRoleID)
+		require.Equal(t, "secret", config.VaultSecretID)
+
+		for _, directives := range []string{"secrets_backend aws", "secrets_backend vault", "secrets_backend vault\nvault_addr https://vault.lan:8200\nvault_path secret/data/unifi"} {
+			dispenser := caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN example.com
+				Unifi https://localhost:8443/ default
+				`+directives+`
+			}
+		`)))
+			config, err := newConfigFromDispenser(dispenser)
+			require.Error(t, err, directives)
+			require.Nil(t, config, directives)
+		}
+	})
+}
@@ -1,8 +1,12 @@
 package unifinames
 
 import (
+	"context"
+	"net/http"
+
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/fsnotify/fsnotify"
 
 	"github.com/coredns/caddy"
 )
@@ -21,8 +25,92 @@ func setup(c *caddy.Controller) error {
 		return plugin.Error("unifi-names", err)
 	}
 
+	setLogFormat(config.LogFormat)
+	if err := config.checkOverlap(); err != nil {
+		return plugin.Error("unifi-names", err)
+	}
+
+	// a configured url always wins over the discovered one
+	if config.AutoDiscover && config.UnifiControllerURL == "" && config.SecretsBackend == "" {
+		url, err := discoverController(config.DiscoveryTimeout)
+		if err != nil {
+			return plugin.Error("unifi-names", err)
+		}
+		log.Infof("discovered the controller at %s", url)
+		config.UnifiControllerURL = url
+	}
+
+	if err := registerMetrics(config.PrometheusNamespace, config.PrometheusLabels); err != nil {
+		return plugin.Error("unifi-names", err)
+	}
+
+	p := &unifinames{
+		Config:       config,
+		limiter:      config.rateLimiter(),
+		workers:      config.workerPool(),
+		refreshNow:   make(chan struct{}, 1),
+		firstRefresh: make(chan struct{}),
+		stop:         make(chan struct{}),
+	}
+	// a reload starts a new plugin, the goroutines of this one must not keep refreshing
+	c.OnShutdown(func() error {
+		p.shutdown()
+		return nil
+	})
+	if config.CacheFile != "" {
+		if err := p.loadCache(); err != nil {
+			log.Errorf("unable to load cache file: %v", err)
+		}
+	}
+	// the records of the other instances are newer than the ones of the cache file
+	if config.RedisAddr != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), config.RequestTimeout)
+		err := p.loadRedis(ctx)
+		cancel()
+		if err != nil {
+			log.Errorf("unable to load records from redis: %v", err)
+		}
+	}
+
+	// the networks file is read by setup like the config file, the Corefile is reloaded on its changes too
+	for _, path := range []string{config.ConfigFile, config.NetworksFile} {
+		if path == "" {
+			continue
+		}
+		path := path
+		registerInstanceHook()
+		var watcher *fsnotify.Watcher
+		c.OnStartup(func() error {
+			var err error
+			watcher, err = watchConfigFile(path, restartInstance)
+			return err
+		})
+		c.OnShutdown(func() error {
+			if watcher == nil {
+				return nil
+			}
+			return watcher.Close()
+		})
+	}
+
+	if config.HTTPAddress != "" {
+		var server *http.Server
+		c.OnStartup(func() error {
+			var err error
+			server, err = p.startHTTPServer(config.HTTPAddress)
+			return err
+		})
+		c.OnShutdown(func() error {
+			if server == nil {
+				return nil
+			}
+			return server.Close()
+		})
+	}
+
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
-		return &unifinames{Next: next, Config: config}
+		p.Next = next
+		return p
 	})
 
 	return nil
@@ -0,0 +1,98 @@
+package unifinames
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// reServiceName matches the client names that announce a service, e.g. _http._tcp.webserver
+var reServiceName = regexp.MustCompile(`(?i)^_([a-z0-9-]+)\._(tcp|udp)\.(.+)$`)
+
+// servicePorts are the ports of the well known services, the other services use srv_port
+var servicePorts = map[string]uint16{
+	"ftp":         21,
+	"ssh":         22,
+	"smtp":        25,
+	"dns":         53,
+	"http":        80,
+	"ntp":         123,
+	"imap":        143,
+	"ldap":        389,
+	"https":       443,
+	"smb":         445,
+	"printer":     515,
+	"ipp":         631,
+	"imaps":       993,
+	"mqtt":        1883,
+	"rdp":         3389,
+	"sip":         5060,
+	"xmpp-client": 5222,
+	"vnc":         5900,
+}
+
+// parseServiceName splits a name like _http._tcp.webserver into the service, the protocol and the
+// name of the host
+func parseServiceName(name string) (string, string, string, bool) {
+	m := reServiceName.FindStringSubmatch(name)
+	if m == nil {
+		return "", "", "", false
+	}
+	return strings.ToLower(m[1]), strings.ToLower(m[2]), m[3], true
+}
+
+// srvPort returns the port of service, the well known port wins over the configured one (0 if neither
+// is known)
+func (c *config) srvPort(service string) uint16 {
+	if port, ok := servicePorts[service]; ok {
+		return port
+	}
+	return c.SRVPort
+}
+
+// setSRVOption sets a named argument of the synthesize_srv directive, e.g. port=8080
+func (c *config) setSRVOption(arg string) error {
+	key, value, ok := strings.Cut(arg, "=")
+	if !ok {
+		return fmt.Errorf("Invalid synthesize_srv option: '%s'", arg)
+	}
+	n, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return fmt.Errorf("Invalid %s value: '%s'", strings.ToLower(key), value)
+	}
+	switch strings.ToLower(key) {
+	case "priority":
+		c.SRVPriority = uint16(n)
+	case "weight":
+		c.SRVWeight = uint16(n)
+	case "port":
+		c.SRVPort = uint16(n)
+	default:
+		return fmt.Errorf("Unknown synthesize_srv option: '%s'", key)
+	}
+	return nil
+}
+
+// srvRecord returns the SRV record of service pointing to target, e.g. _http._tcp.webserver.lan. for
+// webserver.lan.
+func (c *config) srvRecord(service, proto, target string, ttl uint32) (dns.SRV, bool) {
+	port := c.srvPort(service)
+	if port == 0 {
+		return dns.SRV{}, false
+	}
+	return dns.SRV{
+		Hdr: dns.RR_Header{
+			Name:   "_" + service + "._" + proto + "." + target,
+			Rrtype: dns.TypeSRV,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Priority: c.SRVPriority,
+		Weight:   c.SRVWeight,
+		Port:     port,
+		Target:   target,
+	}, true
+}
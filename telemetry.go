@@ -0,0 +1,72 @@
+package unifinames
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// telemetryReport is the json that is posted to telemetry_url after each successful refresh
+type telemetryReport struct {
+	// InstanceID is the hostname of the machine coredns runs on
+	InstanceID string    `json:"instance_id"`
+	Timestamp  time.Time `json:"timestamp"`
+	HostCount  int       `json:"host_count"`
+	// NetworkCounts are the records of the clients by network
+	NetworkCounts     map[string]int `json:"network_counts"`
+	RefreshDurationMS int64          `json:"refresh_duration_ms"`
+	// ConsecutiveFailures are the refreshes that failed before this one
+	ConsecutiveFailures int32 `json:"consecutive_failures"`
+}
+
+// newTelemetryReport returns the report of a refresh that took duration, clients are the ones it found
+func newTelemetryReport(clients []ClientInfo, duration time.Duration, failures int32) telemetryReport {
+	// the hostname only identifies the instance, a report without it is still useful
+	hostname, _ := os.Hostname()
+	networkCounts := map[string]int{}
+	for _, client := range clients {
+		networkCounts[client.Network]++
+	}
+	return telemetryReport{
+		InstanceID:          hostname,
+		Timestamp:           time.Now().UTC(),
+		HostCount:           len(clients),
+		NetworkCounts:       networkCounts,
+		RefreshDurationMS:   duration.Milliseconds(),
+		ConsecutiveFailures: failures,
+	}
+}
+
+// sendTelemetry posts report to telemetry_url with the telemetry_token as the bearer token, it isn't
+// retried, the next refresh sends a new one
+func (c *config) sendTelemetry(report telemetryReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return errors.Annotate(err, "coredns-unifi-names: unable to encode telemetry report")
+	}
+	req, err := http.NewRequest(http.MethodPost, c.TelemetryURL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Annotate(err, "coredns-unifi-names: invalid telemetry request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.TelemetryToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.TelemetryToken)
+	}
+	client := &http.Client{Timeout: c.HTTPTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Annotate(err, "coredns-unifi-names: unable to send telemetry report")
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("coredns-unifi-names: telemetry endpoint answered %s", resp.Status)
+	}
+	return nil
+}
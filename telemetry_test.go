@@ -0,0 +1,46 @@
+package unifinames
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTelemetry(t *testing.T) {
+	reports := make(chan telemetryReport, 1)
+	var authorization string
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		var report telemetryReport
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&report))
+		reports <- report
+	}))
+	defer endpoint.Close()
+	s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+	defer s.Close()
+
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.Config.TelemetryURL = endpoint.URL
+	p.Config.TelemetryToken = "secret"
+	p.consecutiveFailures.Store(2)
+	require.NoError(t, p.refresh())
+	select {
+	case report := <-reports:
+		require.Equal(t, "Bearer secret", authorization)
+		require.Equal(t, 1, report.HostCount)
+		require.Equal(t, map[string]int{"lan": 1}, report.NetworkCounts)
+		require.Equal(t, int32(2), report.ConsecutiveFailures)
+		require.WithinDuration(t, time.Now(), report.Timestamp, time.Minute)
+	case <-time.After(time.Second):
+		t.Fatal("no telemetry report")
+	}
+
+	// the errors of the endpoint aren't errors of the refresh
+	endpoint.Close()
+	require.Error(t, p.Config.sendTelemetry(telemetryReport{}))
+	require.NoError(t, p.refresh())
+}
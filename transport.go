@@ -0,0 +1,253 @@
+package unifinames
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/unpoller/unifi"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+	"golang.org/x/net/publicsuffix"
+)
+
+// newUnifiClient logs into the controller, unifi.NewUnifi always builds its own transport and http client
+// without a timeout so the client is put together here to be able to use the configured transport and
+// http_timeout
+func (p *unifinames) newUnifiClient() (*unifi.Unifi, error) {
+	transport, err := p.Config.transport()
+	if err != nil {
+		return nil, err
+	}
+	base, err := url.Parse(p.Config.UnifiControllerURL)
+	if err != nil {
+		return nil, errors.Annotate(err, "coredns-unifi-names: invalid controller url")
+	}
+
+	newStyle := p.Config.ControllerVersion == "v2"
+	if p.Config.ControllerVersion == "" || p.Config.ControllerVersion == "auto" {
+		newStyle, err = p.isNewStyleAPI(transport)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		return nil, errors.Annotate(err, "coredns-unifi-names: unable to create cookie jar")
+	}
+
+	var roundTripper http.RoundTripper = &apiPathTransport{
+		next:     transport,
+		basePath: strings.TrimRight(base.Path, "/"),
+		newStyle: newStyle,
+	}
+	if header := p.Config.basicAuthHeader(); header != nil {
+		roundTripper = &basicAuthTransport{next: roundTripper, header: header}
+	}
+
+	discard := func(string, ...interface{}) {}
+	uni := &unifi.Unifi{
+		Config: &unifi.Config{
+			User:      p.Config.UnifiUsername,
+			Pass:      p.Config.UnifiPassword,
+			URL:       p.Config.UnifiControllerURL,
+			VerifySSL: p.Config.UnifiVerifySSL,
+			ErrorLog:  discard,
+			DebugLog:  discard,
+		},
+		Client: &http.Client{
+			Jar:       jar,
+			Timeout:   p.Config.HTTPTimeout,
+			Transport: roundTripper,
+		},
+	}
+
+	// auth_mode basic has no session, the server data below checks the credentials
+	if p.Config.AuthMode != "basic" {
+		if err := uni.Login(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := uni.GetServerData(); err != nil {
+		return nil, errors.Annotate(err, "coredns-unifi-names: unable to get server version")
+	}
+	return uni, nil
+}
+
+// isNewStyleAPI returns whether the controller runs on UniFi OS, it answers the root without a redirect
+// to the login page
+func (p *unifinames) isNewStyleAPI(transport http.RoundTripper) (bool, error) {
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   p.Config.HTTPTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(p.Config.UnifiControllerURL + "/")
+	if err != nil {
+		return false, errors.Annotate(err, "coredns-unifi-names: unable to reach controller")
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// tlsVersions maps the values of tls_min_version to the tls versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// transport returns the transport for the controller requests
+func (c *config) transport() (*http.Transport, error) {
+	transport := &http.Transport{
+		Proxy: c.proxy(),
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: !c.UnifiVerifySSL, // nolint: gosec
+			MinVersion:         c.tlsMinVersion(),
+			RootCAs:            c.rootCAs,
+		},
+	}
+	if c.Socks5Proxy != "" {
+		dialer, err := c.socks5Dialer()
+		if err != nil {
+			return nil, err
+		}
+		transport.DialContext = dialer.DialContext
+	}
+	return transport, nil
+}
+
+// tlsMinVersion returns the tls version of tls_min_version, configs built without newConfigFromDispenser
+// get tls 1.2. The versions below 1.2 are deprecated (RFC 8996) so using them is logged
+func (c *config) tlsMinVersion() uint16 {
+	version, ok := tlsVersions[c.TLSMinVersion]
+	if !ok {
+		return tls.VersionTLS12
+	}
+	if version < tls.VersionTLS12 {
+		log.Warningf("tls_min_version %s is deprecated (RFC 8996), only use it for controllers that don't support tls 1.2", c.TLSMinVersion)
+	}
+	return version
+}
+
+// loadRootCAs returns a copy of the system pool with the certificates of ca_cert_file, or only the latter
+// when verify_ssl_system_pool is off, so the certificates are trusted for the controller alone
+func (c *config) loadRootCAs() (*x509.CertPool, error) {
+	if c.CACertFile == "" {
+		return nil, errors.New("coredns-unifi-names: verify_ssl_system_pool can only be turned off with a ca_cert_file")
+	}
+	pool := x509.NewCertPool()
+	if c.VerifySSLSystemPool {
+		system, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, errors.Annotate(err, "coredns-unifi-names: unable to load system certificates")
+		}
+		pool = system
+	}
+	data, err := os.ReadFile(c.CACertFile)
+	if err != nil {
+		return nil, errors.Annotate(err, "coredns-unifi-names: unable to read ca cert file")
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates found in ca cert file '%s'", c.CACertFile)
+	}
+	return pool, nil
+}
+
+// socks5Dialer returns the dialer that connects through socks5_proxy
+func (c *config) socks5Dialer() (proxy.ContextDialer, error) {
+	var auth *proxy.Auth
+	if c.Socks5User != "" {
+		auth = &proxy.Auth{User: c.Socks5User, Password: c.Socks5Pass}
+	}
+	dialer, err := proxy.SOCKS5("tcp", c.Socks5Proxy, auth, proxy.Direct)
+	if err != nil {
+		return nil, errors.Annotate(err, "coredns-unifi-names: unable to create socks5 dialer")
+	}
+	// the socks5 dialer of x/net always implements ContextDialer
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, errors.New("coredns-unifi-names: socks5 dialer doesn't support contexts")
+	}
+	return contextDialer, nil
+}
+
+// proxy returns the proxy function for the controller requests, proxy_url wins over the environment
+func (c *config) proxy() func(*http.Request) (*url.URL, error) {
+	if c.ProxyURL != "" {
+		proxy := (&httpproxy.Config{
+			HTTPProxy:  c.ProxyURL,
+			HTTPSProxy: c.ProxyURL,
+			NoProxy:    c.NoProxy,
+		}).ProxyFunc()
+		return func(req *http.Request) (*url.URL, error) {
+			return proxy(req.URL)
+		}
+	}
+	if c.UseEnvProxy {
+		return http.ProxyFromEnvironment
+	}
+	return nil
+}
+
+// basicAuthHeader returns the Authorization header of auth_mode basic, nil for the session cookie
+func (c *config) basicAuthHeader() http.Header {
+	if c.AuthMode != "basic" {
+		return nil
+	}
+	credentials := base64.StdEncoding.EncodeToString([]byte(c.UnifiUsername + ":" + c.UnifiPassword))
+	return http.Header{"Authorization": []string{"Basic " + credentials}}
+}
+
+// basicAuthTransport adds the Authorization header of auth_mode basic to the controller requests
+type basicAuthTransport struct {
+	next   http.RoundTripper
+	header http.Header
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for key, values := range t.header {
+		req.Header[key] = values
+	}
+	return t.next.RoundTrip(req)
+}
+
+// apiPathTransport rewrites the api paths for controllers running on UniFi OS the same way the unifi
+// package does, it only knows whether to do that after creating its own client
+type apiPathTransport struct {
+	next     http.RoundTripper
+	basePath string
+	newStyle bool
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *apiPathTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.newStyle {
+		return t.next.RoundTrip(req)
+	}
+	path := strings.TrimPrefix(req.URL.Path, t.basePath)
+	if path == unifi.APILoginPath {
+		path = unifi.APILoginPathNew
+	} else if !strings.HasPrefix(path, unifi.APIPrefixNew) && path != unifi.APILoginPathNew {
+		path = unifi.APIPrefixNew + path
+	}
+	req = req.Clone(req.Context())
+	req.URL.Path = t.basePath + path
+	req.URL.RawPath = ""
+	return t.next.RoundTrip(req)
+}
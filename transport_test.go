@@ -0,0 +1,275 @@
+package unifinames
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy(t *testing.T) {
+	request := func(rawURL string) *http.Request {
+		u, err := url.Parse(rawURL)
+		require.NoError(t, err)
+		return &http.Request{URL: u}
+	}
+
+	require.Nil(t, (&config{}).proxy())
+
+	c := &config{ProxyURL: "http://proxy.example.com:3128", NoProxy: "unifi.lan,.example.org"}
+	proxy, err := c.proxy()(request("https://unifi.example.com:8443/api/login"))
+	require.NoError(t, err)
+	require.Equal(t, "proxy.example.com:3128", proxy.Host)
+
+	for _, rawURL := range []string{"https://unifi.lan:8443/", "https://unifi.example.org/"} {
+		proxy, err = c.proxy()(request(rawURL))
+		require.NoError(t, err)
+		require.Nil(t, proxy, rawURL)
+	}
+
+	t.Setenv("HTTPS_PROXY", "http://env-proxy.example.com:3128")
+	c = &config{UseEnvProxy: true}
+	require.NotNil(t, c.proxy())
+	c.ProxyURL = "http://proxy.example.com:3128"
+	proxy, err = c.proxy()(request("https://unifi.example.com:8443/"))
+	require.NoError(t, err)
+	require.Equal(t, "proxy.example.com:3128", proxy.Host)
+}
+
+// socks5Server is a minimal SOCKS5 server (RFC 1928, RFC 1929) that only supports CONNECT to ip addresses
+func socks5Server(t *testing.T, user, pass string) (string, *atomic.Int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	connects := new(atomic.Int32)
+
+	handle := func(conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 256)
+		// greeting: version, number of methods, methods
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+			return
+		}
+		if user == "" {
+			conn.Write([]byte{5, 0})
+		} else {
+			conn.Write([]byte{5, 2})
+			// version, user, password
+			if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+				return
+			}
+			u := make([]byte, buf[1])
+			io.ReadFull(conn, u)
+			io.ReadFull(conn, buf[:1])
+			pw := make([]byte, buf[0])
+			io.ReadFull(conn, pw)
+			if string(u) != user || string(pw) != pass {
+				conn.Write([]byte{1, 1})
+				return
+			}
+			conn.Write([]byte{1, 0})
+		}
+		// request: version, CONNECT, reserved, ipv4, address, port
+		if _, err := io.ReadFull(conn, buf[:10]); err != nil || buf[3] != 1 {
+			return
+		}
+		target, err := net.Dial("tcp", net.JoinHostPort(net.IP(buf[4:8]).String(), strconv.Itoa(int(buf[8])<<8|int(buf[9]))))
+		if err != nil {
+			conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+		connects.Add(1)
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return l.Addr().String(), connects
+}
+
+func TestSocks5Proxy(t *testing.T) {
+	s := MockUnifiController(nil, "lan", "server1", "127.0.0.1")
+	defer s.Close()
+	addr, connects := socks5Server(t, "coredns", "secret")
+
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.Config.Socks5Proxy = addr
+	p.Config.Socks5User = "coredns"
+	p.Config.Socks5Pass = "secret"
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, 1, len(p.aClients))
+	require.Greater(t, connects.Load(), int32(0))
+
+	p = unifinames{Config: newTestConfig(s.URL)}
+	p.Config.Socks5Proxy = addr
+	p.Config.Socks5User = "coredns"
+	p.Config.Socks5Pass = "wrong"
+	require.Error(t, p.getClients(context.Background()))
+}
+
+func TestNewStyleAPI(t *testing.T) {
+	var paths []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch r.URL.Path {
+		case "/", "/api/auth/login":
+			w.WriteHeader(http.StatusOK)
+		case "/proxy/network/status":
+			fmt.Fprint(w, `{"meta": {"rc": "ok", "server_version": "8.0.7", "up": true}}`)
+		case "/proxy/network/api/stat/sites":
+			fmt.Fprint(w, `{"data": [{"_id": "eeeeeeeeeeeeeeeeeeeeeeee", "name": "default", "desc": "Default"}], "meta": {"rc": "ok"}}`)
+		case "/proxy/network/api/s/default/stat/sta":
+			fmt.Fprint(w, `{"data": [{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.1", "network": "lan"}], "meta": {"rc": "ok"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	s := httptest.NewTLSServer(mux)
+	defer s.Close()
+
+	p := unifinames{Config: newTestConfig(s.URL)}
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, 1, len(p.aClients))
+	require.Equal(t, []string{"/", "/api/auth/login", "/proxy/network/status", "/proxy/network/api/stat/sites", "/proxy/network/api/s/default/stat/sta"}, paths)
+
+	// a configured version doesn't ask the controller
+	paths = nil
+	p = unifinames{Config: newTestConfig(s.URL)}
+	p.Config.ControllerVersion = "v2"
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, []string{"/api/auth/login", "/proxy/network/status", "/proxy/network/api/stat/sites", "/proxy/network/api/s/default/stat/sta"}, paths)
+
+	paths = nil
+	p = unifinames{Config: newTestConfig(s.URL)}
+	p.Config.ControllerVersion = "v1"
+	require.Error(t, p.getClients(context.Background()))
+	require.Equal(t, "/api/login", paths[0])
+}
+
+func TestBasicAuth(t *testing.T) {
+	mux := mockUnifiMux(`[{"mac": "00:00:00:00:00:01", "hostname": "server1", "ip": "192.168.1.1", "network": "lan"}]`)
+	var paths []string
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if username, password, ok := r.BasicAuth(); !ok || username != "admin" || password != "admin" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	// basic doesn't log in
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.Config.ControllerVersion = "v1"
+	p.Config.AuthMode = "basic"
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, 1, len(p.aClients))
+	require.Equal(t, []string{"/status", "/api/stat/sites", "/api/s/default/stat/sta"}, paths)
+
+	p = unifinames{Config: newTestConfig(s.URL)}
+	p.Config.ControllerVersion = "v1"
+	p.Config.AuthMode = "basic"
+	p.Config.UnifiPassword = "wrong"
+	var authErr *ErrAuthFailure
+	require.ErrorAs(t, p.getClients(context.Background()), &authErr)
+
+	require.Nil(t, (&config{AuthMode: "session"}).basicAuthHeader())
+	require.Equal(t, "Basic YWRtaW46YWRtaW4=", (&config{AuthMode: "basic", UnifiUsername: "admin", UnifiPassword: "admin"}).basicAuthHeader().Get("Authorization"))
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	s.TLS = &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}
+	s.StartTLS()
+	defer s.Close()
+
+	get := func(version string) error {
+		c := newTestConfig(s.URL)
+		c.TLSMinVersion = version
+		transport, err := c.transport()
+		require.NoError(t, err)
+		resp, err := (&http.Client{Transport: transport}).Get(s.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	require.Error(t, get(""))
+	require.Error(t, get("1.2"))
+	require.NoError(t, get("1.1"))
+	require.NoError(t, get("1.0"))
+}
+
+func TestCACertFile(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw}), 0o600))
+
+	parse := func(directives string) (*config, error) {
+		return newConfigFromDispenser(caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN lan
+				Unifi `+s.URL+` default admin test
+				`+directives+`
+			}
+		`))))
+	}
+	get := func(c *config) error {
+		transport, err := c.transport()
+		require.NoError(t, err)
+		resp, err := (&http.Client{Transport: transport}).Get(s.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	c, err := parse("verifyssl")
+	require.NoError(t, err)
+	require.Error(t, get(c))
+
+	for _, directives := range []string{"ca_cert_file " + path, "ca_cert_file " + path + "\nverify_ssl_system_pool false"} {
+		c, err = parse(directives)
+		require.NoError(t, err, directives)
+		require.True(t, c.UnifiVerifySSL)
+		require.NoError(t, get(c), directives)
+	}
+
+	for _, directives := range []string{"verifyssl\nverify_ssl_system_pool false", "ca_cert_file " + path + ".missing", "verify_ssl_system_pool maybe"} {
+		_, err = parse(directives)
+		require.Error(t, err, directives)
+	}
+}
@@ -0,0 +1,60 @@
+package unifinames
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// loadTrustedMACs reads the "<mac> <hostname>" lines of path, empty lines and lines starting with #
+// are skipped. The macs are lowercased
+func loadTrustedMACs(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Annotate(err, "coredns-unifi-names: unable to read trusted macs")
+	}
+	defer f.Close()
+
+	macs := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid trusted macs line %d: '%s'", line, text)
+		}
+		mac, err := net.ParseMAC(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid mac on trusted macs line %d: '%s'", line, fields[0])
+		}
+		macs[mac.String()] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Annotate(err, "coredns-unifi-names: unable to read trusted macs")
+	}
+	return macs, nil
+}
+
+// trustedMACs returns the current mapping of trusted_macs, the last one that could be read is kept when
+// the file is broken
+func (p *unifinames) trustedMACs() map[string]string {
+	if p.Config.TrustedMACsFile == "" {
+		return nil
+	}
+	macs, err := loadTrustedMACs(p.Config.TrustedMACsFile)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		log.Errorf("keeping the previous trusted macs: %v", err)
+		return p.lastTrustedMACs
+	}
+	p.lastTrustedMACs = macs
+	return macs
+}
@@ -0,0 +1,48 @@
+package unifinames
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadTrustedMACs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trusted-macs.txt")
+	require.NoError(t, os.WriteFile(path, []byte("# phones\n\nAA:BB:CC:DD:EE:01 johns-phone\naa-bb-cc-dd-ee-02  tablet\n"), 0o600))
+	macs, err := loadTrustedMACs(path)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"aa:bb:cc:dd:ee:01": "johns-phone", "aa:bb:cc:dd:ee:02": "tablet"}, macs)
+
+	for _, content := range []string{"aa:bb:cc:dd:ee:01\n", "not-a-mac phone\n", "aa:bb:cc:dd:ee:01 phone extra\n"} {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err := loadTrustedMACs(path)
+		require.Error(t, err, content)
+	}
+	_, err = loadTrustedMACs(filepath.Join(t.TempDir(), "missing.txt"))
+	require.Error(t, err)
+}
+
+func TestTrustedMACs(t *testing.T) {
+	s := MockUnifiControllerWithClients(nil,
+		map[string]interface{}{"mac": "AA:BB:CC:DD:EE:01", "hostname": "iPhone", "ip": "192.168.1.1", "network": "lan"},
+		map[string]interface{}{"mac": "aa:bb:cc:dd:ee:02", "hostname": "server2", "ip": "192.168.1.2", "network": "lan"},
+	)
+	defer s.Close()
+	path := filepath.Join(t.TempDir(), "trusted-macs.txt")
+	require.NoError(t, os.WriteFile(path, []byte("aa:bb:cc:dd:ee:01 johns-phone\n"), 0o600))
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.Config.TrustedMACsFile = path
+
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, 2, len(p.aClients))
+	require.Equal(t, "johns-phone.lan.", p.aClients[0].Hdr.Name)
+	require.Equal(t, "server2.lan.", p.aClients[1].Hdr.Name)
+
+	// a broken file keeps the previous mapping
+	require.NoError(t, os.WriteFile(path, []byte("broken\n"), 0o600))
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, "johns-phone.lan.", p.aClients[0].Hdr.Name)
+}
@@ -0,0 +1,129 @@
+package unifinames
+
+import (
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/pkg/nonwriter"
+	"github.com/miekg/dns"
+	"github.com/unpoller/unifi"
+)
+
+// networkSubnets maps the lowercased names of networks to their subnets, the aliases get the subnets of
+// the networks they stand for
+func networkSubnets(networks []unifi.Network, aliases map[string]string) map[string][]*net.IPNet {
+	subnets := map[string][]*net.IPNet{}
+	for _, network := range networks {
+		_, subnet, err := net.ParseCIDR(network.IPSubnet)
+		if err != nil {
+			continue
+		}
+		name := strings.ToLower(network.Name)
+		if alias, ok := aliases[name]; ok {
+			name = alias
+		}
+		subnets[name] = append(subnets[name], subnet)
+	}
+	return subnets
+}
+
+// remoteIP returns the ip the query came from, nil for the writers that have none like the one of the
+// dns-query endpoint
+func remoteIP(w dns.ResponseWriter) net.IP {
+	if nw, ok := w.(*nonwriter.Writer); ok && nw.ResponseWriter == nil {
+		return nil
+	}
+	addr := w.RemoteAddr()
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+// viewIP returns the ip whose network the records are picked for: the address of the EDNS0 client subnet
+// option for edns_subnet_routing, otherwise the ip the query came from for view_network_match. It is nil
+// when all records are answered
+func (p *unifinames) viewIP(w dns.ResponseWriter, r *dns.Msg) net.IP {
+	if p.Config.EDNSSubnetRouting {
+		if ip := clientSubnet(r); ip != nil {
+			return ip
+		}
+	}
+	if p.Config.ViewNetworkMatch {
+		return remoteIP(w)
+	}
+	return nil
+}
+
+// clientSubnet returns the address of the EDNS0 client subnet option of r (RFC 7871), nil when there is
+// none or its source prefix is 0, the client doesn't want its subnet to be used then
+func clientSubnet(r *dns.Msg) net.IP {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok && subnet.SourceNetmask > 0 {
+			return subnet.Address
+		}
+	}
+	return nil
+}
+
+// viewRecords drops the records of clients that aren't in the network of ip for view_network_match and
+// edns_subnet_routing, ips outside of the known subnets and the records that don't belong to a client are left alone
+func (p *unifinames) viewRecords(rrs []dns.RR, ip net.IP) []dns.RR {
+	if ip == nil {
+		return rrs
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	network := p.viewNetwork(ip)
+	if network == "" {
+		return rrs
+	}
+	return slices.DeleteFunc(rrs, func(rr dns.RR) bool {
+		return p.outsideView(strings.ToLower(rr.Header().Name), network)
+	})
+}
+
+// hiddenFromView reports whether viewRecords drops all records of name for queries from ip, the name
+// doesn't exist for them
+func (p *unifinames) hiddenFromView(name string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	network := p.viewNetwork(ip)
+	return network != "" && p.outsideView(strings.ToLower(name), network)
+}
+
+// viewNetwork returns the network whose subnets contain ip, empty when there is none. p.mu has to be held
+func (p *unifinames) viewNetwork(ip net.IP) string {
+	for name, subnets := range p.networkSubnets {
+		if slices.ContainsFunc(subnets, func(subnet *net.IPNet) bool { return subnet.Contains(ip) }) {
+			return name
+		}
+	}
+	return ""
+}
+
+// outsideView reports whether the lowercased name belongs to clients of which none is in network, p.mu
+// has to be held
+func (p *unifinames) outsideView(name, network string) bool {
+	owned, inView := false, false
+	for _, client := range p.clients {
+		// the names below a client are its wildcard records
+		if client.Hostname == name || strings.HasSuffix(name, "."+client.Hostname) {
+			owned = true
+			inView = inView || client.Network == network
+		}
+	}
+	return owned && !inView
+}
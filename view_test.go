@@ -0,0 +1,92 @@
+package unifinames
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/unpoller/unifi"
+)
+
+func TestNetworkSubnets(t *testing.T) {
+	subnets := networkSubnets([]unifi.Network{
+		{Name: "LAN", IPSubnet: "192.168.1.1/24"},
+		{Name: "Old IoT", IPSubnet: "192.168.2.1/24"},
+		{Name: "WAN"},
+	}, map[string]string{"old iot": "iot"})
+	require.Len(t, subnets, 2)
+	require.Equal(t, "192.168.1.0/24", subnets["lan"][0].String())
+	require.Equal(t, "192.168.2.0/24", subnets["iot"][0].String())
+}
+
+func TestViewNetworkMatch(t *testing.T) {
+	s := MockUnifiControllerWithClients(nil,
+		map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "printer", "ip": "192.168.1.5", "network": "LAN"},
+		map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "camera", "ip": "192.168.10.5", "network": "VLAN1"},
+	)
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.Config.Networks["vlan1"] = &NetworkConfig{Domain: "vlan1.lan."}
+	p.Config.ViewNetworkMatch = true
+	p.Config.WildcardClients = true
+	require.NoError(t, p.refresh())
+
+	query := func(remote, name string) int {
+		d := &dummyResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP(remote), Port: 5353}}
+		rcode, ok := p.resolve(d, new(dns.Msg).SetQuestion(name, dns.TypeA))
+		require.True(t, ok, name)
+		return rcode
+	}
+	require.Equal(t, dns.RcodeSuccess, query("192.168.1.20", "printer.lan."))
+	require.Equal(t, dns.RcodeSuccess, query("192.168.1.20", "admin.printer.lan."))
+	require.Equal(t, dns.RcodeNameError, query("192.168.1.20", "camera.vlan1.lan."))
+	require.Equal(t, dns.RcodeSuccess, query("192.168.10.20", "camera.vlan1.lan."))
+	require.Equal(t, dns.RcodeNameError, query("192.168.10.20", "admin.printer.lan."))
+	// outside of the subnets of the controller
+	require.Equal(t, dns.RcodeSuccess, query("10.0.0.1", "camera.vlan1.lan."))
+
+	// nxdomain_action nxdomain must not answer NODATA for the hidden names
+	p.Config.NXDomainAction = "nxdomain"
+	require.Equal(t, dns.RcodeNameError, query("192.168.1.20", "camera.vlan1.lan."))
+	require.Equal(t, dns.RcodeNameError, query("192.168.10.20", "printer.lan."))
+
+	// the dns-query endpoint has no remote address
+	require.NotNil(t, p.answerHTTP(new(dns.Msg).SetQuestion("printer.lan.", dns.TypeA)))
+}
+
+func TestEDNSSubnetRouting(t *testing.T) {
+	s := MockUnifiControllerWithClients(nil,
+		map[string]interface{}{"mac": "00:00:00:00:00:01", "hostname": "printer", "ip": "192.168.1.5", "network": "LAN"},
+		map[string]interface{}{"mac": "00:00:00:00:00:02", "hostname": "camera", "ip": "192.168.10.5", "network": "VLAN1"},
+	)
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	p.Config.Networks["vlan1"] = &NetworkConfig{Domain: "vlan1.lan."}
+	p.Config.EDNSSubnetRouting = true
+	require.NoError(t, p.refresh())
+
+	query := func(subnet, name string) int {
+		r := new(dns.Msg).SetQuestion(name, dns.TypeA)
+		if subnet != "" {
+			ip, network, err := net.ParseCIDR(subnet)
+			require.NoError(t, err)
+			ones, _ := network.Mask.Size()
+			r.SetEdns0(4096, false)
+			r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(ones), Address: ip.To4(),
+			})
+		}
+		// the query comes from the resolver, not from the subnets of the controller
+		d := &dummyResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5353}}
+		rcode, ok := p.resolve(d, r)
+		require.True(t, ok, name)
+		return rcode
+	}
+	require.Equal(t, dns.RcodeSuccess, query("192.168.1.0/24", "printer.lan."))
+	require.Equal(t, dns.RcodeNameError, query("192.168.1.0/24", "camera.vlan1.lan."))
+	require.Equal(t, dns.RcodeSuccess, query("192.168.10.0/24", "camera.vlan1.lan."))
+	// without the option or with a source prefix of 0 all records are answered
+	require.Equal(t, dns.RcodeSuccess, query("", "camera.vlan1.lan."))
+	require.Equal(t, dns.RcodeSuccess, query("0.0.0.0/0", "camera.vlan1.lan."))
+}
@@ -0,0 +1,46 @@
+package unifinames
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/unpoller/unifi"
+)
+
+// vpnNetwork is the network the vpn clients are handled as, vpn_domain is its domain
+const vpnNetwork = "vpn"
+
+// apiVPNClientPath is the path of the remote user vpn clients of a site, they aren't in stat/sta and the
+// unifi package has no call for them
+const apiVPNClientPath = "/api/s/%s/stat/remoteuservpn"
+
+// getVPNClients returns the remote user vpn clients of the sites as clients of the vpn network, the
+// response has the fields of the other clients so it is parsed into unifi.Client
+func getVPNClients(uni *unifi.Unifi, sites []*unifi.Site) ([]*unifi.Client, error) {
+	var clients []*unifi.Client
+	for _, site := range sites {
+		var response struct {
+			Data []*unifi.Client `json:"data"`
+		}
+		if err := uni.GetData(fmt.Sprintf(apiVPNClientPath, site.Name), &response); err != nil {
+			return clients, err
+		}
+		for _, client := range response.Data {
+			client.Network = vpnNetwork
+			client.NetworkID = ""
+			client.SourceName = uni.URL
+			client.SiteName = site.SiteName
+			// like GetClients, the name and the hostname fill in for each other
+			client.Name = strings.TrimSpace(client.Name)
+			client.Hostname = strings.TrimSpace(client.Hostname)
+			if client.Hostname == "" {
+				client.Hostname = client.Name
+			}
+			if client.Name == "" {
+				client.Name = client.Hostname
+			}
+		}
+		clients = append(clients, response.Data...)
+	}
+	return clients, nil
+}
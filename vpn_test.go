@@ -0,0 +1,48 @@
+package unifinames
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVPNClients(t *testing.T) {
+	s := MockUnifiController(nil, "lan", "server1", "192.168.1.10")
+	defer s.Close()
+	p := unifinames{Config: newTestConfig(s.URL)}
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, 1, len(p.aClients))
+
+	p.Config.VPNDomain = "vpn.home.arpa."
+	p.Config.Networks[vpnNetwork] = &NetworkConfig{Domain: p.Config.VPNDomain}
+	require.NoError(t, p.getClients(context.Background()))
+	require.Equal(t, 2, len(p.aClients))
+	rrs := p.lookup(new(dns.Msg).SetQuestion("roadwarrior.vpn.home.arpa.", dns.TypeA))
+	require.Equal(t, 1, len(rrs))
+	require.Equal(t, "10.8.0.2", rrs[0].(*dns.A).A.String())
+}
+
+func TestVPNDomainConfig(t *testing.T) {
+	parse := func(directives string) (*config, error) {
+		return newConfigFromDispenser(caddyfile.NewDispenser("", bytes.NewReader([]byte(`
+			{
+				Network LAN lan
+				Unifi https://localhost:8443/ default admin test
+				`+directives+`
+			}
+		`))))
+	}
+	config, err := parse("vpn_domain VPN.home.arpa")
+	require.NoError(t, err)
+	require.Equal(t, "vpn.home.arpa.", config.VPNDomain)
+	require.Equal(t, &NetworkConfig{Domain: "vpn.home.arpa."}, config.Networks[vpnNetwork])
+
+	_, err = parse("vpn_domain vpn.home.arpa\nNetwork VPN vpn.lan")
+	require.Error(t, err)
+	_, err = parse("vpn_domain -vpn")
+	require.Error(t, err)
+}
@@ -0,0 +1,50 @@
+package unifinames
+
+import (
+	"math/rand"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// recordWeightKey is the key of a record in the weights of the networks, its lowercased name and its ip
+func recordWeightKey(name, ip string) string {
+	return strings.ToLower(name) + " " + ip
+}
+
+// weightAnswer orders the A and AAAA records of rrs by the weight of their networks, the records of the
+// higher weights come first and the ones of the same weight are shuffled. The answers with other records
+// keep their order
+func (p *unifinames) weightAnswer(rrs []dns.RR) []dns.RR {
+	weights := p.recordWeights.Load()
+	if weights == nil || len(rrs) < 2 {
+		return rrs
+	}
+	weight := func(rr dns.RR) int {
+		var ip string
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A.String()
+		case *dns.AAAA:
+			ip = rr.AAAA.String()
+		}
+		name := rr.Header().Name
+		if w, ok := (*weights)[recordWeightKey(name, ip)]; ok {
+			return w
+		}
+		// the names answered by a wildcard record have the weight of the client of the wildcard
+		return (*weights)[recordWeightKey(strings.TrimPrefix(wildcardName(name), "*."), ip)]
+	}
+	for _, rr := range rrs {
+		if rrtype := rr.Header().Rrtype; rrtype != dns.TypeA && rrtype != dns.TypeAAAA {
+			return rrs
+		}
+	}
+	rrs = slices.Clone(rrs)
+	rand.Shuffle(len(rrs), func(i, j int) { rrs[i], rrs[j] = rrs[j], rrs[i] })
+	slices.SortStableFunc(rrs, func(a, b dns.RR) int {
+		return weight(b) - weight(a)
+	})
+	return rrs
+}